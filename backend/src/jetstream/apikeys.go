@@ -2,8 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces/config"
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
@@ -42,7 +46,17 @@ func (p *portalProxy) addAPIKey(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, err.Error())
 	}
 
-	apiKey, err := p.APIKeysRepository.AddAPIKey(userGUID, comment)
+	scopes, err := parseAPIKeyScopes(c.FormValue("scopes"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	expires, err := parseAPIKeyExpiry(c.FormValue("expires"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	apiKey, err := p.APIKeysRepository.AddAPIKey(userGUID, comment, scopes, expires)
 	if err != nil {
 		log.Errorf("Error adding API key: %v", err)
 		return errors.New("Error adding API key")
@@ -51,6 +65,43 @@ func (p *portalProxy) addAPIKey(c echo.Context) error {
 	return c.JSON(http.StatusOK, apiKey)
 }
 
+// parseAPIKeyScopes parses a comma separated list of scopes, see interfaces.APIKeyScopeReadOnly, etc
+func parseAPIKeyScopes(value string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		switch {
+		case len(scope) == 0:
+			continue
+		case scope == interfaces.APIKeyScopeReadOnly, scope == interfaces.APIKeyScopeAdmin, scope == interfaces.APIKeyScopeProxy:
+		case strings.HasPrefix(scope, interfaces.APIKeyScopeCNSIPrefix) && len(scope) > len(interfaces.APIKeyScopeCNSIPrefix):
+		default:
+			return nil, fmt.Errorf("Unknown API key scope: %s", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+// parseAPIKeyExpiry parses an optional RFC 3339 expiry, which must be in the future
+func parseAPIKeyExpiry(value string) (*time.Time, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, errors.New("API key expiry must be an RFC 3339 date")
+	}
+
+	if !expires.After(time.Now()) {
+		return nil, errors.New("API key expiry must be in the future")
+	}
+
+	return &expires, nil
+}
+
 func (p *portalProxy) listAPIKeys(c echo.Context) error {
 	log.Debug("listAPIKeys")
 
@@ -90,3 +141,28 @@ func (p *portalProxy) deleteAPIKey(c echo.Context) error {
 
 	return nil
 }
+
+func (p *portalProxy) rotateAPIKey(c echo.Context) error {
+	log.Debug("rotateAPIKey")
+
+	userGUID := c.Get("user_id").(string)
+	keyGUID := c.FormValue("guid")
+
+	if len(keyGUID) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "API key guid can't be empty")
+	}
+
+	if err := p.checkIfAPIKeysEnabled(userGUID); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	apiKey, err := p.APIKeysRepository.RotateAPIKey(userGUID, keyGUID)
+	if err != nil {
+		log.Errorf("Error rotating API key: %v", err)
+		return errors.New("Error rotating API key")
+	}
+
+	log.Infof("API key %s of user %s rotated", keyGUID, userGUID)
+
+	return c.JSON(http.StatusOK, apiKey)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/epinio/ui/backend/src/jetstream/repository/apikeys"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
@@ -112,7 +113,7 @@ func Test_addAPIKey(t *testing.T) {
 
 					mockAPIRepo.
 						EXPECT().
-						AddAPIKey(gomock.Eq(userID), gomock.Eq(comment)).
+						AddAPIKey(gomock.Eq(userID), gomock.Eq(comment), gomock.Eq([]string{}), gomock.Eq((*time.Time)(nil))).
 						Return(&retval, nil)
 
 					err := pp.addAPIKey(ctx)
@@ -164,7 +165,7 @@ func Test_addAPIKey(t *testing.T) {
 
 				mockAPIRepo.
 					EXPECT().
-					AddAPIKey(gomock.Eq(userID), gomock.Eq(comment)).
+					AddAPIKey(gomock.Eq(userID), gomock.Eq(comment), gomock.Eq([]string{}), gomock.Eq((*time.Time)(nil))).
 					Return(nil, errors.New("Something went wrong"))
 
 				ctx, _ := makeNewRequestWithParams("POST", map[string]string{"comment": comment})
@@ -183,7 +184,7 @@ func Test_addAPIKey(t *testing.T) {
 
 				mockAPIRepo.
 					EXPECT().
-					AddAPIKey(gomock.Eq(userID), gomock.Eq(comment)).
+					AddAPIKey(gomock.Eq(userID), gomock.Eq(comment), gomock.Eq([]string{}), gomock.Eq((*time.Time)(nil))).
 					Return(&retval, nil)
 
 				ctx, rec := makeNewRequestWithParams("POST", map[string]string{"comment": comment})
@@ -387,3 +388,64 @@ func Test_deleteAPIKeys(t *testing.T) {
 		})
 	})
 }
+
+func Test_parseAPIKeyScopes(t *testing.T) {
+	Convey("Given API key scopes", t, func() {
+		Convey("known scopes should be accepted", func() {
+			scopes, err := parseAPIKeyScopes("read-only, admin,proxy,cnsi:abc,")
+			So(err, ShouldBeNil)
+			So(scopes, ShouldResemble, []string{"read-only", "admin", "proxy", "cnsi:abc"})
+		})
+
+		Convey("unknown scopes should be rejected", func() {
+			_, err := parseAPIKeyScopes("read-only,write")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("endpoint scopes need a guid", func() {
+			_, err := parseAPIKeyScopes("cnsi:")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an API key scoped to an endpoint", t, func() {
+		apiKey := &interfaces.APIKey{Scopes: []string{interfaces.APIKeyScopeCNSIPrefix + mockCFGUID}}
+
+		Convey("requests to other endpoints should be rejected", func() {
+			_, _, ctx, _, db, _ := setupHTTPTest(setupMockReq("GET", "http://localhost/api/v1/cnsis/"+mockCEGUID, nil))
+			defer db.Close()
+			ctx.SetPath("/api/v1/cnsis/:id")
+			ctx.SetParamNames("id")
+			ctx.SetParamValues(mockCEGUID)
+			So(checkAPIKeyScopes(ctx, apiKey), ShouldNotBeNil)
+		})
+
+		Convey("job ids should not be taken for endpoints", func() {
+			_, _, ctx, _, db, _ := setupHTTPTest(setupMockReq("GET", "http://localhost/api/v1/jobs/"+mockJobID, nil))
+			defer db.Close()
+			ctx.SetPath("/api/v1/jobs/:id")
+			ctx.SetParamNames("id")
+			ctx.SetParamValues(mockJobID)
+			So(checkAPIKeyScopes(ctx, apiKey), ShouldBeNil)
+		})
+	})
+
+	Convey("Given an API key expiry", t, func() {
+		Convey("no expiry should be accepted", func() {
+			expires, err := parseAPIKeyExpiry("")
+			So(err, ShouldBeNil)
+			So(expires, ShouldBeNil)
+		})
+
+		Convey("a past expiry should be rejected", func() {
+			_, err := parseAPIKeyExpiry(time.Now().Add(-time.Hour).Format(time.RFC3339))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("a future expiry should be accepted", func() {
+			expires, err := parseAPIKeyExpiry(time.Now().Add(time.Hour).Format(time.RFC3339))
+			So(err, ShouldBeNil)
+			So(expires, ShouldNotBeNil)
+		})
+	})
+}
@@ -19,6 +19,8 @@ type LoginHookFunc func(c echo.Context) error
 //It contains a flag to indicate whether or not the user was signed in with SSO
 type LogoutResponse struct {
 	IsSSO bool `json:"isSSO"`
+	// RedirectURL is where the client should go to also end the user's session with the identity provider
+	RedirectURL string `json:"redirectUrl,omitempty"`
 }
 
 //InitStratosAuthService is used to instantiate an Auth service when setting up the portalProxy
@@ -32,10 +34,7 @@ func (p *portalProxy) InitStratosAuthService(t interfaces.AuthEndpointType) erro
 			p:                      p,
 		}
 	case interfaces.Epinio:
-		auth = &epinioAuth{
-			databaseConnectionPool: p.DatabaseConnectionPool,
-			p:                      p,
-		}
+		auth = newEpinioAuth(p)
 	case interfaces.Remote:
 		auth = &uaaAuth{
 			databaseConnectionPool: p.DatabaseConnectionPool,
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql/driver"
 	"errors"
 	"net/http"
 	"net/url"
@@ -105,6 +106,9 @@ func TestLocalLogin(t *testing.T) {
 			log.Fatalf("Could not initialise auth service: %v", err)
 		}
 
+		//No failed logins for the user or client address
+		expectLoginAttempt(mock)
+
 		rows := sqlmock.NewRows([]string{"user_guid"}).AddRow(userGUID)
 		mock.ExpectQuery(findUserGUID).WithArgs(username).WillReturnRows(rows)
 
@@ -114,8 +118,16 @@ func TestLocalLogin(t *testing.T) {
 		rows = sqlmock.NewRows([]string{"scope"}).AddRow(scope)
 		mock.ExpectQuery(findUserScope).WithArgs(userGUID).WillReturnRows(rows)
 
+		//The user has no second factor
+		mock.ExpectQuery(findMFA).WithArgs(userGUID).WillReturnRows(sqlmock.NewRows(mfaColumns))
+
+		//Expect the failed logins of the user to be reset, and the attempt not to count against the client address
+		mock.ExpectExec(deleteLoginAttempts).WithArgs(loginUserKey(username)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+
 		//Expect exec to update local login time
 		mock.ExpectExec(updateLastLoginTime).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(findSessionVersion).WithArgs(userGUID).WillReturnRows(expectSessionVersionRow(0))
 
 		loginErr := pp.StratosAuthService.Login(ctx)
 
@@ -129,6 +141,66 @@ func TestLocalLogin(t *testing.T) {
 	})
 }
 
+// argon2idHashArg matches password hashes created with Argon2id
+type argon2idHashArg struct{}
+
+func (argon2idHashArg) Match(v driver.Value) bool {
+	hash, ok := v.([]byte)
+	return ok && strings.HasPrefix(string(hash), "$argon2id$") && !crypto.PasswordNeedsRehash(hash)
+}
+
+func TestLocalLoginRehashesPassword(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local Login tests", t, func() {
+
+		username := "localuser"
+		password := "localuserpass"
+		userGUID := "user-guid"
+
+		//A hash created before passwords were hashed with Argon2id
+		passwordHash, _ := (&crypto.BcryptHasher{Cost: 4}).Hash(password)
+
+		req := setupMockReq("POST", "", map[string]string{
+			"username": username,
+			"password": password,
+		})
+
+		_, _, ctx, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+
+		pp.Config.ConsoleConfig.AuthEndpointType = string(interfaces.Local)
+		err := pp.InitStratosAuthService(interfaces.AuthEndpointTypes[pp.Config.ConsoleConfig.AuthEndpointType])
+		if err != nil {
+			log.Fatalf("Could not initialise auth service: %v", err)
+		}
+
+		expectLoginAttempt(mock)
+		mock.ExpectQuery(findUserGUID).WithArgs(username).WillReturnRows(sqlmock.NewRows([]string{"user_guid"}).AddRow(userGUID))
+		mock.ExpectQuery(findPasswordHash).WithArgs(userGUID).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(passwordHash))
+		mock.ExpectQuery(findUserScope).WithArgs(userGUID).WillReturnRows(sqlmock.NewRows([]string{"scope"}).AddRow("stratos.admin"))
+
+		//Expect the hash to be replaced, unless it has changed since it was read
+		mock.ExpectExec(updatePasswordHash).WithArgs(argon2idHashArg{}, userGUID, passwordHash).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		mock.ExpectQuery(findMFA).WithArgs(userGUID).WillReturnRows(sqlmock.NewRows(mfaColumns))
+		mock.ExpectExec(deleteLoginAttempts).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+		mock.ExpectExec(updateLastLoginTime).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(findSessionVersion).WithArgs(userGUID).WillReturnRows(expectSessionVersionRow(0))
+
+		loginErr := pp.StratosAuthService.Login(ctx)
+
+		Convey("Should login and rehash the password with Argon2id", func() {
+			So(loginErr, ShouldBeNil)
+		})
+
+		Convey("Expectations should be met", func() {
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
 func TestLocalLoginWithBadCredentials(t *testing.T) {
 	t.Parallel()
 
@@ -164,6 +236,9 @@ func TestLocalLoginWithBadCredentials(t *testing.T) {
 			log.Fatalf("Could not initialise auth service: %v", err)
 		}
 
+		//The attempt is recorded as a failure for the user and the client address until the credentials are checked
+		expectLoginAttempt(mock)
+
 		rows := sqlmock.NewRows([]string{"user_guid"}).AddRow(userGUID)
 		mock.ExpectQuery(findUserGUID).WithArgs(username).WillReturnRows(rows)
 
@@ -207,6 +282,8 @@ func TestLocalLoginWithNoAdminScope(t *testing.T) {
 		_, _, ctx, pp, db, mock := setupHTTPTest(req)
 		defer db.Close()
 
+		expectLoginAttempt(mock)
+
 		rows := sqlmock.NewRows([]string{"user_guid"}).AddRow(userGUID)
 		mock.ExpectQuery(findUserGUID).WithArgs(username).WillReturnRows(rows)
 
@@ -227,6 +304,10 @@ func TestLocalLoginWithNoAdminScope(t *testing.T) {
 		rows = sqlmock.NewRows([]string{"scope"}).AddRow(wrongScope)
 		mock.ExpectQuery(findUserScope).WithArgs(userGUID).WillReturnRows(rows)
 
+		//The credentials weren't rejected, the attempt is not a failed login
+		expectLoginAttemptForgotten(mock, loginUserKey(username))
+		expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+
 		loginErr := pp.StratosAuthService.Login(ctx)
 
 		Convey("Should fail to login", func() {
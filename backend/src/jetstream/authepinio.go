@@ -1,33 +1,84 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/epinio/ui/backend/src/jetstream/dex"
+	eInterfaces "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/interfaces"
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy"
 	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
 
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 )
 
+const (
+	// Absolute lifetime of an epinio session, in minutes
+	epinioSessionLifetimeEnv     = "EPINIO_SESSION_LIFETIME"
+	defaultEpinioSessionLifetime = 12 * 60
+	// Time after which an inactive epinio session expires, in minutes
+	epinioSessionIdleTimeoutEnv     = "EPINIO_SESSION_IDLE_TIMEOUT"
+	defaultEpinioSessionIdleTimeout = 60
+
+	epinioSessionLastActive   = "epinio_last_active"
+	epinioSessionAuthType     = "epinio_auth_type"
+	epinioSessionLoginCluster = "epinio_login_cluster"
+
+	// Cookie the dashboard's login page reads after a logout, to also end the user's session with the identity provider
+	epinioLogoutRedirectCookie = "epinio-logout-redirect"
+
+	// How often the last active time is written back to the session
+	epinioSessionActivityResolution = time.Minute
+)
+
 // More fields will be moved into here as global portalProxy struct is phased out
 type epinioAuth struct {
 	databaseConnectionPool *sql.DB
 	p                      *portalProxy
+	sessionLifetime        time.Duration
+	sessionIdleTimeout     time.Duration
+}
+
+func newEpinioAuth(p *portalProxy) *epinioAuth {
+	return &epinioAuth{
+		databaseConnectionPool: p.DatabaseConnectionPool,
+		p:                      p,
+		sessionLifetime:        envMinutes(p, epinioSessionLifetimeEnv, defaultEpinioSessionLifetime),
+		sessionIdleTimeout:     envMinutes(p, epinioSessionIdleTimeoutEnv, defaultEpinioSessionIdleTimeout),
+	}
+}
+
+// envMinutes reads a positive number of minutes from the given env var
+func envMinutes(p *portalProxy, name string, defaultValue int) time.Duration {
+	minutes := defaultValue
+	if value, ok := p.Env().Lookup(name); ok {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			minutes = parsed
+		} else {
+			log.Warnf("Invalid value for %s: '%s', using default of %d minutes", name, value, defaultValue)
+		}
+	}
+	return time.Duration(minutes) * time.Minute
 }
 
 func (a *epinioAuth) ShowConfig(config *interfaces.ConsoleConfig) {
 	log.Infof("... Epinio Auth             : %v", true)
+	log.Infof("... Epinio Session Lifetime : %v", a.sessionLifetime)
+	log.Infof("... Epinio Session Idle     : %v", a.sessionIdleTimeout)
 }
 
 // Login provides Local-auth specific Stratos login
@@ -45,13 +96,14 @@ func (a *epinioAuth) Login(c echo.Context) error {
 	authType := c.Get("auth_type").(string)
 
 	var userGUID, username string
+	var userInfo *eInterfaces.TokenMetadata
 	var err error
 
 	switch authType {
 	case "local":
-		userGUID, username, err = a.epinioLocalLogin(c)
+		userGUID, username, userInfo, err = a.epinioLocalLogin(c)
 	case "oidc":
-		userGUID, username, err = a.epinioOIDCLogin(c)
+		userGUID, username, userInfo, err = a.epinioOIDCLogin(c)
 	}
 
 	// Perform the login and fetch session values if successful
@@ -66,8 +118,14 @@ func (a *epinioAuth) Login(c echo.Context) error {
 			Message:   err.Error(),
 		}
 
+		if locked, ok := err.(errLoginLocked); ok {
+			resp.Code = "TooManyRequests"
+			resp.Status = http.StatusTooManyRequests
+			c.Response().Header().Set("Retry-After", locked.RetryAfter())
+		}
+
 		if jsonString, err := json.Marshal(resp); err == nil {
-			c.Response().Status = http.StatusUnauthorized
+			c.Response().Status = int(resp.Status)
 			c.Response().Header().Set("Content-Type", "application/json")
 			c.Response().Write(jsonString)
 		}
@@ -75,7 +133,7 @@ func (a *epinioAuth) Login(c echo.Context) error {
 		return nil
 	}
 
-	err = a.generateLoginSuccessResponse(c, userGUID, username)
+	err = a.generateLoginSuccessResponse(c, userGUID, username, authType, userInfo)
 
 	return err
 }
@@ -106,36 +164,210 @@ func (a *epinioAuth) GetUser(userGUID string) (*interfaces.ConnectedUser, error)
 		Scopes: scopes,
 	}
 
+	// Scopes are the user's Epinio roles, stored against their epinio tokens at login
+	if userInfo := a.getUserInfo(userGUID); userInfo != nil {
+		connectedUser.Admin = userInfo.Admin
+		connectedUser.Scopes = append(scopes, userInfo.Roles...)
+	}
+
 	return connectedUser, nil
 }
 
+// getUserInfo finds the Epinio role information stored against the user's epinio tokens
+func (a *epinioAuth) getUserInfo(userGUID string) *eInterfaces.TokenMetadata {
+	endpoints, err := epinio_utils.FindEpinioEndpoints(a.p)
+	if err != nil {
+		return nil
+	}
+
+	for _, endpoint := range endpoints {
+		tokenRecord, ok := a.p.GetCNSITokenRecord(endpoint.GUID, userGUID)
+		if !ok || len(tokenRecord.Metadata) == 0 {
+			continue
+		}
+
+		var userInfo eInterfaces.TokenMetadata
+		if err := json.Unmarshal([]byte(tokenRecord.Metadata), &userInfo); err != nil {
+			log.Debugf("Unable to parse epinio token metadata for user %s: %v", userGUID, err)
+			continue
+		}
+		return &userInfo
+	}
+
+	return nil
+}
+
 func (a *epinioAuth) BeforeVerifySession(c echo.Context) {}
 
+// VerifySession checks the session has not reached its absolute or idle expiry. For OIDC sessions the user's Dex
+// token must also still be valid (or refreshable). Only used by `/v1/auth/verify`, which the dashboard polls, so
+// unlike VerifySessionActivity it doesn't count as activity
 func (a *epinioAuth) VerifySession(c echo.Context, sessionUser string, sessionExpireTime int64) error {
-	// Never expires
-	// Only used by `/v1/auth/verify`
+	if err := a.verifySessionExpiry(c); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	if err := a.verifyDexToken(c, sessionUser); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
 	return nil
 }
 
+// VerifySessionActivity checks the session is still valid, as VerifySession does, and records the activity
+func (a *epinioAuth) VerifySessionActivity(c echo.Context) error {
+	if err := a.verifySessionExpiry(c); err != nil {
+		return err
+	}
+
+	sessionUser, err := a.p.GetSessionStringValue(c, "user_id")
+	if err != nil {
+		return errors.New("could not find user_id in session")
+	}
+
+	if err := a.verifyDexToken(c, sessionUser); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	lastActive, err := a.p.GetSessionInt64Value(c, epinioSessionLastActive)
+	if err != nil || now.Sub(time.Unix(lastActive, 0)) > epinioSessionActivityResolution {
+		sessionValues := make(map[string]interface{})
+		sessionValues[epinioSessionLastActive] = now.Unix()
+		return a.p.setSessionValues(c, sessionValues)
+	}
+
+	return nil
+}
+
+// verifySessionExpiry checks the session has not reached its absolute or idle expiry
+func (a *epinioAuth) verifySessionExpiry(c echo.Context) error {
+	expiresOn, err := a.SessionExpiresOn(c)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(expiresOn) {
+		return errors.New("session has expired")
+	}
+
+	return nil
+}
+
+// verifyDexToken checks the Dex token of an OIDC session has not expired, refreshing it if it has. If the refresh
+// token is no longer valid neither is the session
+func (a *epinioAuth) verifyDexToken(c echo.Context, sessionUser string) error {
+	authType, _ := a.p.GetSessionStringValue(c, epinioSessionAuthType)
+	if authType != "oidc" {
+		return nil
+	}
+
+	cnsiGUID, err := a.p.GetSessionStringValue(c, epinioSessionLoginCluster)
+	if err != nil {
+		return errors.New("Could not find login cluster in session")
+	}
+
+	tr, ok := a.p.GetCNSITokenRecord(cnsiGUID, sessionUser)
+	if !ok {
+		return errors.New("Could not find Dex token")
+	}
+
+	if time.Now().After(time.Unix(tr.TokenExpiry, 0)) {
+		if _, err := a.p.RefreshDexToken(c.Request().Context(), cnsiGUID, sessionUser); err != nil {
+			msg := "Could not refresh Dex token"
+			log.Error(msg, err)
+			return errors.New(msg)
+		}
+	}
+
+	return nil
+}
+
+// SessionExpiresOn returns the earlier of the session's absolute expiry and idle expiry
+func (a *epinioAuth) SessionExpiresOn(c echo.Context) (time.Time, error) {
+	exp, err := a.p.GetSessionInt64Value(c, "exp")
+	if err != nil {
+		return time.Time{}, errors.New("could not find session expiry")
+	}
+	expiresOn := time.Unix(exp, 0)
+
+	lastActive, err := a.p.GetSessionInt64Value(c, epinioSessionLastActive)
+	if err != nil {
+		// Session pre-dates idle tracking, treat it as active now
+		lastActive = time.Now().Unix()
+	}
+
+	if idleExpiresOn := time.Unix(lastActive, 0).Add(a.sessionIdleTimeout); idleExpiresOn.Before(expiresOn) {
+		expiresOn = idleExpiresOn
+	}
+
+	return expiresOn, nil
+}
+
 // epinioLocalLogin verifies local user credentials
-func (a *epinioAuth) epinioLocalLogin(c echo.Context) (string, string, error) {
+func (a *epinioAuth) epinioLocalLogin(c echo.Context) (string, string, *eInterfaces.TokenMetadata, error) {
 	log.Debug("epinioLocalLogin")
 
 	username, password, err := a.getRancherUsernameAndPassword(c)
 	if err != nil {
 		msg := "unable to determine Username and/or password: %+v"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
+	}
+
+	if err := a.p.checkLoginAllowed(c, username); err != nil {
+		return "", "", nil, err
 	}
+	defer a.p.loginEnded(c)
 
-	if err := a.verifyLocalLoginCreds(username, password); err != nil {
+	epinioEndpoint, err := epinio_utils.FindLoginEndpoint(a.p, c)
+	if err != nil {
+		msg := "unable to find epinio cluster: %+v"
+		log.Errorf(msg, err)
+		return "", "", nil, errors.New(msg)
+	}
+	c.Set(epinio_utils.LoginClusterContextKey, epinioEndpoint.GUID)
+
+	me, err := a.verifyLocalLoginCreds(epinioEndpoint, username, password)
+	if reqErr, ok := err.(interfaces.ErrHTTPRequest); ok && (reqErr.Status == http.StatusUnauthorized || reqErr.Status == http.StatusForbidden) {
+		// Only rejected credentials count, not an unreachable Epinio
+		a.p.loginFailed(c, username)
+	}
+	if err != nil {
 		msg := "unable to verify Username and/or password: %+v"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
+	}
+
+	a.p.loginSucceeded(c, username)
+
+	userInfo := &eInterfaces.TokenMetadata{
+		Admin:      me.IsAdmin(),
+		Roles:      me.RoleIDs(),
+		Namespaces: me.Namespaces,
+	}
+	if err := setTokenMetadata(c, userInfo); err != nil {
+		return "", "", nil, err
+	}
+
+	// User guid, user name, user info, err
+	return username, username, userInfo, nil
+}
+
+// setTokenMetadata stores the user's role information in the token that will be saved against the epinio endpoint/s
+func setTokenMetadata(c echo.Context, userInfo *eInterfaces.TokenMetadata) error {
+	tr, ok := c.Get("token").(*interfaces.TokenRecord)
+	if !ok || tr == nil {
+		return errors.New("missing token")
 	}
 
-	// User guid, user name, err
-	return username, username, nil
+	metadata, err := json.Marshal(userInfo)
+	if err != nil {
+		return fmt.Errorf("unable to marshal user info: %v", err)
+	}
+	tr.Metadata = string(metadata)
+
+	return nil
 }
 
 func (a *epinioAuth) getRancherUsernameAndPassword(c echo.Context) (string, string, error) {
@@ -171,42 +403,49 @@ func (a *epinioAuth) getRancherUsernameAndPassword(c echo.Context) (string, stri
 	return username, password, nil
 }
 
-func (a *epinioAuth) verifyLocalLoginCreds(username, password string) error {
+func (a *epinioAuth) verifyLocalLoginCreds(epinioEndpoint *interfaces.CNSIRecord, username, password string) (*eInterfaces.MeResponse, error) {
 	log.Debug("verifyEpinioCreds")
 
-	// Find the epinio endpoint
-	epinioEndpoint, err := epinio_utils.FindEpinioEndpoint(a.p)
-
-	if err != nil {
-		return fmt.Errorf("failed to find an epinio endpoint: %v", err)
-	}
+	authString := fmt.Sprintf("%s:%s", username, password)
+	return a.fetchEpinioUser(epinioEndpoint, "Basic "+base64.StdEncoding.EncodeToString([]byte(authString)))
+}
 
-	// Make a request to the epinio endpoint that requires auth
+// fetchEpinioUser makes a request to the epinio endpoint's `/api/v1/me`, which both requires auth and returns the user's roles
+func (a *epinioAuth) fetchEpinioUser(epinioEndpoint *interfaces.CNSIRecord, authorization string) (*eInterfaces.MeResponse, error) {
 	credsUrl := fmt.Sprintf("%s/api/v1/me", epinioEndpoint.APIEndpoint.String())
 
 	req, err := http.NewRequest("GET", credsUrl, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request to verify epinio creds: %v", err)
+		return nil, fmt.Errorf("failed to create request to verify epinio creds: %v", err)
 	}
 
-	req.SetBasicAuth(username, password)
+	req.Header.Set("Authorization", authorization)
 
 	var h = a.p.GetHttpClientForRequest(req, epinioEndpoint.SkipSSLValidation)
 	res, err := h.Do(req)
 	if err != nil || res.StatusCode != http.StatusOK {
 		log.Errorf("Error verify epinio creds - response: %v, error: %v", res, err)
-		return interfaces.LogHTTPError(res, err)
+		return nil, interfaces.LogHTTPError(res, err)
 	}
 
 	defer res.Body.Close()
 
-	return nil
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read epinio user: %v", err)
+	}
 
+	me := &eInterfaces.MeResponse{}
+	if err = json.Unmarshal(body, me); err != nil {
+		return nil, fmt.Errorf("failed to parse epinio user: %v", err)
+	}
+
+	return me, nil
 }
 
 // ------------------
 // epinioOIDCLogin verifies DEX credentials
-func (a *epinioAuth) epinioOIDCLogin(c echo.Context) (string, string, error) {
+func (a *epinioAuth) epinioOIDCLogin(c echo.Context) (string, string, *eInterfaces.TokenMetadata, error) {
 	log.Debug("epinioOIDCLogin")
 
 	defer c.Request().Body.Close()
@@ -214,33 +453,56 @@ func (a *epinioAuth) epinioOIDCLogin(c echo.Context) (string, string, error) {
 	if err != nil {
 		msg := "unable to read body: %+v"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
 	var params rancherproxy.LoginOIDCParams
 	if err = json.Unmarshal(body, &params); err != nil {
 		msg := "unable to parse body: %+v"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
 	if len(params.Code) == 0 {
-		return "", "", errors.New("auth code required")
+		return "", "", nil, errors.New("auth code required")
 	}
 
-	oidcProvider, err := a.p.GetDex()
+	// The state created with the redirect url can only be used once
+	loginState, err := a.consumeDexLoginState(c)
+	if err != nil {
+		msg := fmt.Sprintf("unable to find login state: %+v", err)
+		log.Error(msg)
+		return "", "", nil, errors.New(msg)
+	}
+
+	if err = loginState.Validate(params.LoginState()); err != nil {
+		msg := fmt.Sprintf("invalid login state: %+v", err)
+		log.Error(msg)
+		return "", "", nil, errors.New(msg)
+	}
+
+	epinioCnsi, err := a.p.GetCNSIRecord(loginState.Cluster)
+	if err != nil {
+		msg := fmt.Sprintf("unable to find epinio cluster: %+v", err)
+		log.Error(msg)
+		return "", "", nil, errors.New(msg)
+	}
+	epinioEndpoint := &epinioCnsi
+	c.Set(epinio_utils.LoginClusterContextKey, epinioEndpoint.GUID)
+
+	oidcProvider, err := a.p.GetDex(epinioEndpoint.GUID)
 
 	if err != nil {
 		msg := fmt.Sprintf("unable to create dex client: %+v", err)
 		log.Error(msg)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
-	token, err := oidcProvider.ExchangeWithPKCE(c.Request().Context(), params.Code, params.CodeVerifier)
+	token, err := oidcProvider.ExchangeWithPKCE(c.Request().Context(), params.Code, loginState.CodeVerifier)
 	if err != nil {
 		msg := fmt.Sprintf("failed to get token from code: %+v", err)
 		log.Errorf(msg)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
 	tr := &interfaces.TokenRecord{
@@ -248,50 +510,134 @@ func (a *epinioAuth) epinioOIDCLogin(c echo.Context) (string, string, error) {
 		AuthToken:    token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		TokenExpiry:  token.Expiry.Unix(),
-		Metadata:     params.CodeVerifier, // This will be used for refreshing the token
 	}
 
-	idToken, err := oidcProvider.Verify(c.Request().Context(), token.AccessToken)
+	// Prefer the ID token, Dex access tokens carry the same claims
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || len(rawIDToken) == 0 {
+		rawIDToken = token.AccessToken
+	}
+
+	idToken, err := oidcProvider.Verify(c.Request().Context(), rawIDToken)
 	if err != nil {
 		msg := "failed to verify fetched token: %+v"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
-	var claims struct {
-		Email           string   `json:"email"`
-		Groups          []string `json:"groups"`
-		FederatedClaims struct {
-			ConnectorID string `json:"connector_id"`
-		} `json:"federated_claims"`
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(loginState.Nonce)) != 1 {
+		msg := "token nonce does not match login state"
+		log.Error(msg)
+		return "", "", nil, errors.New(msg)
 	}
-	log.Warnf("epinioOIDCLogin: token: %+v", idToken)
 
+	var claims map[string]interface{}
 	if err := idToken.Claims(&claims); err != nil {
 		msg := "token in unexpected format"
 		log.Errorf(msg, err)
-		return "", "", errors.New(msg)
+		return "", "", nil, errors.New(msg)
 	}
 
-	log.Warnf("epinioOIDCLogin: claims: %+v", claims)
+	settings, err := a.p.dexSettings()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	identity, err := settings.Identity(claims)
+	if err != nil {
+		log.Errorf("epinioOIDCLogin: %v", err)
+		return "", "", nil, err
+	}
+
+	if err = loginState.ValidateConnector(identity); err != nil {
+		msg := fmt.Sprintf("invalid login state: %+v", err)
+		log.Error(msg)
+		return "", "", nil, errors.New(msg)
+	}
+
+	log.Debugf("epinioOIDCLogin: identity: %+v", identity)
 
 	c.Set("token", tr)
 
-	return claims.Email, claims.Email, nil
+	userInfo := a.getOIDCUserInfo(epinioEndpoint, token.AccessToken, identity.Groups)
+	if err := setTokenMetadata(c, userInfo); err != nil {
+		return "", "", nil, err
+	}
+
+	return identity.UserID, identity.Name, userInfo, nil
 
 }
 
+// consumeDexLoginState removes the Dex login state from the pre-login session. The pre-login session is destroyed,
+// so that the state can't be reused and a fresh session is created for the logged in user
+func (a *epinioAuth) consumeDexLoginState(c echo.Context) (*dex.LoginState, error) {
+	session, err := a.p.GetSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok := session.Values[dex.LoginStateSessionKey].(string)
+	if !ok || len(encoded) == 0 {
+		return nil, errors.New("no login in progress")
+	}
+
+	delete(session.Values, dex.LoginStateSessionKey)
+	session.Options.MaxAge = -1
+	if err = a.p.SessionStore.Save(c.Request(), c.Response().Writer, session); err != nil {
+		return nil, fmt.Errorf("unable to remove pre-login session: %v", err)
+	}
+	c.Set(jetStreamSessionContextKey, nil)
+
+	return dex.DecodeLoginState(encoded)
+}
+
+// getOIDCUserInfo determines the user's roles from Epinio, using the Dex token, and from the token's group claims.
+// Members of any group in EPINIO_DEX_ADMIN_GROUPS are admins
+func (a *epinioAuth) getOIDCUserInfo(epinioEndpoint *interfaces.CNSIRecord, accessToken string, groups []string) *eInterfaces.TokenMetadata {
+	userInfo := &eInterfaces.TokenMetadata{
+		Roles:      make([]string, 0),
+		Namespaces: make([]string, 0),
+	}
+
+	me, err := a.fetchEpinioUser(epinioEndpoint, "Bearer "+accessToken)
+	if err != nil {
+		log.Warnf("Unable to fetch epinio roles for OIDC user, falling back on group claims: %v", err)
+		userInfo.Roles = append(userInfo.Roles, groups...)
+	} else {
+		userInfo.Admin = me.IsAdmin()
+		userInfo.Roles = me.RoleIDs()
+		userInfo.Namespaces = me.Namespaces
+	}
+
+	adminGroups := strings.Split(a.p.Env().String("EPINIO_DEX_ADMIN_GROUPS", ""), ",")
+	for _, group := range groups {
+		for _, adminGroup := range adminGroups {
+			if adminGroup = strings.TrimSpace(adminGroup); len(adminGroup) > 0 && group == adminGroup {
+				userInfo.Admin = true
+			}
+		}
+	}
+
+	return userInfo
+}
+
 // ------------------
 // generateLoginSuccessResponse
-func (e *epinioAuth) generateLoginSuccessResponse(c echo.Context, userGUID, username string) error {
+func (e *epinioAuth) generateLoginSuccessResponse(c echo.Context, userGUID, username, authType string, userInfo *eInterfaces.TokenMetadata) error {
 	log.Debug("generateLoginSuccessResponse")
 
 	var err error
-	var expiry int64 = math.MaxInt64 // Basic auth type never expires
+	now := time.Now()
+	expiry := now.Add(e.sessionLifetime).Unix()
 
 	sessionValues := make(map[string]interface{})
 	sessionValues["user_id"] = userGUID
 	sessionValues["exp"] = expiry
+	sessionValues[epinioSessionLastActive] = now.Unix()
+	sessionValues[epinioSessionAuthType] = authType
+	if loginCluster, ok := c.Get(epinio_utils.LoginClusterContextKey).(string); ok {
+		sessionValues[epinioSessionLoginCluster] = loginCluster
+	}
 
 	// Ensure that login disregards cookies from the request
 	req := c.Request()
@@ -305,7 +651,7 @@ func (e *epinioAuth) generateLoginSuccessResponse(c echo.Context, userGUID, user
 		return err
 	}
 
-	// This will register and log the user in to the sole epinio instance. It should really move to here
+	// This will connect the user to the epinio cluster/s. It should really move to here
 	err = e.p.ExecuteLoginHooks(c)
 	if err != nil {
 		log.Warnf("Login hooks failed: %v", err)
@@ -315,7 +661,7 @@ func (e *epinioAuth) generateLoginSuccessResponse(c echo.Context, userGUID, user
 		Account:     username,
 		TokenExpiry: expiry,
 		APIEndpoint: nil,
-		Admin:       false,
+		Admin:       userInfo != nil && userInfo.Admin,
 	}
 
 	if jsonString, err := json.Marshal(resp); err == nil {
@@ -343,6 +689,9 @@ func (e *epinioAuth) generateLoginSuccessResponse(c echo.Context, userGUID, user
 func (a *epinioAuth) logout(c echo.Context) error {
 	a.p.removeEmptyCookie(c)
 
+	// This needs the session and the user's token, so must happen before both are removed
+	redirectURL := a.endDexSession(c)
+
 	// Remove the XSRF Token from the session
 	err := a.p.unsetSessionValue(c, XSRFTokenSessionName)
 	if err != nil {
@@ -359,10 +708,66 @@ func (a *epinioAuth) logout(c echo.Context) error {
 		log.Warnf("Logout hooks failed: %v", err)
 	}
 
+	// The dashboard shell ignores the response, it goes to the login page which follows the cookie
+	if len(redirectURL) > 0 {
+		cookie := new(http.Cookie)
+		cookie.Name = epinioLogoutRedirectCookie
+		cookie.Value = url.QueryEscape(redirectURL)
+		cookie.Secure = a.p.SessionStoreOptions.Secure
+		cookie.Path = "/"
+		cookie.MaxAge = 60
+		cookie.SameSite = http.SameSiteLaxMode
+		c.SetCookie(cookie)
+	}
+
 	// Send JSON document
 	resp := &LogoutResponse{
-		IsSSO: a.p.Config.SSOLogin,
+		IsSSO:       a.p.Config.SSOLogin,
+		RedirectURL: redirectURL,
 	}
 
 	return c.JSON(http.StatusOK, resp)
 }
+
+// endDexSession revokes the Dex refresh token of an OIDC user and returns the url to end their session with the
+// identity provider (empty if the provider doesn't support RP-initiated logout)
+func (a *epinioAuth) endDexSession(c echo.Context) string {
+	authType, _ := a.p.GetSessionStringValue(c, epinioSessionAuthType)
+	if authType != "oidc" {
+		return ""
+	}
+
+	userGUID, err := a.p.GetSessionStringValue(c, "user_id")
+	if err != nil {
+		return ""
+	}
+
+	cnsiGUID, err := a.p.GetSessionStringValue(c, epinioSessionLoginCluster)
+	if err != nil {
+		return ""
+	}
+
+	epinioCnsi, err := a.p.GetCNSIRecord(cnsiGUID)
+	if err != nil {
+		log.Warnf("Unable to find epinio cluster %s to end Dex session: %v", cnsiGUID, err)
+		return ""
+	}
+
+	oidcProvider, err := a.p.GetDex(cnsiGUID)
+	if err != nil {
+		log.Warnf("Unable to create dex client to end Dex session: %v", err)
+		return ""
+	}
+
+	if tr, ok := a.p.GetCNSITokenRecordWithDisconnected(cnsiGUID, userGUID); ok && len(tr.RefreshToken) > 0 {
+		err = oidcProvider.RevokeToken(c.Request().Context(), tr.RefreshToken)
+		if err == dex.ErrRevocationNotSupported {
+			log.Debugf("Dex refresh token for %s not revoked: %v", userGUID, err)
+		} else if err != nil {
+			log.Warnf("Unable to revoke Dex refresh token for %s: %v", userGUID, err)
+		}
+	}
+
+	metadata, _ := epinio_utils.GetMetadata(&epinioCnsi)
+	return oidcProvider.EndSessionURL(metadata.UIURL)
+}
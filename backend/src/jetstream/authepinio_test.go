@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const (
+	listCNSIsSQL = `SELECT (.+) FROM cnsis`
+
+	mockEpinioMe = `{"user":"jane","role":"user","roles":[{"id":"admin","namespace":""},{"id":"user","namespace":"workspace"}],"namespaces":["workspace"]}`
+)
+
+func TestEpinioUserRoles(t *testing.T) {
+	t.Parallel()
+
+	Convey("The roles of an OIDC user", t, func() {
+		req := setupMockReq("GET", "", nil)
+		_, _, _, pp, db, _ := setupHTTPTest(req)
+		defer db.Close()
+
+		pp.Env().AppendSource(func(k string) (string, bool) {
+			if k == "EPINIO_DEX_ADMIN_GROUPS" {
+				return "ops, platform", true
+			}
+			return "", false
+		})
+		auth := newEpinioAuth(pp)
+
+		Convey("Should come from Epinio", func() {
+			server := setupMockServer(t, msRoute("/api/v1/me"), msMethod("GET"), msStatus(http.StatusOK), msBody(mockEpinioMe))
+			defer server.Close()
+
+			endpoint := &interfaces.CNSIRecord{APIEndpoint: urlMust(server.URL), SkipSSLValidation: true}
+			userInfo := auth.getOIDCUserInfo(endpoint, "token", []string{"developers"})
+			So(userInfo.Admin, ShouldBeTrue)
+			So(userInfo.Roles, ShouldResemble, []string{"admin", "user:workspace"})
+			So(userInfo.Namespaces, ShouldResemble, []string{"workspace"})
+		})
+
+		Convey("Should fall back on the group claims if Epinio doesn't answer", func() {
+			server := setupMockServer(t, msRoute("/api/v1/me"), msMethod("GET"), msStatus(http.StatusUnauthorized))
+			defer server.Close()
+
+			endpoint := &interfaces.CNSIRecord{APIEndpoint: urlMust(server.URL), SkipSSLValidation: true}
+			userInfo := auth.getOIDCUserInfo(endpoint, "token", []string{"developers"})
+			So(userInfo.Admin, ShouldBeFalse)
+			So(userInfo.Roles, ShouldResemble, []string{"developers"})
+			So(userInfo.Namespaces, ShouldBeEmpty)
+
+			Convey("Members of an admin group are admins", func() {
+				userInfo := auth.getOIDCUserInfo(endpoint, "token", []string{"developers", "platform"})
+				So(userInfo.Admin, ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("The connected user", t, func() {
+		req := setupMockReq("GET", "", nil)
+		_, _, _, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+		auth := newEpinioAuth(pp)
+
+		mock.ExpectQuery(listCNSIsSQL).WillReturnRows(expectCFRow())
+
+		Convey("Should have the roles stored against the user's epinio token", func() {
+			encryptedToken, _ := crypto.EncryptToken(mockEncryptionKey, mockUAAToken)
+			mock.ExpectQuery(selectAnyFromTokens).
+				WithArgs(mockCFGUID, mockUserGUID, mockAdminGUID).
+				WillReturnRows(sqlmock.NewRows([]string{"token_guid", "auth_token", "refresh_token", "token_expiry", "disconnected", "auth_type", "meta_data", "user_guid", "linked_token"}).
+					AddRow(mockTokenGUID, encryptedToken, encryptedToken, mockTokenExpiry, false, "epinio", `{"admin":true,"roles":["admin","user:workspace"],"namespaces":["workspace"]}`, mockUserGUID, nil))
+
+			user, err := auth.GetUser(mockUserGUID)
+			So(err, ShouldBeNil)
+			So(user.Admin, ShouldBeTrue)
+			So(user.Scopes, ShouldResemble, []string{"admin", "user:workspace"})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should have no roles without an epinio token", func() {
+			mock.ExpectQuery(selectAnyFromTokens).
+				WithArgs(mockCFGUID, mockUserGUID, mockAdminGUID).
+				WillReturnRows(sqlmock.NewRows([]string{"token_guid"}))
+
+			user, err := auth.GetUser(mockUserGUID)
+			So(err, ShouldBeNil)
+			So(user.Admin, ShouldBeFalse)
+			So(user.Scopes, ShouldBeEmpty)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestDexSettings(t *testing.T) {
+	t.Parallel()
+
+	Convey("The Dex settings", t, func() {
+		req := setupMockReq("GET", "", nil)
+		_, _, _, pp, db, _ := setupHTTPTest(req)
+		defer db.Close()
+
+		Convey("Should not be found if Dex is not enabled", func() {
+			_, err := pp.dexSettings()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should be the ones loaded by the epinio plugin", func() {
+			pp.Env().AppendSource(func(k string) (string, bool) {
+				if k == "EPINIO_DEX_ENABLED" {
+					return "true", true
+				}
+				return "", false
+			})
+			pp.Plugins["epinio"] = initCFPlugin(pp)
+
+			settings, err := pp.dexSettings()
+			So(err, ShouldBeNil)
+			So(settings.ClientID, ShouldEqual, "epinio-ui")
+
+			again, err := pp.dexSettings()
+			So(err, ShouldBeNil)
+			So(again, ShouldPointTo, settings)
+		})
+	})
+}
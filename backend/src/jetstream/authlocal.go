@@ -19,6 +19,9 @@ import (
 	"github.com/epinio/ui/backend/src/jetstream/repository/localusers"
 )
 
+// The session version of the user at login, see localusers.Repository.RevokeSessions
+const localSessionVersion = "local_session_version"
+
 //More fields will be moved into here as global portalProxy struct is phased out
 type localAuth struct {
 	databaseConnectionPool *sql.DB
@@ -44,9 +47,16 @@ func (a *localAuth) Login(c echo.Context) error {
 		return err
 	}
 
+	//Forget the login attempt unless the credentials are rejected or accepted
+	defer a.p.loginEnded(c)
+
 	//Perform the login and fetch session values if successful
 	userGUID, username, err := a.localLogin(c)
 
+	if locked, ok := err.(errLoginLocked); ok {
+		return locked.HTTPError(c)
+	}
+
 	if err != nil {
 		//Login failed, return response.
 		errMessage := err.Error()
@@ -57,11 +67,106 @@ func (a *localAuth) Login(c echo.Context) error {
 		return err
 	}
 
+	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(a.databaseConnectionPool)
+	if err != nil {
+		log.Errorf("Database error getting repo for Local users: %v", err)
+		return err
+	}
+
+	//Users with a second factor need to verify a code before they are logged in
+	mfa, err := localUsersRepo.FindMFA(userGUID)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Login failed",
+			"Login failed: unable to find MFA of user %s: %v", userGUID, err)
+	}
+	if mfa != nil && mfa.Enabled {
+		return a.startMFALogin(c, userGUID, username)
+	}
+
+	a.completeLogin(c, localUsersRepo, userGUID, username)
 	err = a.generateLoginSuccessResponse(c, userGUID, username)
 
 	return err
 }
 
+//LoginMFA completes a login started by Login with the TOTP or a recovery code of the user
+func (a *localAuth) LoginMFA(c echo.Context) error {
+	userGUID, err := a.p.GetSessionStringValue(c, mfaUserIDSessionKey)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusUnauthorized,
+			"No pending login, please log in again",
+			"MFA login failed: no pending login")
+	}
+	username, _ := a.p.GetSessionStringValue(c, mfaUsernameSessionKey)
+	if expiry, err := a.p.GetSessionInt64Value(c, mfaExpirySessionKey); err != nil || time.Now().Unix() > expiry {
+		return interfaces.NewHTTPShadowError(
+			http.StatusUnauthorized,
+			"Login expired, please log in again",
+			"MFA login of user %s failed: pending login expired", userGUID)
+	}
+
+	if err = a.p.checkLoginAllowed(c, username); err != nil {
+		if locked, ok := err.(errLoginLocked); ok {
+			return locked.HTTPError(c)
+		}
+		return err
+	}
+	defer a.p.loginEnded(c)
+
+	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(a.databaseConnectionPool)
+	if err != nil {
+		log.Errorf("Database error getting repo for Local users: %v", err)
+		return err
+	}
+
+	mfa, err := localUsersRepo.FindMFA(userGUID)
+	if err != nil || mfa == nil || !mfa.Enabled {
+		return interfaces.NewHTTPShadowError(
+			http.StatusUnauthorized,
+			"Login failed, please log in again",
+			"MFA login of user %s failed: MFA not found: %v", userGUID, err)
+	}
+
+	next, err := a.p.verifyMFACode(localUsersRepo, mfa, c.FormValue("code"))
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Login failed",
+			"MFA login of user %s failed: %v", userGUID, err)
+	}
+	if next == nil {
+		a.p.loginFailed(c, username)
+		return interfaces.NewHTTPShadowError(
+			http.StatusUnauthorized,
+			"Access Denied - Invalid code",
+			"MFA login of user %s failed: invalid code", userGUID)
+	}
+
+	//The pending login is now complete
+	for _, key := range []string{mfaUserIDSessionKey, mfaUsernameSessionKey, mfaExpirySessionKey} {
+		if err = a.p.unsetSessionValue(c, key); err != nil {
+			return err
+		}
+	}
+
+	a.completeLogin(c, localUsersRepo, userGUID, username)
+
+	return a.generateLoginSuccessResponse(c, userGUID, username)
+}
+
+//completeLogin resets the failed logins and updates the last login time of a user who has logged in
+func (a *localAuth) completeLogin(c echo.Context, localUsersRepo localusers.Repository, userGUID string, username string) {
+	a.p.loginSucceeded(c, username)
+
+	if err := localUsersRepo.UpdateLastLoginTime(userGUID, time.Now()); err != nil {
+		log.Error(err)
+		log.Errorf("Failed to update last login time for user: %s", userGUID)
+	}
+}
+
 //Logout provides Local-auth specific Stratos login
 func (a *localAuth) Logout(c echo.Context) error {
 	return a.logout(c)
@@ -121,16 +226,56 @@ func (a *localAuth) GetUser(userGUID string) (*interfaces.ConnectedUser, error)
 
 func (a *localAuth) BeforeVerifySession(c echo.Context) {}
 
-//VerifySession verifies the session the specified local user, currently just verifies user exists
+//VerifySession verifies the session the specified local user, i.e. that the user exists and the session has not been revoked
 func (a *localAuth) VerifySession(c echo.Context, sessionUser string, sessionExpireTime int64) error {
+	return a.verifySessionVersion(c, sessionUser)
+}
+
+//VerifySessionActivity ends the sessions of users who have been removed, or whose sessions have been revoked (e.g.
+//because their password was changed)
+func (a *localAuth) VerifySessionActivity(c echo.Context) error {
+	sessionUser, err := a.p.GetSessionStringValue(c, "user_id")
+	if err != nil {
+		return errors.New("could not find user_id in session")
+	}
+
+	return a.verifySessionVersion(c, sessionUser)
+}
+
+//SessionExpiresOn returns the session store's expiry, local sessions don't have a lifetime of their own
+func (a *localAuth) SessionExpiresOn(c echo.Context) (time.Time, error) {
+	expiresOn, err := a.p.GetSessionValue(c, "expires_on")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return expiresOn.(time.Time), nil
+}
+
+//verifySessionVersion checks the session was started with the current session version of the user
+func (a *localAuth) verifySessionVersion(c echo.Context, sessionUser string) error {
 	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(a.databaseConnectionPool)
 	if err != nil {
 		log.Errorf("Database error getting repo for Local users: %v", err)
 		return err
 	}
 
-	_, err = localUsersRepo.FindPasswordHash(sessionUser)
-	return err
+	version, err := localUsersRepo.FindSessionVersion(sessionUser)
+	if err != nil {
+		return err
+	}
+
+	// Sessions started before session versions were introduced have none
+	var sessionVersion int64
+	if value, err := a.p.GetSessionValue(c, localSessionVersion); err == nil {
+		sessionVersion, _ = value.(int64)
+	}
+
+	if sessionVersion != version {
+		return errors.New("session has been revoked")
+	}
+
+	return nil
 }
 
 //localLogin verifies local user credentials against our DB
@@ -144,6 +289,10 @@ func (a *localAuth) localLogin(c echo.Context) (string, string, error) {
 		return "", username, errors.New("Needs usernameand password")
 	}
 
+	if err := a.p.checkLoginAllowed(c, username); err != nil {
+		return "", username, err
+	}
+
 	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(a.databaseConnectionPool)
 	if err != nil {
 		log.Errorf("Database error getting repo for Local users: %v", err)
@@ -158,6 +307,7 @@ func (a *localAuth) localLogin(c echo.Context) (string, string, error) {
 	// Get the GUID for the specified user
 	guid, err := localUsersRepo.FindUserGUID(username)
 	if err != nil {
+		a.p.loginFailed(c, username)
 		return guid, username, fmt.Errorf("Access Denied - Invalid username/password credentials")
 	}
 
@@ -166,6 +316,7 @@ func (a *localAuth) localLogin(c echo.Context) (string, string, error) {
 		authError = fmt.Errorf("Access Denied - Invalid username/password credentials")
 		//Check the password hash
 	} else if authError = crypto.CheckPasswordHash(password, hash); authError != nil {
+		a.p.loginFailed(c, username)
 		authError = fmt.Errorf("Access Denied - Invalid username/password credentials")
 	} else {
 		//Ensure the local user has some kind of admin role configured and we check for it here
@@ -174,17 +325,32 @@ func (a *localAuth) localLogin(c echo.Context) (string, string, error) {
 		if (authError != nil) || (!scopeOK) {
 			authError = fmt.Errorf("Access Denied - User scope invalid")
 		} else {
-			//Update the last login time here if login was successful
-			loginTime := time.Now()
-			if updateLoginTimeErr := localUsersRepo.UpdateLastLoginTime(guid, loginTime); updateLoginTimeErr != nil {
-				log.Error(updateLoginTimeErr)
-				log.Errorf("Failed to update last login time for user: %s", guid)
-			}
+			a.rehashPassword(localUsersRepo, guid, password, hash)
 		}
 	}
 	return guid, username, authError
 }
 
+//rehashPassword replaces a password hash created with an outdated algorithm or parameters. The login succeeds even if
+//the hash can't be replaced, it's tried again on the next login
+func (a *localAuth) rehashPassword(localUsersRepo localusers.Repository, userGUID string, password string, hash []byte) {
+	if !crypto.PasswordNeedsRehash(hash) {
+		return
+	}
+
+	newHash, err := crypto.HashPassword(password)
+	if err != nil {
+		log.Errorf("Unable to rehash password of user %s: %v", userGUID, err)
+		return
+	}
+
+	if updated, err := localUsersRepo.UpdatePasswordHash(userGUID, newHash, hash); err != nil {
+		log.Errorf("Unable to rehash password of user %s: %v", userGUID, err)
+	} else if updated {
+		log.Infof("Rehashed password of user %s", userGUID)
+	}
+}
+
 //generateLoginSuccessResponse
 func (a *localAuth) generateLoginSuccessResponse(c echo.Context, userGUID string, username string) error {
 	log.Debug("generateLoginResponse")
@@ -197,6 +363,14 @@ func (a *localAuth) generateLoginSuccessResponse(c echo.Context, userGUID string
 	sessionValues["user_id"] = userGUID
 	sessionValues["exp"] = expiry
 
+	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(a.databaseConnectionPool)
+	if err != nil {
+		return err
+	}
+	if sessionValues[localSessionVersion], err = localUsersRepo.FindSessionVersion(userGUID); err != nil {
+		return err
+	}
+
 	// Ensure that login disregards cookies from the request
 	req := c.Request()
 	req.Header.Set("Cookie", "")
@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -10,45 +11,106 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Values are stored as `aesgcm:<key id>:<nonce><sealed value>`. The key id identifies the key the value was encrypted
+// with, so that values encrypted with a previous key can still be read after the key has been rotated. The header is
+// authenticated along with the value.
+const (
+	envelopePrefix = "aesgcm:"
+	keyIDLength    = 8
+	headerLength   = len(envelopePrefix) + keyIDLength + 1
+)
+
 // Encrypt - Encrypt a token based on an encryption key
-// The approach used here is based on the following direction on how to AES
-// encrypt/decrypt our secret information, in this case tokens (normal, refresh
-// and OAuth tokens).
-// Source: https://github.com/giorgisio/examples/blob/master/aes-encrypt/main.go
-func Encrypt(key, text []byte) (ciphertext []byte, err error) {
+// The token is sealed with AES-GCM and prefixed with the id of the key, see Decrypt
+func Encrypt(key, text []byte) ([]byte, error) {
 	log.Debug("Encrypt")
-	var block cipher.Block
 
-	if block, err = aes.NewCipher(key); err != nil {
+	gcm, err := newGCM(key)
+	if err != nil {
 		return nil, err
 	}
 
-	ciphertext = make([]byte, aes.BlockSize+len(string(text)))
+	header := envelopeHeader(KeyID(key))
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
 
-	// iv =  initialization vector
-	iv := ciphertext[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return
+	ciphertext := make([]byte, 0, len(header)+len(nonce)+len(text)+gcm.Overhead())
+	ciphertext = append(ciphertext, header...)
+	ciphertext = append(ciphertext, nonce...)
+	return gcm.Seal(ciphertext, nonce, text, header), nil
+}
+
+// Decrypt - Decrypt a token based on an encryption key
+// Tokens encrypted with a previous key (see SetPreviousKeys) are decrypted with that key. Tokens stored before
+// AES-GCM was introduced are decrypted with the legacy AES-CFB scheme
+func Decrypt(key, ciphertext []byte) ([]byte, error) {
+	log.Debug("Decrypt")
+
+	keyID, ok := envelopeKeyID(ciphertext)
+	if !ok {
+		return decryptCFB(legacyKey(key), ciphertext)
 	}
 
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], text)
+	if KeyID(key) != keyID {
+		var found bool
+		if key, found = previousKey(keyID); !found {
+			return nil, fmt.Errorf("unknown encryption key %s", keyID)
+		}
+	}
 
-	return
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := ciphertext[:headerLength]
+	sealed := ciphertext[headerLength:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], header)
 }
 
-// Decrypt - Decrypt a token based on an encryption key
+// IsEncryptedWithKey returns true if the token was encrypted with the given key, using AES-GCM. Tokens that are not
+// should be re-encrypted
+func IsEncryptedWithKey(key, ciphertext []byte) bool {
+	keyID, ok := envelopeKeyID(ciphertext)
+	return ok && keyID == KeyID(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func envelopeHeader(keyID string) []byte {
+	return []byte(envelopePrefix + keyID + ":")
+}
+
+func envelopeKeyID(ciphertext []byte) (string, bool) {
+	if len(ciphertext) < headerLength || !bytes.HasPrefix(ciphertext, []byte(envelopePrefix)) || ciphertext[headerLength-1] != ':' {
+		return "", false
+	}
+	return string(ciphertext[len(envelopePrefix) : headerLength-1]), true
+}
+
+// decryptCFB decrypts tokens stored with the original AES-CFB scheme, which has no integrity check
 // The approach used here is based on the following direction on how to AES
 // encrypt/decrypt our secret information, in this case tokens (normal, refresh
 // and OAuth tokens).
 // Source: https://github.com/giorgisio/examples/blob/master/aes-encrypt/main.go
-func Decrypt(key, ciphertext []byte) (plaintext []byte, err error) {
-	log.Debug("Decrypt")
-
+func decryptCFB(key, ciphertext []byte) (plaintext []byte, err error) {
 	var block cipher.Block
 
 	if block, err = aes.NewCipher(key); err != nil {
@@ -61,16 +123,28 @@ func Decrypt(key, ciphertext []byte) (plaintext []byte, err error) {
 	}
 
 	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	plaintext = make([]byte, len(ciphertext)-aes.BlockSize)
 
 	cfb := cipher.NewCFBDecrypter(block, iv)
-	cfb.XORKeyStream(ciphertext, ciphertext)
-
-	plaintext = ciphertext
+	cfb.XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
 
 	return
 }
 
+// isText returns true if the value is printable UTF-8 text, as all tokens and secrets are. A value decrypted with the
+// wrong key is random bytes, which almost never are
+func isText(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if (r < ' ' && r != '\t' && r != '\n' && r != '\r') || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 // ReadEncryptionKey - Read the encryption key from the shared volume
 func ReadEncryptionKey(v, f string) ([]byte, error) {
 	log.Debug("ReadEncryptionKey")
@@ -2,6 +2,10 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
@@ -24,19 +28,39 @@ func GenerateRandomBytes(n int) ([]byte, error) {
 
 }
 
-//HashPassword accepts a plaintext password string and generates a salted hash
+//HashPassword accepts a plaintext password string and generates a salted hash, with the configured hasher (see
+//SetPasswordHasher)
 func HashPassword(password string) ([]byte, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return bytes, err
+	return currentPasswordHasher().Hash(password)
 }
 
-//CheckPasswordHash accepts a bcrypt salted hash and plaintext password.
-//It verifies the password against the salted hash
+//CheckPasswordHash accepts a salted hash and plaintext password.
+//It verifies the password against the salted hash, using the algorithm and parameters stored in the hash
 func CheckPasswordHash(password string, hash []byte) error {
+	if isArgon2idHash(hash) {
+		return checkArgon2idHash(password, hash)
+	}
 	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
 	return err
 }
 
+// HashAPIKeySecret accepts a salt and an API key secret and generates the hash that is stored instead of the secret.
+// Secrets are random, so a single round of SHA-256 is enough (and keeps the check cheap, it happens on every request)
+func HashAPIKeySecret(salt, secret string) string {
+	hash := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// CheckAPIKeySecret verifies an API key secret against the stored salt and hash, in constant time
+func CheckAPIKeySecret(salt, secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashAPIKeySecret(salt, secret)), []byte(hash)) == 1
+}
+
+// HashRecoveryCode returns the hash stored for an MFA recovery code. Like API key secrets, recovery codes are random
+func HashRecoveryCode(salt, code string) string {
+	return HashAPIKeySecret(salt, NormalizeRecoveryCode(code))
+}
+
 // Note:
 // When it's time to store the encrypted token in PostgreSQL, it's gets a bit
 // hairy. The encrypted token is binary data, not really text data, which
@@ -74,3 +98,23 @@ func DecryptToken(key, t []byte) (string, error) {
 
 	return string(plaintextToken), nil
 }
+
+// ReencryptToken - Re-encrypt a token with the given key. Returns nil if the token is already encrypted with the key
+func ReencryptToken(key, t []byte) ([]byte, error) {
+	if len(t) == 0 || IsEncryptedWithKey(key, t) {
+		return nil, nil
+	}
+
+	plaintextToken, err := DecryptToken(key, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// AES-CFB has no integrity check, with the wrong legacy key the token "decrypts" to garbage. Don't seal that with
+	// the new key, the original would be lost
+	if _, ok := envelopeKeyID(t); !ok && !isText([]byte(plaintextToken)) {
+		return nil, errors.New("legacy token does not decrypt to text, is the key it was encrypted with missing from ENCRYPTION_KEYS_PREVIOUS?")
+	}
+
+	return EncryptToken(key, plaintextToken)
+}
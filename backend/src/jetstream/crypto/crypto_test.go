@@ -1,6 +1,9 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/hex"
 	"io/ioutil"
 	"log"
@@ -8,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -87,6 +91,97 @@ func TestAESEncryptDecrypt(t *testing.T) {
 	})
 }
 
+func TestKeyRotation(t *testing.T) {
+
+	Convey("Given a current and a previous encryption key", t, func() {
+
+		var (
+			mockText      = []byte(`abcdefghijklmnopqrstuvwxyz0123456789`)
+			currentKey    = bytes.Repeat([]byte{1}, 32)
+			previousKey   = bytes.Repeat([]byte{2}, 32)
+			unknownKey    = bytes.Repeat([]byte{3}, 32)
+			encryptLegacy = func(key, text []byte) []byte {
+				block, _ := aes.NewCipher(key)
+				ciphertext := make([]byte, aes.BlockSize+len(text))
+				cipher.NewCFBEncrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(ciphertext[aes.BlockSize:], text)
+				return ciphertext
+			}
+		)
+
+		So(SetPreviousKeys([][]byte{previousKey}), ShouldBeNil)
+
+		Convey("tokens are stored with the id of the key", func() {
+			ciphertext, err := Encrypt(currentKey, mockText)
+			So(err, ShouldBeNil)
+			So(string(ciphertext), ShouldStartWith, "aesgcm:"+KeyID(currentKey)+":")
+			So(IsEncryptedWithKey(currentKey, ciphertext), ShouldBeTrue)
+			So(IsEncryptedWithKey(previousKey, ciphertext), ShouldBeFalse)
+		})
+
+		Convey("tokens encrypted with the previous key can be decrypted", func() {
+			ciphertext, _ := Encrypt(previousKey, mockText)
+			plaintext, err := Decrypt(currentKey, ciphertext)
+			So(err, ShouldBeNil)
+			So(plaintext, ShouldResemble, mockText)
+		})
+
+		Convey("tokens encrypted with an unknown key can not be decrypted", func() {
+			ciphertext, _ := Encrypt(unknownKey, mockText)
+			_, err := Decrypt(currentKey, ciphertext)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("modified tokens can not be decrypted", func() {
+			ciphertext, _ := Encrypt(currentKey, mockText)
+			ciphertext[len(ciphertext)-1] ^= 1
+			_, err := Decrypt(currentKey, ciphertext)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("legacy tokens are decrypted with the oldest key", func() {
+			plaintext, err := Decrypt(currentKey, encryptLegacy(previousKey, mockText))
+			So(err, ShouldBeNil)
+			So(plaintext, ShouldResemble, mockText)
+		})
+
+		Convey("legacy tokens are decrypted with the current key when there are no previous keys", func() {
+			So(SetPreviousKeys(nil), ShouldBeNil)
+			plaintext, err := Decrypt(currentKey, encryptLegacy(currentKey, mockText))
+			So(err, ShouldBeNil)
+			So(plaintext, ShouldResemble, mockText)
+		})
+
+		Convey("tokens are re-encrypted with the current key", func() {
+			reencrypted, err := ReencryptToken(currentKey, encryptLegacy(previousKey, mockText))
+			So(err, ShouldBeNil)
+			So(IsEncryptedWithKey(currentKey, reencrypted), ShouldBeTrue)
+
+			plaintext, err := DecryptToken(currentKey, reencrypted)
+			So(err, ShouldBeNil)
+			So(plaintext, ShouldEqual, string(mockText))
+
+			reencrypted, err = ReencryptToken(currentKey, reencrypted)
+			So(err, ShouldBeNil)
+			So(reencrypted, ShouldBeNil)
+		})
+
+		Convey("legacy tokens are not re-encrypted if the legacy key is wrong", func() {
+			So(SetPreviousKeys(nil), ShouldBeNil)
+			reencrypted, err := ReencryptToken(currentKey, encryptLegacy(previousKey, mockText))
+			So(err, ShouldNotBeNil)
+			So(reencrypted, ShouldBeNil)
+		})
+
+		Convey("invalid previous keys are rejected", func() {
+			So(SetPreviousKeys([][]byte{[]byte("short")}), ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			SetPreviousKeys(nil)
+		})
+	})
+}
+
 func writeFakeEncryptionKey() error {
 
 	var err error
@@ -104,3 +199,118 @@ func writeFakeEncryptionKey() error {
 
 	return nil
 }
+
+func TestTOTP(t *testing.T) {
+
+	Convey("Given the RFC 6238 test secret", t, func() {
+
+		// "12345678901234567890", base32 encoded
+		secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+		Convey("codes should match the test vectors", func() {
+			for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+				generated, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+				So(err, ShouldBeNil)
+				So(generated, ShouldEqual, code)
+			}
+		})
+
+		Convey("codes of the neighbouring periods should be accepted once", func() {
+			now := time.Unix(1111111109, 0)
+			previous, _ := TOTPCode(secret, TOTPStep(now)-1)
+
+			step, ok := VerifyTOTP(secret, previous, now, 0)
+			So(ok, ShouldBeTrue)
+			So(step, ShouldEqual, TOTPStep(now)-1)
+
+			_, ok = VerifyTOTP(secret, previous, now, step)
+			So(ok, ShouldBeFalse)
+
+			old, _ := TOTPCode(secret, TOTPStep(now)-2)
+			_, ok = VerifyTOTP(secret, old, now, 0)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("the uri should contain the secret and issuer", func() {
+			uri := TOTPURI("Epinio", "admin user", secret)
+			So(uri, ShouldStartWith, "otpauth://totp/Epinio:admin%20user?")
+			So(uri, ShouldContainSubstring, "secret="+secret)
+			So(uri, ShouldContainSubstring, "issuer=Epinio")
+		})
+	})
+
+	Convey("Given new recovery codes", t, func() {
+		codes, err := NewRecoveryCodes(10)
+		So(err, ShouldBeNil)
+		So(codes, ShouldHaveLength, 10)
+
+		Convey("they should be hashed regardless of formatting", func() {
+			So(codes[0], ShouldHaveLength, 11)
+			So(HashRecoveryCode("salt", strings.ToUpper(strings.Replace(codes[0], "-", " ", 1))), ShouldEqual, HashRecoveryCode("salt", codes[0]))
+			So(HashRecoveryCode("salt", codes[1]), ShouldNotEqual, HashRecoveryCode("salt", codes[0]))
+		})
+	})
+}
+
+func TestPasswordHash(t *testing.T) {
+
+	Convey("Given password hashers with cheap parameters", t, func() {
+
+		argon2id := &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+		bcryptHasher := &BcryptHasher{Cost: 4}
+
+		Convey("argon2id hashes store the algorithm and parameters", func() {
+			hash, err := argon2id.Hash("password")
+			So(err, ShouldBeNil)
+			So(string(hash), ShouldStartWith, "$argon2id$v=19$m=64,t=1,p=1$")
+
+			So(CheckPasswordHash("password", hash), ShouldBeNil)
+			So(CheckPasswordHash("Password", hash), ShouldEqual, ErrPasswordMismatch)
+
+			other, _ := argon2id.Hash("password")
+			So(string(other), ShouldNotEqual, string(hash))
+		})
+
+		Convey("bcrypt hashes can still be checked", func() {
+			hash, err := bcryptHasher.Hash("password")
+			So(err, ShouldBeNil)
+			So(CheckPasswordHash("password", hash), ShouldBeNil)
+			So(CheckPasswordHash("Password", hash), ShouldNotBeNil)
+		})
+
+		Convey("invalid hashes are rejected", func() {
+			So(CheckPasswordHash("password", []byte("$argon2id$v=19$m=64,t=1,p=1$c2FsdA")), ShouldNotBeNil)
+			So(CheckPasswordHash("password", []byte("plain")), ShouldNotBeNil)
+		})
+
+		Convey("hashes with other algorithms or parameters need a rehash", func() {
+			argon2idHash, _ := argon2id.Hash("password")
+			bcryptHash, _ := bcryptHasher.Hash("password")
+
+			So(argon2id.NeedsRehash(argon2idHash), ShouldBeFalse)
+			So(argon2id.NeedsRehash(bcryptHash), ShouldBeTrue)
+			So((&Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1}).NeedsRehash(argon2idHash), ShouldBeTrue)
+
+			So(bcryptHasher.NeedsRehash(bcryptHash), ShouldBeFalse)
+			So(bcryptHasher.NeedsRehash(argon2idHash), ShouldBeTrue)
+			So((&BcryptHasher{Cost: 5}).NeedsRehash(bcryptHash), ShouldBeTrue)
+		})
+
+		Convey("hashers are created from the configuration", func() {
+			hasher, err := NewPasswordHasher("", PasswordHashParams{})
+			So(err, ShouldBeNil)
+			So(hasher, ShouldResemble, &Argon2idHasher{Memory: DefaultArgon2idMemory, Iterations: DefaultArgon2idIterations, Parallelism: DefaultArgon2idParallelism})
+
+			hasher, err = NewPasswordHasher("bcrypt", PasswordHashParams{BcryptCost: 10})
+			So(err, ShouldBeNil)
+			So(hasher, ShouldResemble, &BcryptHasher{Cost: 10})
+
+			_, err = NewPasswordHasher("bcrypt", PasswordHashParams{BcryptCost: 50})
+			So(err, ShouldNotBeNil)
+			_, err = NewPasswordHasher("argon2id", PasswordHashParams{Argon2idMemory: 4, Argon2idParallelism: 1})
+			So(err, ShouldNotBeNil)
+			_, err = NewPasswordHasher("md5", PasswordHashParams{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// previousKeys are the keys that were used before the current encryption key. Tokens encrypted with them stay readable
+// until they have been re-encrypted with the current key
+var previousKeys struct {
+	sync.RWMutex
+	byID map[string][]byte
+	// legacy is the key tokens stored with AES-CFB were encrypted with
+	legacy []byte
+}
+
+// KeyID returns the id stored with tokens encrypted with the key. It's derived from the key, so it does not need to be
+// configured and reveals nothing about the key
+func KeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])[:keyIDLength]
+}
+
+// SetPreviousKeys configures the keys that were used before the current encryption key, newest first. Tokens stored
+// with AES-CFB, before key ids were introduced, are decrypted with the oldest key (or the current key if there are no
+// previous keys)
+func SetPreviousKeys(keys [][]byte) error {
+	byID := make(map[string][]byte, len(keys))
+	for i, key := range keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("invalid previous encryption key %d: %v", i+1, err)
+		}
+		byID[KeyID(key)] = key
+	}
+
+	previousKeys.Lock()
+	defer previousKeys.Unlock()
+
+	previousKeys.byID = byID
+	previousKeys.legacy = nil
+	if len(keys) > 0 {
+		previousKeys.legacy = keys[len(keys)-1]
+	}
+
+	return nil
+}
+
+func previousKey(keyID string) ([]byte, bool) {
+	previousKeys.RLock()
+	defer previousKeys.RUnlock()
+
+	key, ok := previousKeys.byID[keyID]
+	return key, ok
+}
+
+func legacyKey(current []byte) []byte {
+	previousKeys.RLock()
+	defer previousKeys.RUnlock()
+
+	if previousKeys.legacy != nil {
+		return previousKeys.legacy
+	}
+	return current
+}
@@ -0,0 +1,231 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+// Defaults follow the OWASP password storage recommendations. Argon2id needs far less CPU than bcrypt with a cost
+// of 14, the cost used before hashes were configurable
+const (
+	DefaultArgon2idMemory      = 19 * 1024
+	DefaultArgon2idIterations  = 2
+	DefaultArgon2idParallelism = 1
+	DefaultBcryptCost          = 14
+
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// ErrPasswordMismatch is returned when a password does not match a hash
+var ErrPasswordMismatch = errors.New("password does not match")
+
+var argon2idEncoding = base64.RawStdEncoding
+
+// PasswordHasher hashes passwords with one algorithm and its parameters. The algorithm and parameters are stored in
+// the hash (PHC string format for Argon2id, modular crypt format for bcrypt), so CheckPasswordHash can verify hashes
+// created with any settings
+type PasswordHasher interface {
+	Hash(password string) ([]byte, error)
+	// NeedsRehash returns true if the hash was not created with the algorithm and parameters of this hasher
+	NeedsRehash(hash []byte) bool
+	String() string
+}
+
+// PasswordHashParams are the parameters of the password hashers, zero values mean the defaults
+type PasswordHashParams struct {
+	// Argon2id memory in KiB
+	Argon2idMemory      uint32
+	Argon2idIterations  uint32
+	Argon2idParallelism uint8
+	BcryptCost          int
+}
+
+// Argon2idHasher hashes passwords with Argon2id
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	Cost int
+}
+
+// passwordHasher is the hasher new password hashes are created with, see SetPasswordHasher
+var passwordHasher struct {
+	sync.RWMutex
+	current PasswordHasher
+}
+
+// NewPasswordHasher returns the hasher of the algorithm (Argon2id if empty) with the given parameters
+func NewPasswordHasher(algorithm string, params PasswordHashParams) (PasswordHasher, error) {
+	switch strings.ToLower(algorithm) {
+	case "", PasswordHashArgon2id:
+		hasher := &Argon2idHasher{
+			Memory:      valueOrDefault(params.Argon2idMemory, DefaultArgon2idMemory),
+			Iterations:  valueOrDefault(params.Argon2idIterations, DefaultArgon2idIterations),
+			Parallelism: DefaultArgon2idParallelism,
+		}
+		if params.Argon2idParallelism > 0 {
+			hasher.Parallelism = params.Argon2idParallelism
+		}
+		if hasher.Memory < 8*uint32(hasher.Parallelism) {
+			return nil, fmt.Errorf("argon2id memory must be at least %d KiB", 8*uint32(hasher.Parallelism))
+		}
+		return hasher, nil
+	case PasswordHashBcrypt:
+		hasher := &BcryptHasher{Cost: DefaultBcryptCost}
+		if params.BcryptCost > 0 {
+			hasher.Cost = params.BcryptCost
+		}
+		if hasher.Cost < bcrypt.MinCost || hasher.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return hasher, nil
+	}
+
+	return nil, fmt.Errorf("unknown password hash algorithm %s", algorithm)
+}
+
+func valueOrDefault(value, defaultValue uint32) uint32 {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// SetPasswordHasher configures the hasher used by HashPassword
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasher.Lock()
+	defer passwordHasher.Unlock()
+
+	passwordHasher.current = hasher
+}
+
+func currentPasswordHasher() PasswordHasher {
+	passwordHasher.RLock()
+	defer passwordHasher.RUnlock()
+
+	if passwordHasher.current == nil {
+		return &Argon2idHasher{Memory: DefaultArgon2idMemory, Iterations: DefaultArgon2idIterations, Parallelism: DefaultArgon2idParallelism}
+	}
+	return passwordHasher.current
+}
+
+// PasswordNeedsRehash returns true if the hash was not created with the configured algorithm and parameters. Hashes
+// can only be replaced when the password is known, i.e. after a successful login
+func PasswordNeedsRehash(hash []byte) bool {
+	return currentPasswordHasher().NeedsRehash(hash)
+}
+
+func isArgon2idHash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func (h *Argon2idHasher) String() string {
+	return fmt.Sprintf("argon2id (m=%d, t=%d, p=%d)", h.Memory, h.Iterations, h.Parallelism)
+}
+
+// Hash returns the hash of the password in PHC string format, $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+func (h *Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt, err := GenerateRandomBytes(argon2idSaltLength)
+	if err != nil {
+		return nil, err
+	}
+
+	params := argon2idParams{Argon2idHasher: *h, version: argon2.Version, salt: salt}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2idKeyLength)
+
+	return []byte(params.encode(key)), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, err := decodeArgon2idHash(hash)
+	return err != nil || params.version != argon2.Version || params.Argon2idHasher != *h
+}
+
+type argon2idParams struct {
+	Argon2idHasher
+	version int
+	salt    []byte
+}
+
+func (p argon2idParams) encode(key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", p.version, p.Memory, p.Iterations, p.Parallelism,
+		argon2idEncoding.EncodeToString(p.salt), argon2idEncoding.EncodeToString(key))
+}
+
+func decodeArgon2idHash(hash []byte) (argon2idParams, []byte, error) {
+	var params argon2idParams
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return params, nil, errors.New("invalid argon2id hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &params.version); err != nil {
+		return params, nil, fmt.Errorf("invalid argon2id hash version: %v", err)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, fmt.Errorf("invalid argon2id hash parameters: %v", err)
+	}
+
+	var err error
+	if params.salt, err = argon2idEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, fmt.Errorf("invalid argon2id hash salt: %v", err)
+	}
+	key, err := argon2idEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, fmt.Errorf("invalid argon2id hash key: %v", err)
+	}
+
+	return params, key, nil
+}
+
+func checkArgon2idHash(password string, hash []byte) error {
+	params, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return err
+	}
+	if params.version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %d", params.version)
+	}
+	if params.Parallelism == 0 || params.Iterations == 0 {
+		return errors.New("invalid argon2id hash parameters")
+	}
+
+	computed := argon2.IDKey([]byte(password), params.salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h *BcryptHasher) String() string {
+	return fmt.Sprintf("bcrypt (cost=%d)", h.Cost)
+}
+
+func (h *BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+}
+
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
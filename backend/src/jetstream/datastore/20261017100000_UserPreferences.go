@@ -0,0 +1,22 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017100000, "UserPreferences", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		createPreferencesTable := "CREATE TABLE IF NOT EXISTS user_preferences ("
+		createPreferencesTable += "user_guid                 VARCHAR(255)  NOT NULL,"
+		createPreferencesTable += "pref_key                  VARCHAR(255)  NOT NULL,"
+		createPreferencesTable += "pref_value                TEXT,"
+		createPreferencesTable += "last_updated              TIMESTAMP     NOT NULL DEFAULT CURRENT_TIMESTAMP,"
+		createPreferencesTable += "PRIMARY KEY (user_guid, pref_key) );"
+
+		_, err := txn.Exec(createPreferencesTable)
+		return err
+	})
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"database/sql"
+	"strings"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017110000, "ConfigValueText", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// Config values now include UI settings (banners, performance settings, etc) which exceed 255 characters
+		// Note: SQLite does not enforce VARCHAR lengths
+		alterValue := ""
+		if strings.Contains(conf.Driver.Name, "postgres") {
+			alterValue = "ALTER TABLE config ALTER COLUMN value TYPE TEXT;"
+		} else if strings.Contains(conf.Driver.Name, "mysql") {
+			alterValue = "ALTER TABLE config MODIFY value TEXT NOT NULL;"
+		}
+
+		if len(alterValue) == 0 {
+			return nil
+		}
+
+		_, err := txn.Exec(alterValue)
+		return err
+	})
+}
@@ -0,0 +1,25 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017120000, "Branding", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// Content is stored base64 encoded, so that the same column type works for all database providers
+		createBrandingTable := "CREATE TABLE IF NOT EXISTS branding ("
+		createBrandingTable += "hostname                  VARCHAR(255)  NOT NULL,"
+		createBrandingTable += "asset_key                 VARCHAR(255)  NOT NULL,"
+		createBrandingTable += "content_type              VARCHAR(255)  NOT NULL,"
+		createBrandingTable += "content                   TEXT          NOT NULL,"
+		createBrandingTable += "etag                      VARCHAR(255)  NOT NULL,"
+		createBrandingTable += "last_updated              TIMESTAMP     NOT NULL DEFAULT CURRENT_TIMESTAMP,"
+		createBrandingTable += "PRIMARY KEY (hostname, asset_key) );"
+
+		_, err := txn.Exec(createBrandingTable)
+		return err
+	})
+}
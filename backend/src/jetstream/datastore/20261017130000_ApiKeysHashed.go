@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"strings"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+)
+
+func init() {
+	RegisterMigration(20261017130000, "ApiKeysHashed", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// The secret column now holds a salted hash of the secret. The prefix (the start of the secret) is used to find
+		// the key
+		alterAPIKeys := []string{
+			"ALTER TABLE api_keys ADD salt VARCHAR(32)",
+			"ALTER TABLE api_keys ADD prefix VARCHAR(16)",
+			"ALTER TABLE api_keys ADD scopes TEXT",
+			"ALTER TABLE api_keys ADD created TIMESTAMP NULL",
+			"ALTER TABLE api_keys ADD expires TIMESTAMP NULL",
+		}
+		for _, alter := range alterAPIKeys {
+			if _, err := txn.Exec(alter); err != nil {
+				return err
+			}
+		}
+
+		if _, err := txn.Exec("CREATE INDEX api_keys_prefix ON api_keys (prefix)"); err != nil {
+			return err
+		}
+
+		// Hash the secrets of existing keys, they keep working
+		rows, err := txn.Query("SELECT guid, secret FROM api_keys")
+		if err != nil {
+			return err
+		}
+
+		secrets := make(map[string]string)
+		for rows.Next() {
+			var guid, secret string
+			if err = rows.Scan(&guid, &secret); err != nil {
+				rows.Close()
+				return err
+			}
+			secrets[guid] = secret
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		databaseProvider := SQLITE
+		if strings.Contains(conf.Driver.Name, "postgres") {
+			databaseProvider = PGSQL
+		}
+		hashSecret := ModifySQLStatement("UPDATE api_keys SET secret = $1, salt = $2, prefix = $3 WHERE guid = $4", databaseProvider)
+
+		for guid, secret := range secrets {
+			saltBytes, err := crypto.GenerateRandomBytes(16)
+			if err != nil {
+				return err
+			}
+			salt := hex.EncodeToString(saltBytes)
+
+			prefix := secret
+			if len(prefix) > 8 {
+				prefix = prefix[:8]
+			}
+
+			if _, err = txn.Exec(hashSecret, crypto.HashAPIKeySecret(salt, secret), salt, prefix, guid); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,23 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017140000, "LoginAttempts", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// Failed logins per username (hashed) or client address, shared by all instances. Times are unix seconds
+		createLoginAttemptsTable := "CREATE TABLE IF NOT EXISTS login_attempts ("
+		createLoginAttemptsTable += "attempt_key               VARCHAR(255)  NOT NULL,"
+		createLoginAttemptsTable += "failures                  INT           NOT NULL,"
+		createLoginAttemptsTable += "last_failure              BIGINT        NOT NULL,"
+		createLoginAttemptsTable += "locked_until              BIGINT        NOT NULL,"
+		createLoginAttemptsTable += "PRIMARY KEY (attempt_key) );"
+
+		_, err := txn.Exec(createLoginAttemptsTable)
+		return err
+	})
+}
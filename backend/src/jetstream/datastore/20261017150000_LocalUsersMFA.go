@@ -0,0 +1,26 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017150000, "LocalUsersMFA", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// The TOTP secret is encrypted and base64 encoded. Recovery codes are stored as a comma separated list of hashes
+		createLocalUsersMFATable := "CREATE TABLE IF NOT EXISTS local_users_mfa ("
+		createLocalUsersMFATable += "user_guid                 VARCHAR(36)   NOT NULL,"
+		createLocalUsersMFATable += "secret                    TEXT          NOT NULL,"
+		createLocalUsersMFATable += "enabled                   BOOLEAN       NOT NULL DEFAULT FALSE,"
+		createLocalUsersMFATable += "recovery_salt             VARCHAR(64)   NOT NULL,"
+		createLocalUsersMFATable += "recovery_codes            TEXT          NOT NULL,"
+		createLocalUsersMFATable += "last_step                 BIGINT        NOT NULL DEFAULT 0,"
+		createLocalUsersMFATable += "last_updated              TIMESTAMP     NOT NULL DEFAULT CURRENT_TIMESTAMP,"
+		createLocalUsersMFATable += "PRIMARY KEY (user_guid) );"
+
+		_, err := txn.Exec(createLocalUsersMFATable)
+		return err
+	})
+}
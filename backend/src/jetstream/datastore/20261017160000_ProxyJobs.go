@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"database/sql"
+	"strings"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017160000, "ProxyJobs", func(txn *sql.Tx, conf *goose.DBConf) error {
+		binaryDataType := "BYTEA"
+		if strings.Contains(conf.Driver.Name, "mysql") {
+			binaryDataType = "LONGBLOB"
+		}
+
+		// Long-running proxied requests, shared by all instances. The response is encrypted. Times are unix seconds
+		createProxyJobsTable := "CREATE TABLE IF NOT EXISTS proxy_jobs ("
+		createProxyJobsTable += "id                        VARCHAR(36)   NOT NULL,"
+		createProxyJobsTable += "user_guid                 VARCHAR(36)   NOT NULL,"
+		createProxyJobsTable += "endpoint_guid             VARCHAR(36)   NOT NULL,"
+		createProxyJobsTable += "method                    VARCHAR(16)   NOT NULL,"
+		createProxyJobsTable += "url                       TEXT          NOT NULL,"
+		createProxyJobsTable += "passthrough               BOOLEAN       NOT NULL DEFAULT FALSE,"
+		createProxyJobsTable += "status                    VARCHAR(16)   NOT NULL,"
+		createProxyJobsTable += "status_code               INT           NOT NULL DEFAULT 0,"
+		createProxyJobsTable += "status_text               VARCHAR(255)  NOT NULL DEFAULT '',"
+		createProxyJobsTable += "response                  " + binaryDataType + ","
+		createProxyJobsTable += "created                   BIGINT        NOT NULL,"
+		createProxyJobsTable += "updated                   BIGINT        NOT NULL,"
+		createProxyJobsTable += "expires                   BIGINT        NOT NULL,"
+		createProxyJobsTable += "PRIMARY KEY (id) );"
+
+		_, err := txn.Exec(createProxyJobsTable)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Exec("CREATE INDEX proxy_jobs_user_guid ON proxy_jobs (user_guid);")
+		return err
+	})
+}
@@ -0,0 +1,20 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017170000, "UserActivity", func(txn *sql.Tx, conf *goose.DBConf) error {
+		// Until when users have active sessions (unix seconds), the session store can't be queried by user
+		createUserActivityTable := "CREATE TABLE IF NOT EXISTS user_activity ("
+		createUserActivityTable += "user_guid                 VARCHAR(36)   NOT NULL,"
+		createUserActivityTable += "active_until              BIGINT        NOT NULL,"
+		createUserActivityTable += "PRIMARY KEY (user_guid) );"
+
+		_, err := txn.Exec(createUserActivityTable)
+		return err
+	})
+}
@@ -0,0 +1,17 @@
+package datastore
+
+import (
+	"database/sql"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+)
+
+func init() {
+	RegisterMigration(20261017180000, "LocalUsersSessions", func(txn *sql.Tx, conf *goose.DBConf) error {
+
+		// Sessions remember the session version of the user at login. Incrementing it ends all of the user's sessions,
+		// the session store can't be queried by user
+		_, err := txn.Exec("ALTER TABLE local_users ADD session_version BIGINT NOT NULL DEFAULT 0")
+		return err
+	})
+}
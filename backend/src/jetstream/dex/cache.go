@@ -0,0 +1,124 @@
+package dex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+)
+
+const (
+	// ProviderMaxAge is how long a discovered provider is used before discovery is run again
+	ProviderMaxAge = time.Hour
+
+	// DiscoveryTimeout limits how long discovery of a provider may take
+	DiscoveryTimeout = 15 * time.Second
+
+	// Metric names
+	MetricDiscoveryFailures = "dex_discovery_failures"
+	MetricDiscoveries       = "dex_discoveries"
+	MetricCacheHits         = "dex_provider_cache_hits"
+)
+
+type cachedProvider struct {
+	fingerprint string
+	// done is closed once discovery has finished, provider, err and created are only set then
+	done     chan struct{}
+	provider *OIDCProvider
+	err      error
+	created  time.Time
+}
+
+// usable returns true if the provider was created with fingerprint and is being discovered, or was discovered less
+// than ProviderMaxAge ago
+func (cached *cachedProvider) usable(fingerprint string) bool {
+	if cached.fingerprint != fingerprint {
+		return false
+	}
+
+	select {
+	case <-cached.done:
+		return cached.err == nil && time.Since(cached.created) < ProviderMaxAge
+	default:
+		return true
+	}
+}
+
+// ProviderCache holds a long lived OIDCProvider per epinio endpoint, so that discovery and the JWKS are not fetched
+// on every login, redirect and refresh
+type ProviderCache struct {
+	mu        sync.Mutex
+	providers map[string]*cachedProvider
+}
+
+// NewProviderCache creates an empty ProviderCache
+func NewProviderCache() *ProviderCache {
+	return &ProviderCache{
+		providers: make(map[string]*cachedProvider),
+	}
+}
+
+// Get returns the cached provider for key. A new provider is created if there is none, it has expired or the
+// fingerprint (a summary of the endpoint metadata used to create the provider) has changed. Concurrent requests for
+// the same key wait for a single discovery, which is limited to DiscoveryTimeout, other keys are not held up by it
+func (c *ProviderCache) Get(key, fingerprint string, create func(ctx context.Context) (*OIDCProvider, error)) (*OIDCProvider, error) {
+	c.mu.Lock()
+	if cached, ok := c.providers[key]; ok && cached.usable(fingerprint) {
+		c.mu.Unlock()
+		<-cached.done
+		if cached.err == nil {
+			metrics.Inc(MetricCacheHits)
+		}
+		return cached.provider, cached.err
+	}
+
+	cached := &cachedProvider{
+		fingerprint: fingerprint,
+		done:        make(chan struct{}),
+	}
+	c.providers[key] = cached
+	c.mu.Unlock()
+
+	c.discover(key, cached, create)
+	return cached.provider, cached.err
+}
+
+func (c *ProviderCache) discover(key string, cached *cachedProvider, create func(ctx context.Context) (*OIDCProvider, error)) {
+	defer close(cached.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DiscoveryTimeout)
+	defer cancel()
+
+	metrics.Inc(MetricDiscoveries)
+	cached.provider, cached.err = create(ctx)
+	cached.created = time.Now()
+	if cached.err != nil {
+		// Failures are only shared with the requests that waited for them
+		metrics.Inc(MetricDiscoveryFailures)
+		cached.provider = nil
+		c.invalidate(key, cached)
+		return
+	}
+
+	// Force re-discovery if a token is later signed by a key the provider can't find (e.g. the signing keys have moved)
+	cached.provider.onVerifyFailure = func() {
+		c.invalidate(key, cached)
+	}
+}
+
+// Invalidate removes the cached provider for key
+func (c *ProviderCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.providers, key)
+}
+
+// invalidate removes the cached provider for key, as long as it hasn't already been replaced
+func (c *ProviderCache) invalidate(key string, cached *cachedProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.providers[key] == cached {
+		delete(c.providers, key)
+	}
+}
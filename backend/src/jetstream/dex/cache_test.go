@@ -0,0 +1,108 @@
+package dex
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+)
+
+func TestProviderCache(t *testing.T) {
+
+	Convey("Given a provider cache", t, func() {
+
+		cache := NewProviderCache()
+		created := 0
+		create := func(ctx context.Context) (*OIDCProvider, error) {
+			created++
+			return &OIDCProvider{Issuer: "issuer"}, nil
+		}
+
+		Convey("providers are only created once per fingerprint", func() {
+			first, err := cache.Get("cnsi", "a", create)
+			So(err, ShouldBeNil)
+			second, err := cache.Get("cnsi", "a", create)
+			So(err, ShouldBeNil)
+			So(second, ShouldEqual, first)
+			So(created, ShouldEqual, 1)
+		})
+
+		Convey("a changed fingerprint creates a new provider", func() {
+			first, _ := cache.Get("cnsi", "a", create)
+			second, _ := cache.Get("cnsi", "b", create)
+			So(second, ShouldNotEqual, first)
+			So(created, ShouldEqual, 2)
+		})
+
+		Convey("a verify failure forces re-discovery", func() {
+			first, _ := cache.Get("cnsi", "a", create)
+			first.onVerifyFailure()
+			second, _ := cache.Get("cnsi", "a", create)
+			So(second, ShouldNotEqual, first)
+			So(created, ShouldEqual, 2)
+		})
+
+		Convey("discovery failures are not cached and are counted", func() {
+			failures := metrics.Get(MetricDiscoveryFailures)
+			_, err := cache.Get("cnsi", "a", func(ctx context.Context) (*OIDCProvider, error) {
+				return nil, errors.New("discovery failed")
+			})
+			So(err, ShouldNotBeNil)
+			So(metrics.Get(MetricDiscoveryFailures), ShouldEqual, failures+1)
+
+			_, err = cache.Get("cnsi", "a", create)
+			So(err, ShouldBeNil)
+			So(created, ShouldEqual, 1)
+		})
+
+		Convey("discovery is limited to DiscoveryTimeout", func() {
+			_, err := cache.Get("cnsi", "a", func(ctx context.Context) (*OIDCProvider, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok || time.Until(deadline) > DiscoveryTimeout {
+					return nil, errors.New("no deadline")
+				}
+				return &OIDCProvider{}, nil
+			})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("concurrent requests share a single discovery", func() {
+			var discoveries int32
+			release := make(chan struct{})
+			slowCreate := func(ctx context.Context) (*OIDCProvider, error) {
+				atomic.AddInt32(&discoveries, 1)
+				<-release
+				return &OIDCProvider{Issuer: "issuer"}, nil
+			}
+
+			var wg sync.WaitGroup
+			providers := make([]*OIDCProvider, 5)
+			for i := range providers {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					providers[i], _ = cache.Get("cnsi", "a", slowCreate)
+				}(i)
+			}
+
+			// Other endpoints are not held up by the discovery in progress
+			other, err := cache.Get("other", "a", create)
+			So(err, ShouldBeNil)
+			So(other, ShouldNotBeNil)
+
+			close(release)
+			wg.Wait()
+			So(atomic.LoadInt32(&discoveries), ShouldEqual, 1)
+			for _, provider := range providers {
+				So(provider, ShouldNotBeNil)
+				So(provider, ShouldEqual, providers[0])
+			}
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package dex
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const connectorsEnv = "EPINIO_DEX_CONNECTORS"
+
+// Dex connector ids are used in urls and auth provider ids
+var connectorIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Connector is a Dex connector (GitHub, LDAP, SAML, etc) that users can log in with
+type Connector struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Icon is a hint for the UI, for instance `github` or `ldap`
+	Icon string `json:"icon"`
+}
+
+// parseConnectors parses a comma separated list of `id[:name[:icon]]` entries. The name defaults to the id and the
+// icon to the id, which matches the connector type for the common `github`, `gitlab`, `google`, `ldap`, etc
+func parseConnectors(list string) ([]Connector, error) {
+	connectors := make([]Connector, 0)
+	ids := make(map[string]bool)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		connector := Connector{
+			ID:   strings.TrimSpace(parts[0]),
+			Name: strings.TrimSpace(parts[0]),
+			Icon: strings.TrimSpace(parts[0]),
+		}
+		if len(parts) > 1 && len(strings.TrimSpace(parts[1])) > 0 {
+			connector.Name = strings.TrimSpace(parts[1])
+		}
+		if len(parts) > 2 && len(strings.TrimSpace(parts[2])) > 0 {
+			connector.Icon = strings.TrimSpace(parts[2])
+		}
+
+		if !connectorIDRegex.MatchString(connector.ID) {
+			return nil, fmt.Errorf("%s: invalid connector id `%s`", connectorsEnv, connector.ID)
+		}
+		if ids[connector.ID] {
+			return nil, fmt.Errorf("%s: connector id `%s` is used more than once", connectorsEnv, connector.ID)
+		}
+		ids[connector.ID] = true
+
+		connectors = append(connectors, connector)
+	}
+
+	return connectors, nil
+}
+
+// FindConnector returns the configured connector with the given id
+func (s *Settings) FindConnector(id string) (*Connector, bool) {
+	for i, connector := range s.Connectors {
+		if connector.ID == id {
+			return &s.Connectors[i], true
+		}
+	}
+	return nil, false
+}
@@ -3,6 +3,7 @@ package dex
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -11,16 +12,15 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 
-	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
 	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 )
 
-const (
-	clientID = "epinio-ui"
-)
-
 var (
-	DefaultScopes = []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email", "groups", "audience:server:client_id:epinio-api", "federated:id"}
+	// ErrRevocationNotSupported is returned when the provider has no revocation endpoint
+	ErrRevocationNotSupported = errors.New("provider does not support token revocation")
+
+	// DefaultScopes are requested from Dex, audience scopes are added by the settings
+	DefaultScopes = []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email", "groups", "federated:id"}
 )
 
 // OIDCProvider wraps an oidc.Provider and its Configuration
@@ -30,43 +30,48 @@ type OIDCProvider struct {
 	Provider *oidc.Provider
 	Config   *oauth2.Config
 	P        jInterfaces.PortalProxy
-}
+	Settings *Settings
 
-func createContext(p jInterfaces.PortalProxy, defaultCtx context.Context) (context.Context, error) {
-	epinioCnsi, err := epinio_utils.FindEpinioEndpoint(p)
+	SkipSSLValidation bool
 
-	if err != nil {
-		return nil, err
-	}
+	// Optional endpoints advertised in the provider's discovery document
+	RevocationEndpoint string
+	EndSessionEndpoint string
+
+	// verifier holds the remote key set, which caches the JWKS and fetches it again when it sees an unknown key id
+	verifier *oidc.IDTokenVerifier
+	// onVerifyFailure is called when a token is signed by an unknown key, see ProviderCache
+	onVerifyFailure func()
+}
 
-	if epinioCnsi.SkipSSLValidation {
+func createContext(skipSSLValidation bool, defaultCtx context.Context) (context.Context, error) {
+	if skipSSLValidation {
 		// https://github.com/golang/oauth2/issues/187#issuecomment-227811477
 		tr := &http.Transport{
 			Proxy:           http.ProxyFromEnvironment,
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
 		sslcli := &http.Client{Transport: tr}
-		newctx := context.TODO()
-		return context.WithValue(newctx, oauth2.HTTPClient, sslcli), nil
+		return context.WithValue(defaultCtx, oauth2.HTTPClient, sslcli), nil
 	}
 
 	return defaultCtx, nil
 }
 
 // NewOIDCProviderWithEndpoint construct an OIDCProvider fetching its configuration from the endpoint URL
-func NewOIDCProviderWithEndpoint(p jInterfaces.PortalProxy, ctx context.Context, authEndpoint, issuer, uiUrl string) (*OIDCProvider, error) {
+func NewOIDCProviderWithEndpoint(p jInterfaces.PortalProxy, ctx context.Context, settings *Settings, skipSSLValidation bool, authEndpoint, issuer, uiUrl string) (*OIDCProvider, error) {
 	endpoint, err := url.Parse(authEndpoint)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse auth endpoint")
 	}
 
-	ctx, err = createContext(p, ctx)
+	ctx, err = createContext(skipSSLValidation, ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create context")
 	}
 
-	isLocalDex := strings.HasSuffix(endpoint.Hostname(), ".svc.cluster.local")
-	if isLocalDex {
+	// The discovery document can be fetched from a different (e.g. in cluster) url than the issuer it advertises
+	if strings.TrimRight(issuer, "/") != strings.TrimRight(authEndpoint, "/") {
 		ctx = oidc.InsecureIssuerURLContext(ctx, issuer)
 	}
 
@@ -75,16 +80,27 @@ func NewOIDCProviderWithEndpoint(p jInterfaces.PortalProxy, ctx context.Context,
 		return nil, errors.Wrap(err, "creating the provider")
 	}
 
-	// normally this is the "issuer" (external endpoint)
-	configEndpoint := provider.Endpoint()
-	// but with a local we need to use the internal endpoint
-	if isLocalDex {
-		configEndpoint = oauth2.Endpoint{
-			AuthURL:  authEndpoint + "/auth",
-			TokenURL: authEndpoint + "/token",
-		}
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+		// Optional endpoints
+		RevocationEndpoint string `json:"revocation_endpoint"`
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, errors.Wrap(err, "parsing the provider metadata")
+	}
+	if len(metadata.JWKSURI) == 0 {
+		return nil, errors.New("provider metadata does not contain a jwks_uri")
 	}
 
+	// The browser is sent to the auth url advertised by the provider, everything else is requested by jetstream
+	// via the endpoint it was configured with
+	backchannel := func(providerURL string) string {
+		return backchannelURL(providerURL, issuer, authEndpoint)
+	}
+	configEndpoint := provider.Endpoint()
+	configEndpoint.TokenURL = backchannel(configEndpoint.TokenURL)
+
 	lastIndex := len(uiUrl) - 1
 	safeUiUrl := uiUrl
 	if lastIndex == strings.LastIndex(uiUrl, "/") {
@@ -98,49 +114,90 @@ func NewOIDCProviderWithEndpoint(p jInterfaces.PortalProxy, ctx context.Context,
 
 	config := &oauth2.Config{
 		Endpoint:     configEndpoint,
-		ClientID:     clientID,
+		ClientID:     settings.ClientID,
 		ClientSecret: clientSecret,
-		RedirectURL:  safeUiUrl + "/auth/verify/", // Forward slash is required in order to avoid jetstream 301 --> stripping query params
-		Scopes:       DefaultScopes,
+		RedirectURL:  safeUiUrl + settings.RedirectPath,
+		Scopes:       settings.Scopes,
 	}
 
-	return &OIDCProvider{
+	keySet := &signatureKeySet{keySet: oidc.NewRemoteKeySet(ctx, backchannel(metadata.JWKSURI))}
+
+	pc := &OIDCProvider{
 		Issuer:   issuer,
 		Endpoint: endpoint,
 		Provider: provider,
 		Config:   config,
 		P:        p,
-	}, nil
+		Settings: settings,
+
+		SkipSSLValidation: skipSSLValidation,
+
+		RevocationEndpoint: backchannel(metadata.RevocationEndpoint),
+		EndSessionEndpoint: metadata.EndSessionEndpoint,
+
+		// The audience is checked in Verify, tokens may be issued for one of the configured audiences
+		verifier: oidc.NewVerifier(issuer, keySet, &oidc.Config{SkipClientIDCheck: true}),
+	}
+	keySet.provider = pc
+
+	return pc, nil
+}
+
+// noMatchingKeyError is the error of oidc.RemoteKeySet when none of its keys verifies a token, even after fetching
+// them again
+const noMatchingKeyError = "failed to verify id token signature"
+
+// signatureKeySet tells the provider about tokens signed by a key it doesn't know
+type signatureKeySet struct {
+	keySet   oidc.KeySet
+	provider *OIDCProvider
+}
+
+// VerifySignature verifies the signature of the token with the provider's keys. Other failures (malformed tokens,
+// unreachable key set) don't mean the provider changed, so they aren't reported
+func (k *signatureKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	payload, err := k.keySet.VerifySignature(ctx, jwt)
+	if err != nil && err.Error() == noMatchingKeyError && k.provider.onVerifyFailure != nil {
+		k.provider.onVerifyFailure()
+	}
+	return payload, err
 }
 
-// AuthCodeURLWithPKCE will return an URL that can be used to obtain an auth code, and a code_verifier string.
-// The code_verifier is needed to implement the PKCE auth flow, since this is going to be used by our CLI
+// AuthCodeURLWithPKCE will return an URL that can be used to obtain an auth code. The code_verifier is kept by
+// the caller and is needed to exchange the code for a token (PKCE auth flow)
 // Ref: https://www.oauth.com/oauth2-servers/pkce/
-func (pc *OIDCProvider) AuthCodeURLWithPKCE(state string) (string, string) {
-	codeVerifier := NewCodeVerifier()
+func (pc *OIDCProvider) AuthCodeURLWithPKCE(state, nonce, codeVerifier string, opts ...oauth2.AuthCodeOption) string {
+	verifier := &CodeVerifier{Value: codeVerifier}
 
-	authCodeURL := pc.Config.AuthCodeURL(
-		state,
-		oauth2.SetAuthURLParam("code_verifier", codeVerifier.Value),
-		oauth2.SetAuthURLParam("code_challenge", codeVerifier.ChallengeS256()),
+	opts = append([]oauth2.AuthCodeOption{
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", verifier.ChallengeS256()),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
-	)
+	}, opts...)
 
-	// the redirect URL has the "internal" endpoint, and we need to change it to the external one
-	authCodeURL = strings.Replace(
-		authCodeURL,
-		pc.Config.Endpoint.AuthURL,
-		pc.Provider.Endpoint().AuthURL,
-		1,
-	)
+	return pc.Config.AuthCodeURL(state, opts...)
+}
+
+// WithConnector sends the user straight to the given Dex connector, skipping Dex's connector selection page
+func WithConnector(connectorID string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("connector_id", connectorID)
+}
 
-	return authCodeURL, codeVerifier.Value
+// backchannelURL rewrites a url advertised by the provider (based on the issuer) to use the endpoint jetstream was
+// configured with. This allows jetstream to reach the provider internally, for instance Dex via its in cluster service
+func backchannelURL(providerURL, issuer, endpoint string) string {
+	issuer = strings.TrimRight(issuer, "/")
+	endpoint = strings.TrimRight(endpoint, "/")
+	if len(providerURL) == 0 || issuer == endpoint || !strings.HasPrefix(providerURL, issuer) {
+		return providerURL
+	}
+	return endpoint + strings.TrimPrefix(providerURL, issuer)
 }
 
 // ExchangeWithPKCE will exchange the authCode with a token, checking if the codeVerifier is valid
 func (pc *OIDCProvider) ExchangeWithPKCE(ctx context.Context, authCode, codeVerifier string) (*oauth2.Token, error) {
 
-	newCtx, err := createContext(pc.P, ctx)
+	newCtx, err := createContext(pc.SkipSSLValidation, ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create context")
 	}
@@ -152,23 +209,102 @@ func (pc *OIDCProvider) ExchangeWithPKCE(ctx context.Context, authCode, codeVeri
 	return token, nil
 }
 
+// RefreshToken will exchange the refresh token of the token for a new token, even if the token has not expired yet
+func (pc *OIDCProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	newCtx, err := createContext(pc.SkipSSLValidation, ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create context")
+	}
+
+	// Without an access token the token source doesn't consider the token valid, and always refreshes it
+	newToken, err := pc.Config.TokenSource(newCtx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "refreshing token")
+	}
+	return newToken, nil
+}
+
 // Verify will verify the token, and it will return an oidc.IDToken
 func (pc *OIDCProvider) Verify(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
-	newCtx, err := createContext(pc.P, ctx)
+	newCtx, err := createContext(pc.SkipSSLValidation, ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create context")
 	}
 
-	keySet := oidc.NewRemoteKeySet(newCtx, pc.Endpoint.String()+"/keys")
-	verifier := oidc.NewVerifier(pc.Issuer, keySet, &oidc.Config{ClientID: pc.Config.ClientID})
-
-	token, err := verifier.Verify(newCtx, rawIDToken)
+	token, err := pc.verifier.Verify(newCtx, rawIDToken)
 	if err != nil {
 		return nil, errors.Wrap(err, "verifying rawIDToken")
 	}
+
+	if !pc.Settings.AcceptsAudience(token.Audience) {
+		return nil, fmt.Errorf("verifying rawIDToken: unexpected audience %v", token.Audience)
+	}
+
 	return token, nil
 }
 
+// RevokeToken revokes the given refresh token (RFC 7009). Returns ErrRevocationNotSupported if the provider does not
+// advertise a revocation endpoint (Dex does not)
+func (pc *OIDCProvider) RevokeToken(ctx context.Context, refreshToken string) error {
+	if len(pc.RevocationEndpoint) == 0 {
+		return ErrRevocationNotSupported
+	}
+
+	newCtx, err := createContext(pc.SkipSSLValidation, ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to create context")
+	}
+
+	client := http.DefaultClient
+	if c, ok := newCtx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+
+	form := url.Values{}
+	form.Set("token", refreshToken)
+	form.Set("token_type_hint", "refresh_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pc.RevocationEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "creating revocation request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(pc.Config.ClientID), url.QueryEscape(pc.Config.ClientSecret))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "revoking token")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoking token: unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// EndSessionURL returns the url to end the user's session with the provider (RP-initiated logout), or an empty
+// string if the provider does not advertise an end_session_endpoint
+func (pc *OIDCProvider) EndSessionURL(postLogoutRedirectURL string) string {
+	if len(pc.EndSessionEndpoint) == 0 {
+		return ""
+	}
+
+	endSessionURL, err := url.Parse(pc.EndSessionEndpoint)
+	if err != nil {
+		return ""
+	}
+
+	query := endSessionURL.Query()
+	query.Set("client_id", pc.Config.ClientID)
+	if len(postLogoutRedirectURL) > 0 {
+		query.Set("post_logout_redirect_uri", postLogoutRedirectURL)
+	}
+	endSessionURL.RawQuery = query.Encode()
+
+	return endSessionURL.String()
+}
+
 func (pc OIDCProvider) GetConfig() *oauth2.Config {
 	return pc.Config
 }
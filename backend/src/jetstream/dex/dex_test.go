@@ -0,0 +1,197 @@
+package dex
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/oauth2"
+)
+
+func TestBackchannelURL(t *testing.T) {
+
+	Convey("Given a provider reached via its issuer", t, func() {
+		Convey("urls are not changed", func() {
+			So(backchannelURL("https://auth.example.org/token", "https://auth.example.org", "https://auth.example.org/"), ShouldEqual, "https://auth.example.org/token")
+		})
+	})
+
+	Convey("Given a provider reached via an internal endpoint", t, func() {
+		issuer := "https://auth.example.org"
+		endpoint := "http://dex.epinio.svc.cluster.local:5556"
+
+		Convey("urls under the issuer use the endpoint", func() {
+			So(backchannelURL("https://auth.example.org/keys", issuer, endpoint), ShouldEqual, "http://dex.epinio.svc.cluster.local:5556/keys")
+		})
+
+		Convey("other urls are not changed", func() {
+			So(backchannelURL("https://keys.example.org/jwks", issuer, endpoint), ShouldEqual, "https://keys.example.org/jwks")
+			So(backchannelURL("", issuer, endpoint), ShouldEqual, "")
+		})
+	})
+}
+
+func TestSignatureKeySet(t *testing.T) {
+
+	Convey("Given a provider with a remote key set", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"keys":[]}`))
+		}))
+		defer server.Close()
+
+		failures := 0
+		provider := &OIDCProvider{onVerifyFailure: func() { failures++ }}
+		keySet := &signatureKeySet{keySet: oidc.NewRemoteKeySet(context.Background(), server.URL), provider: provider}
+
+		Convey("tokens signed by an unknown key are reported", func() {
+			_, err := keySet.VerifySignature(context.Background(), signedToken(t, "rotated-key"))
+			So(err, ShouldNotBeNil)
+			So(failures, ShouldEqual, 1)
+		})
+
+		Convey("malformed tokens are not reported", func() {
+			_, err := keySet.VerifySignature(context.Background(), "not.a.token")
+			So(err, ShouldNotBeNil)
+			So(failures, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a provider whose key set can't be fetched", t, func() {
+		failures := 0
+		provider := &OIDCProvider{onVerifyFailure: func() { failures++ }}
+		keySet := &signatureKeySet{keySet: oidc.NewRemoteKeySet(context.Background(), "http://127.0.0.1:1/keys"), provider: provider}
+
+		Convey("tokens are not reported", func() {
+			_, err := keySet.VerifySignature(context.Background(), signedToken(t, "key"))
+			So(err, ShouldNotBeNil)
+			So(failures, ShouldEqual, 0)
+		})
+	})
+}
+
+// signedToken returns a jwt signed by a new RSA key with the given key id
+func signedToken(t *testing.T, keyID string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	signingInput := encode([]byte(`{"alg":"RS256","kid":"`+keyID+`"}`)) + "." + encode([]byte(`{"sub":"user"}`))
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + encode(signature)
+}
+
+func TestRefreshToken(t *testing.T) {
+
+	Convey("Given a provider", t, func() {
+		var refreshToken string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			refreshToken = r.FormValue("refresh_token")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"new-access","refresh_token":"new-refresh","token_type":"bearer","expires_in":3600}`))
+		}))
+		defer server.Close()
+
+		provider := &OIDCProvider{Config: &oauth2.Config{ClientID: "epinio-ui", Endpoint: oauth2.Endpoint{TokenURL: server.URL}}}
+
+		Convey("tokens are refreshed before they expire", func() {
+			token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Minute)}
+			newToken, err := provider.RefreshToken(context.Background(), token)
+			So(err, ShouldBeNil)
+			So(refreshToken, ShouldEqual, "refresh")
+			So(newToken.AccessToken, ShouldEqual, "new-access")
+			So(newToken.RefreshToken, ShouldEqual, "new-refresh")
+		})
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+
+	Convey("Given a provider without a revocation endpoint (e.g. Dex)", t, func() {
+		provider := &OIDCProvider{Config: &oauth2.Config{ClientID: "epinio-ui"}}
+
+		Convey("tokens are not revoked", func() {
+			So(provider.RevokeToken(context.Background(), "refresh"), ShouldEqual, ErrRevocationNotSupported)
+		})
+	})
+
+	Convey("Given a provider with a revocation endpoint", t, func() {
+		status := http.StatusOK
+		var form url.Values
+		var clientID, clientSecret string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			clientID, clientSecret, _ = r.BasicAuth()
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		provider := &OIDCProvider{
+			Config:             &oauth2.Config{ClientID: "epinio-ui", ClientSecret: "secret"},
+			RevocationEndpoint: server.URL,
+		}
+
+		Convey("the refresh token is revoked with the client credentials", func() {
+			So(provider.RevokeToken(context.Background(), "refresh"), ShouldBeNil)
+			So(form.Get("token"), ShouldEqual, "refresh")
+			So(form.Get("token_type_hint"), ShouldEqual, "refresh_token")
+			So(clientID, ShouldEqual, "epinio-ui")
+			So(clientSecret, ShouldEqual, "secret")
+		})
+
+		Convey("failed revocations are reported", func() {
+			status = http.StatusBadRequest
+			So(provider.RevokeToken(context.Background(), "refresh"), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestEndSessionURL(t *testing.T) {
+
+	Convey("Given a provider without an end session endpoint (e.g. Dex)", t, func() {
+		provider := &OIDCProvider{Config: &oauth2.Config{ClientID: "epinio-ui"}}
+
+		Convey("there is no url to end the session", func() {
+			So(provider.EndSessionURL("https://epinio.example.com"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a provider with an end session endpoint", t, func() {
+		provider := &OIDCProvider{
+			Config:             &oauth2.Config{ClientID: "epinio-ui"},
+			EndSessionEndpoint: "https://auth.example.com/logout?realm=epinio",
+		}
+
+		Convey("the url identifies the client and where to return to", func() {
+			endSessionURL, err := url.Parse(provider.EndSessionURL("https://epinio.example.com"))
+			So(err, ShouldBeNil)
+			So(endSessionURL.Host, ShouldEqual, "auth.example.com")
+			So(endSessionURL.Query().Get("realm"), ShouldEqual, "epinio")
+			So(endSessionURL.Query().Get("client_id"), ShouldEqual, "epinio-ui")
+			So(endSessionURL.Query().Get("post_logout_redirect_uri"), ShouldEqual, "https://epinio.example.com")
+		})
+
+		Convey("the return url is optional", func() {
+			endSessionURL, _ := url.Parse(provider.EndSessionURL(""))
+			So(endSessionURL.Query().Has("post_logout_redirect_uri"), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,90 @@
+package dex
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+const (
+	// LoginStateSessionKey is the session key the pre-login state is stored under
+	LoginStateSessionKey = "dex_login_state"
+	// LoginStateLifetime is how long the user has to complete the Dex login
+	LoginStateLifetime = 10 * time.Minute
+)
+
+// LoginState is generated when the Dex redirect url is created and stored in the (pre-login) session. It's used to
+// validate the auth code when it's exchanged for a token
+type LoginState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	Cluster      string `json:"cluster"`
+	// ConnectorID is the Dex connector the user chose to log in with, if any
+	ConnectorID string `json:"connector_id,omitempty"`
+	ExpiresOn   int64  `json:"expires_on"`
+}
+
+// NewLoginState creates a new LoginState for the given cluster and Dex connector (empty if the user chooses the
+// connector in Dex). If state is empty a random one is generated
+func NewLoginState(state, cluster, connectorID string) *LoginState {
+	if len(state) == 0 {
+		state = uniuri.NewLen(32)
+	}
+
+	return &LoginState{
+		State:        state,
+		Nonce:        uniuri.NewLen(32),
+		CodeVerifier: NewCodeVerifier().Value,
+		Cluster:      cluster,
+		ConnectorID:  connectorID,
+		ExpiresOn:    time.Now().Add(LoginStateLifetime).Unix(),
+	}
+}
+
+// Encode serializes the LoginState so it can be stored in the session
+func (s *LoginState) Encode() (string, error) {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode login state: %v", err)
+	}
+	return string(encoded), nil
+}
+
+// DecodeLoginState deserializes a LoginState stored in the session
+func DecodeLoginState(encoded string) (*LoginState, error) {
+	s := &LoginState{}
+	if err := json.Unmarshal([]byte(encoded), s); err != nil {
+		return nil, fmt.Errorf("unable to decode login state: %v", err)
+	}
+	return s, nil
+}
+
+// Validate checks the login state has not expired and that the state matches
+func (s *LoginState) Validate(state string) error {
+	if time.Now().After(time.Unix(s.ExpiresOn, 0)) {
+		return errors.New("login state has expired")
+	}
+
+	if len(state) == 0 {
+		return errors.New("login state is missing")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(s.State)) != 1 {
+		return errors.New("login state does not match")
+	}
+
+	return nil
+}
+
+// ValidateConnector checks the user logged in with the Dex connector chosen when the login was started, if any
+func (s *LoginState) ValidateConnector(identity *Identity) error {
+	if len(s.ConnectorID) > 0 && identity.ConnectorID != s.ConnectorID {
+		return fmt.Errorf("logged in with connector `%s` rather than `%s`", identity.ConnectorID, s.ConnectorID)
+	}
+	return nil
+}
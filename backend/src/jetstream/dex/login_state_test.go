@@ -0,0 +1,71 @@
+package dex
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoginState(t *testing.T) {
+
+	Convey("Given a new login state", t, func() {
+
+		loginState := NewLoginState("", "cluster-guid", "")
+
+		Convey("random state, nonce and verifier are generated", func() {
+			So(loginState.State, ShouldNotBeEmpty)
+			So(loginState.Nonce, ShouldNotBeEmpty)
+			So(loginState.CodeVerifier, ShouldNotBeEmpty)
+			So(loginState.Cluster, ShouldEqual, "cluster-guid")
+		})
+
+		Convey("it survives encoding", func() {
+			encoded, err := loginState.Encode()
+			So(err, ShouldBeNil)
+			decoded, err := DecodeLoginState(encoded)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, loginState)
+		})
+
+		Convey("it validates with a matching state", func() {
+			So(loginState.Validate(loginState.State), ShouldBeNil)
+		})
+
+		Convey("it does not validate without a state", func() {
+			So(loginState.Validate(""), ShouldNotBeNil)
+		})
+
+		Convey("it does not validate with a different state", func() {
+			So(loginState.Validate("other"), ShouldNotBeNil)
+		})
+
+		Convey("any connector is accepted if none was chosen", func() {
+			So(loginState.ValidateConnector(&Identity{ConnectorID: "github"}), ShouldBeNil)
+		})
+
+		Convey("it does not validate once expired", func() {
+			loginState.ExpiresOn = time.Now().Add(-time.Second).Unix()
+			So(loginState.Validate(loginState.State), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a login state for a connector", t, func() {
+
+		loginState := NewLoginState("", "cluster-guid", "github")
+
+		Convey("the connector is kept", func() {
+			So(loginState.ConnectorID, ShouldEqual, "github")
+		})
+
+		Convey("only a login with the connector is accepted", func() {
+			So(loginState.ValidateConnector(&Identity{ConnectorID: "github"}), ShouldBeNil)
+			So(loginState.ValidateConnector(&Identity{ConnectorID: "ldap"}), ShouldNotBeNil)
+			So(loginState.ValidateConnector(&Identity{}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("A client supplied state is kept", t, func() {
+		So(NewLoginState("client-state", "", "").State, ShouldEqual, "client-state")
+	})
+}
@@ -0,0 +1,100 @@
+package dex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const (
+	// RefreshedTokenMaxAge is how long a refreshed token is handed out to requests that want to refresh the same
+	// token, e.g. because they read it before it was refreshed
+	RefreshedTokenMaxAge = 10 * time.Second
+
+	// Metric names
+	MetricTokenRefreshes        = "dex_token_refreshes"
+	MetricTokenRefreshFailures  = "dex_token_refresh_failures"
+	MetricTokenRefreshCoalesced = "dex_token_refreshes_coalesced"
+)
+
+type tokenRefresh struct {
+	done  chan struct{}
+	token jInterfaces.TokenRecord
+	err   error
+}
+
+type refreshedToken struct {
+	token     jInterfaces.TokenRecord
+	refreshed time.Time
+}
+
+// TokenRefreshGroup coalesces concurrent refreshes of the same token. Dex rotates refresh tokens, so only the first of
+// several concurrent refreshes would succeed
+type TokenRefreshGroup struct {
+	mu        sync.Mutex
+	refreshes map[string]*tokenRefresh
+	refreshed map[string]refreshedToken
+}
+
+// NewTokenRefreshGroup creates an empty TokenRefreshGroup
+func NewTokenRefreshGroup() *TokenRefreshGroup {
+	return &TokenRefreshGroup{
+		refreshes: make(map[string]*tokenRefresh),
+		refreshed: make(map[string]refreshedToken),
+	}
+}
+
+// Refresh returns the token refreshed for key in the last RefreshedTokenMaxAge, or waits for a refresh that is in
+// progress. Otherwise the token is refreshed with refresh. The refresh is not cancelled with ctx, so that a rotated
+// refresh token is not lost, ctx only limits how long the caller waits for it
+func (g *TokenRefreshGroup) Refresh(ctx context.Context, key string, refresh func() (jInterfaces.TokenRecord, error)) (jInterfaces.TokenRecord, error) {
+	g.mu.Lock()
+	if recent, ok := g.refreshed[key]; ok && time.Since(recent.refreshed) < RefreshedTokenMaxAge && time.Unix(recent.token.TokenExpiry, 0).After(time.Now()) {
+		g.mu.Unlock()
+		metrics.Inc(MetricTokenRefreshCoalesced)
+		return recent.token, nil
+	}
+
+	r, inProgress := g.refreshes[key]
+	if !inProgress {
+		r = &tokenRefresh{done: make(chan struct{})}
+		g.refreshes[key] = r
+		go g.refresh(key, r, refresh)
+	} else {
+		metrics.Inc(MetricTokenRefreshCoalesced)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.token, r.err
+	case <-ctx.Done():
+		return jInterfaces.TokenRecord{}, ctx.Err()
+	}
+}
+
+func (g *TokenRefreshGroup) refresh(key string, r *tokenRefresh, refresh func() (jInterfaces.TokenRecord, error)) {
+	metrics.Inc(MetricTokenRefreshes)
+	r.token, r.err = refresh()
+	if r.err != nil {
+		metrics.Inc(MetricTokenRefreshFailures)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.refreshes, key)
+
+	now := time.Now()
+	for k, recent := range g.refreshed {
+		if now.Sub(recent.refreshed) >= RefreshedTokenMaxAge {
+			delete(g.refreshed, k)
+		}
+	}
+	if r.err == nil {
+		g.refreshed[key] = refreshedToken{token: r.token, refreshed: now}
+	}
+	close(r.done)
+}
@@ -0,0 +1,95 @@
+package dex
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+func TestTokenRefreshGroup(t *testing.T) {
+
+	Convey("Given a token refresh group", t, func() {
+
+		group := NewTokenRefreshGroup()
+		expiry := time.Now().Add(time.Hour).Unix()
+		refreshes := 0
+		release := make(chan struct{})
+		refresh := func() (jInterfaces.TokenRecord, error) {
+			refreshes++
+			<-release
+			return jInterfaces.TokenRecord{AuthToken: "refreshed", TokenExpiry: expiry}, nil
+		}
+
+		Convey("concurrent refreshes of a token are coalesced", func() {
+			coalesced := metrics.Get(MetricTokenRefreshCoalesced)
+
+			var wg sync.WaitGroup
+			tokens := make([]jInterfaces.TokenRecord, 5)
+			for i := range tokens {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					tokens[i], _ = group.Refresh(context.Background(), "cnsi:user", refresh)
+				}(i)
+			}
+			for metrics.Get(MetricTokenRefreshCoalesced)-coalesced < 4 {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			wg.Wait()
+
+			So(refreshes, ShouldEqual, 1)
+			for _, token := range tokens {
+				So(token.AuthToken, ShouldEqual, "refreshed")
+			}
+
+			Convey("and the refreshed token is handed out for a while", func() {
+				token, err := group.Refresh(context.Background(), "cnsi:user", refresh)
+				So(err, ShouldBeNil)
+				So(token.AuthToken, ShouldEqual, "refreshed")
+				So(refreshes, ShouldEqual, 1)
+			})
+
+			Convey("but not for other tokens", func() {
+				_, err := group.Refresh(context.Background(), "cnsi:other", refresh)
+				So(err, ShouldBeNil)
+				So(refreshes, ShouldEqual, 2)
+			})
+		})
+
+		Convey("failed refreshes are not remembered", func() {
+			failures := 0
+			fail := func() (jInterfaces.TokenRecord, error) {
+				failures++
+				return jInterfaces.TokenRecord{}, errors.New("invalid_grant")
+			}
+
+			_, err := group.Refresh(context.Background(), "cnsi:user", fail)
+			So(err, ShouldNotBeNil)
+			_, err = group.Refresh(context.Background(), "cnsi:user", fail)
+			So(err, ShouldNotBeNil)
+			So(failures, ShouldEqual, 2)
+		})
+
+		Convey("callers stop waiting when their context is done, the refresh continues", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := group.Refresh(ctx, "cnsi:user", refresh)
+			So(err, ShouldEqual, context.Canceled)
+
+			close(release)
+			token, err := group.Refresh(context.Background(), "cnsi:user", refresh)
+			So(err, ShouldBeNil)
+			So(token.AuthToken, ShouldEqual, "refreshed")
+			So(refreshes, ShouldEqual, 1)
+		})
+	})
+}
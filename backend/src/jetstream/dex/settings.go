@@ -0,0 +1,227 @@
+package dex
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+
+	"github.com/epinio/ui/backend/src/jetstream/cf-common/env"
+)
+
+const (
+	// PresetDex is the Dex instance that ships with Epinio
+	PresetDex = "dex"
+	// PresetGeneric is any standards compliant OIDC provider (Keycloak, Authentik, etc)
+	PresetGeneric = "generic"
+)
+
+const (
+	presetEnv       = "EPINIO_OIDC_PRESET"
+	audienceEnv     = "EPINIO_OIDC_AUDIENCE"
+	clientIDEnv     = "EPINIO_DEX_CLIENT_ID"
+	extraScopesEnv  = "EPINIO_DEX_EXTRA_SCOPES"
+	redirectPathEnv = "EPINIO_DEX_REDIRECT_PATH"
+	userIDClaimEnv  = "EPINIO_DEX_USER_ID_CLAIM"
+	nameClaimEnv    = "EPINIO_DEX_NAME_CLAIM"
+	groupsClaimEnv  = "EPINIO_DEX_GROUPS_CLAIM"
+
+	defaultClientID     = "epinio-ui"
+	defaultRedirectPath = "/auth/verify/" // Forward slash is required in order to avoid jetstream 301 --> stripping query params
+	defaultUserIDClaim  = "email"
+	defaultGroupsClaim  = "groups"
+
+	// Dex only adds the audience of another client to a token when asked via a scope
+	dexAudienceScopePrefix = "audience:server:client_id:"
+)
+
+// presets contains the provider specific defaults
+var presets = map[string]struct {
+	scopes    []string
+	audiences string
+}{
+	PresetDex: {
+		scopes:    DefaultScopes,
+		audiences: "epinio-api",
+	},
+	PresetGeneric: {
+		scopes: []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email"},
+	},
+}
+
+// The claims that can be used as a stable user id, and the scope that needs to be requested to get them
+var userIDClaimScopes = map[string]string{
+	"sub":                "openid",
+	"preferred_username": "profile",
+	"email":              "email",
+}
+
+// Settings holds the configurable parts of the OIDC client
+type Settings struct {
+	Preset string
+	// Audiences are accepted in the aud claim of tokens, in addition to the client id. With the Dex preset they are
+	// also requested via scopes
+	Audiences    []string
+	ClientID     string
+	Scopes       []string
+	RedirectPath string
+	// UserIDClaim is the claim used as the user's guid
+	UserIDClaim string
+	// NameClaim is the claim used as the user's display name
+	NameClaim string
+	// GroupsClaim is the claim containing the user's groups
+	GroupsClaim string
+	// Connectors are published as separate auth providers. If empty users pick the connector in Dex
+	Connectors []Connector
+}
+
+// LoadSettings reads the OIDC client settings from the env and validates them
+func LoadSettings(envVars *env.VarSet) (*Settings, error) {
+	presetName := strings.TrimSpace(envVars.String(presetEnv, PresetDex))
+	preset, ok := presets[presetName]
+	if !ok {
+		return nil, fmt.Errorf("%s must be one of `%s` or `%s`, found `%s`", presetEnv, PresetDex, PresetGeneric, presetName)
+	}
+
+	settings := &Settings{
+		Preset:       presetName,
+		Audiences:    splitList(envVars.String(audienceEnv, preset.audiences)),
+		ClientID:     strings.TrimSpace(envVars.String(clientIDEnv, defaultClientID)),
+		Scopes:       append([]string{}, preset.scopes...),
+		RedirectPath: strings.TrimSpace(envVars.String(redirectPathEnv, defaultRedirectPath)),
+		UserIDClaim:  strings.TrimSpace(envVars.String(userIDClaimEnv, defaultUserIDClaim)),
+		GroupsClaim:  strings.TrimSpace(envVars.String(groupsClaimEnv, defaultGroupsClaim)),
+	}
+	settings.NameClaim = strings.TrimSpace(envVars.String(nameClaimEnv, settings.UserIDClaim))
+
+	extraScopes := splitList(envVars.String(extraScopesEnv, ""))
+	if settings.Preset == PresetDex {
+		for _, audience := range settings.Audiences {
+			extraScopes = append(extraScopes, dexAudienceScopePrefix+audience)
+		}
+	}
+	for _, scope := range extraScopes {
+		if !settings.HasScope(scope) {
+			settings.Scopes = append(settings.Scopes, scope)
+		}
+	}
+
+	connectors, err := parseConnectors(envVars.String(connectorsEnv, ""))
+	if err != nil {
+		return nil, err
+	}
+	settings.Connectors = connectors
+
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Validate rejects settings that could not result in a working login
+func (s *Settings) Validate() error {
+	if len(s.ClientID) == 0 {
+		return fmt.Errorf("%s must not be empty", clientIDEnv)
+	}
+
+	if !strings.HasPrefix(s.RedirectPath, "/") {
+		return fmt.Errorf("%s must start with `/`, found `%s`", redirectPathEnv, s.RedirectPath)
+	}
+
+	scope, ok := userIDClaimScopes[s.UserIDClaim]
+	if !ok {
+		return fmt.Errorf("%s must be one of `sub`, `preferred_username` or `email`, found `%s`", userIDClaimEnv, s.UserIDClaim)
+	}
+	if !s.HasScope(scope) {
+		return fmt.Errorf("%s `%s` requires the `%s` scope", userIDClaimEnv, s.UserIDClaim, scope)
+	}
+
+	if len(s.NameClaim) == 0 {
+		return fmt.Errorf("%s must not be empty", nameClaimEnv)
+	}
+
+	if len(s.GroupsClaim) == 0 {
+		return fmt.Errorf("%s must not be empty", groupsClaimEnv)
+	}
+
+	if s.GroupsClaim == s.UserIDClaim || s.GroupsClaim == s.NameClaim {
+		return fmt.Errorf("%s `%s` must differ from the user id and name claims", groupsClaimEnv, s.GroupsClaim)
+	}
+
+	return nil
+}
+
+// AcceptsAudience returns true if a token with the given aud claim is meant for us
+func (s *Settings) AcceptsAudience(audiences []string) bool {
+	for _, audience := range audiences {
+		if audience == s.ClientID {
+			return true
+		}
+		for _, accepted := range s.Audiences {
+			if audience == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasScope returns true if the scope will be requested
+func (s *Settings) HasScope(scope string) bool {
+	for _, existing := range s.Scopes {
+		if existing == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma or space separated list
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// Identity is the user information extracted from a token's claims
+type Identity struct {
+	UserID      string
+	Name        string
+	Groups      []string
+	ConnectorID string
+}
+
+// Identity extracts the user's id, name and groups from the token claims, using the configured claim names
+func (s *Settings) Identity(claims map[string]interface{}) (*Identity, error) {
+	identity := &Identity{}
+
+	identity.UserID, _ = claims[s.UserIDClaim].(string)
+	if len(identity.UserID) == 0 {
+		return nil, fmt.Errorf("token does not contain the user id claim `%s`", s.UserIDClaim)
+	}
+
+	identity.Name, _ = claims[s.NameClaim].(string)
+	if len(identity.Name) == 0 {
+		identity.Name = identity.UserID
+	}
+
+	switch groups := claims[s.GroupsClaim].(type) {
+	case string:
+		// Some providers send a single group as a plain string
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+
+	// Dex specific, identifies the upstream connector the user logged in with
+	if federated, ok := claims["federated_claims"].(map[string]interface{}); ok {
+		identity.ConnectorID, _ = federated["connector_id"].(string)
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,169 @@
+package dex
+
+import (
+	"testing"
+
+	"github.com/epinio/ui/backend/src/jetstream/cf-common/env"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func loadTestSettings(vars map[string]string) (*Settings, error) {
+	return LoadSettings(env.NewVarSet(env.WithMapLookup(vars)))
+}
+
+func TestLoadSettings(t *testing.T) {
+
+	Convey("Given no dex settings", t, func() {
+		settings, err := loadTestSettings(map[string]string{})
+
+		Convey("the defaults are used", func() {
+			So(err, ShouldBeNil)
+			So(settings.Preset, ShouldEqual, PresetDex)
+			So(settings.Audiences, ShouldResemble, []string{"epinio-api"})
+			So(settings.ClientID, ShouldEqual, "epinio-ui")
+			So(settings.Scopes, ShouldResemble, append(append([]string{}, DefaultScopes...), "audience:server:client_id:epinio-api"))
+			So(settings.RedirectPath, ShouldEqual, "/auth/verify/")
+			So(settings.UserIDClaim, ShouldEqual, "email")
+			So(settings.NameClaim, ShouldEqual, "email")
+			So(settings.GroupsClaim, ShouldEqual, "groups")
+		})
+	})
+
+	Convey("Given custom dex settings", t, func() {
+		settings, err := loadTestSettings(map[string]string{
+			"EPINIO_DEX_CLIENT_ID":     "my-ui",
+			"EPINIO_DEX_EXTRA_SCOPES":  "roles, audience:server:client_id:epinio-api email",
+			"EPINIO_DEX_REDIRECT_PATH": "/login/callback",
+			"EPINIO_DEX_USER_ID_CLAIM": "sub",
+			"EPINIO_DEX_NAME_CLAIM":    "name",
+			"EPINIO_DEX_GROUPS_CLAIM":  "roles",
+		})
+
+		Convey("they are used", func() {
+			So(err, ShouldBeNil)
+			So(settings.ClientID, ShouldEqual, "my-ui")
+			So(settings.HasScope("roles"), ShouldBeTrue)
+			So(settings.HasScope("audience:server:client_id:epinio-api"), ShouldBeTrue)
+			So(len(settings.Scopes), ShouldEqual, len(DefaultScopes)+2)
+			So(settings.RedirectPath, ShouldEqual, "/login/callback")
+			So(settings.UserIDClaim, ShouldEqual, "sub")
+			So(settings.NameClaim, ShouldEqual, "name")
+			So(settings.GroupsClaim, ShouldEqual, "roles")
+		})
+	})
+
+	Convey("Given the generic preset", t, func() {
+		settings, err := loadTestSettings(map[string]string{
+			"EPINIO_OIDC_PRESET":   "generic",
+			"EPINIO_OIDC_AUDIENCE": "epinio-api",
+		})
+
+		Convey("no Dex specific scopes are requested", func() {
+			So(err, ShouldBeNil)
+			So(settings.HasScope("email"), ShouldBeTrue)
+			So(settings.HasScope("groups"), ShouldBeFalse)
+			So(settings.HasScope("federated:id"), ShouldBeFalse)
+			So(settings.HasScope("audience:server:client_id:epinio-api"), ShouldBeFalse)
+		})
+
+		Convey("the configured audience is accepted", func() {
+			So(settings.AcceptsAudience([]string{"epinio-ui"}), ShouldBeTrue)
+			So(settings.AcceptsAudience([]string{"account", "epinio-api"}), ShouldBeTrue)
+			So(settings.AcceptsAudience([]string{"account"}), ShouldBeFalse)
+			So(settings.AcceptsAudience(nil), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given invalid dex settings", t, func() {
+		invalid := []map[string]string{
+			{"EPINIO_OIDC_PRESET": "keycloak"},
+			{"EPINIO_DEX_CLIENT_ID": " "},
+			{"EPINIO_DEX_REDIRECT_PATH": "auth/verify/"},
+			{"EPINIO_DEX_USER_ID_CLAIM": "name"},
+			{"EPINIO_DEX_GROUPS_CLAIM": "email"},
+			{"EPINIO_DEX_NAME_CLAIM": "groups"},
+		}
+
+		Convey("they are rejected", func() {
+			for _, vars := range invalid {
+				_, err := loadTestSettings(vars)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestSettingsConnectors(t *testing.T) {
+
+	Convey("Given configured connectors", t, func() {
+		settings, err := loadTestSettings(map[string]string{
+			"EPINIO_DEX_CONNECTORS": "github, corp-ldap:Corporate LDAP:ldap,saml::okta",
+		})
+
+		Convey("they are parsed", func() {
+			So(err, ShouldBeNil)
+			So(settings.Connectors, ShouldResemble, []Connector{
+				{ID: "github", Name: "github", Icon: "github"},
+				{ID: "corp-ldap", Name: "Corporate LDAP", Icon: "ldap"},
+				{ID: "saml", Name: "saml", Icon: "okta"},
+			})
+		})
+
+		Convey("they can be found by id", func() {
+			connector, ok := settings.FindConnector("corp-ldap")
+			So(ok, ShouldBeTrue)
+			So(connector.Name, ShouldEqual, "Corporate LDAP")
+
+			_, ok = settings.FindConnector("google")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given invalid connectors", t, func() {
+		Convey("duplicate ids are rejected", func() {
+			_, err := loadTestSettings(map[string]string{"EPINIO_DEX_CONNECTORS": "github,github:GitHub"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("ids that can't be used in urls are rejected", func() {
+			_, err := loadTestSettings(map[string]string{"EPINIO_DEX_CONNECTORS": "git hub/x"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSettingsIdentity(t *testing.T) {
+
+	Convey("Given the default settings", t, func() {
+		settings, err := loadTestSettings(map[string]string{})
+		So(err, ShouldBeNil)
+
+		Convey("the identity is read from the claims", func() {
+			identity, err := settings.Identity(map[string]interface{}{
+				"email":            "admin@example.org",
+				"groups":           []interface{}{"admins", "devs"},
+				"federated_claims": map[string]interface{}{"connector_id": "github"},
+			})
+			So(err, ShouldBeNil)
+			So(identity.UserID, ShouldEqual, "admin@example.org")
+			So(identity.Name, ShouldEqual, "admin@example.org")
+			So(identity.Groups, ShouldResemble, []string{"admins", "devs"})
+			So(identity.ConnectorID, ShouldEqual, "github")
+		})
+
+		Convey("a single group string is accepted", func() {
+			identity, err := settings.Identity(map[string]interface{}{
+				"email":  "admin@example.org",
+				"groups": "admins",
+			})
+			So(err, ShouldBeNil)
+			So(identity.Groups, ShouldResemble, []string{"admins"})
+		})
+
+		Convey("a missing user id claim is rejected", func() {
+			_, err := settings.Identity(map[string]interface{}{"sub": "1234"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -11,56 +11,77 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// dexTokenRefreshTimeout limits how long Dex may take to refresh a token
+const dexTokenRefreshTimeout = 30 * time.Second
+
 func (p *portalProxy) DoDexFlowRequest(cnsiRequest *interfaces.CNSIRequest, req *http.Request) (*http.Response, error) {
 	log.Debug("DoDexFlowRequest")
 
 	authHandler := p.OAuthHandlerFunc(cnsiRequest, req, func(skipSSLValidation bool, cnsiGUID, userGUID, client, clientSecret, tokenEndpoint string) (t interfaces.TokenRecord, err error) {
-		return p.RefreshDexToken(req.Context(), skipSSLValidation, cnsiGUID, userGUID, client, clientSecret, tokenEndpoint)
+		// The Dex client and its TLS settings come from the Dex provider of the endpoint
+		return p.RefreshDexToken(req.Context(), cnsiGUID, userGUID)
 	})
 
 	return p.DoAuthFlowRequest(cnsiRequest, req, authHandler)
 }
 
-func (p *portalProxy) RefreshDexToken(ctx context.Context, skipSSLValidation bool, cnsiGUID, userGUID, client, clientSecret, tokenEndpoint string) (t interfaces.TokenRecord, err error) {
+// RefreshDexToken refreshes the Dex token of the user for the endpoint. Concurrent refreshes of the same token are
+// coalesced, and the token row is locked while it is refreshed so that other instances wait for the refreshed token
+// rather than refreshing the rotated refresh token again
+func (p *portalProxy) RefreshDexToken(ctx context.Context, cnsiGUID, userGUID string) (t interfaces.TokenRecord, err error) {
 	log.Debug("RefreshDexToken")
 
+	return dexTokenRefreshes.Refresh(ctx, cnsiGUID+":"+userGUID, func() (interfaces.TokenRecord, error) {
+		return p.refreshDexToken(cnsiGUID, userGUID)
+	})
+}
+
+func (p *portalProxy) refreshDexToken(cnsiGUID, userGUID string) (t interfaces.TokenRecord, err error) {
 	userToken, ok := p.GetCNSITokenRecordWithDisconnected(cnsiGUID, userGUID)
 	if !ok {
 		return t, fmt.Errorf("info could not be found for user with GUID %s", userGUID)
 	}
 
-	oidcProvider, err := p.GetDex()
+	oidcProvider, err := p.GetDex(cnsiGUID)
 	if err != nil {
 		return t, fmt.Errorf("failed to get dex client: %+v", err)
 	}
 
-	// Convert out token into oauth2 token
-	oathToken := &oauth2.Token{
-		AccessToken:  userToken.AuthToken,
-		TokenType:    "Bearer",
-		RefreshToken: userToken.RefreshToken,
-		Expiry:       time.Unix(userToken.TokenExpiry, 0),
-	}
-
-	// Get new token (we could dump OAuthHandlerFunc above and just use this plus `Request` part)
-	tokenSource := oidcProvider.GetConfig().TokenSource(ctx, oathToken)
-	newOathToken, err := tokenSource.Token()
+	tokenRepo, err := p.GetStoreFactory().TokenStore()
 	if err != nil {
-		return t, fmt.Errorf("failed to fetch refreshed token: %+v", err)
+		return t, fmt.Errorf(dbReferenceError, err)
 	}
 
-	tokenRecord := &interfaces.TokenRecord{
-		AuthType:     interfaces.AuthTypeDex,
-		AuthToken:    newOathToken.AccessToken,
-		RefreshToken: newOathToken.RefreshToken,
-		TokenExpiry:  newOathToken.Expiry.Unix(),
-		Metadata:     userToken.Metadata, // This will be used for refreshing the token
-	}
+	return tokenRepo.RefreshCNSIToken(cnsiGUID, userGUID, p.Config.EncryptionKeyInBytes, func(storedToken interfaces.TokenRecord) (*interfaces.TokenRecord, error) {
+		if storedToken.AuthToken != userToken.AuthToken && time.Unix(storedToken.TokenExpiry, 0).After(time.Now()) {
+			// Refreshed by another instance while this one waited for the lock
+			return nil, nil
+		}
 
-	err = p.setCNSITokenRecord(cnsiGUID, userGUID, *tokenRecord)
-	if err != nil {
-		return t, fmt.Errorf("couldn't save new token: %v", err)
-	}
+		// Convert out token into oauth2 token
+		oathToken := &oauth2.Token{
+			AccessToken:  storedToken.AuthToken,
+			TokenType:    "Bearer",
+			RefreshToken: storedToken.RefreshToken,
+			Expiry:       time.Unix(storedToken.TokenExpiry, 0),
+		}
 
-	return *tokenRecord, nil
+		// Get new token (we could dump OAuthHandlerFunc above and just use this plus `Request` part). The refresh
+		// token is rotated, so the request is not cancelled with the request that needed the token. It is limited
+		// though, the token row stays locked until it returns
+		ctx, cancel := context.WithTimeout(context.Background(), dexTokenRefreshTimeout)
+		defer cancel()
+		newOathToken, err := oidcProvider.RefreshToken(ctx, oathToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch refreshed token: %+v", err)
+		}
+
+		return &interfaces.TokenRecord{
+			AuthType:     interfaces.AuthTypeDex,
+			AuthToken:    newOathToken.AccessToken,
+			RefreshToken: newOathToken.RefreshToken,
+			TokenExpiry:  newOathToken.Expiry.Unix(),
+			Metadata:     storedToken.Metadata, // This will be used for refreshing the token
+		}, nil
+	})
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/proxyjobs"
+)
+
+const (
+	defaultProxyJobRetention          = time.Hour
+	defaultProxyMaxRunningJobsPerUser = 10
+	// Used if HTTP_CLIENT_TIMEOUT_LONGRUNNING_IN_SECS is not set, i.e. long-running requests don't time out
+	defaultProxyJobMaxRunTime = 10 * time.Minute
+
+	// How often the state of a job is read while a client waits for it to finish
+	proxyJobPollInterval = time.Second
+)
+
+// proxyJobLimits are the limits of long-running proxy jobs, see PROXY_JOB_RETENTION_IN_SECS, etc
+type proxyJobLimits struct {
+	// How long a job is kept after it has finished
+	retention time.Duration
+	// How long a job may run before it is given up on, e.g. because the instance running it was stopped
+	maxRunTime time.Duration
+	// Running jobs per user, 0 if not limited
+	maxRunningPerUser int
+}
+
+// proxyJob is the state of a job returned to the client
+type proxyJob struct {
+	ID         string    `json:"id"`
+	Endpoint   string    `json:"endpoint"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	StatusText string    `json:"statusText,omitempty"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+	Expires    time.Time `json:"expires"`
+}
+
+func newProxyJobLimits(pc interfaces.PortalConfig) proxyJobLimits {
+	limits := proxyJobLimits{
+		retention:         defaultProxyJobRetention,
+		maxRunTime:        time.Duration(pc.HTTPClientTimeoutLongRunningInSecs) * time.Second,
+		maxRunningPerUser: limitOrDefault(pc.ProxyMaxRunningJobsPerUser, defaultProxyMaxRunningJobsPerUser),
+	}
+
+	if pc.ProxyJobRetentionInSecs > 0 {
+		limits.retention = time.Duration(pc.ProxyJobRetentionInSecs) * time.Second
+	}
+	if limits.maxRunTime <= 0 {
+		limits.maxRunTime = defaultProxyJobMaxRunTime
+	}
+
+	return limits
+}
+
+func (p *portalProxy) proxyJobsRepository() (proxyjobs.Repository, error) {
+	return proxyjobs.NewPgsqlProxyJobsRepository(p.DatabaseConnectionPool)
+}
+
+// checkProxyJobLimit refuses long-running requests of users that have too many jobs running already
+func (p *portalProxy) checkProxyJobLimit(userGUID string) error {
+	limits := newProxyJobLimits(p.Config)
+	if limits.maxRunningPerUser == 0 {
+		return nil
+	}
+
+	repo, err := p.proxyJobsRepository()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	running, err := repo.CountRunning(userGUID)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to check running jobs",
+			"Unable to check running jobs: %v", err)
+	}
+	if running >= limits.maxRunningPerUser {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many long-running requests, wait for one to finish")
+	}
+	return nil
+}
+
+// startProxyJob records a long-running request the client stopped waiting for as a job, and stores the response of
+// the endpoint once it arrives on done. Returns the response to send to the client instead
+func (p *portalProxy) startProxyJob(c echo.Context, userGUID, cnsiGUID, method string, uri *url.URL, passthrough bool, done <-chan *interfaces.CNSIRequest) *interfaces.CNSIRequest {
+	timeout := &interfaces.CNSIRequest{
+		GUID:         cnsiGUID,
+		UserGUID:     userGUID,
+		Method:       method,
+		StatusCode:   http.StatusAccepted,
+		Status:       "Long Running Operation still active",
+		ResponseGUID: cnsiGUID,
+	}
+
+	job, err := p.createProxyJob(userGUID, cnsiGUID, method, uri, passthrough)
+	if err != nil {
+		log.Errorf("Unable to create job for long-running request to %s: %v", uri.String(), err)
+		// Nobody waits for the response anymore
+		go func() { <-done }()
+		timeout.Response = makeLongRunningTimeoutError("")
+		return timeout
+	}
+
+	go p.finishProxyJob(*job, done)
+
+	// The jobs routes are next to the proxy routes
+	if prefix := strings.TrimSuffix(c.Path(), "/proxy/*"); prefix != c.Path() {
+		c.Response().Header().Set("Location", prefix+"/jobs/"+job.ID)
+	}
+	timeout.Response = makeLongRunningTimeoutError(job.ID)
+	return timeout
+}
+
+func (p *portalProxy) createProxyJob(userGUID, cnsiGUID, method string, uri *url.URL, passthrough bool) (*proxyjobs.Job, error) {
+	repo, err := p.proxyJobsRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	jobUUID, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	limits := newProxyJobLimits(p.Config)
+	job := proxyjobs.Job{
+		ID:           jobUUID.String(),
+		UserGUID:     userGUID,
+		EndpointGUID: cnsiGUID,
+		Method:       method,
+		URL:          uri.String(),
+		Passthrough:  passthrough,
+		Status:       proxyjobs.JobRunning,
+		Created:      now,
+		Updated:      now,
+		// Jobs that don't finish in time, e.g. because the instance running them was stopped, are deleted
+		Expires: now.Add(limits.maxRunTime + limits.retention),
+	}
+
+	if err = repo.Insert(job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// finishProxyJob stores the response of the endpoint once the request has finished
+func (p *portalProxy) finishProxyJob(job proxyjobs.Job, done <-chan *interfaces.CNSIRequest) {
+	res := <-done
+
+	job.Status = proxyjobs.JobCompleted
+	job.StatusCode = res.StatusCode
+	job.StatusText = res.Status
+	response := res.Response
+	switch {
+	case res.Error == errProxyBodyTooLarge:
+		job.Status = proxyjobs.JobFailed
+		job.StatusCode = http.StatusBadGateway
+		job.StatusText = "Response body is too large"
+		response = nil
+	case res.Error != nil:
+		job.Status = proxyjobs.JobFailed
+		job.StatusText = res.Error.Error()
+	}
+
+	if len(response) > 0 {
+		encrypted, err := crypto.EncryptToken(p.Config.EncryptionKeyInBytes, string(response))
+		if err != nil {
+			job.Status = proxyjobs.JobFailed
+			job.StatusCode = http.StatusInternalServerError
+			job.StatusText = "Unable to store response"
+		}
+		job.Response = encrypted
+	}
+
+	job.Updated = time.Now()
+	job.Expires = job.Updated.Add(newProxyJobLimits(p.Config).retention)
+
+	repo, err := p.proxyJobsRepository()
+	if err != nil {
+		log.Errorf("Unable to store result of job %s: %v", job.ID, err)
+		return
+	}
+
+	updated, err := repo.Finish(job)
+	if err != nil {
+		log.Errorf("Unable to store result of job %s: %v", job.ID, err)
+	} else if !updated {
+		log.Warnf("Job %s finished after it was given up on", job.ID)
+	}
+}
+
+// findProxyJob returns the job with the id in the path, if it belongs to the current user and the API key the request
+// was authenticated with (if any) is allowed to access its endpoint
+func (p *portalProxy) findProxyJob(c echo.Context) (*proxyjobs.Job, error) {
+	userGUID, err := getPortalUserGUID(c)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+
+	repo, err := p.proxyJobsRepository()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	job, err := repo.Find(c.Param("id"))
+	if err != nil {
+		return nil, interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to find job",
+			"Unable to find job: %v", err)
+	}
+
+	// Don't tell users about the jobs of others
+	if job == nil || job.UserGUID != userGUID {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Job not found")
+	}
+
+	if apiKey, ok := c.Get(APIKeyContextKey).(*interfaces.APIKey); ok && !apiKey.AllowsCNSI(job.EndpointGUID) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Job not found")
+	}
+	return job, nil
+}
+
+// getProxyJob returns the state of a job. With ?wait=<seconds> (up to 30) the response is delayed until the job
+// has finished or the time is up
+func (p *portalProxy) getProxyJob(c echo.Context) error {
+	log.Debug("getProxyJob")
+
+	var wait time.Duration
+	if value := c.QueryParam("wait"); len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid wait parameter")
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > longRunningRequestTimeout*time.Second {
+			wait = longRunningRequestTimeout * time.Second
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		job, err := p.findProxyJob(c)
+		if err != nil {
+			return err
+		}
+
+		if job.Status != proxyjobs.JobRunning || !time.Now().Add(proxyJobPollInterval).Before(deadline) {
+			return c.JSON(http.StatusOK, newProxyJob(job))
+		}
+
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-time.After(proxyJobPollInterval):
+		}
+	}
+}
+
+// getProxyJobResponse returns the response of a finished job, as the proxy would have returned it
+func (p *portalProxy) getProxyJobResponse(c echo.Context) error {
+	log.Debug("getProxyJobResponse")
+
+	job, err := p.findProxyJob(c)
+	if err != nil {
+		return err
+	}
+
+	if job.Status == proxyjobs.JobRunning {
+		return echo.NewHTTPError(http.StatusConflict, "Job is still running")
+	}
+
+	res := &interfaces.CNSIRequest{
+		GUID:         job.EndpointGUID,
+		Method:       job.Method,
+		StatusCode:   job.StatusCode,
+		Status:       job.StatusText,
+		ResponseGUID: job.EndpointGUID,
+	}
+	if job.Status == proxyjobs.JobFailed {
+		res.Error = errors.New(job.StatusText)
+	}
+	if len(job.Response) > 0 {
+		response, err := crypto.DecryptToken(p.Config.EncryptionKeyInBytes, job.Response)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to read job response")
+		}
+		res.Response = []byte(response)
+	}
+
+	return sendProxiedResponse(c, map[string]*interfaces.CNSIRequest{job.EndpointGUID: res}, job.Passthrough)
+}
+
+func newProxyJob(job *proxyjobs.Job) proxyJob {
+	return proxyJob{
+		ID:         job.ID,
+		Endpoint:   job.EndpointGUID,
+		Method:     job.Method,
+		URL:        job.URL,
+		Status:     job.Status,
+		StatusCode: job.StatusCode,
+		StatusText: job.StatusText,
+		Created:    job.Created,
+		Updated:    job.Updated,
+		Expires:    job.Expires,
+	}
+}
+
+// makeLongRunningTimeoutError is the response to a long-running request that is still active. The job id, if any,
+// lets the client look up the result once it is available
+func makeLongRunningTimeoutError(jobID string) []byte {
+	description := "Long Running Operation still active"
+	var errorStatus = &PassthroughErrorStatus{
+		StatusCode: http.StatusAccepted,
+		Status:     description,
+	}
+	errorResponse, e := json.Marshal(struct {
+		LongRunningTimeout bool   `json:"longRunningTimeout"`
+		Description        string `json:"description"`
+		ErrorCode          string `json:"error_code"`
+		JobID              string `json:"job_id,omitempty"`
+	}{true, description, "longRunningTimeout", jobID})
+	if e != nil {
+		log.Errorf("makeLongRunningTimeoutError: could not marshal JSON: %+v", e)
+	}
+	passthroughError := &PassthroughError{}
+	passthroughError.Error = errorStatus
+	passthroughError.ErrorResponse = (*json.RawMessage)(&errorResponse)
+	res, e := json.Marshal(passthroughError)
+	if e != nil {
+		log.Errorf("makeLongRunningTimeoutError: could not marshal JSON: %+v", e)
+	}
+	return res
+}
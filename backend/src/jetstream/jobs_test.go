@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/proxyjobs"
+)
+
+const mockJobID = "2d3f5b3c-5e55-4a63-9c1a-0b7a4b0d4b11"
+
+var proxyJobColumns = []string{"user_guid", "endpoint_guid", "method", "url", "passthrough", "status", "status_code", "status_text", "response", "created", "updated", "expires"}
+
+func proxyJobRow(userGUID, status string, passthrough bool, statusCode int, response string) sqlmock.Rows {
+	var encrypted []byte
+	if len(response) > 0 {
+		encrypted, _ = crypto.EncryptToken(mockEncryptionKey, response)
+	}
+	now := time.Now()
+	return sqlmock.NewRows(proxyJobColumns).
+		AddRow(userGUID, mockCFGUID, "POST", "/api/v1/namespaces/workspace/applications", passthrough, status, statusCode, http.StatusText(statusCode), encrypted,
+			now.Add(-time.Minute).Unix(), now.Unix(), now.Add(time.Hour).Unix())
+}
+
+// encryptedArg matches a value encrypted with the mock encryption key
+type encryptedArg struct {
+	plaintext string
+	stored    *[]byte
+}
+
+func (a encryptedArg) Match(v driver.Value) bool {
+	encrypted, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	*a.stored = encrypted
+	decrypted, err := crypto.DecryptToken(mockEncryptionKey, encrypted)
+	return err == nil && decrypted == a.plaintext
+}
+
+func TestGetProxyJob(t *testing.T) {
+	t.Parallel()
+
+	Convey("Proxy job tests", t, func() {
+
+		Convey("Should return the job to its owner", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID, nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobRunning, false, 0, ""))
+
+			So(pp.getProxyJob(ctx), ShouldBeNil)
+			var job proxyJob
+			So(json.Unmarshal(res.Body.Bytes(), &job), ShouldBeNil)
+			So(job.ID, ShouldEqual, mockJobID)
+			So(job.Endpoint, ShouldEqual, mockCFGUID)
+			So(job.Status, ShouldEqual, proxyjobs.JobRunning)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not return the jobs of other users", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID, nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow("other-user", proxyjobs.JobCompleted, false, 200, "{}"))
+
+			err := pp.getProxyJob(ctx)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Should not return jobs for endpoints the API key is not allowed to access", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID, nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			ctx.Set(APIKeyContextKey, &interfaces.APIKey{UserGUID: mockUserGUID, Scopes: []string{interfaces.APIKeyScopeCNSIPrefix + mockCEGUID}})
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobCompleted, false, 200, "{}"))
+
+			err := pp.getProxyJob(ctx)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Should return jobs for endpoints the API key is allowed to access", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID, nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			ctx.Set(APIKeyContextKey, &interfaces.APIKey{UserGUID: mockUserGUID, Scopes: []string{interfaces.APIKeyScopeCNSIPrefix + mockCFGUID}})
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobCompleted, false, 200, "{}"))
+
+			So(pp.getProxyJob(ctx), ShouldBeNil)
+		})
+
+		Convey("Should wait for the job to finish", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID+"?wait=10", nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobRunning, false, 0, ""))
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobCompleted, false, 201, "{}"))
+
+			So(pp.getProxyJob(ctx), ShouldBeNil)
+			var job proxyJob
+			So(json.Unmarshal(res.Body.Bytes(), &job), ShouldBeNil)
+			So(job.Status, ShouldEqual, proxyjobs.JobCompleted)
+			So(job.StatusCode, ShouldEqual, 201)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not return the response of a running job", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID+"/response", nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobRunning, false, 0, ""))
+
+			err := pp.getProxyJobResponse(ctx)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Should return the response as the passthrough proxy would have", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID+"/response", nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobCompleted, true, 201, `{"name":"app"}`))
+
+			So(pp.getProxyJobResponse(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, 201)
+			So(res.Body.String(), ShouldEqual, `{"name":"app"}`)
+		})
+
+		Convey("Should return the response as the proxy would have", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/jobs/"+mockJobID+"/response", nil, mockUserGUID, "id", mockJobID)
+			defer done()
+			mock.ExpectQuery(findProxyJob).WithArgs(mockJobID).WillReturnRows(proxyJobRow(mockUserGUID, proxyjobs.JobCompleted, false, 201, `{"name":"app"}`))
+
+			So(pp.getProxyJobResponse(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusOK)
+			So(strings.TrimSpace(res.Body.String()), ShouldEqual, `{"`+mockCFGUID+`":{"name":"app"}}`)
+		})
+	})
+}
+
+func TestStartProxyJob(t *testing.T) {
+	t.Parallel()
+
+	Convey("Long-running request tests", t, func() {
+		res, ctx, pp, mock, done := setupHandlerTest("GET", "http://localhost/pp/v1/proxy/api/v1/namespaces/workspace/applications", nil, mockUserGUID)
+		defer done()
+		ctx.SetPath("/pp/v1/proxy/*")
+
+		Convey("Should continue as a job", func() {
+			mock.ExpectExec(insertProxyJob).
+				WithArgs(sqlmock.AnyArg(), mockUserGUID, mockCFGUID, "POST", "/api/v1/namespaces/workspace/applications", true, proxyjobs.JobRunning,
+					0, "", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			// The endpoint doesn't respond during the test
+			requests := make(chan *interfaces.CNSIRequest)
+			uri, _ := url.Parse("/api/v1/namespaces/workspace/applications")
+			timeout := pp.startProxyJob(ctx, mockUserGUID, mockCFGUID, "POST", uri, true, requests)
+
+			So(timeout.StatusCode, ShouldEqual, http.StatusAccepted)
+			location := res.Header().Get("Location")
+			So(location, ShouldStartWith, "/pp/v1/jobs/")
+			So(string(timeout.Response), ShouldContainSubstring, `"job_id":"`+strings.TrimPrefix(location, "/pp/v1/jobs/")+`"`)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should store the encrypted response once the job has finished", func() {
+			var stored []byte
+			mock.ExpectExec(finishProxyJob).
+				WithArgs(proxyjobs.JobCompleted, 201, "201 Created", encryptedArg{plaintext: "{}", stored: &stored}, sqlmock.AnyArg(), sqlmock.AnyArg(), mockJobID, proxyjobs.JobRunning).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			requests := make(chan *interfaces.CNSIRequest, 1)
+			requests <- &interfaces.CNSIRequest{GUID: mockCFGUID, StatusCode: 201, Status: "201 Created", Response: []byte("{}")}
+			pp.finishProxyJob(proxyjobs.Job{ID: mockJobID, Status: proxyjobs.JobRunning}, requests)
+
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(string(stored), ShouldNotContainSubstring, "{}")
+		})
+
+		Convey("Should record jobs that failed", func() {
+			mock.ExpectExec(finishProxyJob).
+				WithArgs(proxyjobs.JobFailed, http.StatusBadGateway, "Response body is too large", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), mockJobID, proxyjobs.JobRunning).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			requests := make(chan *interfaces.CNSIRequest, 1)
+			requests <- &interfaces.CNSIRequest{GUID: mockCFGUID, StatusCode: 200, Status: "200 OK", Response: []byte("{"), Error: errProxyBodyTooLarge}
+			pp.finishProxyJob(proxyjobs.Job{ID: mockJobID, Status: proxyjobs.JobRunning}, requests)
+
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should truncate long errors", func() {
+			mock.ExpectExec(finishProxyJob).
+				WithArgs(proxyjobs.JobFailed, 200, strings.Repeat("e", proxyjobs.MaxStatusTextLength), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), mockJobID, proxyjobs.JobRunning).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			requests := make(chan *interfaces.CNSIRequest, 1)
+			requests <- &interfaces.CNSIRequest{GUID: mockCFGUID, StatusCode: 200, Error: errors.New(strings.Repeat("e", 1000))}
+			pp.finishProxyJob(proxyjobs.Job{ID: mockJobID, Status: proxyjobs.JobRunning}, requests)
+
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should refuse long-running requests over the limit", func() {
+			pp.Config.ProxyMaxRunningJobsPerUser = 2
+			mock.ExpectQuery(countRunningJobs).WithArgs(mockUserGUID, proxyjobs.JobRunning, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+			err := pp.checkProxyJobLimit(mockUserGUID)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusTooManyRequests)
+		})
+	})
+}
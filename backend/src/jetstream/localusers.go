@@ -2,6 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	uuid "github.com/satori/go.uuid"
@@ -34,6 +38,21 @@ func (p *portalProxy) FindUserGUID(c echo.Context) (string, error) {
 	return guid, nil
 }
 
+// localUserMinPasswordLength is the shortest password accepted when a local user is created or changes password
+const localUserMinPasswordLength = 8
+
+// localUserInfo is the view of a local user returned by the /users API, it never includes the password hash
+type localUserInfo struct {
+	GUID       string     `json:"guid"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	Scope      string     `json:"scope"`
+	GivenName  string     `json:"given_name"`
+	FamilyName string     `json:"family_name"`
+	Admin      bool       `json:"admin"`
+	LastLogin  *time.Time `json:"last_login"`
+}
+
 func (p *portalProxy) AddLocalUser(c echo.Context) (string, error) {
 	log.Debug("AddLocalUser")
 
@@ -41,6 +60,8 @@ func (p *portalProxy) AddLocalUser(c echo.Context) (string, error) {
 	password := c.FormValue("password")
 	scope := c.FormValue("scope")
 	email := c.FormValue("email")
+	givenName := c.FormValue("given_name")
+	familyName := c.FormValue("family_name")
 
 	if len(username) == 0 || len(password) == 0 || len(scope) == 0 {
 		return "", errors.New("Needs username, password and scope")
@@ -63,7 +84,7 @@ func (p *portalProxy) AddLocalUser(c echo.Context) (string, error) {
 	if err != nil {
 		log.Errorf("Database error getting repo for local users: %v", err)
 	} else {
-		user := interfaces.LocalUser{UserGUID: userGUID, PasswordHash: passwordHash, Username: username, Email: email, Scope: scope}
+		user := interfaces.LocalUser{UserGUID: userGUID, PasswordHash: passwordHash, Username: username, Email: email, Scope: scope, GivenName: givenName, FamilyName: familyName}
 		err = localUsersRepo.AddLocalUser(user)
 		if err != nil {
 			log.Errorf("Error adding local user %v", err)
@@ -72,3 +93,437 @@ func (p *portalProxy) AddLocalUser(c echo.Context) (string, error) {
 	}
 	return userGUID, nil
 }
+
+// localUsersRepository returns the local users repository, as long as local users are used to log in
+func (p *portalProxy) localUsersRepository() (localusers.Repository, error) {
+	if interfaces.AuthEndpointTypes[p.Config.ConsoleConfig.AuthEndpointType] != interfaces.Local {
+		return nil, interfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Local users are not enabled",
+			"Local users are not enabled")
+	}
+
+	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(p.DatabaseConnectionPool)
+	if err != nil {
+		return nil, interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to access local users",
+			"Database error getting repo for local users: %v", err)
+	}
+
+	return localUsersRepo, nil
+}
+
+func (p *portalProxy) isLocalAdminScope(scope string) bool {
+	return scope == p.Config.ConsoleConfig.ConsoleAdminScope
+}
+
+func (p *portalProxy) newLocalUserInfo(localUsersRepo localusers.Repository, user interfaces.LocalUser) localUserInfo {
+	info := localUserInfo{
+		GUID:       user.UserGUID,
+		Username:   user.Username,
+		Email:      user.Email,
+		Scope:      user.Scope,
+		GivenName:  user.GivenName,
+		FamilyName: user.FamilyName,
+		Admin:      p.isLocalAdminScope(user.Scope),
+	}
+
+	// Users that have never logged in have no last login time
+	if lastLogin, err := localUsersRepo.FindLastLoginTime(user.UserGUID); err == nil && !lastLogin.IsZero() {
+		info.LastLogin = &lastLogin
+	}
+
+	return info
+}
+
+// findLocalUser fetches the user given by the id param
+func findLocalUser(c echo.Context, localUsersRepo localusers.Repository) (interfaces.LocalUser, error) {
+	user, err := localUsersRepo.FindUser(c.Param("id"))
+	if err != nil {
+		return user, interfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Local user not found",
+			"Unable to find local user %s: %v", c.Param("id"), err)
+	}
+	return user, nil
+}
+
+// checkLocalAdminRemains makes sure that removing the admin scope from (or deleting) the given user leaves at least
+// one local admin
+func (p *portalProxy) checkLocalAdminRemains(localUsersRepo localusers.Repository, userGUID string) error {
+	users, err := localUsersRepo.ListLocalUsers()
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to list local users",
+			"Unable to list local users: %v", err)
+	}
+
+	for _, user := range users {
+		if user.UserGUID != userGUID && p.isLocalAdminScope(user.Scope) {
+			return nil
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusConflict, "At least one local user must keep the admin scope")
+}
+
+func validateLocalUserPassword(password string) error {
+	if len(password) < localUserMinPasswordLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", localUserMinPasswordLength))
+	}
+	return nil
+}
+
+// formValue returns the value of a form field and whether it was sent at all, so that fields can be cleared
+func formValue(c echo.Context, name string) (string, bool) {
+	params, err := c.FormParams()
+	if err != nil {
+		return "", false
+	}
+	values, ok := params[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return strings.TrimSpace(values[0]), true
+}
+
+// listLocalUsers lists all local users, with their last login time (admin)
+// GET /users
+func (p *portalProxy) listLocalUsers(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	users, err := localUsersRepo.ListLocalUsers()
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to list local users",
+			"Unable to list local users: %v", err)
+	}
+
+	infos := make([]localUserInfo, len(users))
+	for i, user := range users {
+		infos[i] = p.newLocalUserInfo(localUsersRepo, user)
+	}
+
+	return c.JSON(http.StatusOK, infos)
+}
+
+// getLocalUser fetches a single local user (admin)
+// GET /users/:id
+func (p *portalProxy) getLocalUser(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, err := findLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, p.newLocalUserInfo(localUsersRepo, user))
+}
+
+// createLocalUser adds a local user (admin)
+// POST /users
+func (p *portalProxy) createLocalUser(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	username := c.FormValue("username")
+	if len(strings.TrimSpace(username)) == 0 || username != strings.TrimSpace(username) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Username must not be empty or start or end with spaces")
+	}
+	if len(strings.TrimSpace(c.FormValue("scope"))) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Scope must not be empty")
+	}
+	if err = validateLocalUserPassword(c.FormValue("password")); err != nil {
+		return err
+	}
+	if _, err = localUsersRepo.FindUserGUID(username); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "A local user with this username already exists")
+	}
+
+	userGUID, err := p.AddLocalUser(c)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to add local user",
+			"Unable to add local user %s: %v", username, err)
+	}
+
+	log.Infof("Local user `%s` (%s) created with scope `%s` by user `%s`", username, userGUID, c.FormValue("scope"), c.Get("user_id"))
+
+	user, err := localUsersRepo.FindUser(userGUID)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to fetch local user",
+			"Unable to fetch new local user %s: %v", userGUID, err)
+	}
+
+	return c.JSON(http.StatusCreated, p.newLocalUserInfo(localUsersRepo, user))
+}
+
+// updateLocalUser changes the username, email, names or scope of a local user. Only the fields sent are changed (admin)
+// PUT /users/:id
+func (p *portalProxy) updateLocalUser(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, err := findLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	changes := []string{}
+
+	if username, ok := formValue(c, "username"); ok && username != user.Username {
+		if len(username) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Username must not be empty")
+		}
+		if _, err = localUsersRepo.FindUserGUID(username); err == nil {
+			return echo.NewHTTPError(http.StatusConflict, "A local user with this username already exists")
+		}
+		changes = append(changes, fmt.Sprintf("username `%s` -> `%s`", user.Username, username))
+		user.Username = username
+	}
+
+	if scope, ok := formValue(c, "scope"); ok && scope != user.Scope {
+		if len(scope) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Scope must not be empty")
+		}
+		if p.isLocalAdminScope(user.Scope) && !p.isLocalAdminScope(scope) {
+			if user.UserGUID == c.Get("user_id") {
+				return echo.NewHTTPError(http.StatusBadRequest, "You can not remove your own admin scope")
+			}
+			if err = p.checkLocalAdminRemains(localUsersRepo, user.UserGUID); err != nil {
+				return err
+			}
+		}
+		changes = append(changes, fmt.Sprintf("scope `%s` -> `%s`", user.Scope, scope))
+		user.Scope = scope
+	}
+
+	if email, ok := formValue(c, "email"); ok && email != user.Email {
+		changes = append(changes, "email")
+		user.Email = email
+	}
+	if givenName, ok := formValue(c, "given_name"); ok && givenName != user.GivenName {
+		changes = append(changes, "given name")
+		user.GivenName = givenName
+	}
+	if familyName, ok := formValue(c, "family_name"); ok && familyName != user.FamilyName {
+		changes = append(changes, "family name")
+		user.FamilyName = familyName
+	}
+
+	if len(changes) > 0 {
+		// The password hash isn't part of the user fetched above, but is always written back
+		if user.PasswordHash, err = localUsersRepo.FindPasswordHash(user.UserGUID); err != nil {
+			return interfaces.NewHTTPShadowError(
+				http.StatusInternalServerError,
+				"Unable to update local user",
+				"Unable to find password hash of local user %s: %v", user.UserGUID, err)
+		}
+		if err = localUsersRepo.UpdateLocalUser(user); err != nil {
+			return interfaces.NewHTTPShadowError(
+				http.StatusInternalServerError,
+				"Unable to update local user",
+				"Unable to update local user %s: %v", user.UserGUID, err)
+		}
+		log.Infof("Local user `%s` (%s) updated by user `%s`: %s", user.Username, user.UserGUID, c.Get("user_id"), strings.Join(changes, ", "))
+	}
+
+	return c.JSON(http.StatusOK, p.newLocalUserInfo(localUsersRepo, user))
+}
+
+// resetLocalUserPassword sets a new password for a local user (admin)
+// POST /users/:id/password
+func (p *portalProxy) resetLocalUserPassword(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, err := findLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if err = p.setLocalUserPassword(localUsersRepo, user, c.FormValue("password")); err != nil {
+		return err
+	}
+
+	log.Infof("Password of local user `%s` (%s) reset by user `%s`", user.Username, user.UserGUID, c.Get("user_id"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deleteLocalUser removes a local user. Admins can't remove themselves or the last admin (admin)
+// DELETE /users/:id
+func (p *portalProxy) deleteLocalUser(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, err := findLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if user.UserGUID == c.Get("user_id") {
+		return echo.NewHTTPError(http.StatusBadRequest, "You can not delete yourself")
+	}
+	if p.isLocalAdminScope(user.Scope) {
+		if err = p.checkLocalAdminRemains(localUsersRepo, user.UserGUID); err != nil {
+			return err
+		}
+	}
+
+	// The user's sessions end with the user, the API keys and tokens are removed first so none are left behind
+	if err = p.APIKeysRepository.DeleteAPIKeys(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to delete local user",
+			"Unable to delete API keys of local user %s: %v", user.UserGUID, err)
+	}
+
+	tokenRepo, err := p.GetStoreFactory().TokenStore()
+	if err == nil {
+		err = tokenRepo.DeleteUserTokens(user.UserGUID)
+	}
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to delete local user",
+			"Unable to delete tokens of local user %s: %v", user.UserGUID, err)
+	}
+
+	if err = localUsersRepo.DeleteLocalUser(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to delete local user",
+			"Unable to delete local user %s: %v", user.UserGUID, err)
+	}
+
+	log.Infof("Local user `%s` (%s) deleted by user `%s`", user.Username, user.UserGUID, c.Get("user_id"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// changeOwnPassword lets a local user change their password, the current password is required
+// POST /users/me/password
+func (p *portalProxy) changeOwnPassword(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	userGUID, ok := c.Get("user_id").(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	user, err := localUsersRepo.FindUser(userGUID)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Local user not found",
+			"Unable to find local user %s: %v", userGUID, err)
+	}
+
+	// The current password can be guessed here as well as at the login, so it counts towards the same limits
+	if err = p.checkLoginAllowed(c, user.Username); err != nil {
+		if locked, ok := err.(errLoginLocked); ok {
+			return locked.HTTPError(c)
+		}
+		return err
+	}
+	defer p.loginEnded(c)
+
+	hash, err := localUsersRepo.FindPasswordHash(userGUID)
+	if err == nil && crypto.CheckPasswordHash(c.FormValue("current_password"), hash) != nil {
+		p.loginFailed(c, user.Username)
+		err = errors.New("invalid current password")
+	}
+	if err != nil {
+		log.Warnf("Password change for local user `%s` (%s) rejected: %v", user.Username, userGUID, err)
+		return echo.NewHTTPError(http.StatusForbidden, "Current password is not correct")
+	}
+	p.loginSucceeded(c, user.Username)
+
+	if c.FormValue("password") == c.FormValue("current_password") {
+		return echo.NewHTTPError(http.StatusBadRequest, "New password must differ from the current password")
+	}
+
+	if err = p.setLocalUserPassword(localUsersRepo, user, c.FormValue("password")); err != nil {
+		return err
+	}
+
+	// The user's other sessions have ended, this one continues
+	version, err := localUsersRepo.FindSessionVersion(userGUID)
+	if err == nil {
+		err = p.setSessionValues(c, map[string]interface{}{localSessionVersion: version})
+	}
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to update session",
+			"Unable to update session of local user %s: %v", userGUID, err)
+	}
+
+	log.Infof("Local user `%s` (%s) changed their password", user.Username, userGUID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// setLocalUserPassword validates, hashes and stores a new password for the user. The user's sessions and API keys no
+// longer work once the password has changed
+func (p *portalProxy) setLocalUserPassword(localUsersRepo localusers.Repository, user interfaces.LocalUser, password string) error {
+	if err := validateLocalUserPassword(password); err != nil {
+		return err
+	}
+
+	passwordHash, err := crypto.HashPassword(password)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to change password",
+			"Error hashing user password: %v", err)
+	}
+
+	user.PasswordHash = passwordHash
+	if err = localUsersRepo.UpdateLocalUser(user); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to change password",
+			"Unable to update password of local user %s: %v", user.UserGUID, err)
+	}
+
+	if err = localUsersRepo.RevokeSessions(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Password changed, unable to end the user's sessions",
+			"Unable to revoke sessions of local user %s: %v", user.UserGUID, err)
+	}
+
+	if err = p.APIKeysRepository.DeleteAPIKeys(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Password changed, unable to remove the user's API keys",
+			"Unable to delete API keys of local user %s: %v", user.UserGUID, err)
+	}
+
+	return nil
+}
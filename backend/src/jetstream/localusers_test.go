@@ -1,10 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -17,6 +22,13 @@ import (
 
 const (
 	insertLocalUserSQL = `INSERT INTO local_users (user_guid, password_hash, user_name, user_email, user_scope) VALUES ($1, $2, $3, $4, $5)`
+	listLocalUsersSQL  = `SELECT user_guid, user_name, (.+) FROM local_users ORDER BY (.+)`
+	findLocalUserSQL   = `SELECT user_name, user_email, (.+) FROM local_users WHERE (.+)`
+	deleteLocalUserSQL = `DELETE FROM local_users WHERE (.+)`
+	deleteMFASQL       = `DELETE FROM local_users_mfa WHERE (.+)`
+	updateLocalUserSQL = `UPDATE local_users SET password_hash=(.+)`
+	deleteAPIKeysSQL   = `DELETE FROM api_keys WHERE user_guid = (.+)`
+	deleteTokensSQL    = `DELETE FROM tokens WHERE user_guid = (.+)`
 )
 
 func TestAddLocalUser(t *testing.T) {
@@ -243,3 +255,309 @@ func TestUpdateLastLoginTime(t *testing.T) {
 		})
 	})
 }
+
+func localUserRow(username, scope string) sqlmock.Rows {
+	return sqlmock.NewRows([]string{"user_name", "user_email", "user_scope", "given_name", "family_name"}).
+		AddRow(username, "", scope, "", "")
+}
+
+func TestListLocalUsers(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user management tests", t, func() {
+		res, ctx, pp, mock, done := setupHandlerTest("GET", "", nil, "admin-guid")
+		defer done()
+		initLocalAuth(pp)
+
+		lastLogin := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(listLocalUsersSQL).WillReturnRows(
+			sqlmock.NewRows([]string{"user_guid", "user_name", "user_email", "user_scope", "given_name", "family_name"}).
+				AddRow("admin-guid", "admin", "admin@example.org", UAAAdminIdentifier, "Admin", "User").
+				AddRow("user-guid", "user", nil, "stratos.user", nil, nil))
+		mock.ExpectQuery(findLastLoginTime).WillReturnRows(sqlmock.NewRows([]string{"last_login"}).AddRow(lastLogin))
+		mock.ExpectQuery(findLastLoginTime).WillReturnError(sql.ErrNoRows)
+
+		err := pp.listLocalUsers(ctx)
+
+		Convey("Should list the users, with their last login time", func() {
+			So(err, ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusOK)
+
+			var users []localUserInfo
+			So(json.Unmarshal(res.Body.Bytes(), &users), ShouldBeNil)
+			So(users, ShouldHaveLength, 2)
+			So(users[0].Admin, ShouldBeTrue)
+			So(users[0].LastLogin, ShouldNotBeNil)
+			So(users[0].LastLogin.Equal(lastLogin), ShouldBeTrue)
+			So(users[1].Admin, ShouldBeFalse)
+			So(users[1].LastLogin, ShouldBeNil)
+			So(res.Body.String(), ShouldNotContainSubstring, "password")
+		})
+
+		Convey("Expectations should be met", func() {
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLocalUsersNotEnabled(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user management tests", t, func() {
+		_, ctx, pp, _, done := setupHandlerTest("GET", "", nil, "admin-guid")
+		defer done()
+		initLocalAuth(pp)
+		pp.Config.ConsoleConfig.AuthEndpointType = string(interfaces.Epinio)
+
+		err := pp.listLocalUsers(ctx)
+
+		Convey("Should fail with not found", func() {
+			So(err, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(err.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestDeleteLocalUser(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user management tests", t, func() {
+
+		Convey("Should delete a user", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("DELETE", "", nil, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectExec(deleteAPIKeysSQL).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec(deleteTokensSQL).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(deleteMFASQL).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(deleteLocalUserSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(pp.deleteLocalUser(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNoContent)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should keep the user if their API keys can't be removed", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("DELETE", "", nil, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectExec(deleteAPIKeysSQL).WillReturnError(errors.New("database is locked"))
+
+			err := pp.deleteLocalUser(ctx)
+			So(err, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(err.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusInternalServerError)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not delete yourself", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("DELETE", "", nil, "admin-guid", "id", "admin-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("admin", UAAAdminIdentifier))
+
+			So(pp.deleteLocalUser(ctx), ShouldResemble, echo.NewHTTPError(http.StatusBadRequest, "You can not delete yourself"))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not delete the last admin", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("DELETE", "", nil, "user-guid", "id", "admin-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("admin", UAAAdminIdentifier))
+			mock.ExpectQuery(listLocalUsersSQL).WillReturnRows(
+				sqlmock.NewRows([]string{"user_guid", "user_name", "user_email", "user_scope", "given_name", "family_name"}).
+					AddRow("admin-guid", "admin", "", UAAAdminIdentifier, "", "").
+					AddRow("user-guid", "user", "", "stratos.user", "", ""))
+
+			So(pp.deleteLocalUser(ctx), ShouldResemble, echo.NewHTTPError(http.StatusConflict, "At least one local user must keep the admin scope"))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestUpdateLocalUserScope(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user management tests", t, func() {
+
+		Convey("Should change the scope of a user", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("PUT", "", map[string]string{"scope": UAAAdminIdentifier}, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findPasswordHash).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow([]byte("hash")))
+			mock.ExpectExec(updateLastLoginTime).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(findLastLoginTime).WillReturnError(sql.ErrNoRows)
+
+			So(pp.updateLocalUser(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusOK)
+
+			var user localUserInfo
+			So(json.Unmarshal(res.Body.Bytes(), &user), ShouldBeNil)
+			So(user.Scope, ShouldEqual, UAAAdminIdentifier)
+			So(user.Admin, ShouldBeTrue)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not remove your own admin scope", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("PUT", "", map[string]string{"scope": "stratos.user"}, "admin-guid", "id", "admin-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("admin", UAAAdminIdentifier))
+
+			So(pp.updateLocalUser(ctx), ShouldResemble, echo.NewHTTPError(http.StatusBadRequest, "You can not remove your own admin scope"))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLocalUserPasswords(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user management tests", t, func() {
+
+		Convey("Should reject short passwords", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"password": "short"}, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+
+			So(pp.resetLocalUserPassword(ctx), ShouldResemble, echo.NewHTTPError(http.StatusBadRequest, "Password must be at least 8 characters"))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should require the current password to change your own", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{
+				"current_password": "notmypassword",
+				"password":         "mynewpassword",
+			}, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			hash, _ := crypto.HashPassword("changeme")
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			expectLoginAttempt(mock)
+			mock.ExpectQuery(findPasswordHash).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+
+			So(pp.changeOwnPassword(ctx), ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "Current password is not correct"))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not check the current password once it has failed too often", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{
+				"current_password": "changeme",
+				"password":         "mynewpassword",
+			}, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			lockedUntil := time.Now().Add(30 * time.Second).Unix()
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findLoginAttempts).WithArgs(loginUserKey("user")).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(5, time.Now().Unix(), lockedUntil))
+
+			err := pp.changeOwnPassword(ctx)
+			So(err, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(err.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(res.Header().Get("Retry-After"), ShouldBeIn, []string{"29", "30"})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should end the sessions and remove the API keys of the user on a reset", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"password": "mynewpassword"}, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectExec(updateLocalUserSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(revokeSessions).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(deleteAPIKeysSQL).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(pp.resetLocalUserPassword(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNoContent)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should keep your own session when you change your password", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{
+				"current_password": "changeme",
+				"password":         "mynewpassword",
+			}, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			hash, _ := crypto.HashPassword("changeme")
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			expectLoginAttempt(mock)
+			mock.ExpectQuery(findPasswordHash).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+			mock.ExpectExec(deleteLoginAttempts).WithArgs(loginUserKey("user")).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+			mock.ExpectExec(updateLocalUserSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(revokeSessions).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(deleteAPIKeysSQL).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnRows(expectSessionVersionRow(3))
+
+			So(pp.changeOwnPassword(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNoContent)
+
+			version, err := pp.GetSessionInt64Value(ctx, localSessionVersion)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 3)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLocalSessionVersion(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local user sessions", t, func() {
+		req := setupMockReq("GET", "", nil)
+		_, _, ctx, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+
+		auth := &localAuth{databaseConnectionPool: db, p: pp}
+		So(pp.setSessionValues(ctx, map[string]interface{}{"user_id": "user-guid", localSessionVersion: int64(2)}), ShouldBeNil)
+
+		Convey("Should be valid with the current session version of the user", func() {
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnRows(expectSessionVersionRow(2))
+
+			So(auth.VerifySessionActivity(ctx), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should end once they have been revoked", func() {
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnRows(expectSessionVersionRow(3))
+
+			So(auth.VerifySessionActivity(ctx), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should end once the user has been removed", func() {
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnError(sql.ErrNoRows)
+
+			So(auth.VerifySession(ctx, "user-guid", 0), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should be valid without a session version until the first revocation", func() {
+			So(pp.unsetSessionValue(ctx, localSessionVersion), ShouldBeNil)
+
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnRows(expectSessionVersionRow(0))
+			So(auth.VerifySessionActivity(ctx), ShouldBeNil)
+
+			mock.ExpectQuery(findSessionVersion).WithArgs("user-guid").WillReturnRows(expectSessionVersionRow(1))
+			So(auth.VerifySessionActivity(ctx), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
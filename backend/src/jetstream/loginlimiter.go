@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/loginattempts"
+)
+
+const (
+	defaultLoginMaxAttempts      = 5
+	defaultLoginMaxAttemptsPerIP = 20
+	defaultLoginBackoff          = time.Second
+	defaultLoginLockout          = 15 * time.Minute
+
+	// How often a failed login is recorded again when another instance recorded one for the same key at the same time
+	loginAttemptsRetries = 3
+
+	// Context key of the login attempt whose credentials are being checked
+	loginAttemptContextKey = "login_attempt"
+)
+
+// loginLimits are the thresholds for failed logins, see LOGIN_MAX_ATTEMPTS, etc
+type loginLimits struct {
+	// Failures of a username or from a client address before it is locked out, 0 if not limited
+	maxAttempts      int
+	maxAttemptsPerIP int
+	// Delay after the first failed login of a username, doubled with every further failure
+	backoff time.Duration
+	// How long a lockout lasts, failures are forgotten after the same time
+	lockout time.Duration
+}
+
+// errLoginLocked is returned when a login is refused without checking the credentials, due to earlier failures
+type errLoginLocked struct {
+	retryAfter time.Duration
+}
+
+func (e errLoginLocked) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+// RetryAfter is the value of the Retry-After header, in whole seconds
+func (e errLoginLocked) RetryAfter() string {
+	return strconv.FormatInt(int64(math.Ceil(e.retryAfter.Seconds())), 10)
+}
+
+// HTTPError sets the Retry-After header and returns the error to respond with
+func (e errLoginLocked) HTTPError(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", e.RetryAfter())
+	return interfaces.NewHTTPShadowError(
+		http.StatusTooManyRequests,
+		e.Error(),
+		"Login refused: locked for another %v", e.retryAfter)
+}
+
+func newLoginLimits(pc interfaces.PortalConfig) loginLimits {
+	limits := loginLimits{
+		maxAttempts:      limitOrDefault(pc.LoginMaxAttempts, defaultLoginMaxAttempts),
+		maxAttemptsPerIP: limitOrDefault(pc.LoginMaxAttemptsPerIP, defaultLoginMaxAttemptsPerIP),
+		backoff:          defaultLoginBackoff,
+		lockout:          defaultLoginLockout,
+	}
+
+	switch {
+	case pc.LoginBackoffInSecs < 0:
+		limits.backoff = 0
+	case pc.LoginBackoffInSecs > 0:
+		limits.backoff = time.Duration(pc.LoginBackoffInSecs) * time.Second
+	}
+
+	if pc.LoginLockoutInSecs > 0 {
+		limits.lockout = time.Duration(pc.LoginLockoutInSecs) * time.Second
+	}
+
+	return limits
+}
+
+// limitOrDefault returns the configured limit, the default if not configured or 0 (unlimited) if negative
+func limitOrDefault(value int64, defaultValue int) int {
+	switch {
+	case value < 0:
+		return 0
+	case value == 0:
+		return defaultValue
+	}
+	return int(value)
+}
+
+// loginUserKey identifies the failed logins of a username. The username is hashed, mistyped passwords are often
+// entered as username
+func loginUserKey(username string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(username))))
+	return "user:" + hex.EncodeToString(hash[:])
+}
+
+// loginIPKey identifies the failed logins from the client address. The address is taken from X-Forwarded-For only
+// for requests from TRUSTED_PROXIES (see newIPExtractor) and is always a parsed IP
+func loginIPKey(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// newIPExtractor returns how the client address of a request is determined. Without trusted proxies it is the address
+// the request came from, otherwise the nearest address in X-Forwarded-For that is not one of the proxies. Clients could
+// choose their own address if the header was trusted regardless of where the request came from
+func newIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	var ranges []echo.TrustOption
+	for _, proxy := range trustedProxies {
+		if proxy = strings.TrimSpace(proxy); len(proxy) == 0 {
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy range %s: %v", proxy, err)
+		}
+		ranges = append(ranges, echo.TrustIPRange(ipRange))
+	}
+
+	if len(ranges) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	return echo.ExtractIPFromXFFHeader(append(options, ranges...)...), nil
+}
+
+// loginKey is a key failed logins are counted against, with the failures allowed before it is locked out
+type loginKey struct {
+	key         string
+	maxAttempts int
+}
+
+// keys returns the keys limited for a login attempt, the username first
+func (l loginLimits) keys(c echo.Context, username string) []loginKey {
+	keys := make([]loginKey, 0, 2)
+	if l.maxAttempts > 0 {
+		keys = append(keys, loginKey{key: loginUserKey(username), maxAttempts: l.maxAttempts})
+	}
+	if l.maxAttemptsPerIP > 0 {
+		keys = append(keys, loginKey{key: loginIPKey(c), maxAttempts: l.maxAttemptsPerIP})
+	}
+	return keys
+}
+
+// nextLoginAttempts returns the attempts of a key after another failed login. Usernames back off exponentially,
+// client addresses are shared by many users and are only locked once they reach their max failures
+func (l loginLimits) nextLoginAttempts(previous *loginattempts.Attempts, key string, maxAttempts int, now time.Time) loginattempts.Attempts {
+	next := loginattempts.Attempts{Key: key, Failures: 1, LastFailure: now, LockedUntil: now}
+
+	if previous != nil && now.Sub(previous.LastFailure) < l.lockout {
+		next.Failures = previous.Failures + 1
+		next.LockedUntil = previous.LockedUntil
+	}
+
+	var delay time.Duration
+	switch {
+	case next.Failures >= maxAttempts:
+		delay = l.lockout
+	case l.backoff > 0 && strings.HasPrefix(key, "user:"):
+		delay = l.lockout
+		if next.Failures < 32 && l.backoff<<uint(next.Failures-1) < l.lockout {
+			delay = l.backoff << uint(next.Failures-1)
+		}
+	}
+
+	if lockedUntil := now.Add(delay); lockedUntil.After(next.LockedUntil) {
+		next.LockedUntil = lockedUntil
+	}
+
+	return next
+}
+
+func (p *portalProxy) loginAttemptsRepository() (loginattempts.Repository, error) {
+	return loginattempts.NewPgsqlLoginAttemptsRepository(p.DatabaseConnectionPool)
+}
+
+// loginAttempt is a login whose credentials are being checked. It is recorded as a failure before the credentials are
+// checked, so that parallel attempts can't get past a lockout, and forgotten again unless the credentials are rejected
+type loginAttempt struct {
+	recorded []recordedLoginAttempt
+	// Whether the credentials were rejected or accepted
+	done bool
+}
+
+// recordedLoginAttempt is the failure recorded for a key by a login attempt
+type recordedLoginAttempt struct {
+	key      loginKey
+	previous *loginattempts.Attempts
+	attempts loginattempts.Attempts
+}
+
+// checkLoginAllowed returns errLoginLocked if the username or the client address are locked out, otherwise it records
+// the login attempt until the credentials are found to be valid (loginSucceeded) or invalid (loginFailed). Callers
+// defer loginEnded to forget attempts that end without either. Logins are allowed if the lock state can't be determined
+func (p *portalProxy) checkLoginAllowed(c echo.Context, username string) error {
+	limits := newLoginLimits(p.Config)
+
+	repo, err := p.loginAttemptsRepository()
+	if err != nil {
+		log.Errorf("Unable to check failed logins: %v", err)
+		return nil
+	}
+
+	attempt := &loginAttempt{}
+	now := time.Now()
+	for _, key := range limits.keys(c, username) {
+		previous, attempts, err := limits.recordAttempt(repo, key, now)
+		if locked, ok := err.(errLoginLocked); ok {
+			limits.forget(repo, attempt.recorded)
+			log.Warnf("Login of user `%s` from %s refused for another %v due to failed logins", username, c.RealIP(), locked.retryAfter)
+			return locked
+		}
+		if err != nil {
+			log.Errorf("Unable to check failed logins: %v", err)
+			continue
+		}
+		attempt.recorded = append(attempt.recorded, recordedLoginAttempt{key: key, previous: previous, attempts: *attempts})
+	}
+
+	c.Set(loginAttemptContextKey, attempt)
+	return nil
+}
+
+// recordAttempt counts a login attempt as a failure of the key, unless the key is locked out. Other instances may do
+// the same at the same time, the update only succeeds if the attempts haven't changed since they were read
+func (l loginLimits) recordAttempt(repo loginattempts.Repository, key loginKey, now time.Time) (*loginattempts.Attempts, *loginattempts.Attempts, error) {
+	var err error
+	for i := 0; i < loginAttemptsRetries; i++ {
+		var previous *loginattempts.Attempts
+		if previous, err = repo.Find(key.key); err != nil {
+			return nil, nil, err
+		}
+		if previous != nil && previous.LockedUntil.After(now) {
+			return nil, nil, errLoginLocked{retryAfter: previous.LockedUntil.Sub(now)}
+		}
+
+		next := l.nextLoginAttempts(previous, key.key, key.maxAttempts, now)
+
+		if previous == nil {
+			// Fails if another instance inserted the key first
+			if err = repo.Insert(next); err == nil {
+				return nil, &next, nil
+			}
+			continue
+		}
+
+		var updated bool
+		if updated, err = repo.Update(next, previous.Failures); err != nil {
+			return nil, nil, err
+		} else if updated {
+			return previous, &next, nil
+		}
+		err = fmt.Errorf("login attempts of %s changed concurrently", key.key)
+	}
+
+	return nil, nil, err
+}
+
+// forget takes back failures recorded for login attempts whose credentials weren't rejected. A key is restored to
+// what it was before the attempt if nothing else was recorded for it since
+func (l loginLimits) forget(repo loginattempts.Repository, recorded []recordedLoginAttempt) {
+	for _, r := range recorded {
+		if err := l.forgetAttempt(repo, r); err != nil {
+			log.Errorf("Unable to reset login attempt: %v", err)
+		}
+	}
+}
+
+func (l loginLimits) forgetAttempt(repo loginattempts.Repository, recorded recordedLoginAttempt) error {
+	var err error
+	for i := 0; i < loginAttemptsRetries; i++ {
+		var current *loginattempts.Attempts
+		if current, err = repo.Find(recorded.key.key); err != nil || current == nil || current.Failures == 0 {
+			return err
+		}
+
+		next := *current
+		next.Failures--
+		if current.Failures == recorded.attempts.Failures {
+			if recorded.previous != nil {
+				next = *recorded.previous
+			} else {
+				next.LockedUntil = next.LastFailure
+			}
+		}
+
+		var updated bool
+		if updated, err = repo.Update(next, current.Failures); err != nil || updated {
+			return err
+		}
+		err = fmt.Errorf("login attempts of %s changed concurrently", recorded.key.key)
+	}
+
+	return err
+}
+
+func currentLoginAttempt(c echo.Context) *loginAttempt {
+	attempt, _ := c.Get(loginAttemptContextKey).(*loginAttempt)
+	if attempt == nil || attempt.done {
+		return nil
+	}
+	return attempt
+}
+
+// loginFailed keeps the failure recorded for a login with invalid credentials against the username and the client
+// address
+func (p *portalProxy) loginFailed(c echo.Context, username string) {
+	attempt := currentLoginAttempt(c)
+	if attempt == nil {
+		return
+	}
+	attempt.done = true
+
+	for _, recorded := range attempt.recorded {
+		if recorded.attempts.Failures >= recorded.key.maxAttempts {
+			log.Warnf("Login of user `%s` from %s failed %d times, locked until %v", username, c.RealIP(), recorded.attempts.Failures, recorded.attempts.LockedUntil)
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins of the username. Failures from the client address are kept, a successful
+// login must not allow guessing the passwords of other users
+func (p *portalProxy) loginSucceeded(c echo.Context, username string) {
+	repo, err := p.loginAttemptsRepository()
+	if err != nil {
+		log.Errorf("Unable to reset failed logins: %v", err)
+		return
+	}
+	if err = repo.Delete(loginUserKey(username)); err != nil {
+		log.Errorf("Unable to reset failed logins: %v", err)
+	}
+
+	if attempt := currentLoginAttempt(c); attempt != nil {
+		attempt.done = true
+
+		userKey := loginUserKey(username)
+		recorded := make([]recordedLoginAttempt, 0, len(attempt.recorded))
+		for _, r := range attempt.recorded {
+			if r.key.key != userKey {
+				recorded = append(recorded, r)
+			}
+		}
+		newLoginLimits(p.Config).forget(repo, recorded)
+	}
+}
+
+// loginEnded forgets the login attempt recorded by checkLoginAllowed if its credentials were neither rejected nor
+// accepted, e.g. because they couldn't be checked or a second factor is still needed
+func (p *portalProxy) loginEnded(c echo.Context) {
+	attempt := currentLoginAttempt(c)
+	if attempt == nil {
+		return
+	}
+	attempt.done = true
+
+	repo, err := p.loginAttemptsRepository()
+	if err != nil {
+		log.Errorf("Unable to reset login attempt: %v", err)
+		return
+	}
+	newLoginLimits(p.Config).forget(repo, attempt.recorded)
+}
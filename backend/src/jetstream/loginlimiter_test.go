@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/loginattempts"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNextLoginAttempts(t *testing.T) {
+	t.Parallel()
+
+	Convey("Failed login tests", t, func() {
+		limits := newLoginLimits(interfaces.PortalConfig{})
+		now := time.Unix(1700000000, 0)
+		userKey := loginUserKey("admin")
+
+		Convey("Should use the defaults", func() {
+			So(limits.maxAttempts, ShouldEqual, defaultLoginMaxAttempts)
+			So(limits.maxAttemptsPerIP, ShouldEqual, defaultLoginMaxAttemptsPerIP)
+			So(limits.backoff, ShouldEqual, defaultLoginBackoff)
+			So(limits.lockout, ShouldEqual, defaultLoginLockout)
+		})
+
+		Convey("Should disable limits that are negative", func() {
+			limits = newLoginLimits(interfaces.PortalConfig{LoginMaxAttemptsPerIP: -1, LoginBackoffInSecs: -1})
+			So(limits.maxAttempts, ShouldEqual, defaultLoginMaxAttempts)
+			So(limits.maxAttemptsPerIP, ShouldEqual, 0)
+			So(limits.backoff, ShouldEqual, 0)
+		})
+
+		Convey("Should back off exponentially, then lock out the username", func() {
+			var attempts *loginattempts.Attempts
+			for failures, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, defaultLoginLockout} {
+				next := limits.nextLoginAttempts(attempts, userKey, limits.maxAttempts, now)
+				So(next.Failures, ShouldEqual, failures+1)
+				So(next.LockedUntil, ShouldEqual, now.Add(delay))
+				attempts = &next
+			}
+		})
+
+		Convey("Should forget failures after the lockout", func() {
+			previous := &loginattempts.Attempts{Key: userKey, Failures: 4, LastFailure: now.Add(-defaultLoginLockout), LockedUntil: now.Add(-defaultLoginLockout)}
+			next := limits.nextLoginAttempts(previous, userKey, limits.maxAttempts, now)
+			So(next.Failures, ShouldEqual, 1)
+			So(next.LockedUntil, ShouldEqual, now.Add(time.Second))
+		})
+
+		Convey("Should only lock out client addresses at their max", func() {
+			previous := &loginattempts.Attempts{Key: "ip:10.0.0.1", Failures: 10, LastFailure: now, LockedUntil: now}
+			next := limits.nextLoginAttempts(previous, "ip:10.0.0.1", limits.maxAttemptsPerIP, now)
+			So(next.LockedUntil, ShouldEqual, now)
+
+			previous.Failures = defaultLoginMaxAttemptsPerIP - 1
+			next = limits.nextLoginAttempts(previous, "ip:10.0.0.1", limits.maxAttemptsPerIP, now)
+			So(next.LockedUntil, ShouldEqual, now.Add(defaultLoginLockout))
+		})
+
+		Convey("Should not hash usernames differently by case", func() {
+			So(loginUserKey(" Admin"), ShouldEqual, userKey)
+		})
+	})
+}
+
+func TestLoginLocked(t *testing.T) {
+	t.Parallel()
+
+	Convey("Failed login tests", t, func() {
+		req := setupMockReq("POST", "", map[string]string{
+			"username": "localuser",
+			"password": "localuserpass",
+		})
+
+		res, _, ctx, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+
+		pp.Config.ConsoleConfig.AuthEndpointType = string(interfaces.Local)
+		if err := pp.InitStratosAuthService(interfaces.AuthEndpointTypes[pp.Config.ConsoleConfig.AuthEndpointType]); err != nil {
+			log.Fatalf("Could not initialise auth service: %v", err)
+		}
+
+		lockedUntil := time.Now().Add(30 * time.Second).Unix()
+		mock.ExpectQuery(findLoginAttempts).WithArgs(loginUserKey("localuser")).
+			WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(5, time.Now().Unix(), lockedUntil))
+
+		loginErr := pp.StratosAuthService.Login(ctx)
+
+		Convey("Should refuse the login without checking the password", func() {
+			So(loginErr, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(loginErr.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(res.Header().Get("Retry-After"), ShouldBeIn, []string{"29", "30"})
+		})
+
+		Convey("Expectations should be met", func() {
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestRecordLoginAttempt(t *testing.T) {
+	t.Parallel()
+
+	Convey("Failed login tests", t, func() {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+
+		repo, _ := loginattempts.NewPgsqlLoginAttemptsRepository(db)
+		limits := newLoginLimits(interfaces.PortalConfig{})
+		now := time.Now()
+		key := loginKey{key: loginUserKey("admin"), maxAttempts: limits.maxAttempts}
+
+		Convey("Should retry when another instance changed the attempts", func() {
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(1, now.Unix()-10, now.Unix()-9))
+			mock.ExpectExec(updateLoginAttempts).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(2, now.Unix()-10, now.Unix()-8))
+			mock.ExpectExec(updateLoginAttempts).WithArgs(3, now.Unix(), now.Add(4*time.Second).Unix(), key.key, 2).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			previous, attempts, err := limits.recordAttempt(repo, key, now)
+			So(err, ShouldBeNil)
+			So(previous.Failures, ShouldEqual, 2)
+			So(attempts.Failures, ShouldEqual, 3)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should refuse the attempt when another one locked the key first", func() {
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).WillReturnRows(sqlmock.NewRows(loginAttemptsColumns))
+			mock.ExpectExec(insertLoginAttempts).WillReturnError(fmt.Errorf("duplicate key"))
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(1, now.Unix(), now.Add(time.Second).Unix()))
+
+			_, _, err := limits.recordAttempt(repo, key, now)
+			So(err, ShouldHaveSameTypeAs, errLoginLocked{})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should give up when the attempts keep changing", func() {
+			for i := 0; i < loginAttemptsRetries; i++ {
+				mock.ExpectQuery(findLoginAttempts).WillReturnRows(sqlmock.NewRows(loginAttemptsColumns))
+				mock.ExpectExec(insertLoginAttempts).WillReturnError(fmt.Errorf("duplicate key"))
+			}
+
+			_, _, err := limits.recordAttempt(repo, key, now)
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should restore the attempts before a forgotten attempt", func() {
+			previous := &loginattempts.Attempts{Key: key.key, Failures: 2, LastFailure: now.Add(-time.Minute), LockedUntil: now.Add(-time.Minute)}
+			recorded := recordedLoginAttempt{key: key, previous: previous, attempts: limits.nextLoginAttempts(previous, key.key, key.maxAttempts, now)}
+
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(3, now.Unix(), now.Add(4*time.Second).Unix()))
+			mock.ExpectExec(updateLoginAttempts).WithArgs(2, previous.LastFailure.Unix(), previous.LockedUntil.Unix(), key.key, 3).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(limits.forgetAttempt(repo, recorded), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should keep failures recorded since a forgotten attempt", func() {
+			recorded := recordedLoginAttempt{key: key, attempts: limits.nextLoginAttempts(nil, key.key, key.maxAttempts, now)}
+
+			mock.ExpectQuery(findLoginAttempts).WithArgs(key.key).
+				WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(2, now.Unix(), now.Add(2*time.Second).Unix()))
+			mock.ExpectExec(updateLoginAttempts).WithArgs(1, now.Unix(), now.Add(2*time.Second).Unix(), key.key, 2).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(limits.forgetAttempt(repo, recorded), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLoginIPExtractor(t *testing.T) {
+	t.Parallel()
+
+	Convey("Client address tests", t, func() {
+		req := httptest.NewRequest("POST", "/pp/v1/auth/login/uaa", nil)
+		req.RemoteAddr = "10.42.0.7:51234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.4")
+		req.Header.Set("X-Real-IP", "203.0.113.9")
+
+		Convey("Should ignore forwarding headers without trusted proxies", func() {
+			extractor, err := newIPExtractor(nil)
+			So(err, ShouldBeNil)
+			So(extractor(req), ShouldEqual, "10.42.0.7")
+		})
+
+		Convey("Should use the nearest address that isn't a trusted proxy", func() {
+			extractor, err := newIPExtractor([]string{"10.42.0.0/16"})
+			So(err, ShouldBeNil)
+			So(extractor(req), ShouldEqual, "198.51.100.4")
+		})
+
+		Convey("Should ignore forwarding headers from untrusted addresses", func() {
+			extractor, err := newIPExtractor([]string{"10.43.0.0/16"})
+			So(err, ShouldBeNil)
+			So(extractor(req), ShouldEqual, "10.42.0.7")
+		})
+
+		Convey("Should fail for invalid ranges", func() {
+			_, err := newIPExtractor([]string{"10.42.0.7"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -8,9 +8,11 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -27,6 +29,7 @@ import (
 
 	"github.com/epinio/ui/backend/src/jetstream/custombinder"
 	"github.com/epinio/ui/backend/src/jetstream/dex"
+	eInterfaces "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/interfaces"
 	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
 
 	"bitbucket.org/liamstask/goose/lib/goose"
@@ -49,8 +52,11 @@ import (
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces/config"
 	"github.com/epinio/ui/backend/src/jetstream/repository/localusers"
+	"github.com/epinio/ui/backend/src/jetstream/repository/loginattempts"
+	"github.com/epinio/ui/backend/src/jetstream/repository/proxyjobs"
 	"github.com/epinio/ui/backend/src/jetstream/repository/sessiondata"
 	"github.com/epinio/ui/backend/src/jetstream/repository/tokens"
+	"github.com/epinio/ui/backend/src/jetstream/repository/useractivity"
 )
 
 // @title Epinio API
@@ -93,8 +99,12 @@ var (
 	// Clients to use typically for mutating operations - typically allow a longer request timeout
 	httpClientMutating        = http.Client{}
 	httpClientMutatingSkipSSL = http.Client{}
-	// Cached dex client
-	dexClient interfaces.OIDCProvider
+	// Dex clients, per epinio endpoint
+	dexProviders = dex.NewProviderCache()
+	// Dex token refreshes in progress, per endpoint and user
+	dexTokenRefreshes = dex.NewTokenRefreshGroup()
+	// When this instance last recorded the activity of users
+	userActivity = newUserActivityRecorder()
 )
 
 // getEnvironmentLookup return a search path for configuration settings
@@ -183,7 +193,14 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Info("Encryption key set.")
+	if err = setPreviousEncryptionKeys(portalConfig); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Encryption key set (id %s).", crypto.KeyID(portalConfig.EncryptionKeyInBytes))
+
+	if err = setPasswordHasher(portalConfig); err != nil {
+		log.Fatal(err)
+	}
 
 	// Load database configuration
 	var dc datastore.DatabaseConfig
@@ -201,6 +218,9 @@ func main() {
 	localusers.InitRepositoryProvider(dc.DatabaseProvider)
 	sessiondata.InitRepositoryProvider(dc.DatabaseProvider)
 	apikeys.InitRepositoryProvider(dc.DatabaseProvider)
+	loginattempts.InitRepositoryProvider(dc.DatabaseProvider)
+	proxyjobs.InitRepositoryProvider(dc.DatabaseProvider)
+	useractivity.InitRepositoryProvider(dc.DatabaseProvider)
 
 	// Establish a Postgresql connection pool
 	databaseConnectionPool, migratorConf, err := initConnPool(dc, envLookup)
@@ -291,6 +311,39 @@ func main() {
 	}()
 	log.Info("Session data store initialized.")
 
+	// Login Attempts: delete failed logins that no longer count towards a lockout
+	loginAttemptsStore, err := loginattempts.NewPgsqlLoginAttemptsRepository(databaseConnectionPool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	attemptsQuitCleanup, attemptsDoneCleanup := loginAttemptsStore.Cleanup(time.Minute*5, newLoginLimits(portalConfig).lockout)
+	defer func() {
+		log.Info(`... Cleaning up login attempts`)
+		loginAttemptsStore.StopCleanup(attemptsQuitCleanup, attemptsDoneCleanup)
+	}()
+
+	// Proxy Jobs: delete the jobs of long-running requests past their retention
+	proxyJobsStore, err := proxyjobs.NewPgsqlProxyJobsRepository(databaseConnectionPool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobsQuitCleanup, jobsDoneCleanup := proxyJobsStore.Cleanup(time.Minute * 5)
+	defer func() {
+		log.Info(`... Cleaning up proxy jobs`)
+		proxyJobsStore.StopCleanup(jobsQuitCleanup, jobsDoneCleanup)
+	}()
+
+	// User Activity: delete the activity of users whose sessions have all expired
+	userActivityStore, err := useractivity.NewPgsqlUserActivityRepository(databaseConnectionPool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activityQuitCleanup, activityDoneCleanup := userActivityStore.Cleanup(time.Minute * 5)
+	defer func() {
+		log.Info(`... Cleaning up user activity`)
+		userActivityStore.StopCleanup(activityQuitCleanup, activityDoneCleanup)
+	}()
+
 	// Setup the global interface for the proxy
 	portalProxy := newPortalProxy(portalConfig, databaseConnectionPool, sessionStore, sessionStoreOptions, envLookup)
 	portalProxy.SessionDataStore = sessionDataStore
@@ -298,6 +351,18 @@ func main() {
 	store := factory.NewDefaultStoreFactory(databaseConnectionPool)
 	portalProxy.SetStoreFactory(store)
 
+	// Move secrets stored with previous keys, or before authenticated encryption was used, to the current key
+	if portalConfig.CanMigrateDatabaseSchema {
+		go portalProxy.reencryptSecrets()
+	}
+
+	// Token Refresher: refresh the endpoint tokens of active users before they expire
+	refreshQuit, refreshDone := portalProxy.RefreshTokens()
+	defer func() {
+		log.Info(`... Stopping token refresher`)
+		portalProxy.StopRefreshTokens(refreshQuit, refreshDone)
+	}()
+
 	log.Info("Initialization complete.")
 
 	c := make(chan os.Signal, 2)
@@ -308,6 +373,10 @@ func main() {
 		fmt.Println()
 		log.Info("Attempting to shut down gracefully...")
 
+		// Token Refresher, before the database is closed so that the refreshes in progress are stored
+		log.Info(`... Stopping token refresher`)
+		portalProxy.StopRefreshTokens(refreshQuit, refreshDone)
+
 		// Database connection pool
 		log.Info(`... Closing database connection pool`)
 		databaseConnectionPool.Close()
@@ -322,6 +391,18 @@ func main() {
 		log.Info(`... Stopping sessiondata store cleanup`)
 		sessionDataStore.StopCleanup(dataQuitCleanup, dataDoneCleanup)
 
+		// Login Attempts
+		log.Info(`... Stopping login attempts cleanup`)
+		loginAttemptsStore.StopCleanup(attemptsQuitCleanup, attemptsDoneCleanup)
+
+		// Proxy Jobs
+		log.Info(`... Stopping proxy jobs cleanup`)
+		proxyJobsStore.StopCleanup(jobsQuitCleanup, jobsDoneCleanup)
+
+		// User Activity
+		log.Info(`... Stopping user activity cleanup`)
+		userActivityStore.StopCleanup(activityQuitCleanup, activityDoneCleanup)
+
 		// Plugin cleanup
 		for _, plugin := range portalProxy.Plugins {
 			if pCleanup, ok := plugin.(interfaces.StratosPluginCleanup); ok {
@@ -494,6 +575,58 @@ func getEncryptionKey(pc interfaces.PortalConfig) ([]byte, error) {
 	return key, nil
 }
 
+// setPreviousEncryptionKeys configures the keys used before the current key, so that tokens encrypted with them can
+// still be read until they are re-encrypted
+func setPreviousEncryptionKeys(pc interfaces.PortalConfig) error {
+	keys := make([][]byte, 0, len(pc.EncryptionKeysPrevious))
+	for i, hexKey := range pc.EncryptionKeysPrevious {
+		hexKey = strings.TrimSpace(hexKey)
+		if len(hexKey) == 0 {
+			continue
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return fmt.Errorf("Unable to decode previous encryption key %d: %v", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return crypto.SetPreviousKeys(keys)
+}
+
+// setPasswordHasher configures the algorithm and parameters new password hashes are created with. Existing hashes
+// stay valid and are replaced when their users log in
+func setPasswordHasher(pc interfaces.PortalConfig) error {
+	for name, value := range map[string]int64{
+		"PASSWORD_HASH_ARGON2ID_MEMORY_KIB":  pc.PasswordHashArgon2idMemoryKiB,
+		"PASSWORD_HASH_ARGON2ID_ITERATIONS":  pc.PasswordHashArgon2idIterations,
+		"PASSWORD_HASH_ARGON2ID_PARALLELISM": pc.PasswordHashArgon2idParallelism,
+		"PASSWORD_HASH_BCRYPT_COST":          pc.PasswordHashBcryptCost,
+	} {
+		if value < 0 || value > math.MaxUint32 {
+			return fmt.Errorf("Invalid value %d for %s", value, name)
+		}
+	}
+	if pc.PasswordHashArgon2idParallelism > math.MaxUint8 {
+		return fmt.Errorf("Invalid value %d for PASSWORD_HASH_ARGON2ID_PARALLELISM", pc.PasswordHashArgon2idParallelism)
+	}
+
+	hasher, err := crypto.NewPasswordHasher(pc.PasswordHashAlgorithm, crypto.PasswordHashParams{
+		Argon2idMemory:      uint32(pc.PasswordHashArgon2idMemoryKiB),
+		Argon2idIterations:  uint32(pc.PasswordHashArgon2idIterations),
+		Argon2idParallelism: uint8(pc.PasswordHashArgon2idParallelism),
+		BcryptCost:          int(pc.PasswordHashBcryptCost),
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid password hash configuration: %v", err)
+	}
+
+	crypto.SetPasswordHasher(hasher)
+	log.Infof("Password hashing: %s", hasher)
+
+	return nil
+}
+
 func initConnPool(dc datastore.DatabaseConfig, env *env.VarSet) (*sql.DB, *goose.DBConf, error) {
 	log.Debug("initConnPool")
 
@@ -814,6 +947,12 @@ func start(config interfaces.PortalConfig, p *portalProxy, needSetupMiddleware b
 
 	e.Binder = new(custombinder.CustomBinder)
 
+	ipExtractor, err := newIPExtractor(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = ipExtractor
+
 	// Root level middleware
 	if !isUpgrade {
 		e.Use(sessionCleanupMiddleware)
@@ -1016,6 +1155,7 @@ func (p *portalProxy) registerRoutes(e *echo.Echo, needSetupMiddleware bool) {
 
 	loginAuthGroup := pp.Group("/v1/auth")
 	loginAuthGroup.POST("/login/uaa", p.consoleLogin)
+	loginAuthGroup.POST("/login/mfa", p.loginMFA)
 	loginAuthGroup.POST("/logout", p.consoleLogout)
 
 	// SSO Routes will only respond if SSO is enabled
@@ -1048,6 +1188,15 @@ func (p *portalProxy) registerRoutes(e *echo.Echo, needSetupMiddleware bool) {
 	sessionGroup.POST("/api_keys", p.addAPIKey)
 	sessionGroup.GET("/api_keys", p.listAPIKeys)
 	sessionGroup.DELETE("/api_keys", p.deleteAPIKey)
+	sessionGroup.POST("/api_keys/rotate", p.rotateAPIKey)
+
+	// Local users can change their own password
+	sessionGroup.POST("/users/me/password", p.changeOwnPassword)
+	sessionGroup.GET("/users/me/mfa", p.getMFAStatus)
+	sessionGroup.POST("/users/me/mfa", p.enrolMFA)
+	sessionGroup.POST("/users/me/mfa/verify", p.verifyMFA)
+	sessionGroup.POST("/users/me/mfa/recovery_codes", p.regenerateMFARecoveryCodes)
+	sessionGroup.POST("/users/me/mfa/disable", p.disableMFA)
 
 	for _, plugin := range p.Plugins {
 		middlewarePlugin, err := plugin.GetMiddlewarePlugin()
@@ -1075,6 +1224,14 @@ func (p *portalProxy) registerRoutes(e *echo.Echo, needSetupMiddleware bool) {
 	// Connect to Endpoint (SSO)
 	stableAPIGroup.GET("/tokens", p.ssoLoginToCNSI)
 
+	// Requests to endpoints
+	stableAPIGroup.Any("/direct/r/:uuid/*", p.ProxySingleRequest)
+	stableAPIGroup.Any("/proxy/*", p.proxy)
+
+	// Long-running requests to endpoints
+	stableAPIGroup.GET("/jobs/:id", p.getProxyJob)
+	stableAPIGroup.GET("/jobs/:id/response", p.getProxyJobResponse)
+
 	sessionAuthGroup := sessionGroup.Group("/auth")
 
 	// Connect to Endpoint (SSO)
@@ -1103,11 +1260,26 @@ func (p *portalProxy) registerRoutes(e *echo.Echo, needSetupMiddleware bool) {
 	// Proxy single socket request
 	group.Any("/*", p.proxy)
 
+	sessionGroup.GET("/jobs/:id", p.getProxyJob)
+	sessionGroup.GET("/jobs/:id/response", p.getProxyJobResponse)
+
 	// The admin-only routes need to be last as the admin middleware will be
 	// applied to any routes below it's instantiation
 	adminGroup := sessionGroup
 	adminGroup.Use(p.adminMiddleware)
 
+	// Counters published by expvar (cache hits, discovery failures, etc)
+	adminGroup.GET("/metrics", echo.WrapHandler(expvar.Handler()))
+
+	// Local user management
+	adminGroup.GET("/users", p.listLocalUsers)
+	adminGroup.POST("/users", p.createLocalUser)
+	adminGroup.GET("/users/:id", p.getLocalUser)
+	adminGroup.PUT("/users/:id", p.updateLocalUser)
+	adminGroup.DELETE("/users/:id", p.deleteLocalUser)
+	adminGroup.POST("/users/:id/password", p.resetLocalUserPassword)
+	adminGroup.DELETE("/users/:id/mfa", p.resetLocalUserMFA)
+
 	p.PluginRegisterRoutes = make(map[string]func(echo.Context) error)
 
 	for _, plugin := range p.Plugins {
@@ -1313,22 +1485,44 @@ func (portalProxy *portalProxy) SetStoreFactory(f interfaces.StoreFactory) inter
 	return old
 }
 
-func (p *portalProxy) GetDex() (interfaces.OIDCProvider, error) {
-	if dexClient != nil {
-		return dexClient, nil
+// dexSettingsPlugin is implemented by the epinio plugin, which loads and validates the OIDC client settings at start up
+type dexSettingsPlugin interface {
+	DexSettings() *dex.Settings
+}
+
+// dexSettings returns the OIDC client settings of the epinio plugin
+func (p *portalProxy) dexSettings() (*dex.Settings, error) {
+	if plugin, ok := p.GetPlugin(eInterfaces.EndpointType).(dexSettingsPlugin); ok {
+		if settings := plugin.DexSettings(); settings != nil {
+			return settings, nil
+		}
 	}
+	return nil, errors.New("dex is not enabled")
+}
 
-	epinioCnsi, err := epinio_utils.FindEpinioEndpoint(p)
+// GetDex returns the (cached) OIDC provider for the Dex instance of the given Epinio endpoint
+func (p *portalProxy) GetDex(cnsiGUID string) (interfaces.OIDCProvider, error) {
+	epinioCnsi, err := p.GetCNSIRecord(cnsiGUID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find epinio endpoint for dex auth url: %+v", err)
 	}
 
-	metadata, err := epinio_utils.GetMetadata(epinioCnsi)
+	metadata, err := epinio_utils.GetMetadata(&epinioCnsi)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find epinio endpoint for dex auth url: %+v", err)
 	}
 
-	dexClient, err := dex.NewOIDCProviderWithEndpoint(p, context.Background(), epinioCnsi.AuthorizationEndpoint, metadata.DexIssuer, metadata.UIURL)
+	settings, err := p.dexSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes to any of these will invalidate the cached client
+	fingerprint := fmt.Sprintf("%s|%s|%s|%t|%s", epinioCnsi.AuthorizationEndpoint, metadata.DexIssuer, metadata.UIURL, epinioCnsi.SkipSSLValidation, p.Env().String("EPINIO_DEX_SECRET", ""))
+
+	dexClient, err := dexProviders.Get(cnsiGUID, fingerprint, func(ctx context.Context) (*dex.OIDCProvider, error) {
+		return dex.NewOIDCProviderWithEndpoint(p, ctx, settings, epinioCnsi.SkipSSLValidation, epinioCnsi.AuthorizationEndpoint, metadata.DexIssuer, metadata.UIURL)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dex OIDC provider: %+v", err)
 	}
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"expvar"
+)
+
+// Jetstream's counters are published via expvar under a single `jetstream` map, see `/pp/v1/metrics`
+var counters = expvar.NewMap("jetstream")
+
+// Add adds delta to the named counter
+func Add(name string, delta int64) {
+	counters.Add(name, delta)
+}
+
+// Inc increments the named counter
+func Inc(name string) {
+	counters.Add(name, 1)
+}
+
+// Get returns the current value of the named counter
+func Get(name string) int64 {
+	if v, ok := counters.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
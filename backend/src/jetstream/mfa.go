@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/localusers"
+)
+
+const (
+	// Issuer shown by authenticator apps
+	mfaIssuer        = "Epinio"
+	mfaRecoveryCodes = 10
+	// How long a user has to enter their code after their password was accepted
+	mfaPendingLifetime = 5 * time.Minute
+
+	// Session values of a login that is waiting for the second factor
+	mfaUserIDSessionKey   = "mfa_user_id"
+	mfaUsernameSessionKey = "mfa_username"
+	mfaExpirySessionKey   = "mfa_exp"
+)
+
+type mfaStatus struct {
+	Enabled                bool `json:"enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// mfaEnrolment is returned once, when a user starts to enrol. The URI is shown as a QR code
+type mfaEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// mfaRecoveryCodesRes is returned once, only the hashes of the codes are stored
+type mfaRecoveryCodesRes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// mfaRequiredRes is the response to a login with valid credentials that still needs a code
+type mfaRequiredRes struct {
+	MFARequired bool  `json:"mfa_required"`
+	Expiry      int64 `json:"mfa_expiry"`
+}
+
+// newMFARecoveryCodes returns new recovery codes, along with the salt and hashes to store
+func newMFARecoveryCodes() ([]string, string, []string, error) {
+	codes, err := crypto.NewRecoveryCodes(mfaRecoveryCodes)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	saltBytes, err := crypto.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	salt := hex.EncodeToString(saltBytes)
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = crypto.HashRecoveryCode(salt, code)
+	}
+
+	return codes, salt, hashes, nil
+}
+
+// findRecoveryCode returns the index of the hash of the code, -1 if it isn't a remaining recovery code
+func findRecoveryCode(mfa *interfaces.LocalUserMFA, code string) int {
+	if len(crypto.NormalizeRecoveryCode(code)) == 0 {
+		return -1
+	}
+
+	hash := []byte(crypto.HashRecoveryCode(mfa.RecoverySalt, code))
+	found := -1
+	for i, stored := range mfa.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			found = i
+		}
+	}
+	return found
+}
+
+// verifyMFACode checks a TOTP code or, once MFA is enabled, a recovery code and records its use so it can't be used
+// again. Returns the updated MFA of the user, nil if the code is not valid
+func (p *portalProxy) verifyMFACode(localUsersRepo localusers.Repository, mfa *interfaces.LocalUserMFA, code string) (*interfaces.LocalUserMFA, error) {
+	secret, err := crypto.DecryptToken(p.Config.EncryptionKeyInBytes, mfa.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	next := *mfa
+	if step, ok := crypto.VerifyTOTP(secret, code, time.Now(), mfa.LastStep); ok {
+		next.LastStep = step
+	} else if i := findRecoveryCode(mfa, code); mfa.Enabled && i >= 0 {
+		next.RecoveryCodes = append(append([]string{}, mfa.RecoveryCodes[:i]...), mfa.RecoveryCodes[i+1:]...)
+	} else {
+		return nil, nil
+	}
+
+	// Fails if the same code was used by another request in the meantime
+	updated, err := localUsersRepo.UpdateMFAUsage(next, *mfa)
+	if err != nil || !updated {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// currentLocalUser returns the logged in local user and their MFA, nil if they haven't enrolled
+func currentLocalUser(c echo.Context, localUsersRepo localusers.Repository) (interfaces.LocalUser, *interfaces.LocalUserMFA, error) {
+	userGUID, ok := c.Get("user_id").(string)
+	if !ok {
+		return interfaces.LocalUser{}, nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	user, err := localUsersRepo.FindUser(userGUID)
+	if err != nil {
+		return user, nil, interfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Local user not found",
+			"Unable to find local user %s: %v", userGUID, err)
+	}
+
+	mfa, err := localUsersRepo.FindMFA(userGUID)
+	if err != nil {
+		return user, nil, interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to find MFA",
+			"Unable to find MFA of local user %s: %v", userGUID, err)
+	}
+
+	return user, mfa, nil
+}
+
+// checkMFACode verifies the code sent with a request to change the MFA of the logged in user
+func (p *portalProxy) checkMFACode(c echo.Context, localUsersRepo localusers.Repository, user interfaces.LocalUser, mfa *interfaces.LocalUserMFA) (*interfaces.LocalUserMFA, error) {
+	next, err := p.verifyMFACode(localUsersRepo, mfa, c.FormValue("code"))
+	if err != nil {
+		return nil, interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to verify code",
+			"Unable to verify MFA code of local user %s: %v", user.UserGUID, err)
+	}
+	if next == nil {
+		log.Warnf("MFA change of local user `%s` (%s) rejected: invalid code", user.Username, user.UserGUID)
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Code is not correct")
+	}
+	return next, nil
+}
+
+func (p *portalProxy) getMFAStatus(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	_, mfa, err := currentLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	status := mfaStatus{}
+	if mfa != nil && mfa.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesRemaining = len(mfa.RecoveryCodes)
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+// enrolMFA generates a new TOTP secret for the logged in user. MFA is only enabled once a code has been verified
+func (p *portalProxy) enrolMFA(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, mfa, err := currentLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if mfa != nil && mfa.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "MFA is already enabled")
+	}
+
+	secret, err := crypto.NewTOTPSecret()
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to enrol MFA",
+			"Unable to generate TOTP secret: %v", err)
+	}
+
+	encryptedSecret, err := crypto.EncryptToken(p.Config.EncryptionKeyInBytes, secret)
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to enrol MFA",
+			"Unable to encrypt TOTP secret: %v", err)
+	}
+
+	err = localUsersRepo.SaveMFA(interfaces.LocalUserMFA{UserGUID: user.UserGUID, Secret: encryptedSecret})
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to enrol MFA",
+			"Unable to save MFA of local user %s: %v", user.UserGUID, err)
+	}
+
+	log.Infof("Local user `%s` (%s) started MFA enrolment", user.Username, user.UserGUID)
+
+	return c.JSON(http.StatusOK, mfaEnrolment{
+		Secret: secret,
+		URI:    crypto.TOTPURI(mfaIssuer, user.Username, secret),
+	})
+}
+
+// verifyMFA enables MFA for the logged in user, once they have shown they can generate codes
+func (p *portalProxy) verifyMFA(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, mfa, err := currentLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mfa == nil:
+		return echo.NewHTTPError(http.StatusNotFound, "MFA enrolment has not been started")
+	case mfa.Enabled:
+		return echo.NewHTTPError(http.StatusConflict, "MFA is already enabled")
+	}
+
+	next, err := p.checkMFACode(c, localUsersRepo, user, mfa)
+	if err != nil {
+		return err
+	}
+
+	next.Enabled = true
+	return p.saveMFARecoveryCodes(c, localUsersRepo, user, next, "enabled MFA")
+}
+
+// regenerateMFARecoveryCodes replaces the recovery codes of the logged in user
+func (p *portalProxy) regenerateMFARecoveryCodes(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, mfa, err := currentLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if mfa == nil || !mfa.Enabled {
+		return echo.NewHTTPError(http.StatusNotFound, "MFA is not enabled")
+	}
+
+	next, err := p.checkMFACode(c, localUsersRepo, user, mfa)
+	if err != nil {
+		return err
+	}
+
+	return p.saveMFARecoveryCodes(c, localUsersRepo, user, next, "regenerated their MFA recovery codes")
+}
+
+// saveMFARecoveryCodes stores the MFA with new recovery codes and returns the codes
+func (p *portalProxy) saveMFARecoveryCodes(c echo.Context, localUsersRepo localusers.Repository, user interfaces.LocalUser, mfa *interfaces.LocalUserMFA, action string) error {
+	codes, salt, hashes, err := newMFARecoveryCodes()
+	if err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to generate recovery codes",
+			"Unable to generate MFA recovery codes: %v", err)
+	}
+
+	mfa.RecoverySalt = salt
+	mfa.RecoveryCodes = hashes
+	if err = localUsersRepo.SaveMFA(*mfa); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to save MFA",
+			"Unable to save MFA of local user %s: %v", user.UserGUID, err)
+	}
+
+	log.Infof("Local user `%s` (%s) %s", user.Username, user.UserGUID, action)
+
+	return c.JSON(http.StatusOK, mfaRecoveryCodesRes{RecoveryCodes: codes})
+}
+
+// disableMFA removes the second factor of the logged in user. A code is needed unless enrolment wasn't completed
+func (p *portalProxy) disableMFA(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, mfa, err := currentLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if mfa == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "MFA is not enabled")
+	}
+
+	if mfa.Enabled {
+		if _, err = p.checkMFACode(c, localUsersRepo, user, mfa); err != nil {
+			return err
+		}
+	}
+
+	if err = localUsersRepo.DeleteMFA(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to disable MFA",
+			"Unable to delete MFA of local user %s: %v", user.UserGUID, err)
+	}
+
+	log.Infof("Local user `%s` (%s) disabled MFA", user.Username, user.UserGUID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// resetLocalUserMFA lets an admin remove the second factor of a user who has lost their device and recovery codes
+func (p *portalProxy) resetLocalUserMFA(c echo.Context) error {
+	localUsersRepo, err := p.localUsersRepository()
+	if err != nil {
+		return err
+	}
+
+	user, err := findLocalUser(c, localUsersRepo)
+	if err != nil {
+		return err
+	}
+
+	if err = localUsersRepo.DeleteMFA(user.UserGUID); err != nil {
+		return interfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to reset MFA",
+			"Unable to delete MFA of local user %s: %v", user.UserGUID, err)
+	}
+
+	log.Infof("MFA of local user `%s` (%s) reset by %v", user.Username, user.UserGUID, c.Get("user_id"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// loginMFA completes a local login with the second factor
+func (p *portalProxy) loginMFA(c echo.Context) error {
+	auth, ok := p.StratosAuthService.(*localAuth)
+	if !ok {
+		return interfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Local Login is not enabled",
+			"Local Login is not enabled")
+	}
+	return auth.LoginMFA(c)
+}
+
+// startMFALogin stores the user in a short-lived pre-auth session, which doesn't allow access until LoginMFA has
+// verified their code
+func (a *localAuth) startMFALogin(c echo.Context, userGUID string, username string) error {
+	expiry := time.Now().Add(mfaPendingLifetime).Unix()
+
+	// Ensure that login disregards cookies from the request
+	c.Request().Header.Set("Cookie", "")
+	err := a.p.setSessionValues(c, map[string]interface{}{
+		mfaUserIDSessionKey:   userGUID,
+		mfaUsernameSessionKey: username,
+		mfaExpirySessionKey:   expiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Local user `%s` needs to verify MFA code", username)
+
+	jsonString, err := json.Marshal(mfaRequiredRes{MFARequired: true, Expiry: expiry})
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Content-Type", "application/json")
+	c.Response().WriteHeader(http.StatusAccepted)
+	_, err = c.Response().Write(jsonString)
+	return err
+}
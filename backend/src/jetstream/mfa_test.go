@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/localusers"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	updateMFAUsageSQL = `UPDATE local_users_mfa (.+)`
+	insertMFASQL      = `INSERT INTO local_users_mfa (.+)`
+
+	mockMFASecret       = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	mockMFASalt         = "0123456789abcdef"
+	mockMFARecoveryCode = "abcde-fghij"
+)
+
+var mfaColumns = []string{"secret", "enabled", "recovery_salt", "recovery_codes", "last_step"}
+
+// mfaRow returns the MFA of a user with mockMFASecret and mockMFARecoveryCode
+func mfaRow(enabled bool, lastStep int64) sqlmock.Rows {
+	secret, _ := crypto.EncryptToken(mockEncryptionKey, mockMFASecret)
+	return sqlmock.NewRows(mfaColumns).AddRow(base64.StdEncoding.EncodeToString(secret), enabled, mockMFASalt,
+		crypto.HashRecoveryCode(mockMFASalt, mockMFARecoveryCode), lastStep)
+}
+
+func currentMFACode() string {
+	code, _ := crypto.TOTPCode(mockMFASecret, crypto.TOTPStep(time.Now()))
+	return code
+}
+
+func expectSaveMFA(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec(deleteMFASQL).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMFASQL).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestLocalLoginWithMFA(t *testing.T) {
+	t.Parallel()
+
+	Convey("Local MFA login tests", t, func() {
+		userGUID := "user-guid"
+
+		Convey("Should ask for a code after the password", func() {
+			passwordHash, _ := crypto.HashPassword("localuserpass")
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"username": "localuser", "password": "localuserpass"}, "")
+			defer done()
+			initLocalAuth(pp)
+
+			expectLoginAttempt(mock)
+			mock.ExpectQuery(findUserGUID).WillReturnRows(sqlmock.NewRows([]string{"user_guid"}).AddRow(userGUID))
+			mock.ExpectQuery(findPasswordHash).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(passwordHash))
+			mock.ExpectQuery(findUserScope).WillReturnRows(sqlmock.NewRows([]string{"scope"}).AddRow("stratos.admin"))
+			mock.ExpectQuery(findMFA).WithArgs(userGUID).WillReturnRows(mfaRow(true, 0))
+			expectLoginAttemptForgotten(mock, loginUserKey("localuser"))
+			expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+
+			So(pp.StratosAuthService.Login(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusAccepted)
+
+			var body mfaRequiredRes
+			So(json.Unmarshal(res.Body.Bytes(), &body), ShouldBeNil)
+			So(body.MFARequired, ShouldBeTrue)
+
+			// Not logged in yet
+			pending, _ := pp.GetSessionStringValue(ctx, mfaUserIDSessionKey)
+			So(pending, ShouldEqual, userGUID)
+			_, err := pp.GetSessionValue(ctx, "user_id")
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		setupPendingLogin := func(code string, expiry time.Time) (*httptest.ResponseRecorder, echo.Context, *portalProxy, sqlmock.Sqlmock, func()) {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"code": code}, "")
+			initLocalAuth(pp)
+			pp.setSessionValues(ctx, map[string]interface{}{
+				mfaUserIDSessionKey:   userGUID,
+				mfaUsernameSessionKey: "localuser",
+				mfaExpirySessionKey:   expiry.Unix(),
+			})
+			return res, ctx, pp, mock, done
+		}
+
+		Convey("Should log in with a valid code", func() {
+			_, ctx, pp, mock, done := setupPendingLogin(currentMFACode(), time.Now().Add(time.Minute))
+			defer done()
+
+			expectLoginAttempt(mock)
+			mock.ExpectQuery(findMFA).WithArgs(userGUID).WillReturnRows(mfaRow(true, 0))
+			mock.ExpectExec(updateMFAUsageSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(deleteLoginAttempts).WithArgs(loginUserKey("localuser")).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectLoginAttemptForgotten(mock, loginIPKey(ctx))
+			mock.ExpectExec(updateLastLoginTime).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(findSessionVersion).WithArgs(userGUID).WillReturnRows(expectSessionVersionRow(0))
+
+			So(pp.loginMFA(ctx), ShouldBeNil)
+
+			loggedIn, _ := pp.GetSessionStringValue(ctx, "user_id")
+			So(loggedIn, ShouldEqual, userGUID)
+			_, err := pp.GetSessionValue(ctx, mfaUserIDSessionKey)
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should record an invalid code as a failed login", func() {
+			_, ctx, pp, mock, done := setupPendingLogin("000000", time.Now().Add(time.Minute))
+			defer done()
+
+			expectLoginAttempt(mock)
+			mock.ExpectQuery(findMFA).WithArgs(userGUID).WillReturnRows(mfaRow(true, crypto.TOTPStep(time.Now())+1))
+
+			err := pp.loginMFA(ctx)
+			So(err, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(err.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusUnauthorized)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should refuse an expired login", func() {
+			_, ctx, pp, mock, done := setupPendingLogin(currentMFACode(), time.Now().Add(-time.Second))
+			defer done()
+
+			err := pp.loginMFA(ctx)
+			So(err, ShouldHaveSameTypeAs, interfaces.ErrHTTPShadow{})
+			So(err.(interfaces.ErrHTTPShadow).HTTPError.Code, ShouldEqual, http.StatusUnauthorized)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestVerifyMFACode(t *testing.T) {
+	t.Parallel()
+
+	Convey("MFA code tests", t, func() {
+		req := setupMockReq("POST", "", nil)
+		_, _, _, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+
+		repo, _ := localusers.NewPgsqlLocalUsersRepository(db)
+		secret, _ := crypto.EncryptToken(mockEncryptionKey, mockMFASecret)
+		mfa := &interfaces.LocalUserMFA{
+			UserGUID:      "user-guid",
+			Secret:        secret,
+			Enabled:       true,
+			RecoverySalt:  mockMFASalt,
+			RecoveryCodes: []string{"other", crypto.HashRecoveryCode(mockMFASalt, mockMFARecoveryCode)},
+		}
+
+		Convey("Should not accept a code twice", func() {
+			mock.ExpectExec(updateMFAUsageSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			code := currentMFACode()
+			next, err := pp.verifyMFACode(repo, mfa, code)
+			So(err, ShouldBeNil)
+			So(next.LastStep, ShouldBeGreaterThanOrEqualTo, crypto.TOTPStep(time.Now())-1)
+
+			next, err = pp.verifyMFACode(repo, next, code)
+			So(err, ShouldBeNil)
+			So(next, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should use up a recovery code", func() {
+			mock.ExpectExec(updateMFAUsageSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			next, err := pp.verifyMFACode(repo, mfa, " ABCDE-FGHIJ ")
+			So(err, ShouldBeNil)
+			So(next.RecoveryCodes, ShouldResemble, []string{"other"})
+			So(len(mfa.RecoveryCodes), ShouldEqual, 2)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not accept recovery codes before MFA is enabled", func() {
+			mfa.Enabled = false
+			next, err := pp.verifyMFACode(repo, mfa, mockMFARecoveryCode)
+			So(err, ShouldBeNil)
+			So(next, ShouldBeNil)
+		})
+
+		Convey("Should not accept a code used by another request at the same time", func() {
+			mock.ExpectExec(updateMFAUsageSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			next, err := pp.verifyMFACode(repo, mfa, mockMFARecoveryCode)
+			So(err, ShouldBeNil)
+			So(next, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestMFAEnrolment(t *testing.T) {
+	t.Parallel()
+
+	Convey("MFA enrolment tests", t, func() {
+
+		Convey("Should return the secret and URI", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", nil, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findMFA).WillReturnRows(sqlmock.NewRows(mfaColumns))
+			expectSaveMFA(mock)
+
+			So(pp.enrolMFA(ctx), ShouldBeNil)
+
+			var enrolment mfaEnrolment
+			So(json.Unmarshal(res.Body.Bytes(), &enrolment), ShouldBeNil)
+			So(enrolment.Secret, ShouldNotBeEmpty)
+			So(strings.HasPrefix(enrolment.URI, "otpauth://totp/Epinio:user?"), ShouldBeTrue)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not enrol again once enabled", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("POST", "", nil, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findMFA).WillReturnRows(mfaRow(true, 0))
+
+			err := pp.enrolMFA(ctx)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Should enable MFA and return recovery codes", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"code": currentMFACode()}, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findMFA).WillReturnRows(mfaRow(false, 0))
+			mock.ExpectExec(updateMFAUsageSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+			expectSaveMFA(mock)
+
+			So(pp.verifyMFA(ctx), ShouldBeNil)
+
+			var codes mfaRecoveryCodesRes
+			So(json.Unmarshal(res.Body.Bytes(), &codes), ShouldBeNil)
+			So(len(codes.RecoveryCodes), ShouldEqual, mfaRecoveryCodes)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not enable MFA with an invalid code", func() {
+			_, ctx, pp, mock, done := setupHandlerTest("POST", "", map[string]string{"code": "000000"}, "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectQuery(findMFA).WillReturnRows(mfaRow(false, crypto.TOTPStep(time.Now())+1))
+
+			err := pp.verifyMFA(ctx)
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusForbidden)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should let an admin reset the MFA of a user", func() {
+			res, ctx, pp, mock, done := setupHandlerTest("DELETE", "", nil, "admin-guid", "id", "user-guid")
+			defer done()
+			initLocalAuth(pp)
+
+			mock.ExpectQuery(findLocalUserSQL).WillReturnRows(localUserRow("user", "stratos.user"))
+			mock.ExpectExec(deleteMFASQL).WithArgs("user-guid").WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(pp.resetLocalUserMFA(ctx), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNoContent)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
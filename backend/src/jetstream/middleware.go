@@ -30,6 +30,9 @@ const StratosSSOErrorHeader = "x-stratos-sso-error"
 // APIKeySkipperContextKey - name of a context key that indicates that valid API key was supplied
 const APIKeySkipperContextKey = "valid_api_key"
 
+// APIKeyContextKey - name of a context key that holds the API key the request was authenticated with
+const APIKeyContextKey = "api_key"
+
 // APIKeyHeader - API key authentication header name
 const APIKeyHeader = "Authentication"
 
@@ -126,6 +129,18 @@ func (p *portalProxy) sessionMiddlewareWithConfig(config MiddlewareConfig) echo.
 
 			userID, err := p.GetSessionValue(c, "user_id")
 			if err == nil {
+				// Some auth providers expire sessions before the session store does
+				if lifetime, ok := p.StratosAuthService.(interfaces.StratosAuthSessionLifetime); ok {
+					if err = lifetime.VerifySessionActivity(c); err != nil {
+						p.clearSessionCookie(c, false)
+						return handleSessionError(p.Config, c, err, false, "User session has expired")
+					}
+				}
+
+				if userGUID, ok := userID.(string); ok {
+					p.recordUserActivity(c, userGUID)
+				}
+
 				c.Set("user_id", userID)
 				return h(c)
 			}
@@ -243,8 +258,18 @@ func (p *portalProxy) setSecureCacheContentMiddleware(h echo.HandlerFunc) echo.H
 	}
 }
 
+// AdminMiddleware only lets requests from admins through
+func (p *portalProxy) AdminMiddleware() echo.MiddlewareFunc {
+	return p.adminMiddleware
+}
+
 func (p *portalProxy) adminMiddleware(h echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		// API keys need the admin scope (keys without scopes have all the permissions of their user)
+		if apiKey, ok := c.Get(APIKeyContextKey).(*interfaces.APIKey); ok && !apiKey.AllowsAdmin() {
+			return echo.NewHTTPError(http.StatusForbidden, "API key does not have the admin scope")
+		}
+
 		// if user is an admin, passthrough request
 
 		// get the user guid
@@ -363,7 +388,18 @@ func (p *portalProxy) apiKeyMiddleware(h echo.HandlerFunc) echo.HandlerFunc {
 			}
 		}
 
+		if apiKey.IsExpired() {
+			log.Debugf("apiKeyMiddleware: API key %s has expired", apiKey.GUID)
+			return h(c)
+		}
+
+		if err = checkAPIKeyScopes(c, apiKey); err != nil {
+			log.Infof("apiKeyMiddleware: API key %s of user %s rejected: %v", apiKey.GUID, apiKey.UserGUID, err)
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+
 		c.Set(APIKeySkipperContextKey, true)
+		c.Set(APIKeyContextKey, apiKey)
 		c.Set("user_id", apiKey.UserGUID)
 
 		// some endpoints check not only the context store, but also the contents of the session store
@@ -380,6 +416,58 @@ func (p *portalProxy) apiKeyMiddleware(h echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// checkAPIKeyScopes makes sure the request is allowed by the scopes of the key. Admin endpoints are checked by the
+// admin middleware
+func checkAPIKeyScopes(c echo.Context, apiKey *interfaces.APIKey) error {
+	if apiKey.HasScope(interfaces.APIKeyScopeReadOnly) {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			return errors.New("API key is read-only")
+		}
+	}
+
+	if isProxyRequest(c) && !apiKey.AllowsProxy() {
+		return errors.New("API key does not have the proxy scope")
+	}
+
+	for _, cnsiGUID := range requestedCNSIs(c) {
+		if !apiKey.AllowsCNSI(cnsiGUID) {
+			return fmt.Errorf("API key is not allowed to access endpoint %s", cnsiGUID)
+		}
+	}
+
+	return nil
+}
+
+// isProxyRequest is true for the requests passed on to the endpoints (see the /proxy and /direct routes)
+func isProxyRequest(c echo.Context) bool {
+	return strings.Contains(c.Path(), "/proxy/") || strings.Contains(c.Path(), "/direct/r/")
+}
+
+// requestedCNSIs returns the guids of the endpoints the request is for (routes use different params)
+func requestedCNSIs(c echo.Context) []string {
+	id := c.Param("id")
+	if strings.Contains(c.Path(), "/jobs/:id") {
+		// Job ids are not endpoints, findProxyJob checks the endpoint of the job
+		id = ""
+	}
+
+	candidates := []string{c.Param("cnsi_guid"), id, c.Param("uuid"), c.QueryParam("guid")}
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationForm) {
+		candidates = append(candidates, c.FormValue("cnsi_guid"))
+	}
+	candidates = append(candidates, strings.Split(c.Request().Header.Get("x-cap-cnsi-list"), ",")...)
+
+	guids := make([]string, 0, len(candidates))
+	for _, guid := range candidates {
+		if guid = strings.TrimSpace(guid); len(guid) > 0 {
+			guids = append(guids, guid)
+		}
+	}
+	return guids
+}
+
 func (p *portalProxy) apiKeySkipper(c echo.Context) bool {
 	return c.Get(APIKeySkipperContextKey) != nil && c.Get(APIKeySkipperContextKey).(bool) == true
 }
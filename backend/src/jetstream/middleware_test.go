@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/epinio/ui/backend/src/jetstream/repository/apikeys"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
@@ -376,3 +377,194 @@ func Test_apiKeyMiddleware(t *testing.T) {
 		})
 	})
 }
+
+func Test_apiKeyMiddlewareScopes(t *testing.T) {
+	t.Parallel()
+
+	// disabling logging noise
+	log.SetLevel(log.PanicLevel)
+
+	ctrl := gomock.NewController(t)
+	mockAPIRepo := apikeys.NewMockRepository(ctrl)
+	mockStratosAuth := mock_interfaces.NewMockStratosAuth(ctrl)
+	pp := makeMockServer(mockAPIRepo, mockStratosAuth)
+	defer ctrl.Finish()
+	defer pp.DatabaseConnectionPool.Close()
+
+	handlerFunc := func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+
+	middleware := pp.apiKeyMiddleware(handlerFunc)
+	apiKeySecret := "SecretMcSecretface"
+
+	Convey("when API keys are enabled for all users", t, func() {
+		pp.Config.APIKeysEnabled = config.APIKeysConfigEnum.AllUsers
+
+		apiKey := &interfaces.APIKey{
+			UserGUID: "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa",
+			GUID:     "00000000-0000-0000-0000-000000000000",
+		}
+
+		Convey("when the key has expired", func() {
+			ctx, rec := makeNewRequest()
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+
+			expired := time.Now().Add(-time.Minute)
+			apiKey.Expires = &expired
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			err := middleware(ctx)
+
+			Convey("should not set user_id in the context", func() {
+				So(ctx.Get("user_id"), ShouldBeNil)
+			})
+
+			Convey("request should be passed on unauthenticated", func() {
+				So(err, ShouldBeNil)
+				So(rec.Code, ShouldEqual, 200)
+			})
+		})
+
+		Convey("when a read-only key is used to change something", func() {
+			ctx, _ := makeNewRequestWithParams("POST", map[string]string{})
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+
+			apiKey.Scopes = []string{interfaces.APIKeyScopeReadOnly}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			err := middleware(ctx)
+
+			Convey("request should be forbidden", func() {
+				So(err, ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "API key is read-only"))
+				So(ctx.Get("user_id"), ShouldBeNil)
+			})
+		})
+
+		Convey("when a key is used for an endpoint outside its scopes", func() {
+			ctx, _ := makeNewRequest()
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+			ctx.Request().Header.Add("x-cap-cnsi-list", "allowed,other")
+
+			apiKey.Scopes = []string{interfaces.APIKeyScopeCNSIPrefix + "allowed"}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			err := middleware(ctx)
+
+			Convey("request should be forbidden", func() {
+				So(err, ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "API key is not allowed to access endpoint other"))
+			})
+		})
+
+		Convey("when a key without scopes is used for a request to an endpoint", func() {
+			ctx, _ := makeNewRequest()
+			ctx.SetPath("/api/v1/proxy/*")
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+
+			apiKey.Scopes = []string{}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			err := middleware(ctx)
+
+			Convey("request should be forbidden", func() {
+				So(err, ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "API key does not have the proxy scope"))
+				So(ctx.Get("user_id"), ShouldBeNil)
+			})
+		})
+
+		Convey("when a key without scopes is used for a direct request to an endpoint", func() {
+			ctx, _ := makeNewRequest()
+			ctx.SetPath("/api/v1/direct/r/:uuid/*")
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+
+			apiKey.Scopes = []string{}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			err := middleware(ctx)
+
+			Convey("request should be forbidden", func() {
+				So(err, ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "API key does not have the proxy scope"))
+			})
+		})
+
+		Convey("when a key with the proxy scope is used for a request to an endpoint", func() {
+			ctx, rec := makeNewRequestWithParams("POST", map[string]string{})
+			ctx.SetPath("/api/v1/proxy/*")
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+
+			apiKey.Scopes = []string{interfaces.APIKeyScopeProxy}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			mockAPIRepo.
+				EXPECT().
+				UpdateAPIKeyLastUsed(gomock.Eq(apiKey.GUID)).
+				Return(nil)
+
+			err := middleware(ctx)
+
+			Convey("request should be successful", func() {
+				So(err, ShouldBeNil)
+				So(rec.Code, ShouldEqual, 200)
+				So(ctx.Get("user_id"), ShouldEqual, apiKey.UserGUID)
+			})
+		})
+
+		Convey("when a key is used for an endpoint in its scopes", func() {
+			ctx, rec := makeNewRequest()
+			ctx.Request().Header.Add("Authentication", "Bearer "+apiKeySecret)
+			ctx.Request().Header.Add("x-cap-cnsi-list", "allowed")
+
+			apiKey.Scopes = []string{interfaces.APIKeyScopeReadOnly, interfaces.APIKeyScopeCNSIPrefix + "allowed"}
+
+			mockAPIRepo.
+				EXPECT().
+				GetAPIKeyBySecret(gomock.Eq(apiKeySecret)).
+				Return(apiKey, nil)
+
+			mockAPIRepo.
+				EXPECT().
+				UpdateAPIKeyLastUsed(gomock.Eq(apiKey.GUID)).
+				Return(nil)
+
+			err := middleware(ctx)
+
+			Convey("should set the key in the context", func() {
+				So(ctx.Get(APIKeyContextKey), ShouldEqual, apiKey)
+			})
+
+			Convey("request should be successful", func() {
+				So(err, ShouldBeNil)
+				So(rec.Code, ShouldEqual, 200)
+			})
+
+			Convey("admin endpoints should be forbidden", func() {
+				err := pp.adminMiddleware(handlerFunc)(ctx)
+				So(err, ShouldResemble, echo.NewHTTPError(http.StatusForbidden, "API key does not have the admin scope"))
+			})
+		})
+	})
+}
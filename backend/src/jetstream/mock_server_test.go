@@ -19,6 +19,7 @@ import (
 
 	"github.com/epinio/ui/backend/src/jetstream/crypto"
 	"github.com/epinio/ui/backend/src/jetstream/factory"
+	"github.com/epinio/ui/backend/src/jetstream/repository/apikeys"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	"github.com/epinio/ui/backend/src/jetstream/repository/tokens"
 
@@ -179,9 +180,15 @@ func setupPortalProxy(db *sql.DB) *portalProxy {
 	store := factory.NewDefaultStoreFactory(db)
 	pp.SetStoreFactory(store)
 
+	pp.APIKeysRepository, _ = apikeys.NewPgsqlAPIKeysRepository(db)
+
 	return pp
 }
 
+func expectSessionVersionRow(version int64) sqlmock.Rows {
+	return sqlmock.NewRows([]string{"session_version"}).AddRow(version)
+}
+
 func expectNoRows() sqlmock.Rows {
 	return sqlmock.NewRows([]string{"COUNT(*)"}).AddRow("0")
 }
@@ -218,6 +225,23 @@ func expectEncryptedTokenRow(mockEncryptionKey []byte) sqlmock.Rows {
 		AddRow(mockTokenGUID, encryptedUaaToken, encryptedUaaToken, mockTokenExpiry, false, "OAuth2", "", mockUserGUID, nil)
 }
 
+var loginAttemptsColumns = []string{"failures", "last_failure", "locked_until"}
+
+// expectLoginAttempt expects a login attempt to be recorded for a username and a client address without failed logins
+func expectLoginAttempt(mock sqlmock.Sqlmock) {
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(findLoginAttempts).WillReturnRows(sqlmock.NewRows(loginAttemptsColumns))
+		mock.ExpectExec(insertLoginAttempts).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+}
+
+// expectLoginAttemptForgotten expects the login attempt recorded for the key by expectLoginAttempt to be taken back
+func expectLoginAttemptForgotten(mock sqlmock.Sqlmock, key string) {
+	now := time.Now().Unix()
+	mock.ExpectQuery(findLoginAttempts).WithArgs(key).WillReturnRows(sqlmock.NewRows(loginAttemptsColumns).AddRow(1, now, now))
+	mock.ExpectExec(updateLoginAttempts).WithArgs(0, now, now, key, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
 func setupHTTPTest(req *http.Request) (*httptest.ResponseRecorder, *echo.Echo, echo.Context, *portalProxy, *sql.DB, sqlmock.Sqlmock) {
 	res := httptest.NewRecorder()
 	e, ctx := setupEchoContext(res, req)
@@ -230,6 +254,36 @@ func setupHTTPTest(req *http.Request) (*httptest.ResponseRecorder, *echo.Echo, e
 	return res, e, ctx, pp, db, mock
 }
 
+// setupHandlerTest sets up the test of a handler called by the given user (none if empty), with path parameters given as
+// name and value pairs. done closes the mock database
+func setupHandlerTest(method, url string, formValues map[string]string, userID string, params ...string) (*httptest.ResponseRecorder, echo.Context, *portalProxy, sqlmock.Sqlmock, func()) {
+	req := setupMockReq(method, url, formValues)
+	res, _, ctx, pp, db, mock := setupHTTPTest(req)
+
+	if len(userID) > 0 {
+		ctx.Set("user_id", userID)
+	}
+	if len(params) > 0 {
+		var names, values []string
+		for i := 0; i+1 < len(params); i += 2 {
+			names = append(names, params[i])
+			values = append(values, params[i+1])
+		}
+		ctx.SetParamNames(names...)
+		ctx.SetParamValues(values...)
+	}
+
+	return res, ctx, pp, mock, func() { db.Close() }
+}
+
+// initLocalAuth switches the portal proxy to local users
+func initLocalAuth(pp *portalProxy) {
+	pp.Config.ConsoleConfig.AuthEndpointType = string(interfaces.Local)
+	if err := pp.InitStratosAuthService(interfaces.AuthEndpointTypes[pp.Config.ConsoleConfig.AuthEndpointType]); err != nil {
+		log.Fatalf("Could not initialise auth service: %v", err)
+	}
+}
+
 func msRoute(route string) mockServerFunc {
 	return func(ms *mockServer) {
 		ms.Route = route
@@ -312,7 +366,19 @@ const (
 	findPasswordHash    = `SELECT password_hash FROM local_users WHERE (.+)`
 	findUserScope       = `SELECT user_scope FROM local_users WHERE (.+)`
 	updateLastLoginTime = `UPDATE local_users (.+)`
+	updatePasswordHash  = `UPDATE local_users SET password_hash(.+)`
 	findLastLoginTime   = `SELECT last_login FROM local_users WHERE (.+)`
+	findMFA             = `SELECT secret, enabled, (.+) FROM local_users_mfa WHERE (.+)`
+	findSessionVersion  = `SELECT session_version FROM local_users WHERE (.+)`
+	revokeSessions      = `UPDATE local_users SET session_version (.+)`
+	findLoginAttempts   = `SELECT failures, last_failure, locked_until FROM login_attempts WHERE (.+)`
+	insertLoginAttempts = `INSERT INTO login_attempts (.+)`
+	updateLoginAttempts = `UPDATE login_attempts (.+)`
+	deleteLoginAttempts = `DELETE FROM login_attempts WHERE (.+)`
+	findProxyJob        = `SELECT user_guid, (.+) FROM proxy_jobs WHERE (.+)`
+	insertProxyJob      = `INSERT INTO proxy_jobs (.+)`
+	finishProxyJob      = `UPDATE proxy_jobs SET (.+)`
+	countRunningJobs    = `SELECT COUNT\(\*\) FROM proxy_jobs WHERE (.+)`
 	getDbVersion        = `SELECT version_id FROM goose_db_version WHERE is_applied = '1' ORDER BY id DESC LIMIT 1`
 )
 
@@ -44,13 +44,29 @@ func (p *portalProxy) OAuthHandlerFunc(cnsiRequest *interfaces.CNSIRequest, req
 				return res, errors.New("failed to authorize")
 			}
 
+			// A streamed request body has been sent and can't be sent again. Refresh the token for the next request
+			// and leave retrying to the client
+			if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+				if _, err := refreshOAuthTokenFunc(cnsi.SkipSSLValidation, cnsiRequest.GUID, cnsiRequest.UserGUID, cnsi.ClientId, cnsi.ClientSecret, cnsi.TokenEndpoint); err != nil {
+					log.Info(err)
+				}
+				return res, nil
+			}
+
 			if bodyReader := res.Body; bodyReader != nil {
 				var body []byte
 				if body, err = ioutil.ReadAll(bodyReader); err != nil {
 					return nil, errors.New("failed to read request body")
 				}
 				log.Debugf("Failed to authorize: %+v", string(body))
+				bodyReader.Close()
+			}
 
+			// Send the same body again
+			if req.GetBody != nil {
+				if req.Body, err = req.GetBody(); err != nil {
+					return nil, fmt.Errorf("failed to resend request body: %v", err)
+				}
 			}
 
 			got401 = true
@@ -10,7 +10,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -28,9 +30,141 @@ const (
 )
 
 // Timeout for long-running requests, after which we will return indicating request it still active
-// to prevent hitting the 2 minute browser timeout
+// to prevent hitting the 2 minute browser timeout. The request continues as a job (see startProxyJob)
 const longRunningRequestTimeout = 30
 
+// Size limits of proxied bodies in MB, see PROXY_MAX_*_BODY_MB. Bodies proxied by ProxySingleRequest are streamed,
+// bodies of ProxyRequest (which aggregates the responses of several endpoints into one JSON document) are held in
+// memory
+const (
+	defaultProxyMaxStreamedBodyMB = 1024
+	defaultProxyMaxBufferedBodyMB = 64
+)
+
+var errProxyBodyTooLarge = errors.New("body exceeds the size limit")
+
+// proxyBodyLimits are the size limits of proxied bodies in bytes, 0 if not limited
+type proxyBodyLimits struct {
+	request  int64
+	response int64
+	buffered int64
+}
+
+func newProxyBodyLimits(pc interfaces.PortalConfig) proxyBodyLimits {
+	return proxyBodyLimits{
+		request:  int64(limitOrDefault(pc.ProxyMaxRequestBodyMB, defaultProxyMaxStreamedBodyMB)) << 20,
+		response: int64(limitOrDefault(pc.ProxyMaxResponseBodyMB, defaultProxyMaxStreamedBodyMB)) << 20,
+		buffered: int64(limitOrDefault(pc.ProxyMaxBufferedBodyMB, defaultProxyMaxBufferedBodyMB)) << 20,
+	}
+}
+
+// limitedBody reads a body and fails with errProxyBodyTooLarge once more than limit bytes (if > 0) have been read
+type limitedBody struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded atomic.Bool
+}
+
+func newLimitedBody(r io.Reader, limit int64) *limitedBody {
+	return &limitedBody{r: r, limit: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.limit > 0 && b.read > b.limit {
+		b.exceeded.Store(true)
+		return n, errProxyBodyTooLarge
+	}
+	return n, err
+}
+
+// Exceeded returns true if the body was larger than the limit. Safe to call while the body is being read
+func (b *limitedBody) Exceeded() bool {
+	return b.exceeded.Load()
+}
+
+// readLimitedBody reads a body that is held in memory
+func readLimitedBody(r io.Reader, limit int64) ([]byte, error) {
+	return ioutil.ReadAll(newLimitedBody(r, limit))
+}
+
+// Upstream response headers forwarded by ProxySingleRequest if PROXY_RESPONSE_HEADERS is not set. Conditional and
+// range requests are passed to the endpoint as they are, these headers let the client use the 304 and 206 responses
+var defaultProxyResponseHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Retry-After",
+	"Vary",
+}
+
+// Hop-by-hop headers (RFC 7230 section 6.1) describe the connection to the endpoint and are never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxyResponseHeaders returns the canonical names of the upstream response headers to forward, nil if all headers
+// are forwarded ("*")
+func proxyResponseHeaders(pc interfaces.PortalConfig) map[string]bool {
+	names := defaultProxyResponseHeaders
+	if len(strings.TrimSpace(pc.ProxyResponseHeaders)) > 0 {
+		names = strings.Split(pc.ProxyResponseHeaders, ",")
+	}
+
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			return nil
+		}
+		if len(name) > 0 {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return allowed
+}
+
+// copyProxyResponseHeaders copies the allowed upstream response headers. Hop-by-hop headers (including the ones named
+// in the Connection header), cookies and CORS headers are never copied, even if all headers are allowed
+func copyProxyResponseHeaders(dst, src http.Header, allowed map[string]bool) {
+	skip := make(map[string]bool)
+	for _, name := range hopByHopHeaders {
+		skip[name] = true
+	}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for k, v := range src {
+		k = http.CanonicalHeaderKey(k)
+		switch {
+		case skip[k], k == "Set-Cookie", strings.HasPrefix(k, "Access-Control-"):
+		case allowed == nil || allowed[k]:
+			dst[k] = append([]string(nil), v...)
+		}
+	}
+}
+
 type PassthroughErrorStatus struct {
 	StatusCode int    `json:"statusCode"`
 	Status     string `json:"status"`
@@ -83,13 +217,20 @@ func getPortalUserGUID(c echo.Context) (string, error) {
 	return portalUserGUIDIntf.(string), nil
 }
 
-func getRequestParts(c echo.Context) (*http.Request, []byte, error) {
+// getRequestParts reads the request body into memory. Fails with errProxyBodyTooLarge if the body is larger than limit
+// (if > 0)
+func getRequestParts(c echo.Context, limit int64) (*http.Request, []byte, error) {
 	log.Debug("getRequestParts")
 	var body []byte
 	var err error
 	req := c.Request()
+	if limit > 0 && req.ContentLength > limit {
+		return nil, nil, errProxyBodyTooLarge
+	}
 	if bodyReader := req.Body; bodyReader != nil {
-		if body, err = ioutil.ReadAll(bodyReader); err != nil {
+		if body, err = readLimitedBody(bodyReader, limit); err == errProxyBodyTooLarge {
+			return nil, nil, err
+		} else if err != nil {
 			return nil, nil, errors.New("Failed to read request body")
 		}
 	}
@@ -248,8 +389,10 @@ func (p *portalProxy) ProxyRequest(c echo.Context, uri *url.URL) (map[string]*in
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	req, body, err := getRequestParts(c)
-	if err != nil {
+	req, body, err := getRequestParts(c, newProxyBodyLimits(p.Config).buffered)
+	if err == errProxyBodyTooLarge {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body is too large")
+	} else if err != nil {
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
@@ -266,6 +409,9 @@ func (p *portalProxy) ProxyRequest(c echo.Context, uri *url.URL) (map[string]*in
 			err := errors.New("Requested long-running proxy to multiple CNSIs. Only single CNSI is supported for long running passthrough")
 			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
+		if err := p.checkProxyJobLimit(portalUserGUID); err != nil {
+			return nil, err
+		}
 	}
 
 	// send the request to each CNSI
@@ -303,53 +449,18 @@ func (p *portalProxy) ProxyRequest(c echo.Context, uri *url.URL) (map[string]*in
 			responses[res.GUID] = res
 		}
 	} else {
-		// Long running has a timeout
-		for range cnsiList {
-			select {
-			case res := <-done:
-				responses[res.GUID] = res
-			case <-time.After(longRunningRequestTimeout * time.Second):
-				// For all those that have not completed, add a timeout response
-				for _, id := range cnsiList {
-					if _, ok := responses[id]; !ok {
-						// Did not get a response for the endpoint
-						responses[id] = &interfaces.CNSIRequest{
-							GUID:         id,
-							UserGUID:     portalUserGUID,
-							Method:       req.Method,
-							StatusCode:   http.StatusAccepted,
-							Status:       "Long Running Operation still active",
-							Response:     makeLongRunningTimeoutError(),
-							Error:        nil,
-							ResponseGUID: id,
-						}
-					}
-				}
-				break
-			}
+		// Long running requests continue as a job once the client has waited for longRunningRequestTimeout
+		select {
+		case res := <-done:
+			responses[res.GUID] = res
+		case <-time.After(longRunningRequestTimeout * time.Second):
+			responses[cnsiList[0]] = p.startProxyJob(c, portalUserGUID, cnsiList[0], req.Method, uri, shouldPassthrough, done)
 		}
 	}
 
 	return responses, nil
 }
 
-func makeLongRunningTimeoutError() []byte {
-	description := "Long Running Operation still active"
-	var errorStatus = &PassthroughErrorStatus{
-		StatusCode: http.StatusAccepted,
-		Status:     description,
-	}
-	errorResponse := []byte(fmt.Sprint("{\"longRunningTimeout\": true, \"description\": \"" + description + "\", \"error_code\": \"longRunningTimeout\"}"))
-	passthroughError := &PassthroughError{}
-	passthroughError.Error = errorStatus
-	passthroughError.ErrorResponse = (*json.RawMessage)(&errorResponse)
-	res, e := json.Marshal(passthroughError)
-	if e != nil {
-		log.Errorf("makeLongRunningTimeoutError: could not marshal JSON: %+v", e)
-	}
-	return res
-}
-
 // TODO: This should be used by the function above
 func (p *portalProxy) DoProxyRequest(requests []interfaces.ProxyRequestInfo) (map[string]*interfaces.CNSIRequest, error) {
 	log.Debug("DoProxyRequest")
@@ -428,7 +539,10 @@ func (p *portalProxy) DoProxySingleRequestWithToken(cnsiGUID string, token *inte
 
 func (p *portalProxy) SendProxiedResponse(c echo.Context, responses map[string]*interfaces.CNSIRequest) error {
 	shouldPassthrough := "true" == c.Request().Header.Get("x-cap-passthrough")
+	return sendProxiedResponse(c, responses, shouldPassthrough)
+}
 
+func sendProxiedResponse(c echo.Context, responses map[string]*interfaces.CNSIRequest, shouldPassthrough bool) error {
 	var cnsiList []string
 	for k := range responses {
 		cnsiList = append(cnsiList, k)
@@ -469,7 +583,9 @@ func (p *portalProxy) doRequest(cnsiRequest *interfaces.CNSIRequest, done chan<-
 	var req *http.Request
 	var err error
 
-	if len(cnsiRequest.Body) > 0 {
+	if cnsiRequest.BodyReader != nil {
+		body = cnsiRequest.BodyReader
+	} else if len(cnsiRequest.Body) > 0 {
 		body = bytes.NewReader(cnsiRequest.Body)
 	}
 
@@ -483,6 +599,9 @@ func (p *portalProxy) doRequest(cnsiRequest *interfaces.CNSIRequest, done chan<-
 		}
 		return
 	}
+	if cnsiRequest.BodyReader != nil && cnsiRequest.ContentLength > 0 {
+		req.ContentLength = cnsiRequest.ContentLength
+	}
 
 	var tokenRec interfaces.TokenRecord
 	if cnsiRequest.Token != nil {
@@ -522,12 +641,19 @@ func (p *portalProxy) doRequest(cnsiRequest *interfaces.CNSIRequest, done chan<-
 		cnsiRequest.Status = "Error proxing request"
 		cnsiRequest.Response = []byte(err.Error())
 		cnsiRequest.Error = err
+		if res != nil && res.Body != nil {
+			res.Body.Close()
+		}
 	} else if res.Body != nil {
 		cnsiRequest.StatusCode = res.StatusCode
 		cnsiRequest.Status = res.Status
 		cnsiRequest.ResponseHeader = res.Header
-		cnsiRequest.Response, cnsiRequest.Error = ioutil.ReadAll(res.Body)
-		defer res.Body.Close()
+		if cnsiRequest.StreamResponse {
+			cnsiRequest.ResponseBody = res.Body
+		} else {
+			cnsiRequest.Response, cnsiRequest.Error = readLimitedBody(res.Body, newProxyBodyLimits(p.Config).buffered)
+			defer res.Body.Close()
+		}
 	}
 
 	// If Status Code >=400, log this as a warning
@@ -569,13 +695,14 @@ func (p *portalProxy) ProxySingleRequest(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	req, body, err := getRequestParts(c)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	limits := newProxyBodyLimits(p.Config)
+	req := c.Request()
+	if limits.request > 0 && req.ContentLength > limits.request {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body is too large")
 	}
 
 	done := make(chan *interfaces.CNSIRequest)
-	cnsiRequest, buildErr := p.buildCNSIRequest(cnsi, portalUserGUID, req.Method, &uri, body, header)
+	cnsiRequest, buildErr := p.buildCNSIRequest(cnsi, portalUserGUID, req.Method, &uri, nil, header)
 	if buildErr != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, buildErr.Error())
 	}
@@ -591,19 +718,61 @@ func (p *portalProxy) ProxySingleRequest(c echo.Context) error {
 		}
 	}
 
+	// Stream the bodies in both directions, so that uploads and downloads don't need to fit into memory
+	var body *limitedBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = newLimitedBody(req.Body, limits.request)
+		cnsiRequest.BodyReader = body
+		cnsiRequest.ContentLength = req.ContentLength
+	}
+	cnsiRequest.StreamResponse = true
+
 	go p.doRequest(&cnsiRequest, done)
 	res := <-done
 
+	if res.ResponseBody != nil {
+		defer res.ResponseBody.Close()
+	}
+
+	if body != nil && body.Exceeded() {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body is too large")
+	}
+
+	if res.ResponseBody != nil && limits.response > 0 {
+		if length, err := strconv.ParseInt(res.ResponseHeader.Get("content-length"), 10, 64); err == nil && length > limits.response {
+			log.Warnf("Passthrough response: URL: %s, length %d exceeds the limit of %d bytes", res.URL.String(), length, limits.response)
+			return echo.NewHTTPError(http.StatusBadGateway, "Response body is too large")
+		}
+	}
+
+	if res.StatusCode == 0 {
+		// The request could not be sent
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to proxy request")
+	}
+
 	// Copy content-length header from original response header
 	c.Response().Header().Set("proxy-content-length", res.ResponseHeader.Get("content-length"))
+	copyProxyResponseHeaders(c.Response().Header(), res.ResponseHeader, proxyResponseHeaders(p.Config))
 
-	// FIXME: cnsiRequest.Status info is lost for failures, only get a status code
+	// The reason phrase of the status line can't be set, pass on the status of the endpoint (or the reason the request
+	// failed) in a header instead
+	c.Response().Header().Set("proxy-status", res.Status)
 	c.Response().WriteHeader(res.StatusCode)
 
-	// we don't care if this fails
-	_, writeErr := c.Response().Write(res.Response)
-	if writeErr != nil {
-		log.Errorf("Failed to write passthrough response %v", err)
+	if res.ResponseBody == nil {
+		// we don't care if this fails
+		_, writeErr := c.Response().Write(res.Response)
+		if writeErr != nil {
+			log.Errorf("Failed to write passthrough response %v", writeErr)
+		}
+		return nil
+	}
+
+	if _, err = io.Copy(c.Response(), newLimitedBody(res.ResponseBody, limits.response)); err != nil {
+		// The status has been sent already. Abort the connection, so that the client doesn't take the truncated body
+		// for the whole response
+		log.Errorf("Failed to stream passthrough response from %s: %v", res.URL.String(), err)
+		panic(http.ErrAbortHandler)
 	}
 
 	return nil
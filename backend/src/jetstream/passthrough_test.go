@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/labstack/echo/v4"
 	. "github.com/smartystreets/goconvey/convey"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
@@ -205,7 +212,7 @@ func TestPassthroughGetRequestParts(t *testing.T) {
 		_, _, ctx, _, db, _ := setupHTTPTest(req)
 		defer db.Close()
 
-		_, _, err := getRequestParts(ctx)
+		_, _, err := getRequestParts(ctx, 0)
 
 		So(err, ShouldBeNil)
 	})
@@ -308,3 +315,222 @@ func TestValidateCNSIListWithInvalidGUID(t *testing.T) {
 	})
 
 }
+
+// newDirectProxyRequest returns a request to the direct proxy of the test endpoint
+func newDirectProxyRequest(method string, body io.Reader, contentLength int64) *http.Request {
+	req := httptest.NewRequest(method, "/pp/v1/direct/r/"+mockCFGUID+"/upload", body)
+	req.ContentLength = contentLength
+	req.Header.Set(noTokenHeader, "true")
+	return req
+}
+
+// setupDirectProxyTest sets up the request to the direct proxy of an endpoint served by the handler
+func setupDirectProxyTest(req *http.Request, handler http.HandlerFunc) (*httptest.ResponseRecorder, *portalProxy, sqlmock.Sqlmock, func() error, func()) {
+	server := httptest.NewTLSServer(handler)
+
+	res, _, ctx, pp, db, mock := setupHTTPTest(req)
+	ctx.SetParamNames("uuid", "*")
+	ctx.SetParamValues(mockCFGUID, "upload")
+	ctx.Set("user_id", mockUserGUID)
+
+	endpointRow := func() sqlmock.Rows {
+		return sqlmock.NewRows(rowFieldsForCNSI).
+			AddRow(mockCFGUID, "Some fancy Cluster", "epinio", server.URL, mockAuthEndpoint, mockAuthEndpoint, "", true, mockClientId, cipherClientSecret, false, "", "")
+	}
+	mock.ExpectQuery(selectAnyFromCNSIs).WillReturnRows(endpointRow())
+	mock.ExpectQuery(selectAnyFromCNSIs).WillReturnRows(endpointRow())
+
+	return res, pp, mock, func() error { return pp.ProxySingleRequest(ctx) }, func() {
+		db.Close()
+		server.Close()
+	}
+}
+
+func TestProxySingleRequestStreams(t *testing.T) {
+	t.Parallel()
+
+	Convey("Direct proxy tests", t, func() {
+		upload := bytes.Repeat([]byte("a"), 3<<20)
+
+		Convey("Should stream the request and response bodies", func() {
+			var contentLength int64
+			res, _, mock, proxy, done := setupDirectProxyTest(newDirectProxyRequest("POST", bytes.NewReader(upload), int64(len(upload))), func(w http.ResponseWriter, r *http.Request) {
+				received, _ := ioutil.ReadAll(r.Body)
+				contentLength = r.ContentLength
+				w.WriteHeader(http.StatusCreated)
+				w.Write(received)
+			})
+			defer done()
+
+			So(proxy(), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusCreated)
+			So(contentLength, ShouldEqual, len(upload))
+			So(res.Body.Len(), ShouldEqual, len(upload))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should refuse request bodies over the limit", func() {
+			_, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("POST", bytes.NewReader(upload), int64(len(upload))), func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Request should not have been proxied")
+			})
+			defer done()
+			pp.Config.ProxyMaxRequestBodyMB = 2
+
+			err := proxy()
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+
+		Convey("Should stop streaming request bodies of unknown length at the limit", func() {
+			_, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("POST", bytes.NewReader(upload), -1), func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+			})
+			defer done()
+			pp.Config.ProxyMaxRequestBodyMB = 2
+
+			err := proxy()
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+
+		Convey("Should refuse response bodies over the limit", func() {
+			_, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("POST", nil, 0), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(upload)))
+				w.Write(upload)
+			})
+			defer done()
+			pp.Config.ProxyMaxResponseBodyMB = 2
+
+			err := proxy()
+			So(err.(*echo.HTTPError).Code, ShouldEqual, http.StatusBadGateway)
+		})
+
+		Convey("Should abort response bodies of unknown length at the limit", func() {
+			_, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("POST", nil, 0), func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 3; i++ {
+					w.Write(upload[:1<<20])
+					w.(http.Flusher).Flush()
+				}
+			})
+			defer done()
+			pp.Config.ProxyMaxResponseBodyMB = 2
+
+			So(func() { proxy() }, ShouldPanicWith, http.ErrAbortHandler)
+		})
+	})
+}
+
+func TestProxySingleRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	Convey("Direct proxy response headers", t, func() {
+		content := []byte("0123456789")
+		endpoint := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "hop")
+			w.Header().Set("X-Custom", "custom")
+			w.Header().Set("Set-Cookie", "session=upstream")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Content-Disposition", `attachment; filename="app.tar"`)
+			http.ServeContent(w, r, "app.tar", time.Unix(0, 0), bytes.NewReader(content))
+		}
+		etagEndpoint := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			endpoint(w, r)
+		}
+
+		Convey("Should forward the allowed headers and the status", func() {
+			res, _, mock, proxy, done := setupDirectProxyTest(newDirectProxyRequest("GET", nil, 0), etagEndpoint)
+			defer done()
+
+			So(proxy(), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusOK)
+			So(res.Header().Get("proxy-status"), ShouldEqual, "200 OK")
+			So(res.Header().Get("Content-Type"), ShouldEqual, "application/x-tar")
+			So(res.Header().Get("Content-Length"), ShouldEqual, "10")
+			So(res.Header().Get("ETag"), ShouldEqual, `"v1"`)
+			So(res.Header().Get("Cache-Control"), ShouldEqual, "no-cache")
+			So(res.Header().Get("Content-Disposition"), ShouldEqual, `attachment; filename="app.tar"`)
+			So(res.Header().Get("X-Custom"), ShouldBeEmpty)
+			So(res.Header().Get("Set-Cookie"), ShouldBeEmpty)
+			So(res.Body.String(), ShouldEqual, string(content))
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should forward all headers but hop-by-hop headers, cookies and CORS headers if configured", func() {
+			res, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("GET", nil, 0), etagEndpoint)
+			defer done()
+			pp.Config.ProxyResponseHeaders = "*"
+
+			So(proxy(), ShouldBeNil)
+			So(res.Header().Get("X-Custom"), ShouldEqual, "custom")
+			So(res.Header().Get("ETag"), ShouldEqual, `"v1"`)
+			So(res.Header().Get("Connection"), ShouldBeEmpty)
+			So(res.Header().Get("X-Hop"), ShouldBeEmpty)
+			So(res.Header().Get("Set-Cookie"), ShouldBeEmpty)
+			So(res.Header().Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+		})
+
+		Convey("Should forward the configured headers only", func() {
+			res, pp, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("GET", nil, 0), etagEndpoint)
+			defer done()
+			pp.Config.ProxyResponseHeaders = "x-custom, content-type"
+
+			So(proxy(), ShouldBeNil)
+			So(res.Header().Get("X-Custom"), ShouldEqual, "custom")
+			So(res.Header().Get("Content-Type"), ShouldEqual, "application/x-tar")
+			So(res.Header().Get("ETag"), ShouldBeEmpty)
+		})
+
+		Convey("Should pass on conditional requests", func() {
+			req := newDirectProxyRequest("GET", nil, 0)
+			req.Header.Set("If-None-Match", `"v1"`)
+			res, _, _, proxy, done := setupDirectProxyTest(req, etagEndpoint)
+			defer done()
+
+			So(proxy(), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNotModified)
+			So(res.Header().Get("ETag"), ShouldEqual, `"v1"`)
+			So(res.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Should pass on range requests", func() {
+			req := newDirectProxyRequest("GET", nil, 0)
+			req.Header.Set("Range", "bytes=2-5")
+			res, _, _, proxy, done := setupDirectProxyTest(req, endpoint)
+			defer done()
+
+			So(proxy(), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusPartialContent)
+			So(res.Header().Get("proxy-status"), ShouldEqual, "206 Partial Content")
+			So(res.Header().Get("Content-Range"), ShouldEqual, "bytes 2-5/10")
+			So(res.Header().Get("Accept-Ranges"), ShouldEqual, "bytes")
+			So(res.Body.String(), ShouldEqual, "2345")
+		})
+
+		Convey("Should pass on the reason requests failed", func() {
+			res, _, _, proxy, done := setupDirectProxyTest(newDirectProxyRequest("GET", nil, 0), func(w http.ResponseWriter, r *http.Request) {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			})
+			defer done()
+
+			So(proxy(), ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusInternalServerError)
+			So(res.Header().Get("proxy-status"), ShouldEqual, "Error proxing request")
+		})
+	})
+}
+
+func TestPassthroughBufferedLimit(t *testing.T) {
+	t.Parallel()
+
+	Convey("Request bodies held in memory are limited", t, func() {
+		req := httptest.NewRequest("POST", "/pp/v1/proxy/info", bytes.NewReader(make([]byte, 2048)))
+		req.ContentLength = -1
+		_, _, ctx, _, db, _ := setupHTTPTest(req)
+		defer db.Close()
+
+		_, _, err := getRequestParts(ctx, 1024)
+		So(err, ShouldEqual, errProxyBodyTooLarge)
+	})
+}
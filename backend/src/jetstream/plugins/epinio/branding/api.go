@@ -0,0 +1,185 @@
+package branding
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+// AssetInfo describes a stored asset, without its content
+type AssetInfo struct {
+	Hostname    string `json:"hostname"`
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	ETag        string `json:"etag"`
+	URL         string `json:"url"`
+}
+
+// ServeAsset serves an asset for the hostname of the request (public)
+// /rancher/branding/:asset
+func ServeAsset(ec echo.Context, p jInterfaces.PortalProxy) error {
+	assets, err := GetAssets(p, Hostname(ec))
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to fetch branding",
+			"Unable to fetch branding: %v", err)
+	}
+
+	asset, ok := assets[ec.Param("asset")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Branding asset not found")
+	}
+
+	etag := fmt.Sprintf(`"%s"`, asset.ETag)
+	header := ec.Response().Header()
+	header.Set("ETag", etag)
+	if ec.QueryParam("v") == asset.ETag {
+		// The url changes with the content
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		header.Set("Cache-Control", "public, max-age=300")
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Uploaded SVGs may carry scripts or event handlers, never run them in the origin of the UI
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+
+	for _, match := range strings.Split(ec.Request().Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return ec.NoContent(http.StatusNotModified)
+		}
+	}
+
+	return ec.Blob(http.StatusOK, asset.ContentType, asset.Content)
+}
+
+// ListAssets lists the assets stored for a hostname (admin)
+// /epinio/branding?hostname=
+func ListAssets(ec echo.Context, p jInterfaces.PortalProxy) error {
+	hostname := hostnameParam(ec)
+
+	store, err := getStore(p)
+	if err != nil {
+		return err
+	}
+
+	assets, err := store.List(hostname)
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to fetch branding",
+			"Unable to fetch branding: %v", err)
+	}
+
+	infos := make([]AssetInfo, len(assets))
+	for i, asset := range assets {
+		infos[i] = AssetInfo{
+			Hostname:    asset.Hostname,
+			Key:         asset.Key,
+			ContentType: asset.ContentType,
+			Size:        len(asset.Content),
+			ETag:        asset.ETag,
+			URL:         AssetURL(asset),
+		}
+	}
+
+	return ec.JSON(http.StatusOK, infos)
+}
+
+// UploadAsset stores the request body as an asset for a hostname (admin)
+// /epinio/branding/:asset?hostname=
+func UploadAsset(ec echo.Context, p jInterfaces.PortalProxy) error {
+	hostname := hostnameParam(ec)
+	key := ec.Param("asset")
+
+	definition, ok := assetDefinitions[key]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown branding asset")
+	}
+
+	defer ec.Request().Body.Close()
+	// Read one byte more than allowed, so that oversized uploads are rejected rather than truncated
+	content, err := io.ReadAll(io.LimitReader(ec.Request().Body, int64(definition.maxSize)+1))
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Unable to read branding asset",
+			"Unable to read branding asset: %v", err)
+	}
+
+	asset, err := NewAsset(hostname, key, ec.Request().Header.Get(echo.HeaderContentType), content)
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid branding asset: %v", err),
+			"Invalid branding asset: %v", err)
+	}
+
+	store, err := getStore(p)
+	if err != nil {
+		return err
+	}
+
+	if err = store.Save(asset); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to store branding asset",
+			"Unable to store branding asset: %v", err)
+	}
+
+	invalidateCache(hostname)
+	log.Infof("Branding asset `%s` for hostname `%s` changed by user `%s`", key, hostname, ec.Get("user_id"))
+
+	return ec.JSON(http.StatusOK, AssetInfo{
+		Hostname:    asset.Hostname,
+		Key:         asset.Key,
+		ContentType: asset.ContentType,
+		Size:        len(asset.Content),
+		ETag:        asset.ETag,
+		URL:         AssetURL(asset),
+	})
+}
+
+// DeleteAsset removes an asset for a hostname (admin)
+// /epinio/branding/:asset?hostname=
+func DeleteAsset(ec echo.Context, p jInterfaces.PortalProxy) error {
+	hostname := hostnameParam(ec)
+	key := ec.Param("asset")
+
+	if _, ok := assetDefinitions[key]; !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown branding asset")
+	}
+
+	store, err := getStore(p)
+	if err != nil {
+		return err
+	}
+
+	if err = store.Delete(hostname, key); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to delete branding asset",
+			"Unable to delete branding asset: %v", err)
+	}
+
+	invalidateCache(hostname)
+	log.Infof("Branding asset `%s` for hostname `%s` removed by user `%s`", key, hostname, ec.Get("user_id"))
+
+	return ec.NoContent(http.StatusNoContent)
+}
+
+// hostnameParam returns the hostname the admin is changing, the default branding if none is given
+func hostnameParam(ec echo.Context) string {
+	hostname := strings.ToLower(strings.TrimSpace(ec.QueryParam("hostname")))
+	if len(hostname) == 0 {
+		return DefaultHostname
+	}
+	return hostname
+}
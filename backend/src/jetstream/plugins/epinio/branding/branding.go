@@ -0,0 +1,273 @@
+package branding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/brandingstore"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const (
+	// DefaultHostname is used for requests to hostnames without their own branding
+	DefaultHostname = "*"
+
+	AssetLogo         = "logo"
+	AssetFavicon      = "favicon"
+	AssetPrimaryColor = "primary-color"
+	AssetLoginText    = "login-text"
+
+	// AssetsPath is where assets are served from (see the rancher proxy routes)
+	AssetsPath = "/pp/v1/epinio/rancher/branding"
+
+	// Assets are re-read from the database after this time, so that uploads via another replica are picked up
+	cacheTTL = 10 * time.Second
+)
+
+var primaryColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// assetDefinition describes the content allowed for an asset
+type assetDefinition struct {
+	maxSize      int
+	contentTypes []string
+	validate     func(content []byte) error
+}
+
+var assetDefinitions = map[string]assetDefinition{
+	AssetLogo: {
+		maxSize:      512 * 1024,
+		contentTypes: []string{"image/png", "image/jpeg", "image/svg+xml"},
+	},
+	AssetFavicon: {
+		maxSize:      128 * 1024,
+		contentTypes: []string{"image/png", "image/x-icon", "image/vnd.microsoft.icon", "image/svg+xml"},
+	},
+	AssetPrimaryColor: {
+		maxSize:      16,
+		contentTypes: []string{"text/plain"},
+		validate: func(content []byte) error {
+			if !primaryColorRegex.Match(content) {
+				return fmt.Errorf("must be a hex color, e.g. #3d98d3")
+			}
+			return nil
+		},
+	},
+	AssetLoginText: {
+		maxSize:      4096,
+		contentTypes: []string{"text/plain"},
+	},
+}
+
+// cache holds the assets of the hostnames that have branding, shared by all requests. Hostnames come from the
+// request, so only those found in the database are cached
+var cache struct {
+	sync.Mutex
+	hostnames        map[string]bool
+	hostnamesExpires time.Time
+	assets           map[string][]*brandingstore.Asset
+	expires          map[string]time.Time
+}
+
+func getStore(p jInterfaces.PortalProxy) (brandingstore.BrandingStore, error) {
+	return brandingstore.NewBrandingDBStore(p.GetDatabaseConnection())
+}
+
+// Hostname returns the hostname the request was made to, which determines the branding to use
+func Hostname(ec echo.Context) string {
+	host := interfaces.GetBaseURL(ec)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(host)
+}
+
+func listAssets(p jInterfaces.PortalProxy, hostname string) ([]*brandingstore.Asset, error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	if cache.hostnames == nil || !now.Before(cache.hostnamesExpires) {
+		if err := loadHostnames(p, now); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hostnames without branding use the default branding
+	if !cache.hostnames[hostname] {
+		return nil, nil
+	}
+
+	if assets, ok := cache.assets[hostname]; ok && now.Before(cache.expires[hostname]) {
+		return assets, nil
+	}
+
+	store, err := getStore(p)
+	if err != nil {
+		return nil, err
+	}
+
+	assets, err := store.List(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.assets[hostname] = assets
+	cache.expires[hostname] = now.Add(cacheTTL)
+
+	return assets, nil
+}
+
+// loadHostnames re-reads the hostnames that have branding, and drops the expired assets from the cache
+func loadHostnames(p jInterfaces.PortalProxy, now time.Time) error {
+	store, err := getStore(p)
+	if err != nil {
+		return err
+	}
+
+	hostnames, err := store.Hostnames()
+	if err != nil {
+		return err
+	}
+
+	cache.hostnames = make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		cache.hostnames[hostname] = true
+	}
+	cache.hostnamesExpires = now.Add(cacheTTL)
+
+	if cache.assets == nil {
+		cache.assets = make(map[string][]*brandingstore.Asset)
+		cache.expires = make(map[string]time.Time)
+	}
+	for hostname, expires := range cache.expires {
+		if !now.Before(expires) || !cache.hostnames[hostname] {
+			delete(cache.assets, hostname)
+			delete(cache.expires, hostname)
+		}
+	}
+
+	return nil
+}
+
+func invalidateCache(hostname string) {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.assets, hostname)
+	delete(cache.expires, hostname)
+	// The hostname may have gained or lost its last asset
+	cache.hostnames = nil
+}
+
+// GetAssets returns the assets to use for the hostname, by key. Assets not uploaded for the hostname come from the
+// default branding
+func GetAssets(p jInterfaces.PortalProxy, hostname string) (map[string]*brandingstore.Asset, error) {
+	assets := make(map[string]*brandingstore.Asset)
+
+	hostnames := []string{DefaultHostname}
+	if hostname != DefaultHostname {
+		hostnames = append(hostnames, hostname)
+	}
+
+	for _, h := range hostnames {
+		hostAssets, err := listAssets(p, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, asset := range hostAssets {
+			assets[asset.Key] = asset
+		}
+	}
+
+	return assets, nil
+}
+
+// AssetURL returns the url the asset is served from. The etag is included so that browsers fetch changed assets
+func AssetURL(asset *brandingstore.Asset) string {
+	return fmt.Sprintf("%s/%s?v=%s", AssetsPath, asset.Key, asset.ETag)
+}
+
+// NewAsset validates uploaded content and creates an asset from it
+func NewAsset(hostname, key, contentType string, content []byte) (*brandingstore.Asset, error) {
+	definition, ok := assetDefinitions[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown branding asset %s", key)
+	}
+
+	if len(content) == 0 {
+		return nil, fmt.Errorf("%s must not be empty", key)
+	}
+
+	if len(content) > definition.maxSize {
+		return nil, fmt.Errorf("%s must be at most %d bytes", key, definition.maxSize)
+	}
+
+	// Ignore any parameters (charset, etc)
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	allowed := false
+	for _, t := range definition.contentTypes {
+		allowed = allowed || t == contentType
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%s must be one of %s", key, strings.Join(definition.contentTypes, ", "))
+	}
+
+	if err := checkContent(contentType, content); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+
+	if definition.validate != nil {
+		if err := definition.validate(content); err != nil {
+			return nil, fmt.Errorf("%s %v", key, err)
+		}
+	}
+
+	hash := sha256.Sum256(content)
+
+	return &brandingstore.Asset{
+		Hostname:    hostname,
+		Key:         key,
+		ContentType: contentType,
+		Content:     content,
+		ETag:        hex.EncodeToString(hash[:16]),
+	}, nil
+}
+
+// checkContent makes sure the content matches the declared content type
+func checkContent(contentType string, content []byte) error {
+	detected := http.DetectContentType(content)
+
+	switch contentType {
+	case "image/png", "image/jpeg":
+		if detected != contentType {
+			return fmt.Errorf("content is not %s", contentType)
+		}
+	case "image/x-icon", "image/vnd.microsoft.icon":
+		if detected != "image/x-icon" {
+			return fmt.Errorf("content is not an icon")
+		}
+	case "image/svg+xml":
+		if !bytes.Contains(bytes.ToLower(content), []byte("<svg")) {
+			return fmt.Errorf("content is not an svg")
+		}
+		if bytes.Contains(bytes.ToLower(content), []byte("<script")) {
+			return fmt.Errorf("svg must not contain scripts")
+		}
+	case "text/plain":
+		if !strings.HasPrefix(detected, "text/plain") {
+			return fmt.Errorf("content is not text")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package branding
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const (
+	listHostsSQL  = `SELECT DISTINCT hostname FROM branding`
+	listAssetsSQL = `SELECT hostname, asset_key, content_type, content, etag FROM branding WHERE hostname = \$1`
+
+	pngHeader = "\x89PNG\r\n\x1a\n"
+)
+
+// testPortalProxy only provides the database connection
+type testPortalProxy struct {
+	jInterfaces.PortalProxy
+	db *sql.DB
+}
+
+func (p *testPortalProxy) GetDatabaseConnection() *sql.DB {
+	return p.db
+}
+
+// resetCache forgets the assets cached by previous tests
+func resetCache() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.hostnames = nil
+	cache.assets = nil
+	cache.expires = nil
+}
+
+func TestNewAsset(t *testing.T) {
+	t.Parallel()
+
+	Convey("Uploaded branding assets", t, func() {
+		tests := []struct {
+			name        string
+			key         string
+			contentType string
+			content     string
+			valid       bool
+		}{
+			{"A png logo", AssetLogo, "image/png", pngHeader + "data", true},
+			{"A png logo with content type parameters", AssetLogo, "image/png; charset=binary", pngHeader + "data", true},
+			{"A logo that isn't a png", AssetLogo, "image/png", "GIF89a data", false},
+			{"A logo that is too large", AssetLogo, "image/png", pngHeader + strings.Repeat("a", 512*1024), false},
+			{"An empty logo", AssetLogo, "image/png", "", false},
+			{"A logo of an unsupported type", AssetLogo, "image/gif", "GIF89a data", false},
+			{"An svg logo", AssetLogo, "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, true},
+			{"An svg logo with a script", AssetLogo, "image/svg+xml", `<svg><script>alert(1)</script></svg>`, false},
+			{"An svg logo with an upper case script", AssetLogo, "image/svg+xml", `<SVG><SCRIPT>alert(1)</SCRIPT></SVG>`, false},
+			{"An svg logo that isn't an svg", AssetLogo, "image/svg+xml", `<html></html>`, false},
+			{"An icon favicon", AssetFavicon, "image/x-icon", "\x00\x00\x01\x00data", true},
+			{"A favicon that isn't an icon", AssetFavicon, "image/vnd.microsoft.icon", pngHeader + "data", false},
+			{"A favicon that is too large", AssetFavicon, "image/png", pngHeader + strings.Repeat("a", 128*1024), false},
+			{"A primary color", AssetPrimaryColor, "text/plain", "#3d98d3", true},
+			{"A primary color that isn't a hex color", AssetPrimaryColor, "text/plain", "blue", false},
+			{"A login text", AssetLoginText, "text/plain; charset=utf-8", "Welcome", true},
+			{"A login text that isn't text", AssetLoginText, "text/plain", pngHeader + "data", false},
+			{"A login text that is too long", AssetLoginText, "text/plain", strings.Repeat("a", 4097), false},
+			{"An unknown asset", "background", "image/png", pngHeader + "data", false},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				asset, err := NewAsset("ui.example.org", test.key, test.contentType, []byte(test.content))
+				So(err == nil, ShouldEqual, test.valid)
+				if test.valid {
+					So(asset.Hostname, ShouldEqual, "ui.example.org")
+					So(asset.Key, ShouldEqual, test.key)
+					So(asset.ContentType, ShouldEqual, strings.Split(test.contentType, ";")[0])
+					So(asset.ETag, ShouldHaveLength, 32)
+				}
+			})
+		}
+
+		Convey("Should have an etag that changes with the content", func() {
+			first, err := NewAsset(DefaultHostname, AssetLoginText, "text/plain", []byte("Welcome"))
+			So(err, ShouldBeNil)
+			second, err := NewAsset(DefaultHostname, AssetLoginText, "text/plain", []byte("Welcome back"))
+			So(err, ShouldBeNil)
+			So(first.ETag, ShouldNotEqual, second.ETag)
+		})
+	})
+}
+
+func TestServeAsset(t *testing.T) {
+
+	Convey("Serving branding assets", t, func() {
+		resetCache()
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer db.Close()
+		p := &testPortalProxy{db: db}
+
+		assetRows := func(hostname string, assets map[string]string) sqlmock.Rows {
+			rows := sqlmock.NewRows([]string{"hostname", "asset_key", "content_type", "content", "etag"})
+			for key, content := range assets {
+				rows.AddRow(hostname, key, "text/plain", base64.StdEncoding.EncodeToString([]byte(content)), key+"-"+hostname)
+			}
+			return rows
+		}
+
+		// The default branding has a login text and a primary color, ui.example.org replaces the login text
+		mock.ExpectQuery(listHostsSQL).
+			WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(DefaultHostname).AddRow("ui.example.org"))
+		mock.ExpectQuery(listAssetsSQL).WithArgs(DefaultHostname).
+			WillReturnRows(assetRows(DefaultHostname, map[string]string{AssetLoginText: "Welcome", AssetPrimaryColor: "#3d98d3"}))
+
+		serve := func(host, key, query string, header map[string]string) (*httptest.ResponseRecorder, error) {
+			req := httptest.NewRequest(http.MethodGet, AssetsPath+"/"+key+query, nil)
+			req.Host = host
+			for name, value := range header {
+				req.Header.Set(name, value)
+			}
+			res := httptest.NewRecorder()
+			ctx := echo.New().NewContext(req, res)
+			ctx.SetParamNames("asset")
+			ctx.SetParamValues(key)
+			return res, ServeAsset(ctx, p)
+		}
+
+		Convey("Should use the branding of the hostname", func() {
+			mock.ExpectQuery(listAssetsSQL).WithArgs("ui.example.org").
+				WillReturnRows(assetRows("ui.example.org", map[string]string{AssetLoginText: "Welcome to UI"}))
+
+			res, err := serve("UI.example.org:443", AssetLoginText, "", nil)
+			So(err, ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusOK)
+			So(res.Body.String(), ShouldEqual, "Welcome to UI")
+			So(res.Header().Get("ETag"), ShouldEqual, `"login-text-ui.example.org"`)
+
+			Convey("and the default branding for assets it doesn't have", func() {
+				res, err := serve("ui.example.org", AssetPrimaryColor, "", nil)
+				So(err, ShouldBeNil)
+				So(res.Body.String(), ShouldEqual, "#3d98d3")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("Should use the default branding for hostnames without their own", func() {
+			res, err := serve("other.example.org", AssetLoginText, "", nil)
+			So(err, ShouldBeNil)
+			So(res.Body.String(), ShouldEqual, "Welcome")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should not find assets that weren't uploaded", func() {
+			_, err := serve("other.example.org", AssetLogo, "", nil)
+			httpErr, ok := err.(*echo.HTTPError)
+			So(ok, ShouldBeTrue)
+			So(httpErr.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Should not send unchanged assets", func() {
+			res, err := serve("other.example.org", AssetLoginText, "", map[string]string{"If-None-Match": `"old", "login-text-*"`})
+			So(err, ShouldBeNil)
+			So(res.Code, ShouldEqual, http.StatusNotModified)
+			So(res.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Should be cached for a short time", func() {
+			res, err := serve("other.example.org", AssetLoginText, "", nil)
+			So(err, ShouldBeNil)
+			So(res.Header().Get("Cache-Control"), ShouldEqual, "public, max-age=300")
+		})
+
+		Convey("Should be cached for good when requested by etag", func() {
+			res, err := serve("other.example.org", AssetLoginText, "?v=login-text-*", nil)
+			So(err, ShouldBeNil)
+			So(res.Header().Get("Cache-Control"), ShouldEqual, "public, max-age=31536000, immutable")
+		})
+
+		Convey("Should not run scripts", func() {
+			res, err := serve("other.example.org", AssetLoginText, "", nil)
+			So(err, ShouldBeNil)
+			So(res.Header().Get("Content-Security-Policy"), ShouldContainSubstring, "sandbox")
+			So(res.Header().Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package brandingstore
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/datastore"
+)
+
+var (
+	listAssets  = `SELECT hostname, asset_key, content_type, content, etag FROM branding WHERE hostname = $1`
+	listHosts   = `SELECT DISTINCT hostname FROM branding`
+	countAsset  = `SELECT COUNT(*) FROM branding WHERE hostname = $1 AND asset_key = $2`
+	insertAsset = `INSERT INTO branding (hostname, asset_key, content_type, content, etag) VALUES ($1, $2, $3, $4, $5)`
+	updateAsset = `UPDATE branding SET content_type = $1, content = $2, etag = $3, last_updated = CURRENT_TIMESTAMP WHERE hostname = $4 AND asset_key = $5`
+	deleteAsset = `DELETE FROM branding WHERE hostname = $1 AND asset_key = $2`
+)
+
+// InitRepositoryProvider - One time init for the given DB Provider
+func InitRepositoryProvider(databaseProvider string) {
+	// Modify the database statements if needed, for the given database type
+	listAssets = datastore.ModifySQLStatement(listAssets, databaseProvider)
+	listHosts = datastore.ModifySQLStatement(listHosts, databaseProvider)
+	countAsset = datastore.ModifySQLStatement(countAsset, databaseProvider)
+	insertAsset = datastore.ModifySQLStatement(insertAsset, databaseProvider)
+	updateAsset = datastore.ModifySQLStatement(updateAsset, databaseProvider)
+	deleteAsset = datastore.ModifySQLStatement(deleteAsset, databaseProvider)
+}
+
+// BrandingDBStore is a DB-backed branding repository
+type BrandingDBStore struct {
+	db *sql.DB
+}
+
+// NewBrandingDBStore will create a new instance of the BrandingDBStore
+func NewBrandingDBStore(dcp *sql.DB) (BrandingStore, error) {
+	return &BrandingDBStore{db: dcp}, nil
+}
+
+// List - Returns all assets stored for the hostname
+func (b *BrandingDBStore) List(hostname string) ([]*Asset, error) {
+	log.Debug("List")
+	rows, err := b.db.Query(listAssets, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Branding records: %v", err)
+	}
+	defer rows.Close()
+
+	assets := make([]*Asset, 0)
+	for rows.Next() {
+		var content string
+		asset := &Asset{}
+		if err := rows.Scan(&asset.Hostname, &asset.Key, &asset.ContentType, &content, &asset.ETag); err != nil {
+			return nil, fmt.Errorf("Unable to scan Branding records: %v", err)
+		}
+		if asset.Content, err = base64.StdEncoding.DecodeString(content); err != nil {
+			return nil, fmt.Errorf("Unable to decode Branding record: %v", err)
+		}
+		assets = append(assets, asset)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to List Branding records: %v", err)
+	}
+
+	return assets, nil
+}
+
+// Hostnames - Returns the hostnames that have assets
+func (b *BrandingDBStore) Hostnames() ([]string, error) {
+	log.Debug("Hostnames")
+	rows, err := b.db.Query(listHosts)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Branding hostnames: %v", err)
+	}
+	defer rows.Close()
+
+	hostnames := make([]string, 0)
+	for rows.Next() {
+		var hostname string
+		if err := rows.Scan(&hostname); err != nil {
+			return nil, fmt.Errorf("Unable to scan Branding hostnames: %v", err)
+		}
+		hostnames = append(hostnames, hostname)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to List Branding hostnames: %v", err)
+	}
+
+	return hostnames, nil
+}
+
+// Save will create or replace the asset in the datastore
+func (b *BrandingDBStore) Save(asset *Asset) error {
+	log.Debug("Save")
+	txn, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Unable to start Branding transaction: %v", err)
+	}
+
+	var count int
+	if err := txn.QueryRow(countAsset, asset.Hostname, asset.Key).Scan(&count); err != nil {
+		txn.Rollback()
+		return fmt.Errorf("Unable to find Branding record: %v", err)
+	}
+
+	content := base64.StdEncoding.EncodeToString(asset.Content)
+	if count == 0 {
+		_, err = txn.Exec(insertAsset, asset.Hostname, asset.Key, asset.ContentType, content, asset.ETag)
+	} else {
+		_, err = txn.Exec(updateAsset, asset.ContentType, content, asset.ETag, asset.Hostname, asset.Key)
+	}
+	if err != nil {
+		txn.Rollback()
+		return fmt.Errorf("Unable to save Branding record: %v", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("Unable to save Branding record: %v", err)
+	}
+
+	return nil
+}
+
+// Delete will remove the asset from the datastore
+func (b *BrandingDBStore) Delete(hostname, key string) error {
+	if _, err := b.db.Exec(deleteAsset, hostname, key); err != nil {
+		return fmt.Errorf("Unable to delete Branding record: %v", err)
+	}
+	return nil
+}
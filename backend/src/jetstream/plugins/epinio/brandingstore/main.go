@@ -0,0 +1,22 @@
+package brandingstore
+
+// Asset is a branding asset (logo, favicon, etc) for a hostname
+type Asset struct {
+	Hostname    string
+	Key         string
+	ContentType string
+	Content     []byte
+	ETag        string
+}
+
+// BrandingStore is the branding assets repository
+type BrandingStore interface {
+	// List returns all assets for the hostname
+	List(hostname string) ([]*Asset, error)
+	// Hostnames returns the hostnames that have assets
+	Hostnames() ([]string, error)
+	// Save creates or replaces an asset
+	Save(asset *Asset) error
+	// Delete removes an asset
+	Delete(hostname, key string) error
+}
@@ -0,0 +1,159 @@
+package epinio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	epinioClustersConfigEnv = "EPINIO_CLUSTERS_CONFIG"
+	epinioClusterNameEnv    = "EPINIO_CLUSTER_NAME"
+
+	// defaultClusterName must match EPINIO_STANDALONE_CLUSTER_NAME in the front end
+	defaultClusterName = "default"
+)
+
+// epinioCluster describes a single Epinio install (API, WSS and Dex urls) that the UI can talk to
+type epinioCluster struct {
+	Name              string `yaml:"name"`
+	APIURL            string `yaml:"apiUrl"`
+	WSSURL            string `yaml:"wssUrl"`
+	AuthURL           string `yaml:"dexAuthUrl"`
+	DexIssuer         string `yaml:"dexIssuer"`
+	UIURL             string `yaml:"uiUrl"`
+	SkipSSLValidation bool   `yaml:"skipSSLValidation"`
+}
+
+type epinioClustersConfig struct {
+	Clusters []epinioCluster `yaml:"clusters"`
+}
+
+// loadClusters collects the Epinio clusters to register. Clusters come from
+// - the un-indexed env vars (EPINIO_API_URL, etc), registered as `default`
+// - indexed env vars (EPINIO_API_URL_1, EPINIO_CLUSTER_NAME_1, etc), starting at 1 and stopping at the first gap
+// - the yaml file referenced by EPINIO_CLUSTERS_CONFIG
+func loadClusters(portalProxy interfaces.PortalProxy) ([]epinioCluster, error) {
+	clusters := make([]epinioCluster, 0)
+
+	if cluster, ok := clusterFromEnv(portalProxy, ""); ok {
+		clusters = append(clusters, cluster)
+	}
+
+	for i := 1; ; i++ {
+		cluster, ok := clusterFromEnv(portalProxy, fmt.Sprintf("_%d", i))
+		if !ok {
+			break
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	if configPath, ok := portalProxy.Env().Lookup(epinioClustersConfigEnv); ok && len(configPath) > 0 {
+		fromFile, err := clustersFromFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, fromFile...)
+	}
+
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("failed to find Epinio API url env `%s` (or `%s_1`, or clusters config `%s`)", epinioApiUrlEnv, epinioApiUrlEnv, epinioClustersConfigEnv)
+	}
+
+	names := make(map[string]bool)
+	for i := range clusters {
+		applyClusterDefaults(&clusters[i])
+		if names[clusters[i].Name] {
+			return nil, fmt.Errorf("epinio cluster name `%s` is used more than once", clusters[i].Name)
+		}
+		names[clusters[i].Name] = true
+	}
+
+	return clusters, nil
+}
+
+// clusterFromEnv reads a cluster from the env vars with the given suffix (empty for the default cluster)
+func clusterFromEnv(portalProxy interfaces.PortalProxy, suffix string) (epinioCluster, bool) {
+	env := portalProxy.Env()
+
+	apiUrl, _ := env.Lookup(epinioApiUrlEnv + suffix)
+	if len(apiUrl) == 0 {
+		return epinioCluster{}, false
+	}
+
+	name := defaultClusterName
+	if len(suffix) > 0 {
+		name = env.String(epinioClusterNameEnv+suffix, strings.TrimPrefix(suffix, "_"))
+	}
+
+	skipSSLValidation, err := env.Bool(epinioApiUrlskipSSLValidationEnv + suffix)
+	if err != nil {
+		skipSSLValidation = false
+	}
+
+	return epinioCluster{
+		Name:              name,
+		APIURL:            apiUrl,
+		WSSURL:            env.String(epinioApiWsUrl+suffix, ""),
+		AuthURL:           env.String(epinioDexAuthUrl+suffix, ""),
+		DexIssuer:         env.String(epinioDexIssuer+suffix, ""),
+		UIURL:             env.String(epinioUiUrl+suffix, ""),
+		SkipSSLValidation: skipSSLValidation,
+	}, true
+}
+
+func clustersFromFile(path string) ([]epinioCluster, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read epinio clusters config `%s`: %v", path, err)
+	}
+
+	var config epinioClustersConfig
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse epinio clusters config `%s`: %v", path, err)
+	}
+
+	for i, cluster := range config.Clusters {
+		if len(cluster.Name) == 0 || len(cluster.APIURL) == 0 {
+			return nil, fmt.Errorf("epinio clusters config `%s`: cluster %d requires a name and apiUrl", path, i)
+		}
+	}
+
+	return config.Clusters, nil
+}
+
+// applyClusterDefaults fills in any optional url that was not supplied, based on the API url
+func applyClusterDefaults(cluster *epinioCluster) {
+	if cluster.WSSURL == "" {
+		cluster.WSSURL = strings.Replace(cluster.APIURL, "https://", "wss://", 1)
+		log.Infof("Didn't find WSS url for cluster `%s`, falling back to `%s`", cluster.Name, cluster.WSSURL)
+	}
+
+	if cluster.AuthURL == "" {
+		cluster.AuthURL = strings.Replace(cluster.APIURL, "epinio.", "auth.", 1)
+		log.Infof("Didn't find Dex auth url for cluster `%s`, falling back to `%s`", cluster.Name, cluster.AuthURL)
+	}
+
+	if cluster.DexIssuer == "" {
+		cluster.DexIssuer = cluster.AuthURL
+	}
+
+	if cluster.UIURL == "" {
+		cluster.UIURL = cluster.APIURL // Default to the same as the epinio api
+	}
+}
+
+func (epinio *Epinio) findCluster(apiEndpoint string) (*epinioCluster, error) {
+	apiEndpoint = strings.TrimRight(apiEndpoint, "/")
+	for i, cluster := range epinio.clusters {
+		if strings.TrimRight(cluster.APIURL, "/") == apiEndpoint {
+			return &epinio.clusters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no epinio cluster configured with api url %s", apiEndpoint)
+}
@@ -0,0 +1,186 @@
+package epinio
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/epinio/ui/backend/src/jetstream/cf-common/env"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+// testPortalProxy only provides the env vars
+type testPortalProxy struct {
+	interfaces.PortalProxy
+	env *env.VarSet
+}
+
+func (p *testPortalProxy) Env() *env.VarSet {
+	return p.env
+}
+
+func newTestPortalProxy(vars map[string]string) *testPortalProxy {
+	return &testPortalProxy{
+		env: env.NewVarSet().AppendSource(func(name string) (string, bool) {
+			value, ok := vars[name]
+			return value, ok
+		}),
+	}
+}
+
+func TestLoadClusters(t *testing.T) {
+	t.Parallel()
+
+	Convey("Loading the Epinio clusters", t, func() {
+		tests := []struct {
+			name     string
+			env      map[string]string
+			file     string
+			clusters []epinioCluster
+			err      bool
+		}{
+			{
+				name: "Should register the un-indexed env vars as the default cluster with derived urls",
+				env:  map[string]string{"EPINIO_API_URL": "https://epinio.example.org"},
+				clusters: []epinioCluster{{
+					Name:      "default",
+					APIURL:    "https://epinio.example.org",
+					WSSURL:    "wss://epinio.example.org",
+					AuthURL:   "https://auth.example.org",
+					DexIssuer: "https://auth.example.org",
+					UIURL:     "https://epinio.example.org",
+				}},
+			},
+			{
+				name: "Should keep the urls that are given",
+				env: map[string]string{
+					"EPINIO_API_URL":      "https://epinio.example.org",
+					"EPINIO_WSS_URL":      "wss://ws.example.org",
+					"EPINIO_DEX_AUTH_URL": "https://dex.example.org",
+					"EPINIO_DEX_ISSUER":   "https://issuer.example.org",
+					"EPINIO_UI_URL":       "https://ui.example.org",
+					"EPINIO_API_SKIP_SSL": "true",
+				},
+				clusters: []epinioCluster{{
+					Name:              "default",
+					APIURL:            "https://epinio.example.org",
+					WSSURL:            "wss://ws.example.org",
+					AuthURL:           "https://dex.example.org",
+					DexIssuer:         "https://issuer.example.org",
+					UIURL:             "https://ui.example.org",
+					SkipSSLValidation: true,
+				}},
+			},
+			{
+				name: "Should read indexed env vars up to the first gap, named by index if no name is given",
+				env: map[string]string{
+					"EPINIO_API_URL_1":      "https://epinio.one.org",
+					"EPINIO_CLUSTER_NAME_1": "one",
+					"EPINIO_API_URL_2":      "https://epinio.two.org",
+					"EPINIO_API_URL_4":      "https://epinio.four.org",
+				},
+				clusters: []epinioCluster{
+					{
+						Name:      "one",
+						APIURL:    "https://epinio.one.org",
+						WSSURL:    "wss://epinio.one.org",
+						AuthURL:   "https://auth.one.org",
+						DexIssuer: "https://auth.one.org",
+						UIURL:     "https://epinio.one.org",
+					},
+					{
+						Name:      "2",
+						APIURL:    "https://epinio.two.org",
+						WSSURL:    "wss://epinio.two.org",
+						AuthURL:   "https://auth.two.org",
+						DexIssuer: "https://auth.two.org",
+						UIURL:     "https://epinio.two.org",
+					},
+				},
+			},
+			{
+				name: "Should add the clusters from the config file",
+				env:  map[string]string{"EPINIO_API_URL": "https://epinio.example.org"},
+				file: "clusters:\n- name: other\n  apiUrl: https://epinio.other.org\n  dexAuthUrl: https://dex.other.org\n",
+				clusters: []epinioCluster{
+					{
+						Name:      "default",
+						APIURL:    "https://epinio.example.org",
+						WSSURL:    "wss://epinio.example.org",
+						AuthURL:   "https://auth.example.org",
+						DexIssuer: "https://auth.example.org",
+						UIURL:     "https://epinio.example.org",
+					},
+					{
+						Name:      "other",
+						APIURL:    "https://epinio.other.org",
+						WSSURL:    "wss://epinio.other.org",
+						AuthURL:   "https://dex.other.org",
+						DexIssuer: "https://dex.other.org",
+						UIURL:     "https://epinio.other.org",
+					},
+				},
+			},
+			{
+				name: "Should fail without any cluster",
+				env:  map[string]string{},
+				err:  true,
+			},
+			{
+				name: "Should fail if a name is used more than once",
+				env: map[string]string{
+					"EPINIO_API_URL":        "https://epinio.example.org",
+					"EPINIO_API_URL_1":      "https://epinio.one.org",
+					"EPINIO_CLUSTER_NAME_1": "default",
+				},
+				err: true,
+			},
+			{
+				name: "Should fail if a file cluster reuses an env cluster name",
+				env:  map[string]string{"EPINIO_API_URL_1": "https://epinio.one.org"},
+				file: "clusters:\n- name: \"1\"\n  apiUrl: https://epinio.other.org\n",
+				err:  true,
+			},
+			{
+				name: "Should fail if the config file is malformed",
+				env:  map[string]string{},
+				file: "clusters: [name: other\n",
+				err:  true,
+			},
+			{
+				name: "Should fail if a file cluster has no api url",
+				env:  map[string]string{},
+				file: "clusters:\n- name: other\n",
+				err:  true,
+			},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				if len(test.file) > 0 {
+					path := filepath.Join(t.TempDir(), "clusters.yaml")
+					So(ioutil.WriteFile(path, []byte(test.file), 0600), ShouldBeNil)
+					test.env[epinioClustersConfigEnv] = path
+				}
+
+				clusters, err := loadClusters(newTestPortalProxy(test.env))
+				if test.err {
+					So(err, ShouldNotBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(clusters, ShouldResemble, test.clusters)
+			})
+		}
+
+		Convey("Should fail if the config file is missing", func() {
+			_, err := loadClusters(newTestPortalProxy(map[string]string{
+				epinioClustersConfigEnv: filepath.Join(t.TempDir(), "missing.yaml"),
+			}))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -3,19 +3,59 @@ package epiniodex
 import (
 	"net/http"
 
+	"github.com/epinio/ui/backend/src/jetstream/dex"
+
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/api"
+	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
 
 	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 
 	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
 )
 
 type RedirectUrlResponse struct {
 	RedirectUrl string `json:"redirectUrl"`
+	State       string `json:"state"`
 }
 
-func RedirectUrl(ec echo.Context, p jInterfaces.PortalProxy) error {
-	oidcProvider, err := p.GetDex()
+// RedirectUrl creates the url to start a Dex login. The state, nonce and PKCE code verifier are stored in the
+// (pre-login) session and validated when the resulting auth code is exchanged. The client can supply its own `state`
+// and a `connector_id` to skip Dex's connector selection
+func RedirectUrl(ec echo.Context, p jInterfaces.PortalProxy, settings *dex.Settings) error {
+	if settings == nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Dex is not enabled",
+			"Dex is not enabled",
+		)
+	}
+
+	authCodeOpts := make([]oauth2.AuthCodeOption, 0)
+	connectorID := ec.QueryParams().Get("connector_id")
+	if len(connectorID) > 0 {
+		if _, ok := settings.FindConnector(connectorID); !ok {
+			return jInterfaces.NewHTTPShadowError(
+				http.StatusBadRequest,
+				"Unknown Dex connector",
+				"Unknown Dex connector: %s",
+				connectorID,
+			)
+		}
+		authCodeOpts = append(authCodeOpts, dex.WithConnector(connectorID))
+	}
+
+	epinioCnsi, err := epinio_utils.FindLoginEndpoint(p, ec)
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Unknown Epinio cluster",
+			"Unknown Epinio cluster: %+v",
+			err,
+		)
+	}
+
+	oidcProvider, err := p.GetDex(epinioCnsi.GUID)
 
 	if err != nil {
 		return jInterfaces.NewHTTPShadowError(
@@ -26,18 +66,30 @@ func RedirectUrl(ec echo.Context, p jInterfaces.PortalProxy) error {
 		)
 	}
 
-	state := ec.QueryParams().Get("state")
-	if len(state) == 0 {
+	loginState := dex.NewLoginState(ec.QueryParams().Get("state"), epinioCnsi.GUID, connectorID)
+	encodedLoginState, err := loginState.Encode()
+	if err != nil {
+		return err
+	}
+
+	session, err := p.GetSession(ec)
+	if err != nil {
 		return jInterfaces.NewHTTPShadowError(
 			http.StatusInternalServerError,
-			"Invalid request, `state` required",
-			"Invalid request, `state` required",
+			"Failed to create session",
+			"Failed to create session: %+v",
+			err,
 		)
 	}
+	session.Values[dex.LoginStateSessionKey] = encodedLoginState
+	if err = p.SaveSession(ec, session); err != nil {
+		return err
+	}
 
-	dexUrl, _ := oidcProvider.AuthCodeURLWithPKCE(state)
+	dexUrl := oidcProvider.AuthCodeURLWithPKCE(loginState.State, loginState.Nonce, loginState.CodeVerifier, authCodeOpts...)
 
 	return api.SendResponse(ec, RedirectUrlResponse{
 		RedirectUrl: dexUrl,
+		State:       loginState.State,
 	})
 }
@@ -2,6 +2,7 @@ package interfaces
 
 const (
 	EndpointType = "epinio"
+	AdminRole    = "admin"
 )
 
 type CNSIMetadata struct {
@@ -9,3 +10,52 @@ type CNSIMetadata struct {
 	DexAuthUrl string `json:"dex_auth_url"`
 	DexIssuer  string `json:"dex_issuer"`
 }
+
+// MeResponse is the subset of Epinio's `/api/v1/me` response needed to determine the user's roles
+type MeResponse struct {
+	User       string   `json:"user"`
+	Role       string   `json:"role"`
+	Roles      []MeRole `json:"roles"`
+	Namespaces []string `json:"namespaces"`
+}
+
+type MeRole struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+}
+
+// TokenMetadata is stored in the metadata of the user's epinio endpoint tokens
+type TokenMetadata struct {
+	Admin      bool     `json:"admin"`
+	Roles      []string `json:"roles"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// IsAdmin returns true if the user has the global (not namespace scoped) admin role
+func (me MeResponse) IsAdmin() bool {
+	if me.Role == AdminRole {
+		return true
+	}
+	for _, role := range me.Roles {
+		if role.ID == AdminRole && role.Namespace == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleIDs returns the IDs of the user's roles. Namespace scoped roles are returned as `<role>:<namespace>`
+func (me MeResponse) RoleIDs() []string {
+	roles := make([]string, 0, len(me.Roles)+1)
+	if len(me.Roles) == 0 && me.Role != "" {
+		roles = append(roles, me.Role)
+	}
+	for _, role := range me.Roles {
+		if role.Namespace == "" {
+			roles = append(roles, role.ID)
+		} else {
+			roles = append(roles, role.ID+":"+role.Namespace)
+		}
+	}
+	return roles
+}
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/epinio/ui/backend/src/jetstream/dex"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/branding"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/brandingstore"
 	epinioDex "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/dex"
 	eInterfaces "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/interfaces"
 	normanProxy "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/norman"
 	steveProxy "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/steve"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/userpreferencesstore"
 	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
 
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
@@ -19,6 +23,7 @@ import (
 )
 
 const (
+	// The following can also be suffixed with an index (`_1`, `_2`, ...) to register additional clusters
 	epinioApiUrlEnv                  = "EPINIO_API_URL"
 	epinioApiWsUrl                   = "EPINIO_WSS_URL"
 	epinioDexAuthUrl                 = "EPINIO_DEX_AUTH_URL"
@@ -29,13 +34,10 @@ const (
 
 // Epinio - Plugin
 type Epinio struct {
-	portalProxy                   interfaces.PortalProxy
-	epinioApiUrl                  string
-	epinioApiWsUrl                string
-	epinioAuthUrl                 string
-	epinioDexIssuer               string
-	epinioUiUrl                   string
-	epinioApiUrlskipSSLValidation bool
+	portalProxy interfaces.PortalProxy
+	clusters    []epinioCluster
+	// OIDC client settings, nil if Dex is not enabled
+	dexSettings *dex.Settings
 }
 
 func init() {
@@ -48,59 +50,52 @@ func Init(portalProxy interfaces.PortalProxy) (interfaces.StratosPlugin, error)
 		return nil, fmt.Errorf("epinio plugin requires auth endpoint type of %s", interfaces.Epinio)
 	}
 
-	epinioApiUrlValue, _ := portalProxy.Env().Lookup(epinioApiUrlEnv)
-	if len(epinioApiUrlValue) == 0 {
-		return nil, fmt.Errorf("failed to find Epinio API url env `%s`", epinioApiUrlEnv)
-	}
-
-	epinioApiWsUrlValue, _ := portalProxy.Env().Lookup(epinioApiWsUrl)
-	if len(epinioApiWsUrlValue) == 0 {
-		epinioApiWsUrlValue = strings.Replace(epinioApiUrlValue, "https://", "wss://", 1)
-		log.Infof("Didn't find `%s`, falling back to `%s`", epinioApiWsUrl, epinioApiWsUrlValue)
+	userpreferencesstore.InitRepositoryProvider(portalProxy.GetConfig().DatabaseProviderName)
+	brandingstore.InitRepositoryProvider(portalProxy.GetConfig().DatabaseProviderName)
 
-	}
-
-	epinioApiUrlskipSSLValidation, err := portalProxy.Env().Bool(epinioApiUrlskipSSLValidationEnv)
+	clusters, err := loadClusters(portalProxy)
 	if err != nil {
-		epinioApiUrlskipSSLValidation = false
+		return nil, err
 	}
 
-	epinioAuthUrlValue, _ := portalProxy.Env().Lookup(epinioDexAuthUrl)
-	if epinioAuthUrlValue == "" {
-		epinioAuthUrlValue = strings.Replace(epinioApiUrlValue, "epinio.", "auth.", 1)
-		log.Infof("Didn't find `%s`, falling back to `%s`", epinioDexAuthUrl, epinioAuthUrlValue)
-	}
-
-	epinioDexIssuerValue, _ := portalProxy.Env().Lookup(epinioDexIssuer)
-	if epinioDexIssuerValue == "" {
-		epinioDexIssuerValue = epinioAuthUrlValue
+	var dexSettings *dex.Settings
+	if dexEnabled, _ := portalProxy.Env().Bool("EPINIO_DEX_ENABLED"); dexEnabled {
+		dexSettings, err = dex.LoadSettings(portalProxy.Env())
+		if err != nil {
+			return nil, fmt.Errorf("invalid dex settings: %v", err)
+		}
+		log.Infof("OIDC preset: '%s', audiences: '%s', client: '%s', scopes: '%s', redirect path: '%s', claims (user id, name, groups): '%s', '%s', '%s'",
+			dexSettings.Preset, strings.Join(dexSettings.Audiences, " "), dexSettings.ClientID, strings.Join(dexSettings.Scopes, " "), dexSettings.RedirectPath,
+			dexSettings.UserIDClaim, dexSettings.NameClaim, dexSettings.GroupsClaim)
+		for _, connector := range dexSettings.Connectors {
+			log.Infof("Dex connector: '%s' ('%s', icon '%s')", connector.ID, connector.Name, connector.Icon)
+		}
 	}
 
-	epinioUiUrlValue, _ := portalProxy.Env().Lookup(epinioUiUrl)
-	if epinioUiUrlValue == "" {
-		epinioUiUrlValue = epinioApiUrlValue // Default to the same as the epinio api
+	for _, cluster := range clusters {
+		log.Infof("\n"+
+			"Epinio cluster: '%s'\n"+
+			"Epinio API url: '%s'\n"+
+			"Epinio WSS url: '%s'\n"+
+			"Epinio Auth url: '%s'\n"+
+			"Epinio Auth issuer: '%s'\n"+
+			"Epinio UI url: '%s'\n"+
+			"Skipping SSL Validation: '%+v'",
+			cluster.Name, cluster.APIURL, cluster.WSSURL, cluster.AuthURL, cluster.DexIssuer, cluster.UIURL, cluster.SkipSSLValidation)
 	}
 
-	log.Infof("\n"+
-		"Epinio API url: '%s'\n"+
-		"Epinio WSS url: '%s'\n"+
-		"Epinio Auth url: '%s'\n"+
-		"Epinio Auth issuer: '%s'\n"+
-		"Epinio UI url: '%s'\n"+
-		"Skipping SSL Validation: '%+v'",
-		epinioApiUrlValue, epinioApiWsUrlValue, epinioAuthUrlValue, epinioDexIssuerValue, epinioUiUrlValue, epinioApiUrlskipSSLValidation)
-
 	return &Epinio{
-		portalProxy:                   portalProxy,
-		epinioApiUrl:                  epinioApiUrlValue,
-		epinioApiWsUrl:                epinioApiWsUrlValue,
-		epinioAuthUrl:                 epinioAuthUrlValue,
-		epinioDexIssuer:               epinioDexIssuerValue,
-		epinioUiUrl:                   epinioUiUrlValue,
-		epinioApiUrlskipSSLValidation: epinioApiUrlskipSSLValidation,
+		portalProxy: portalProxy,
+		clusters:    clusters,
+		dexSettings: dexSettings,
 	}, nil
 }
 
+// DexSettings returns the OIDC client settings validated at start up, nil if Dex is not enabled
+func (epinio *Epinio) DexSettings() *dex.Settings {
+	return epinio.dexSettings
+}
+
 // MiddlewarePlugin interface
 func (epinio *Epinio) EchoMiddleware(h echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -154,7 +149,18 @@ func (epinio *Epinio) GetRoutePlugin() (interfaces.RoutePlugin, error) {
 
 // AddAdminGroupRoutes adds the admin routes for this plugin to the Echo server
 func (epinio *Epinio) AddAdminGroupRoutes(echoGroup *echo.Group) {
-	// no-op
+	p := epinio.portalProxy
+
+	brandingGroup := echoGroup.Group("/epinio/branding")
+	brandingGroup.GET("", func(c echo.Context) error {
+		return branding.ListAssets(c, p)
+	})
+	brandingGroup.PUT("/:asset", func(c echo.Context) error {
+		return branding.UploadAsset(c, p)
+	})
+	brandingGroup.DELETE("/:asset", func(c echo.Context) error {
+		return branding.DeleteAsset(c, p)
+	})
 }
 
 // AddSessionGroupRoutes adds the session routes for this plugin to the Echo server
@@ -174,10 +180,16 @@ func (epinio *Epinio) AddRootGroupRoutes(echoGroup *echo.Group) {
 	rancherProxyGroup.GET("/version", steveProxy.GetRancherVersion)
 	rancherProxyGroup.GET("/rancherversion", steveProxy.GetRancherVersion)
 
+	// Branding assets (public, cacheable)
+	rancherProxyGroup.GET("/branding/:asset", func(c echo.Context) error {
+		return branding.ServeAsset(c, p)
+	})
+
 	// Rancher Steve API
 	steveGroup := rancherProxyGroup.Group("/v1")
 	steveGroup.Use(p.SetSecureCacheContentMiddleware)
   steveGroup.GET("/schemas", steveProxy.SteveSchemas)
+	steveGroup.GET("/schemas/:id", steveProxy.SteveSchema)
 	steveGroup.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			// TODO: RC Tech Debt - This was done as there was no pp/session access in the rancher proxy stuff. Can now be fixed
@@ -190,26 +202,54 @@ func (epinio *Epinio) AddRootGroupRoutes(echoGroup *echo.Group) {
 	})
 
 	// Rancher Steve API (unsecure)
-	steveGroup.GET("/management.cattle.io.settings", steveProxy.MgmtSettings)
-	steveGroup.GET("/management.cattle.io.setting", steveProxy.MgmtSettings)
+	for _, settingsPath := range []string{"/management.cattle.io.settings", "/management.cattle.io.setting"} {
+		steveGroup.GET(settingsPath, func(c echo.Context) error {
+			return steveProxy.MgmtSettings(c, p)
+		})
+		steveGroup.GET(settingsPath+"/:id", func(c echo.Context) error {
+			return steveProxy.MgmtSetting(c, p)
+		})
+	}
 
 	// Rancher Steve API (secure)
 	steveGroup.Use(p.SessionMiddleware())
-	steveGroup.GET("/management.cattle.io.cluster", steveProxy.Clusters)
-	steveGroup.GET("/userpreferences", steveProxy.GetUserPrefs)
-	steveGroup.PUT("/userpreferences/*", steveProxy.GetSpecificUserPrefs)
+	steveGroup.GET("/management.cattle.io.cluster", func(c echo.Context) error {
+		return steveProxy.Clusters(c, p)
+	})
+	steveGroup.GET("/userpreferences", func(c echo.Context) error {
+		return steveProxy.GetUserPrefs(c, p)
+	})
+	steveGroup.GET("/userpreferences/*", func(c echo.Context) error {
+		return steveProxy.GetSpecificUserPrefs(c, p)
+	})
+	steveGroup.PUT("/userpreferences/*", func(c echo.Context) error {
+		return steveProxy.UpdateUserPrefs(c, p)
+	})
+	steveGroup.GET("/subscribe", func(c echo.Context) error {
+		return steveProxy.Subscribe(c, p)
+	})
+
+	// Rancher Steve API (admin)
+	for _, settingsPath := range []string{"/management.cattle.io.settings", "/management.cattle.io.setting"} {
+		steveGroup.PUT(settingsPath+"/:id", func(c echo.Context) error {
+			return steveProxy.UpdateMgmtSetting(c, p)
+		}, p.AdminMiddleware())
+	}
 
 	// Rancher Norman API
 	normanGroup := rancherProxyGroup.Group("/v3")
 	normanGroup.Use(p.SetSecureCacheContentMiddleware)
 	// Rancher Norman API (secure)
 	normanGroup.Use(p.SessionMiddleware())
-	normanGroup.GET("/users", normanProxy.GetUser)
+	normanGroup.GET("/users", func(c echo.Context) error {
+		return normanProxy.GetUser(c, p)
+	})
 	normanGroup.POST("/tokens", func(c echo.Context) error {
 		return normanProxy.TokenLogout(c, p)
 	})
 	normanGroup.GET("/principals", normanProxy.GetPrincipals)
 	normanGroup.GET("/schemas", normanProxy.NormanSchemas)
+	normanGroup.GET("/schemas/:id", normanProxy.NormanSchema)
 
 	// Rancher Norman API (public)
 	normanPublicGroup := rancherProxyGroup.Group("/v3-public")
@@ -219,16 +259,19 @@ func (epinio *Epinio) AddRootGroupRoutes(echoGroup *echo.Group) {
 		return p.GetStratosAuthService().Login(c)
 	})
 
-	epinioDexEnabled, _ := p.Env().Bool("EPINIO_DEX_ENABLED")
-	if epinioDexEnabled {
-		normanPublicGroup.POST("/authProviders/"+normanProxy.RancherEpinioAuthProvider+"/login", func(c echo.Context) error {
+	if epinio.dexSettings != nil {
+		oidcLogin := func(c echo.Context) error {
 			c.Set("auth_type", "oidc")
 			return p.GetStratosAuthService().Login(c)
-		})
+		}
+		normanPublicGroup.POST("/authProviders/"+normanProxy.RancherEpinioAuthProvider+"/login", oidcLogin)
+		for _, connector := range epinio.dexSettings.Connectors {
+			normanPublicGroup.POST("/authProviders/"+normanProxy.ConnectorAuthProviderID(connector.ID)+"/login", oidcLogin)
+		}
 	}
 
 	normanPublicGroup.GET("/authProviders", func(c echo.Context) error {
-		return normanProxy.GetAuthProviders(c, epinio.portalProxy)
+		return normanProxy.GetAuthProviders(c, epinio.dexSettings)
 	})
 
 	// Dex (public)
@@ -236,7 +279,7 @@ func (epinio *Epinio) AddRootGroupRoutes(echoGroup *echo.Group) {
 	dexGroup.Use(p.SetSecureCacheContentMiddleware)
 
 	dexGroup.GET("/redirectUrl", func(c echo.Context) error {
-		return epinioDex.RedirectUrl(c, epinio.portalProxy)
+		return epinioDex.RedirectUrl(c, epinio.portalProxy, epinio.dexSettings)
 	})
 
 }
@@ -249,59 +292,72 @@ func (epinio *Epinio) Init() error {
 	// Add logout hook to automatically disconnect the Epinio instance when the user logs out
 	epinio.portalProxy.AddLogoutHook(0, epinio.logoutHook)
 
-	cnsiName := "default" // This must match EPINIO_STANDALONE_CLUSTER_ID in front end
-	apiEndpoint := epinio.epinioApiUrl
-	apiWsUrl := epinio.epinioApiWsUrl
-	apiAuthUrl := epinio.epinioAuthUrl
-	skipSSLValidation := epinio.epinioApiUrlskipSSLValidation
-	fetchInfo := epinio.Info
-
-	if epinioCnsi, err := epinio_utils.FindEpinioEndpoint(epinio.portalProxy); err == nil {
+	existing, err := epinio_utils.FindEpinioEndpoints(epinio.portalProxy)
+	if err != nil {
+		existing = make([]*interfaces.CNSIRecord, 0)
+	}
 
-		if epinioCnsi.APIEndpoint.String() == apiEndpoint && epinioCnsi.DopplerLoggingEndpoint == apiWsUrl && epinioCnsi.AuthorizationEndpoint == apiAuthUrl {
-			// skip
-			log.Infof("Found existing endpoint %s as \"%s\" (%s) with the same API & WS API. Skipping auto-registration", apiEndpoint, cnsiName, epinioCnsi.GUID)
-			return nil
+	// Remove any endpoint that's no longer configured, or whose config has changed
+	registered := make(map[string]bool)
+	for _, epinioCnsi := range existing {
+		cluster, err := epinio.findCluster(epinioCnsi.APIEndpoint.String())
+		if err == nil && cluster.Name == epinioCnsi.Name && epinioCnsi.DopplerLoggingEndpoint == cluster.WSSURL && epinioCnsi.AuthorizationEndpoint == cluster.AuthURL {
+			log.Infof("Found existing endpoint %s as \"%s\" (%s) with the same API & WS API. Skipping auto-registration", cluster.APIURL, cluster.Name, epinioCnsi.GUID)
+			registered[cluster.Name] = true
+			continue
 		}
 
-		log.Infof("Found existing endpoint %s as \"%s\" (%s). Removing in case of updates", apiEndpoint, cnsiName, epinioCnsi.GUID)
-
-		cnsiRepo, err := epinio.portalProxy.GetStoreFactory().EndpointStore()
-		if err != nil {
-			msg := "unable to establish a cnsi database reference: '%v'"
-			log.Errorf(msg, err)
-			return fmt.Errorf(msg, err)
+		log.Infof("Found existing endpoint %s as \"%s\" (%s). Removing in case of updates", epinioCnsi.APIEndpoint.String(), epinioCnsi.Name, epinioCnsi.GUID)
+		if err := epinio.removeEndpoint(epinioCnsi); err != nil {
+			return err
 		}
+	}
 
-		// Delete the endpoint
-		err = cnsiRepo.Delete(epinioCnsi.GUID)
-		if err != nil {
-			msg := "unable to delete existing epinio record: %v"
-			log.Errorf(msg, err)
-			return fmt.Errorf(msg, err)
+	for _, cluster := range epinio.clusters {
+		if registered[cluster.Name] {
+			continue
 		}
 
-		tokenRepo, err := epinio.portalProxy.GetStoreFactory().TokenStore()
-		if err != nil {
-			msg := "unable to establish a token database reference: '%v'"
-			log.Errorf(msg, err)
-			return fmt.Errorf(msg, err)
-		}
+		epinioCnsi, err := epinio.portalProxy.DoRegisterEndpoint(cluster.Name, cluster.APIURL, cluster.SkipSSLValidation, "", "", false, "", epinio.Info)
+		log.Infof("Auto-registering epinio endpoint %s as \"%s\" (%s)", cluster.APIURL, cluster.Name, epinioCnsi.GUID)
 
-		err = tokenRepo.DeleteCNSITokens(epinioCnsi.GUID)
 		if err != nil {
-			msg := "unable to delete epinio Tokens: %v"
-			log.Errorf(msg, err)
-			return fmt.Errorf(msg, err)
+			log.Errorf("Could not auto-register Epinio endpoint: %v. %+v", err, epinioCnsi)
 		}
 	}
 
-	epinioCnsi, err := epinio.portalProxy.DoRegisterEndpoint(cnsiName, apiEndpoint, skipSSLValidation, "", "", false, "", fetchInfo)
-	log.Infof("Auto-registering epinio endpoint %s as \"%s\" (%s)", apiEndpoint, cnsiName, epinioCnsi.GUID)
+	return nil
+}
+
+// removeEndpoint removes a registered epinio endpoint and all of its tokens
+func (epinio *Epinio) removeEndpoint(epinioCnsi *interfaces.CNSIRecord) error {
+	cnsiRepo, err := epinio.portalProxy.GetStoreFactory().EndpointStore()
+	if err != nil {
+		msg := "unable to establish a cnsi database reference: '%v'"
+		log.Errorf(msg, err)
+		return fmt.Errorf(msg, err)
+	}
+
+	// Delete the endpoint
+	err = cnsiRepo.Delete(epinioCnsi.GUID)
+	if err != nil {
+		msg := "unable to delete existing epinio record: %v"
+		log.Errorf(msg, err)
+		return fmt.Errorf(msg, err)
+	}
+
+	tokenRepo, err := epinio.portalProxy.GetStoreFactory().TokenStore()
+	if err != nil {
+		msg := "unable to establish a token database reference: '%v'"
+		log.Errorf(msg, err)
+		return fmt.Errorf(msg, err)
+	}
 
+	err = tokenRepo.DeleteCNSITokens(epinioCnsi.GUID)
 	if err != nil {
-		log.Errorf("Could not auto-register Epinio endpoint: %v. %+v", err, epinioCnsi)
-		return nil
+		msg := "unable to delete epinio Tokens: %v"
+		log.Errorf(msg, err)
+		return fmt.Errorf(msg, err)
 	}
 
 	return nil
@@ -311,17 +367,24 @@ func (epinio *Epinio) Info(apiEndpoint string, skipSSLValidation bool) (interfac
 	log.Debug("Info")
 	v2InfoResponse := interfaces.V2Info{}
 
+	cluster, err := epinio.findCluster(apiEndpoint)
+	if err != nil {
+		// Endpoint registered outside of the cluster config, use the settings of the first (default) cluster
+		log.Debugf("%v, using settings of cluster `%s`", err, epinio.clusters[0].Name)
+		cluster = &epinio.clusters[0]
+	}
+
 	newCNSI := interfaces.CNSIRecord{
 		CNSIType:               eInterfaces.EndpointType,
-		DopplerLoggingEndpoint: epinio.epinioApiWsUrl,
-		AuthorizationEndpoint:  epinio.epinioAuthUrl,
+		DopplerLoggingEndpoint: cluster.WSSURL,
+		AuthorizationEndpoint:  cluster.AuthURL,
 	}
 
 	// marshal Epinio metadata into the CNSIRecord
 	marshalledMetadata, err := json.Marshal(eInterfaces.CNSIMetadata{
-		UIURL:      epinio.epinioUiUrl,
-		DexAuthUrl: epinio.epinioAuthUrl,
-		DexIssuer:  epinio.epinioDexIssuer,
+		UIURL:      cluster.UIURL,
+		DexAuthUrl: cluster.AuthURL,
+		DexIssuer:  cluster.DexIssuer,
 	})
 	if err != nil {
 		return newCNSI, v2InfoResponse, err
@@ -335,49 +398,65 @@ func (epinio *Epinio) UpdateMetadata(info *interfaces.Info, userGUID string, ech
 }
 
 func (epinio *Epinio) loginHook(context echo.Context) error {
-	log.Infof("Determining if user should auto-connect to %s.", epinio.epinioApiUrl)
+	log.Info("Determining which epinio clusters the user should auto-connect to.")
 
 	_, err := epinio.portalProxy.GetSessionStringValue(context, "user_id")
 	if err != nil {
 		return fmt.Errorf("could not determine user_id from session: %s", err)
 	}
 
-	epinioCnsi, err := epinio.portalProxy.GetCNSIRecordByEndpoint(epinio.epinioApiUrl)
-	if err != nil {
+	endpoints, err := epinio_utils.FindEpinioEndpoints(epinio.portalProxy)
+	if err != nil || len(endpoints) == 0 {
 		err := "could not find pre-registered epinio instance"
 		log.Warnf(err)
 		return errors.New(err)
 	}
 
-	log.Info("Auto-connecting to the auto-registered endpoint with credentials")
-	_, err = epinio.portalProxy.DoLoginToCNSI(context, epinioCnsi.GUID, false)
-	if err != nil {
-		log.Warnf("Could not auto-connect using credentials to auto-registered endpoint: %s", err.Error())
-		return err
+	loginCluster, _ := context.Get(epinio_utils.LoginClusterContextKey).(string)
+	token, _ := context.Get("token").(*interfaces.TokenRecord)
+
+	for _, epinioCnsi := range endpoints {
+		isLoginCluster := loginCluster == "" || epinioCnsi.GUID == loginCluster
+
+		// Dex tokens are issued by the Dex instance of a specific cluster, so only connect to that one
+		if token != nil && token.AuthType == interfaces.AuthTypeDex && !isLoginCluster {
+			continue
+		}
+
+		log.Infof("Auto-connecting to the auto-registered endpoint \"%s\" with credentials", epinioCnsi.Name)
+		_, err = epinio.portalProxy.DoLoginToCNSI(context, epinioCnsi.GUID, false)
+		if err != nil {
+			log.Warnf("Could not auto-connect using credentials to auto-registered endpoint \"%s\": %s", epinioCnsi.Name, err.Error())
+			if isLoginCluster {
+				return err
+			}
+		}
 	}
+
 	return nil
 }
 
 func (epinio *Epinio) logoutHook(context echo.Context) error {
-	log.Infof("Determining if user should auto-connect to %s.", epinio.epinioApiUrl)
+	log.Info("Disconnecting user from epinio clusters.")
 
 	userGUID, err := epinio.portalProxy.GetSessionStringValue(context, "user_id")
 	if err != nil {
 		return fmt.Errorf("could not determine user_id from session: %s", err)
 	}
 
-	epinioCnsi, err := epinio.portalProxy.GetCNSIRecordByEndpoint(epinio.epinioApiUrl)
-	if err != nil {
+	endpoints, err := epinio_utils.FindEpinioEndpoints(epinio.portalProxy)
+	if err != nil || len(endpoints) == 0 {
 		err := "could not find pre-registered epinio instance"
 		log.Warnf(err)
 		return errors.New(err)
 	}
 
-	log.Info("Auto-connecting to the auto-registered endpoint with credentials")
-	err = epinio.portalProxy.DeleteEndpointToken(epinioCnsi.GUID, userGUID)
-	if err != nil {
-		log.Warnf("Could not auto-disconnect creds to auto-registered endpoint: %s", err.Error())
-		return err
+	for _, epinioCnsi := range endpoints {
+		err = epinio.portalProxy.DeleteEndpointToken(epinioCnsi.GUID, userGUID)
+		if err != nil {
+			log.Warnf("Could not auto-disconnect creds to auto-registered endpoint \"%s\": %s", epinioCnsi.Name, err.Error())
+			return err
+		}
 	}
 	return nil
 }
@@ -56,6 +56,10 @@ type AuthProvider struct {
 	Links       map[string]string `json:"links"`
 	BaseType    string            `json:"baseType"`
 	RedirectUrl string            `json:"redirectUrl"`
+	// Dex connector specific
+	ConnectorID string `json:"connectorId,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	Icon        string `json:"icon,omitempty"`
 }
 
 type Collection struct {
@@ -134,6 +138,8 @@ type User struct {
 	Me                 bool              `json:"me"`
 	Enabled            bool              `json:"enabled"`
 	PrinicpalIDs       []string          `json:"principalIds"`
+	Admin              bool              `json:"admin"`
+	Roles              []string          `json:"roles"`
 }
 
 type Principal struct {
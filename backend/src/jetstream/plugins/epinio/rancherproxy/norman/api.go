@@ -1,9 +1,13 @@
 package norman
 
 import (
+	"net/http"
+
+	"github.com/epinio/ui/backend/src/jetstream/dex"
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/api"
 
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/schemas"
 	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 
 	"github.com/labstack/echo/v4"
@@ -11,19 +15,18 @@ import (
 
 // Get the available auth providers
 // /v3/authProviders
-func GetAuthProviders(ec echo.Context, p jInterfaces.PortalProxy) error {
-	col, err := NewAuthProviders(ec, p)
+func GetAuthProviders(ec echo.Context, dexSettings *dex.Settings) error {
+	return api.SendResponse(ec, NewAuthProviders(ec, dexSettings))
+}
 
+// /v3/users
+func GetUser(ec echo.Context, p jInterfaces.PortalProxy) error {
+	connectedUser, err := p.GetStratosAuthService().GetUser(ec.Get("user_id").(string))
 	if err != nil {
 		return err
 	}
 
-	return api.SendResponse(ec, col)
-}
-
-// /v3/users
-func GetUser(ec echo.Context) error {
-	user := NewUser(interfaces.GetSelfLink(ec), ec.Get("user_id").(string))
+	user := NewUser(interfaces.GetSelfLink(ec), connectedUser)
 
 	return api.SendResponse(ec, user)
 }
@@ -43,18 +46,18 @@ func GetPrincipals(ec echo.Context) error {
 
 // /v3/schemas
 func NormanSchemas(ec echo.Context) error {
-	col := interfaces.Collection{
-		Type:         interfaces.CollectionType,
-		ResourceType: interfaces.SchemaType,
-		Actions:      make(map[string]string),
-		Links:        make(map[string]string),
-		Revision:     "1",
-	}
+	col := schemas.NewSchemas(ec)
+	col.Revision = "1"
 
-	col.Links["self"] = interfaces.GetSelfLink(ec)
-	col.Data = make([]interface{}, 0)
+	return api.SendResponse(ec, col)
+}
 
-	api.SendResponse(ec, col)
+// /v3/schemas/:id
+func NormanSchema(ec echo.Context) error {
+	schema, ok := schemas.NewSchema(ec, ec.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown schema")
+	}
 
-	return nil
+	return api.SendResponse(ec, schema)
 }
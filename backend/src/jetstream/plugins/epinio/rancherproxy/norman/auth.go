@@ -2,9 +2,11 @@ package norman
 
 import (
 	"fmt"
+	"net/url"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/epinio/ui/backend/src/jetstream/dex"
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
 	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 )
@@ -13,6 +15,27 @@ const (
 	RancherEpinioAuthProvider = "epinio"
 )
 
+// ConnectorAuthProviderID is the id of the auth provider for a specific Dex connector
+func ConnectorAuthProviderID(connectorID string) string {
+	return fmt.Sprintf("%s-%s", RancherEpinioAuthProvider, connectorID)
+}
+
+// NewConnectorAuthProvider creates an auth provider that logs in via a specific Dex connector
+func NewConnectorAuthProvider(ec echo.Context, connector dex.Connector) interfaces.AuthProvider {
+	ap := NewAuthProvider(ec, ConnectorAuthProviderID(connector.ID))
+	ap.ConnectorID = connector.ID
+	ap.DisplayName = connector.Name
+	ap.Icon = connector.Icon
+
+	// The redirect url itself is unique per request, this is where to fetch it from (relative to the rancher proxy,
+	// like the url requested by the login component)
+	query := url.Values{}
+	query.Set("connector_id", connector.ID)
+	ap.Links["redirectUrl"] = "/dex/redirectUrl?" + query.Encode()
+
+	return ap
+}
+
 func NewAuthProvider(ec echo.Context, id string) interfaces.AuthProvider {
 
 	typ := fmt.Sprintf("%sProvider", id)
@@ -30,7 +53,8 @@ func NewAuthProvider(ec echo.Context, id string) interfaces.AuthProvider {
 	return ap
 }
 
-func NewAuthProviders(ec echo.Context, p jInterfaces.PortalProxy) (*interfaces.Collection, error) {
+// NewAuthProviders lists the local auth provider, and the OIDC one if Dex is enabled (dexSettings isn't nil)
+func NewAuthProviders(ec echo.Context, dexSettings *dex.Settings) *interfaces.Collection {
 	col := interfaces.Collection{
 		Type:         interfaces.CollectionType,
 		ResourceType: interfaces.AuthProviderResourceType,
@@ -40,26 +64,27 @@ func NewAuthProviders(ec echo.Context, p jInterfaces.PortalProxy) (*interfaces.C
 
 	col.Links["self"] = interfaces.GetSelfLink(ec)
 
-	epinioDexEnabled, _ := p.Env().Bool("EPINIO_DEX_ENABLED")
-
-	providerCount := 1
-	if epinioDexEnabled {
-		providerCount = 2
-	}
-
-	col.Data = make([]interface{}, providerCount)
+	col.Data = make([]interface{}, 0)
 
-	col.Data[0] = NewAuthProvider(ec, "local")
+	col.Data = append(col.Data, NewAuthProvider(ec, "local"))
 
-	if epinioDexEnabled {
-		// Note - The auth provider `RedirectUrl` is not created here (it needs to be unique per request)
-		col.Data[1] = NewAuthProvider(ec, RancherEpinioAuthProvider)
+	if dexSettings != nil {
+		// Note - The auth provider `RedirectUrl` is not created here (it needs to be unique per request). Without
+		// connectors the choice is left to Dex
+		if len(dexSettings.Connectors) == 0 {
+			col.Data = append(col.Data, NewAuthProvider(ec, RancherEpinioAuthProvider))
+		}
+		for _, connector := range dexSettings.Connectors {
+			col.Data = append(col.Data, NewConnectorAuthProvider(ec, connector))
+		}
 	}
 
-	return &col, nil
+	return &col
 }
 
-func NewUser(baseURL, name string) *interfaces.Collection {
+func NewUser(baseURL string, connectedUser *jInterfaces.ConnectedUser) *interfaces.Collection {
+	name := connectedUser.Name
+
 	col := interfaces.Collection{
 		Type:         interfaces.CollectionType,
 		ResourceType: interfaces.UserResourceType,
@@ -83,6 +108,8 @@ func NewUser(baseURL, name string) *interfaces.Collection {
 		State:              "active",
 		Actions:            make(map[string]string),
 		Links:              make(map[string]string),
+		Admin:              connectedUser.Admin,
+		Roles:              connectedUser.Scopes,
 	}
 
 	user.PrinicpalIDs = make([]string, 1)
@@ -0,0 +1,54 @@
+package norman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/epinio/ui/backend/src/jetstream/dex"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+)
+
+func TestNewAuthProviders(t *testing.T) {
+	t.Parallel()
+
+	Convey("The auth providers", t, func() {
+		req := httptest.NewRequest(http.MethodGet, "/v3-public/authProviders", nil)
+		ec := echo.New().NewContext(req, httptest.NewRecorder())
+
+		ids := func(col *interfaces.Collection) []string {
+			ids := make([]string, 0)
+			for _, data := range col.Data {
+				ids = append(ids, data.(interfaces.AuthProvider).ID)
+			}
+			return ids
+		}
+
+		Convey("Should only be local without Dex", func() {
+			So(ids(NewAuthProviders(ec, nil)), ShouldResemble, []string{"local"})
+		})
+
+		Convey("Should leave the choice of connector to Dex if none is configured", func() {
+			So(ids(NewAuthProviders(ec, &dex.Settings{})), ShouldResemble, []string{"local", "epinio"})
+		})
+
+		Convey("Should have one provider per connector", func() {
+			col := NewAuthProviders(ec, &dex.Settings{Connectors: []dex.Connector{
+				{ID: "github", Name: "GitHub", Icon: "github"},
+				{ID: "corp-ldap", Name: "Corporate LDAP", Icon: "ldap"},
+			}})
+			So(ids(col), ShouldResemble, []string{"local", "epinio-github", "epinio-corp-ldap"})
+
+			provider := col.Data[2].(interfaces.AuthProvider)
+			So(provider.Type, ShouldEqual, "epinio-corp-ldapProvider")
+			So(provider.ConnectorID, ShouldEqual, "corp-ldap")
+			So(provider.DisplayName, ShouldEqual, "Corporate LDAP")
+			So(provider.Icon, ShouldEqual, "ldap")
+			So(provider.Actions["login"], ShouldEqual, "https://example.com/v3-public/authProviders/epinio-corp-ldap/login")
+			So(provider.Links["redirectUrl"], ShouldEqual, "/dex/redirectUrl?connector_id=corp-ldap")
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package schemas
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+)
+
+//go:embed schemas.yaml
+var schemasYaml []byte
+
+// field describes a resource field, see schemas.yaml
+type field struct {
+	Type        string `yaml:"type" json:"type"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	Required    bool   `yaml:"required" json:"required"`
+	Create      bool   `yaml:"create" json:"create"`
+	Update      bool   `yaml:"update" json:"update"`
+	Nullable    bool   `yaml:"nullable" json:"nullable"`
+	Min         *int   `yaml:"min" json:"min,omitempty"`
+	// Fields are the nested fields of an `object` field
+	Fields map[string]field `yaml:"fields" json:"resourceFields,omitempty"`
+}
+
+// definition describes a resource type, see schemas.yaml
+type definition struct {
+	ID                string           `yaml:"id"`
+	PluralName        string           `yaml:"pluralName"`
+	Namespaced        bool             `yaml:"namespaced"`
+	Proxied           bool             `yaml:"proxied"`
+	EpinioPath        string           `yaml:"epinioPath"`
+	ResourceMethods   []string         `yaml:"resourceMethods"`
+	CollectionMethods []string         `yaml:"collectionMethods"`
+	Fields            map[string]field `yaml:"fields"`
+}
+
+var definitions []definition
+
+func init() {
+	var err error
+	// The file is embedded, parsing it is covered by the tests
+	if definitions, err = loadDefinitions(schemasYaml); err != nil {
+		log.Errorf("Unable to parse rancher proxy schemas: %v", err)
+	}
+}
+
+// loadDefinitions parses the resource types in the format of schemas.yaml
+func loadDefinitions(data []byte) ([]definition, error) {
+	var loaded []definition
+	if err := yaml.UnmarshalStrict(data, &loaded); err != nil {
+		return nil, err
+	}
+
+	for i := range loaded {
+		if len(loaded[i].PluralName) == 0 {
+			loaded[i].PluralName = loaded[i].ID + "s"
+		}
+	}
+
+	return loaded, nil
+}
+
+// NewSchemas creates the collection of all schemas. The self link of the request is used as base for the schema links
+func NewSchemas(ec echo.Context) *interfaces.Collection {
+	col := interfaces.Collection{
+		Type:         interfaces.CollectionType,
+		ResourceType: interfaces.SchemaType,
+		Actions:      make(map[string]string),
+		Links:        make(map[string]string),
+	}
+
+	col.Links["self"] = interfaces.GetSelfLink(ec)
+
+	baseURL := interfaces.GetSelfLink(ec)
+
+	col.Data = make([]interface{}, len(definitions))
+	for i, definition := range definitions {
+		col.Data[i] = newSchema(baseURL, definition)
+	}
+
+	return &col
+}
+
+// NewSchema creates the schema with the given id. The self link of the request is used as base for the schema links
+func NewSchema(ec echo.Context, id string) (*interfaces.Schema, bool) {
+	baseURL := strings.TrimSuffix(interfaces.GetSelfLink(ec), "/"+id)
+
+	for _, definition := range definitions {
+		if definition.ID == id {
+			return newSchema(baseURL, definition), true
+		}
+	}
+
+	return nil, false
+}
+
+func newSchema(baseURL string, definition definition) *interfaces.Schema {
+
+	schema := interfaces.Schema{}
+	schema.ID = definition.ID
+	schema.Type = interfaces.SchemaType
+	schema.Links = make(map[string]string)
+	schema.Links["self"] = fmt.Sprintf("%s/%s", baseURL, definition.ID)
+	if definition.Proxied {
+		// Both /v1/schemas/<id> and /v3/schemas/<id> map to a collection at /v1/<id> or /v3/<id>
+		schema.Links["collection"] = strings.Replace(schema.Links["self"], "/schemas/", "/", 1)
+	}
+	schema.PluralName = definition.PluralName
+	schema.ResourceMethods = definition.ResourceMethods
+	schema.CollectionMethods = definition.CollectionMethods
+
+	schema.ResourceFields = make(map[string]interface{}, len(definition.Fields))
+	for name, field := range definition.Fields {
+		schema.ResourceFields[name] = field
+	}
+
+	schema.Attributes = make(map[string]interface{})
+	schema.Attributes["namespaced"] = definition.Namespaced
+	if len(definition.EpinioPath) > 0 {
+		schema.Attributes["epinioPath"] = definition.EpinioPath
+	}
+
+	return &schema
+}
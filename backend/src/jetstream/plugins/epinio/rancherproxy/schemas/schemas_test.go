@@ -0,0 +1,105 @@
+package schemas
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// checkFields checks the fields of a schema, and the nested fields of its `object` fields
+func checkFields(fields map[string]field) {
+	for name, field := range fields {
+		So(name, ShouldNotContainSubstring, ".")
+		So(field.Type, ShouldNotBeEmpty)
+		if field.Type == "object" {
+			So(field.Fields, ShouldNotBeEmpty)
+			checkFields(field.Fields)
+		} else {
+			So(field.Fields, ShouldBeEmpty)
+		}
+	}
+}
+
+func TestSchemasYaml(t *testing.T) {
+	t.Parallel()
+
+	Convey("The embedded schemas", t, func() {
+		loaded, err := loadDefinitions(schemasYaml)
+		So(err, ShouldBeNil)
+		So(loaded, ShouldNotBeEmpty)
+
+		Convey("Should have unique ids and plural names", func() {
+			ids := make(map[string]bool)
+			for _, definition := range loaded {
+				So(definition.ID, ShouldNotBeEmpty)
+				So(definition.PluralName, ShouldNotBeEmpty)
+				So(ids[definition.ID], ShouldBeFalse)
+				ids[definition.ID] = true
+			}
+		})
+
+		Convey("Should be served by the proxy or by Epinio", func() {
+			for _, definition := range loaded {
+				So(definition.Proxied || strings.HasPrefix(definition.EpinioPath, "/api/v1/"), ShouldBeTrue)
+			}
+		})
+
+		Convey("Should have typed fields, nested fields only in objects", func() {
+			for _, definition := range loaded {
+				So(definition.Fields, ShouldNotBeEmpty)
+				checkFields(definition.Fields)
+			}
+		})
+	})
+
+	Convey("Schemas with unknown keys should be rejected", t, func() {
+		_, err := loadDefinitions([]byte("- id: things\n  feilds: {}\n"))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Missing plural names should default to the id", t, func() {
+		loaded, err := loadDefinitions([]byte("- id: thing\n"))
+		So(err, ShouldBeNil)
+		So(loaded[0].PluralName, ShouldEqual, "things")
+	})
+}
+
+func TestNewSchema(t *testing.T) {
+	t.Parallel()
+
+	Convey("A schema", t, func() {
+		loaded, err := loadDefinitions([]byte(`
+- id: applications
+  namespaced: true
+  epinioPath: /api/v1/namespaces/:namespace/applications
+  resourceMethods: [GET]
+  collectionMethods: [GET]
+  fields:
+    meta:
+      type: object
+      fields:
+        name: {type: string, required: true}
+    status: {type: string}
+`))
+		So(err, ShouldBeNil)
+
+		schema := newSchema("https://example.org/v1/schemas", loaded[0])
+		So(schema.Links["self"], ShouldEqual, "https://example.org/v1/schemas/applications")
+		So(schema.Links, ShouldNotContainKey, "collection")
+		So(schema.Attributes["namespaced"], ShouldBeTrue)
+
+		Convey("Should nest the fields of objects", func() {
+			encoded, err := json.Marshal(schema.ResourceFields)
+			So(err, ShouldBeNil)
+
+			var decoded map[string]map[string]interface{}
+			So(json.Unmarshal(encoded, &decoded), ShouldBeNil)
+			So(decoded["status"], ShouldNotContainKey, "resourceFields")
+			So(decoded["meta"]["resourceFields"], ShouldResemble, map[string]interface{}{
+				"name": map[string]interface{}{"type": "string", "required": true, "create": false, "update": false, "nullable": false},
+			})
+		})
+	})
+}
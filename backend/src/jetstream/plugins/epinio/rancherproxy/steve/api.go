@@ -1,23 +1,80 @@
 package steve
 
 import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/branding"
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/api"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/schemas"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 
 	"github.com/labstack/echo/v4"
 )
 
 // Fetch settings
 // /v1/management.cattle.io.setting
-func MgmtSettings(ec echo.Context) error {
+func MgmtSettings(ec echo.Context, p jInterfaces.PortalProxy) error {
 
-	col := NewDefaultSettings(ec)
+	col, err := NewSettings(ec, p)
+	if err != nil {
+		return err
+	}
 
 	return api.SendResponse(ec, col)
 }
 
+// Fetch a single setting
+// /v1/management.cattle.io.setting/:id
+func MgmtSetting(ec echo.Context, p jInterfaces.PortalProxy) error {
+	definition, ok := findSettingDefinition(ec.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown setting")
+	}
+
+	customized, err := getCustomizedSettings(p)
+	if err != nil {
+		return err
+	}
+
+	assets, err := branding.GetAssets(p, branding.Hostname(ec))
+	if err != nil {
+		return err
+	}
+
+	baseURL := strings.TrimSuffix(interfaces.GetSelfLink(ec), "/"+definition.id)
+	return api.SendResponse(ec, newSetting(baseURL, *definition, customized, assets))
+}
+
+// Update a setting (admin only)
+// /v1/management.cattle.io.setting/:id
+func UpdateMgmtSetting(ec echo.Context, p jInterfaces.PortalProxy) error {
+	var update struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(ec.Request().Body).Decode(&update); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Invalid setting",
+			"Invalid setting: %v", err)
+	}
+
+	userID, _ := ec.Get("user_id").(string)
+	if err := UpdateSetting(p, ec.Param("id"), update.Value, userID); err != nil {
+		return err
+	}
+
+	return MgmtSetting(ec, p)
+}
+
 // /v1/management.cattle.io.cluster
-func Clusters(ec echo.Context) error {
-	col := NewClusters(ec)
+func Clusters(ec echo.Context, p jInterfaces.PortalProxy) error {
+	col, err := NewClusters(ec, p)
+	if err != nil {
+		return err
+	}
 
 	return api.SendResponse(ec, col)
 }
@@ -25,7 +82,17 @@ func Clusters(ec echo.Context) error {
 // /v1/schemas
 func SteveSchemas(ec echo.Context) error {
 
-	col := NewDefaultSchemas(ec)
+	col := schemas.NewSchemas(ec)
 
 	return api.SendResponse(ec, col)
 }
+
+// /v1/schemas/:id
+func SteveSchema(ec echo.Context) error {
+	schema, ok := schemas.NewSchema(ec, ec.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown schema")
+	}
+
+	return api.SendResponse(ec, schema)
+}
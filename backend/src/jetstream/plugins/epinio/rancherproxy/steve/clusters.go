@@ -6,9 +6,11 @@ import (
 	"github.com/labstack/echo/v4"
 
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 )
 
-func NewClusters(ec echo.Context) *interfaces.Collection {
+func NewClusters(ec echo.Context, p jInterfaces.PortalProxy) (*interfaces.Collection, error) {
 	col := interfaces.Collection{
 		Type:         interfaces.CollectionType,
 		ResourceType: interfaces.ClusterResourceType,
@@ -20,13 +22,28 @@ func NewClusters(ec echo.Context) *interfaces.Collection {
 
 	baseURL := interfaces.GetSelfLink(ec)
 
-	col.Data = make([]interface{}, 1)
-	col.Data[0] = NewCluster(baseURL, "default") // Must match EPINIO_STANDALONE_CLUSTER_NAME from front end
+	endpoints, err := epinio_utils.FindEpinioEndpoints(p)
+	if err != nil {
+		return nil, err
+	}
+
+	col.Data = make([]interface{}, len(endpoints))
+	for i, endpoint := range endpoints {
+		col.Data[i] = NewCluster(baseURL, endpoint)
+	}
 
-	return &col
+	return &col, nil
 }
 
-func NewCluster(baseURL, id string) *interfaces.Cluster {
+// NewCluster creates a cluster for the given epinio endpoint. The ID is the endpoint name, the default cluster must
+// match EPINIO_STANDALONE_CLUSTER_NAME from front end
+func NewCluster(baseURL string, endpoint *jInterfaces.CNSIRecord) *interfaces.Cluster {
+	id := endpoint.Name
+	name := id
+	if id == epinio_utils.DefaultClusterName {
+		name = "local"
+	}
+
 	cluster := interfaces.Cluster{}
 	cluster.Actions = make(map[string]string)
 	cluster.APIVersion = "management.cattle.io/v3"
@@ -35,10 +52,13 @@ func NewCluster(baseURL, id string) *interfaces.Cluster {
 	cluster.Links = make(map[string]string)
 	cluster.Links["self"] = fmt.Sprintf("%s/%s", baseURL, id)
 	cluster.Metadata = interfaces.Metadata{
-		Name: "local",
+		Name: name,
 	}
 	cluster.Spec = make(map[string]interface{})
+	cluster.Spec["displayName"] = id
 	cluster.Status = make(map[string]interface{})
+	cluster.Status["apiEndpoint"] = endpoint.APIEndpoint.String()
+	cluster.Status["endpointGuid"] = endpoint.GUID
 	cluster.Type = "management.cattle.io.cluster"
 
 	return &cluster
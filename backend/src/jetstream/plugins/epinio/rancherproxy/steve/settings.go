@@ -1,20 +1,172 @@
 package steve
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/branding"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/brandingstore"
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/console_config"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 )
 
 const (
 	epinioVersion = "EPINIO_VERSION"
 	epinioTheme   = "EPINIO_THEME"
+
+	// settingsGroupName is the console_config group that stores customized settings
+	settingsGroupName = "settings"
+
+	// Customized settings are re-read from the database after this time, so that changes made via another replica
+	// are picked up
+	settingsCacheTTL = 10 * time.Second
+
+	maxSettingLength = 256 * 1024
 )
 
-func NewDefaultSettings(ec echo.Context) *interfaces.Collection {
+// settingDefinition describes a setting served by the steve proxy
+type settingDefinition struct {
+	id           string
+	defaultValue func() string
+	// validate is nil for settings that can't be changed
+	validate func(value string) error
+}
+
+var settingDefinitions = []settingDefinition{
+	{
+		id:           "first-login",
+		defaultValue: func() string { return "false" },
+	},
+	{
+		id:           "ui-pl",
+		defaultValue: func() string { return "Epinio" },
+		validate:     validateProductName,
+	},
+	{
+		id:           "server-version",
+		defaultValue: getEpinioVersion,
+	},
+	{
+		id:           "ui-theme",
+		defaultValue: func() string { return os.Getenv(epinioTheme) },
+		validate:     validateTheme,
+	},
+	{
+		id:           "ui-favicon",
+		defaultValue: GetFavicon,
+		validate:     validateFavicon,
+	},
+	{
+		id:           "ui-performance",
+		defaultValue: GetUiPerformanceSettings,
+		validate:     validateJSONObject,
+	},
+	{
+		id:           "ui-banners",
+		defaultValue: func() string { return "{}" },
+		validate:     validateJSONObject,
+	},
+	// Set via branding assets
+	{
+		id:           "ui-logo-light",
+		defaultValue: func() string { return "" },
+	},
+	{
+		id:           "ui-logo-dark",
+		defaultValue: func() string { return "" },
+	},
+	{
+		id:           "ui-primary-color",
+		defaultValue: func() string { return "" },
+	},
+	{
+		id:           "ui-login-text",
+		defaultValue: func() string { return "" },
+	},
+}
+
+// brandedSettings are the settings whose value comes from a branding asset, if one has been uploaded. The value is
+// either the asset's url or, for text assets, its content
+var brandedSettings = map[string]string{
+	"ui-favicon":       branding.AssetFavicon,
+	"ui-logo-light":    branding.AssetLogo,
+	"ui-logo-dark":     branding.AssetLogo,
+	"ui-primary-color": branding.AssetPrimaryColor,
+	"ui-login-text":    branding.AssetLoginText,
+}
+
+// settingsCache holds the customized settings, shared by all requests
+var settingsCache struct {
+	sync.Mutex
+	values  map[string]string
+	expires time.Time
+}
+
+func findSettingDefinition(id string) (*settingDefinition, bool) {
+	for i := range settingDefinitions {
+		if settingDefinitions[i].id == id {
+			return &settingDefinitions[i], true
+		}
+	}
+	return nil, false
+}
+
+func getEpinioVersion() string {
+	epinioVersion := os.Getenv(epinioVersion)
+	if epinioVersion == "" {
+		epinioVersion = "unknown"
+	}
+	return epinioVersion
+}
+
+func getSettingsStore(p jInterfaces.PortalProxy) (console_config.Repository, error) {
+	return console_config.NewPostgresConsoleConfigRepository(p.GetDatabaseConnection())
+}
+
+// getCustomizedSettings returns the settings changed by an admin
+func getCustomizedSettings(p jInterfaces.PortalProxy) (map[string]string, error) {
+	settingsCache.Lock()
+	defer settingsCache.Unlock()
+
+	if settingsCache.values != nil && time.Now().Before(settingsCache.expires) {
+		return settingsCache.values, nil
+	}
+
+	store, err := getSettingsStore(p)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := store.GetValues(settingsGroupName)
+	if err != nil {
+		return nil, err
+	}
+
+	settingsCache.values = values
+	settingsCache.expires = time.Now().Add(settingsCacheTTL)
+
+	return values, nil
+}
+
+func invalidateSettingsCache() {
+	settingsCache.Lock()
+	defer settingsCache.Unlock()
+	settingsCache.values = nil
+}
+
+func NewSettings(ec echo.Context, p jInterfaces.PortalProxy) (*interfaces.Collection, error) {
 	col := interfaces.Collection{
 		Type:         interfaces.CollectionType,
 		ResourceType: interfaces.SettingsResourceType,
@@ -26,26 +178,49 @@ func NewDefaultSettings(ec echo.Context) *interfaces.Collection {
 
 	baseURL := interfaces.GetSelfLink(ec)
 
-	epinioVersion := os.Getenv(epinioVersion)
-	if epinioVersion == "" {
-		epinioVersion = "unknown"
+	customized, err := getCustomizedSettings(p)
+	if err != nil {
+		// Don't lock everyone out of the UI, fall back on the defaults
+		log.Errorf("Unable to fetch customized settings: %v", err)
+		customized = make(map[string]string)
 	}
 
-	epinioTheme := os.Getenv(epinioTheme)
-	if epinioTheme == "" {
-		epinioTheme = ""
+	assets, err := branding.GetAssets(p, branding.Hostname(ec))
+	if err != nil {
+		log.Errorf("Unable to fetch branding: %v", err)
+		assets = make(map[string]*brandingstore.Asset)
 	}
 
-	col.Data = make([]interface{}, 6)
 	// Visible to all, regardless of auth
-	col.Data[0] = NewStringSettings(baseURL, "first-login", "false")
-	col.Data[1] = NewStringSettings(baseURL, "ui-pl", "Epinio")
-	col.Data[2] = NewStringSettings(baseURL, "server-version", epinioVersion)
-	col.Data[3] = NewStringSettings(baseURL, "ui-theme", epinioTheme)
-	col.Data[4] = NewStringSettings(baseURL, "ui-favicon", GetFavicon())
-	col.Data[5] = NewStringSettings(baseURL, "ui-performance", GetUiPerformanceSettings())
+	col.Data = make([]interface{}, len(settingDefinitions))
+	for i, definition := range settingDefinitions {
+		col.Data[i] = newSetting(baseURL, definition, customized, assets)
+	}
 
-	return &col
+	return &col, nil
+}
+
+// newSetting creates a setting. Branding for the request's hostname takes precedence over customized values, which
+// take precedence over the default
+func newSetting(baseURL string, definition settingDefinition, customized map[string]string, assets map[string]*brandingstore.Asset) *interfaces.Setting {
+	setting := NewStringSettings(baseURL, definition.id, definition.defaultValue())
+	if definition.validate != nil {
+		// Tells the shell the setting can be changed
+		setting.Links["update"] = setting.Links["self"]
+	}
+	if value, ok := customized[definition.id]; ok && definition.validate != nil {
+		setting.Value = value
+		setting.Customized = true
+	}
+	if asset, ok := assets[brandedSettings[definition.id]]; ok {
+		if strings.HasPrefix(asset.ContentType, "text/") {
+			setting.Value = string(asset.Content)
+		} else {
+			setting.Value = branding.AssetURL(asset)
+		}
+		setting.Customized = true
+	}
+	return setting
 }
 
 func NewStringSettings(baseURL, id, value string) *interfaces.Setting {
@@ -64,6 +239,102 @@ func NewStringSettings(baseURL, id, value string) *interfaces.Setting {
 	return &setting
 }
 
+// UpdateSetting validates and stores a new value for a setting. Setting the default value removes the customization
+func UpdateSetting(p jInterfaces.PortalProxy, id, value, userID string) error {
+	definition, ok := findSettingDefinition(id)
+	if !ok {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusNotFound,
+			"Unknown setting",
+			"Unknown setting: %s", id)
+	}
+
+	if definition.validate == nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusForbidden,
+			"Setting can not be changed",
+			"Setting can not be changed: %s", id)
+	}
+
+	if len(value) > maxSettingLength {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Setting value is too large",
+			"Setting value is too large: %s (%d bytes)", id, len(value))
+	}
+
+	if err := definition.validate(value); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid value for %s: %v", id, err),
+			"Invalid value for setting %s: %v", id, err)
+	}
+
+	store, err := getSettingsStore(p)
+	if err != nil {
+		return err
+	}
+
+	if value == definition.defaultValue() {
+		err = store.DeleteValue(settingsGroupName, id)
+	} else {
+		err = store.SetValue(settingsGroupName, id, value)
+	}
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to store setting",
+			"Unable to store setting %s: %v", id, err)
+	}
+
+	invalidateSettingsCache()
+	log.Infof("Setting `%s` changed by user `%s`", id, userID)
+
+	return nil
+}
+
+func validateProductName(value string) error {
+	if len(strings.TrimSpace(value)) == 0 {
+		return errors.New("must not be empty")
+	}
+	if len(value) > 100 {
+		return errors.New("must be at most 100 characters")
+	}
+	return nil
+}
+
+func validateTheme(value string) error {
+	switch value {
+	case "", "ui-light", "ui-dark", "ui-auto":
+		return nil
+	}
+	return errors.New("must be one of ui-light, ui-dark or ui-auto")
+}
+
+func validateFavicon(value string) error {
+	if strings.HasPrefix(value, "https://") {
+		_, err := url.ParseRequestURI(value)
+		return err
+	}
+
+	for _, prefix := range []string{"data:image/png;base64,", "data:image/x-icon;base64,", "data:image/svg+xml;base64,"} {
+		if strings.HasPrefix(value, prefix) {
+			_, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+			return err
+		}
+	}
+
+	return errors.New("must be an https url or a base64 encoded png, ico or svg data url")
+}
+
+func validateJSONObject(value string) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &obj); err != nil || obj == nil {
+		return errors.New("must be a json object")
+	}
+	return nil
+}
+
 func GetUiPerformanceSettings() string {
 
 	raw := []byte(`{
@@ -0,0 +1,163 @@
+package steve
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const (
+	findConfigValueSQL   = `SELECT name, value, last_updated FROM config WHERE (.+)`
+	insertConfigValueSQL = `INSERT INTO config`
+	updateConfigValueSQL = `UPDATE config SET`
+	deleteConfigValueSQL = `DELETE FROM config WHERE`
+)
+
+// testPortalProxy only provides the database connection
+type testPortalProxy struct {
+	jInterfaces.PortalProxy
+	db *sql.DB
+}
+
+func (p *testPortalProxy) GetDatabaseConnection() *sql.DB {
+	return p.db
+}
+
+// errorStatus returns the status of an http (shadow) error
+func errorStatus(err error) int {
+	if shadowErr, ok := err.(jInterfaces.ErrHTTPShadow); ok {
+		return shadowErr.HTTPError.Code
+	}
+	return 0
+}
+
+func TestNewSetting(t *testing.T) {
+	t.Parallel()
+
+	Convey("A setting", t, func() {
+		baseURL := "https://example.org/v1/management.cattle.io.settings"
+
+		Convey("Should have an update link if it can be changed", func() {
+			definition, ok := findSettingDefinition("ui-pl")
+			So(ok, ShouldBeTrue)
+
+			setting := newSetting(baseURL, *definition, map[string]string{}, nil)
+			So(setting.Links["update"], ShouldEqual, baseURL+"/ui-pl")
+		})
+
+		Convey("Should not have an update link if it is read-only", func() {
+			definition, ok := findSettingDefinition("server-version")
+			So(ok, ShouldBeTrue)
+
+			setting := newSetting(baseURL, *definition, map[string]string{}, nil)
+			So(setting.Links, ShouldNotContainKey, "update")
+		})
+	})
+}
+
+func TestSettingValidators(t *testing.T) {
+	t.Parallel()
+
+	Convey("Setting values", t, func() {
+		tests := []struct {
+			name     string
+			validate func(string) error
+			value    string
+			valid    bool
+		}{
+			{"A product name", validateProductName, "My Epinio", true},
+			{"An empty product name", validateProductName, "  ", false},
+			{"A long product name", validateProductName, strings.Repeat("a", 101), false},
+			{"A theme", validateTheme, "ui-dark", true},
+			{"No theme", validateTheme, "", true},
+			{"An unknown theme", validateTheme, "ui-pink", false},
+			{"A favicon url", validateFavicon, "https://example.org/favicon.ico", true},
+			{"An insecure favicon url", validateFavicon, "http://example.org/favicon.ico", false},
+			{"A favicon data url", validateFavicon, "data:image/png;base64,iVBORw0KGgo=", true},
+			{"A favicon data url that's not base64", validateFavicon, "data:image/png;base64,not base64", false},
+			{"A favicon data url that's not an image", validateFavicon, "data:text/html;base64,PGgxPg==", false},
+			{"A json object", validateJSONObject, `{"enabled": true}`, true},
+			{"A json array", validateJSONObject, `[]`, false},
+			{"Json null", validateJSONObject, `null`, false},
+			{"Not json", validateJSONObject, `{enabled}`, false},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				So(test.validate(test.value) == nil, ShouldEqual, test.valid)
+			})
+		}
+	})
+}
+
+func TestUpdateSetting(t *testing.T) {
+	t.Parallel()
+
+	Convey("Updating a setting", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer db.Close()
+		p := &testPortalProxy{db: db}
+
+		Convey("Should store a valid value", func() {
+			mock.ExpectQuery(findConfigValueSQL).WithArgs(settingsGroupName, "ui-pl").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "value", "last_updated"}))
+			mock.ExpectExec(insertConfigValueSQL).WithArgs(settingsGroupName, "ui-pl", "My Epinio").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			So(UpdateSetting(p, "ui-pl", "My Epinio", "admin"), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should replace a customized value", func() {
+			mock.ExpectQuery(findConfigValueSQL).WithArgs(settingsGroupName, "ui-theme").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "value", "last_updated"}).AddRow("ui-theme", "ui-light", "2026-10-17"))
+			mock.ExpectExec(updateConfigValueSQL).WithArgs("ui-dark", settingsGroupName, "ui-theme").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(UpdateSetting(p, "ui-theme", "ui-dark", "admin"), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should remove the customization when set to the default", func() {
+			mock.ExpectExec(deleteConfigValueSQL).WithArgs(settingsGroupName, "ui-pl").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			So(UpdateSetting(p, "ui-pl", "Epinio", "admin"), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should fail if the value can't be stored", func() {
+			mock.ExpectQuery(findConfigValueSQL).WillReturnError(sql.ErrConnDone)
+
+			So(errorStatus(UpdateSetting(p, "ui-pl", "My Epinio", "admin")), ShouldEqual, http.StatusInternalServerError)
+		})
+
+		tests := []struct {
+			name   string
+			id     string
+			value  string
+			status int
+		}{
+			{"Should reject unknown settings", "ui-unknown", "value", http.StatusNotFound},
+			{"Should reject read-only settings", "server-version", "v1.0.0", http.StatusForbidden},
+			{"Should reject invalid values", "ui-theme", "ui-pink", http.StatusBadRequest},
+			{"Should reject large values", "ui-banners", `{"text": "` + strings.Repeat("a", maxSettingLength) + `"}`, http.StatusBadRequest},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				So(errorStatus(UpdateSetting(p, test.id, test.value, "admin")), ShouldEqual, test.status)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package steve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	epinio_utils "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/utils"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	subscribePollIntervalEnv     = "EPINIO_SUBSCRIBE_POLL_INTERVAL"
+	defaultSubscribePollInterval = 10 * time.Second
+
+	// Steve watch protocol messages
+	subscribeStart  = "resource.start"
+	subscribeStop   = "resource.stop"
+	subscribeError  = "resource.error"
+	subscribeCreate = "resource.create"
+	subscribeChange = "resource.change"
+	subscribeRemove = "resource.remove"
+	subscribePing   = "ping"
+)
+
+// watchedResources are the Epinio resources whose changes are sent to subscribers, by resource type
+var watchedResources = map[string]string{
+	"applications": "/api/v1/applications",
+	"namespaces":   "/api/v1/namespaces",
+}
+
+// staticResources are served by the steve proxy but never change while the user is logged in. Subscribing to them is
+// accepted, no events will be sent
+var staticResources = map[string]bool{
+	"schema":                       true,
+	"management.cattle.io.setting": true,
+	"management.cattle.io.cluster": true,
+	"userpreference":               true,
+}
+
+// subscribeRequest is sent by the client to start or stop watching a resource type
+type subscribeRequest struct {
+	ResourceType    string `json:"resourceType"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Stop            bool   `json:"stop,omitempty"`
+}
+
+// subscribeMessage is sent to the client
+type subscribeMessage struct {
+	Name         string      `json:"name"`
+	ResourceType string      `json:"resourceType,omitempty"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+// watchedResource is the last known state of a resource, used to find changes
+type watchedResource struct {
+	version string
+	object  map[string]interface{}
+}
+
+// subscription bridges changes to Epinio resources, found by polling the Epinio API, to a Steve subscribe socket
+type subscription struct {
+	p        jInterfaces.PortalProxy
+	ws       *websocket.Conn
+	cnsiGUID string
+	apiURL   string
+	userID   string
+
+	// watches contains the known state of each watched resource type (nil until the first poll)
+	watches map[string]map[string]watchedResource
+}
+
+// Subscribe emulates Steve's watch protocol
+// /v1/subscribe
+func Subscribe(ec echo.Context, p jInterfaces.PortalProxy) error {
+	userID, ok := ec.Get("user_id").(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+
+	epinioCnsi, err := epinio_utils.FindLoginEndpoint(p, ec)
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Unknown Epinio cluster",
+			"Unknown Epinio cluster: %+v",
+			err,
+		)
+	}
+
+	ws, pingTicker, err := jInterfaces.UpgradeToWebSocket(ec)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	defer pingTicker.Stop()
+
+	s := &subscription{
+		p:        p,
+		ws:       ws,
+		cnsiGUID: epinioCnsi.GUID,
+		apiURL:   epinioCnsi.APIEndpoint.String(),
+		userID:   userID,
+		watches:  make(map[string]map[string]watchedResource),
+	}
+
+	return s.run(subscribePollInterval(p))
+}
+
+func subscribePollInterval(p jInterfaces.PortalProxy) time.Duration {
+	seconds, err := strconv.Atoi(p.Env().String(subscribePollIntervalEnv, ""))
+	if err != nil || seconds <= 0 {
+		return defaultSubscribePollInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (s *subscription) run(pollInterval time.Duration) error {
+	requests := make(chan subscribeRequest)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	// All writes happen in this go routine, the reader only passes on requests
+	go func() {
+		defer close(closed)
+		for {
+			var request subscribeRequest
+			if err := s.ws.ReadJSON(&request); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Debugf("Steve subscribe socket closed: %v", err)
+				}
+				return
+			}
+			select {
+			case requests <- request:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	pollTicker := time.NewTicker(pollInterval)
+	defer pollTicker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case request := <-requests:
+			if err := s.handleRequest(request); err != nil {
+				return nil
+			}
+		case <-pollTicker.C:
+			if err := s.send(subscribeMessage{Name: subscribePing, Data: map[string]interface{}{}}); err != nil {
+				return nil
+			}
+			for resourceType := range s.watches {
+				if err := s.poll(resourceType); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// handleRequest starts or stops watching a resource type. An error is only returned if the socket can't be written to
+func (s *subscription) handleRequest(request subscribeRequest) error {
+	resourceType := request.ResourceType
+
+	if request.Stop {
+		delete(s.watches, resourceType)
+		return s.send(subscribeMessage{Name: subscribeStop, ResourceType: resourceType})
+	}
+
+	if _, ok := watchedResources[resourceType]; ok {
+		// The first poll records the current state, the client has fetched it already
+		s.watches[resourceType] = nil
+		if err := s.send(subscribeMessage{Name: subscribeStart, ResourceType: resourceType}); err != nil {
+			return err
+		}
+		return s.poll(resourceType)
+	}
+
+	if staticResources[resourceType] {
+		return s.send(subscribeMessage{Name: subscribeStart, ResourceType: resourceType})
+	}
+
+	if err := s.send(subscribeMessage{
+		Name:         subscribeError,
+		ResourceType: resourceType,
+		Data:         map[string]string{"error": fmt.Sprintf("resource type %s can not be watched", resourceType)},
+	}); err != nil {
+		return err
+	}
+	return s.send(subscribeMessage{Name: subscribeStop, ResourceType: resourceType})
+}
+
+// poll fetches the current state of a resource type and sends the differences to the last known state
+func (s *subscription) poll(resourceType string) error {
+	current, err := s.fetch(resourceType)
+	if err != nil {
+		log.Warnf("Unable to fetch %s for steve subscription: %v", resourceType, err)
+		return s.send(subscribeMessage{
+			Name:         subscribeError,
+			ResourceType: resourceType,
+			Data:         map[string]string{"error": fmt.Sprintf("unable to fetch %s", resourceType)},
+		})
+	}
+
+	previous := s.watches[resourceType]
+	s.watches[resourceType] = current
+
+	if previous == nil {
+		return nil
+	}
+
+	for _, message := range diffResources(resourceType, previous, current) {
+		if err = s.send(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diffResources returns the messages that bring a client from the previous to the current state of a resource type,
+// ordered by resource id
+func diffResources(resourceType string, previous, current map[string]watchedResource) []subscribeMessage {
+	messages := make([]subscribeMessage, 0)
+
+	for _, id := range sortedIDs(current) {
+		resource := current[id]
+		old, existed := previous[id]
+		switch {
+		case !existed:
+			messages = append(messages, subscribeMessage{Name: subscribeCreate, ResourceType: resourceType, Data: resource.object})
+		case old.version != resource.version:
+			messages = append(messages, subscribeMessage{Name: subscribeChange, ResourceType: resourceType, Data: resource.object})
+		}
+	}
+
+	for _, id := range sortedIDs(previous) {
+		if _, exists := current[id]; !exists {
+			messages = append(messages, subscribeMessage{Name: subscribeRemove, ResourceType: resourceType, Data: previous[id].object})
+		}
+	}
+
+	return messages
+}
+
+func sortedIDs(resources map[string]watchedResource) []string {
+	ids := make([]string, 0, len(resources))
+	for id := range resources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fetch requests a resource type from Epinio, as the user, and returns the resources by id
+func (s *subscription) fetch(resourceType string) (map[string]watchedResource, error) {
+	res, err := s.p.DoProxySingleRequest(s.cnsiGUID, s.userID, http.MethodGet, s.apiURL+watchedResources[resourceType], nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return parseResources(resourceType, res.Response)
+}
+
+// parseResources turns a list of Epinio resources into Steve objects by id. The resource version is a hash of the
+// resource, so that any change to it is found
+func parseResources(resourceType string, body []byte) (map[string]watchedResource, error) {
+	var objects []json.RawMessage
+	if err := json.Unmarshal(body, &objects); err != nil {
+		return nil, err
+	}
+
+	resources := make(map[string]watchedResource, len(objects))
+	for _, raw := range objects {
+		var object map[string]interface{}
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, err
+		}
+
+		var meta struct {
+			Meta struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, err
+		}
+
+		id := meta.Meta.Name
+		if len(meta.Meta.Namespace) > 0 {
+			id = meta.Meta.Namespace + "/" + meta.Meta.Name
+		}
+
+		hash := sha256.Sum256(raw)
+		version := hex.EncodeToString(hash[:])
+
+		// Steve objects are identified by id and type
+		object["id"] = id
+		object["type"] = resourceType
+		object["metadata"] = map[string]interface{}{
+			"name":            meta.Meta.Name,
+			"namespace":       meta.Meta.Namespace,
+			"resourceVersion": version,
+		}
+
+		resources[id] = watchedResource{version: version, object: object}
+	}
+
+	return resources, nil
+}
+
+func (s *subscription) send(message subscribeMessage) error {
+	if err := s.ws.WriteJSON(message); err != nil {
+		log.Debugf("Unable to write to steve subscribe socket: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package steve
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mustParseResources parses a list of Epinio applications
+func mustParseResources(body string) map[string]watchedResource {
+	resources, err := parseResources("applications", []byte(body))
+	So(err, ShouldBeNil)
+	return resources
+}
+
+func TestParseResources(t *testing.T) {
+	t.Parallel()
+
+	Convey("Parsing Epinio resources", t, func() {
+		resources := mustParseResources(`[
+			{"meta": {"name": "app", "namespace": "workspace"}, "status": "running"},
+			{"meta": {"name": "workspace"}}
+		]`)
+		So(resources, ShouldHaveLength, 2)
+
+		Convey("Should identify them by namespace and name", func() {
+			So(resources, ShouldContainKey, "workspace/app")
+			So(resources, ShouldContainKey, "workspace")
+
+			object := resources["workspace/app"].object
+			So(object["id"], ShouldEqual, "workspace/app")
+			So(object["type"], ShouldEqual, "applications")
+			So(object["status"], ShouldEqual, "running")
+		})
+
+		Convey("Should set the resource version", func() {
+			resource := resources["workspace/app"]
+			So(resource.version, ShouldNotBeEmpty)
+			So(resource.object["metadata"], ShouldResemble, map[string]interface{}{
+				"name":            "app",
+				"namespace":       "workspace",
+				"resourceVersion": resource.version,
+			})
+		})
+
+		Convey("Should reject anything but a list", func() {
+			_, err := parseResources("applications", []byte(`{"meta": {"name": "app"}}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Resource versions", t, func() {
+		versionOf := func(body string) string {
+			return mustParseResources("[" + body + "]")["workspace/app"].version
+		}
+		app := `{"meta": {"name": "app", "namespace": "workspace"}, "status": "running"}`
+
+		tests := []struct {
+			name    string
+			body    string
+			changed bool
+		}{
+			{"Should be the same for the same resource", app, false},
+			{"Should change with the status", `{"meta": {"name": "app", "namespace": "workspace"}, "status": "staging"}`, true},
+			{"Should change with new fields", `{"meta": {"name": "app", "namespace": "workspace"}, "status": "running", "image_url": "img"}`, true},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				So(versionOf(test.body) != versionOf(app), ShouldEqual, test.changed)
+			})
+		}
+	})
+}
+
+func TestDiffResources(t *testing.T) {
+	t.Parallel()
+
+	Convey("The difference between two states", t, func() {
+		const (
+			app1        = `{"meta": {"name": "app1", "namespace": "workspace"}, "status": "running"}`
+			app1Changed = `{"meta": {"name": "app1", "namespace": "workspace"}, "status": "staging"}`
+			app2        = `{"meta": {"name": "app2", "namespace": "workspace"}, "status": "running"}`
+		)
+
+		tests := []struct {
+			name     string
+			previous string
+			current  string
+			messages []string
+		}{
+			{"Should be empty if nothing changed", "[" + app1 + "," + app2 + "]", "[" + app2 + "," + app1 + "]", []string{}},
+			{"Should create new resources", "[" + app1 + "]", "[" + app1 + "," + app2 + "]", []string{subscribeCreate + " workspace/app2"}},
+			{"Should change changed resources", "[" + app1 + "," + app2 + "]", "[" + app1Changed + "," + app2 + "]", []string{subscribeChange + " workspace/app1"}},
+			{"Should remove removed resources", "[" + app1 + "," + app2 + "]", "[" + app2 + "]", []string{subscribeRemove + " workspace/app1"}},
+			{"Should create everything after an empty state", "[]", "[" + app2 + "," + app1 + "]", []string{subscribeCreate + " workspace/app1", subscribeCreate + " workspace/app2"}},
+			{"Should remove everything if nothing is left", "[" + app1 + "," + app2 + "]", "[]", []string{subscribeRemove + " workspace/app1", subscribeRemove + " workspace/app2"}},
+			{"Should combine changes, creations before removals", "[" + app1 + "]", "[" + app2 + "]", []string{subscribeCreate + " workspace/app2", subscribeRemove + " workspace/app1"}},
+		}
+
+		for _, test := range tests {
+			test := test
+			Convey(test.name, func() {
+				messages := diffResources("applications", mustParseResources(test.previous), mustParseResources(test.current))
+
+				summary := make([]string, len(messages))
+				for i, message := range messages {
+					So(message.ResourceType, ShouldEqual, "applications")
+					summary[i] = message.Name + " " + message.Data.(map[string]interface{})["id"].(string)
+				}
+				So(summary, ShouldResemble, test.messages)
+			})
+		}
+
+		Convey("Should send the current state of changed resources", func() {
+			messages := diffResources("applications", mustParseResources("["+app1+"]"), mustParseResources("["+app1Changed+"]"))
+			So(messages, ShouldHaveLength, 1)
+			So(messages[0].Data.(map[string]interface{})["status"], ShouldEqual, "staging")
+		})
+
+		Convey("Should send the last known state of removed resources", func() {
+			messages := diffResources("applications", mustParseResources("["+app1+"]"), mustParseResources("[]"))
+			So(messages, ShouldHaveLength, 1)
+			So(messages[0].Data.(map[string]interface{})["status"], ShouldEqual, "running")
+		})
+	})
+}
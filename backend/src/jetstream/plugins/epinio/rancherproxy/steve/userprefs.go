@@ -4,9 +4,13 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 
 	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/rancherproxy/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/plugins/epinio/userpreferencesstore"
+	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 
 	"github.com/labstack/echo/v4"
 )
@@ -14,6 +18,15 @@ import (
 //go:embed default_prefs.json
 var DefaultUserPreferences string
 
+const (
+	// maxUserPrefsSize is the largest user preferences update accepted
+	maxUserPrefsSize = 1024 * 1024
+	// maxUserPrefKeyLength matches the size of the pref_key column
+	maxUserPrefKeyLength = 255
+	// maxUserPrefValueLength is the largest (encoded) value of a single preference
+	maxUserPrefValueLength = 64 * 1024
+)
+
 func NewUserPrefCollection() *interfaces.Collection {
 	col := interfaces.Collection{
 		Type:         interfaces.CollectionType,
@@ -35,10 +48,14 @@ func NewUserPref(userId string) *interfaces.UserPref {
 	return &pref
 }
 
-func GetUserPrefs(c echo.Context) error {
+func GetUserPrefs(c echo.Context, p jInterfaces.PortalProxy) error {
+	pref, err := createPref(c, p, true)
+	if err != nil {
+		return err
+	}
+
 	col := NewUserPrefCollection()
 	col.Data = make([]interface{}, 1)
-	pref := createPref(c, true)
 	col.Data[0] = pref
 
 	host := interfaces.GetBaseURL(c)
@@ -50,14 +67,110 @@ func GetUserPrefs(c echo.Context) error {
 }
 
 // Get user profile
-func GetSpecificUserPrefs(c echo.Context) error {
-	return c.JSON(http.StatusOK, createPref(c, false))
+func GetSpecificUserPrefs(c echo.Context, p jInterfaces.PortalProxy) error {
+	pref, err := createPref(c, p, false)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, pref)
 }
 
-func createPref(c echo.Context, isList bool) *interfaces.UserPref {
+// Update user profile. Only the preferences supplied in the request are changed, those set to null are reset to their
+// defaults
+func UpdateUserPrefs(c echo.Context, p jInterfaces.PortalProxy) error {
 	userID := c.Get("user_id").(string)
 
-	data := json.RawMessage(DefaultUserPreferences)
+	defer c.Request().Body.Close()
+	// Read one byte more than allowed, so that oversized updates are rejected rather than truncated
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxUserPrefsSize+1))
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Unable to read user preferences",
+			"Unable to read user preferences: %v", err)
+	}
+	if len(body) > maxUserPrefsSize {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			fmt.Sprintf("User preferences must be at most %d bytes", maxUserPrefsSize),
+			"User preferences update of user %s is too large", userID)
+	}
+
+	var update struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.Unmarshal(body, &update); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			"Invalid user preferences",
+			"Invalid user preferences: %v", err)
+	}
+
+	prefs, reset, err := parseUserPrefs(update.Data)
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid user preferences: %v", err),
+			"Invalid user preferences: %v", err)
+	}
+
+	store, err := userpreferencesstore.NewUserPreferencesDBStore(p.GetDatabaseConnection())
+	if err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to get user preferences store",
+			"Unable to get user preferences store: %v", err)
+	}
+
+	if err = store.Save(userID, prefs, reset); err != nil {
+		return jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to save user preferences",
+			"Unable to save user preferences: %v", err)
+	}
+
+	return GetSpecificUserPrefs(c, p)
+}
+
+// parseUserPrefs splits updated preferences into the values to store and the preferences to reset (null values)
+func parseUserPrefs(data map[string]interface{}) (map[string]string, []string, error) {
+	prefs := make(map[string]string, len(data))
+	reset := make([]string, 0)
+	for key, value := range data {
+		if len(key) > maxUserPrefKeyLength {
+			return nil, nil, fmt.Errorf("preference names must be at most %d characters", maxUserPrefKeyLength)
+		}
+		if value == nil {
+			reset = append(reset, key)
+			continue
+		}
+		// Rancher stores every preference as a string, anything else is stored as its json representation
+		str, ok := value.(string)
+		if !ok {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", key, err)
+			}
+			str = string(encoded)
+		}
+		if len(str) > maxUserPrefValueLength {
+			return nil, nil, fmt.Errorf("%s: value must be at most %d bytes", key, maxUserPrefValueLength)
+		}
+		prefs[key] = str
+	}
+	sort.Strings(reset)
+
+	return prefs, reset, nil
+}
+
+func createPref(c echo.Context, p jInterfaces.PortalProxy, isList bool) (*interfaces.UserPref, error) {
+	userID := c.Get("user_id").(string)
+
+	data, err := getMergedPrefs(p, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	pref := NewUserPref(userID)
 	pref.Data = data
 
@@ -75,5 +188,35 @@ func createPref(c echo.Context, isList bool) *interfaces.UserPref {
 	pref.Links["remove"] = user
 	pref.Links["update"] = user
 
-	return pref
+	return pref, nil
+}
+
+// getMergedPrefs returns the default preferences overridden by those the user has stored
+func getMergedPrefs(p jInterfaces.PortalProxy, userID string) (map[string]string, error) {
+	prefs := make(map[string]string)
+	if err := json.Unmarshal([]byte(DefaultUserPreferences), &prefs); err != nil {
+		return nil, fmt.Errorf("Unable to parse default user preferences: %v", err)
+	}
+
+	store, err := userpreferencesstore.NewUserPreferencesDBStore(p.GetDatabaseConnection())
+	if err != nil {
+		return nil, jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to get user preferences store",
+			"Unable to get user preferences store: %v", err)
+	}
+
+	stored, err := store.Get(userID)
+	if err != nil {
+		return nil, jInterfaces.NewHTTPShadowError(
+			http.StatusInternalServerError,
+			"Unable to get user preferences",
+			"Unable to get user preferences: %v", err)
+	}
+
+	for key, value := range stored {
+		prefs[key] = value
+	}
+
+	return prefs, nil
 }
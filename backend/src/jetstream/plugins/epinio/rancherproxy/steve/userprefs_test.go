@@ -0,0 +1,98 @@
+package steve
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseUserPrefs(t *testing.T) {
+	t.Parallel()
+
+	Convey("Updated user preferences", t, func() {
+
+		Convey("Should be stored as strings", func() {
+			prefs, reset, err := parseUserPrefs(map[string]interface{}{
+				"theme":     "ui-dark",
+				"seen":      true,
+				"rows":      float64(50),
+				"favorites": []interface{}{"app"},
+				"cluster":   map[string]interface{}{"name": "default"},
+			})
+			So(err, ShouldBeNil)
+			So(reset, ShouldBeEmpty)
+			So(prefs, ShouldResemble, map[string]string{
+				"theme":     "ui-dark",
+				"seen":      "true",
+				"rows":      "50",
+				"favorites": `["app"]`,
+				"cluster":   `{"name":"default"}`,
+			})
+		})
+
+		Convey("Should be reset if null", func() {
+			prefs, reset, err := parseUserPrefs(map[string]interface{}{
+				"theme":  "ui-dark",
+				"locale": nil,
+				"banner": nil,
+			})
+			So(err, ShouldBeNil)
+			So(prefs, ShouldResemble, map[string]string{"theme": "ui-dark"})
+			So(reset, ShouldResemble, []string{"banner", "locale"})
+		})
+
+		Convey("Should be rejected if they can't be encoded", func() {
+			_, _, err := parseUserPrefs(map[string]interface{}{"rows": math.Inf(1)})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should be rejected if a name is too long", func() {
+			_, _, err := parseUserPrefs(map[string]interface{}{strings.Repeat("k", maxUserPrefKeyLength+1): "value"})
+			So(err, ShouldNotBeNil)
+
+			_, _, err = parseUserPrefs(map[string]interface{}{strings.Repeat("k", maxUserPrefKeyLength): "value"})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should be rejected if a value is too long", func() {
+			_, _, err := parseUserPrefs(map[string]interface{}{"banner": strings.Repeat("v", maxUserPrefValueLength+1)})
+			So(err, ShouldNotBeNil)
+
+			_, _, err = parseUserPrefs(map[string]interface{}{"favorites": []interface{}{strings.Repeat("v", maxUserPrefValueLength)}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUpdateUserPrefs(t *testing.T) {
+	t.Parallel()
+
+	Convey("Updating user preferences", t, func() {
+		update := func(body string) error {
+			req := httptest.NewRequest(http.MethodPut, "/v1/userpreferences/user-guid", strings.NewReader(body))
+			ctx := echo.New().NewContext(req, httptest.NewRecorder())
+			ctx.Set("user_id", "user-guid")
+			return UpdateUserPrefs(ctx, &testPortalProxy{})
+		}
+
+		Convey("Should be rejected if the body is too large", func() {
+			body := `{"data": {"banner": "` + strings.Repeat("v", maxUserPrefsSize) + `"}}`
+			So(errorStatus(update(body)), ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Should be rejected if a name is too long", func() {
+			body := `{"data": {"` + strings.Repeat("k", maxUserPrefKeyLength+1) + `": "value"}}`
+			So(errorStatus(update(body)), ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Should be rejected if a value is too long", func() {
+			body := `{"data": {"banner": "` + strings.Repeat("v", maxUserPrefValueLength+1) + `"}}`
+			So(errorStatus(update(body)), ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
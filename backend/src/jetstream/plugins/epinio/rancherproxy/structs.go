@@ -16,6 +16,17 @@ type LoginParams struct {
 }
 
 type LoginOIDCParams struct {
-	Code         string `json:"code"`
+	Code  string `json:"code"`
+	State string `json:"state"`
+	// The dashboard shell only forwards the `pkceCodeVerifier` it persisted with its nonce, the epinio login sets it
+	// to the state (the actual code verifier never leaves the backend)
 	CodeVerifier string `json:"code_verifier"`
 }
+
+// LoginState returns the state the Dex login was started with
+func (p LoginOIDCParams) LoginState() string {
+	if len(p.State) > 0 {
+		return p.State
+	}
+	return p.CodeVerifier
+}
@@ -0,0 +1,10 @@
+package userpreferencesstore
+
+// UserPreferencesStore is the user preferences repository
+type UserPreferencesStore interface {
+	// Get returns all stored preferences for the user, keyed by preference name
+	Get(userGUID string) (map[string]string, error)
+	// Save persists the given preferences for the user and removes the reset ones, so that they fall back on their
+	// defaults. Preferences not included are left untouched
+	Save(userGUID string, prefs map[string]string, reset []string) error
+}
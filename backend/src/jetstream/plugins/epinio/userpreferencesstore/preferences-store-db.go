@@ -0,0 +1,104 @@
+package userpreferencesstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/datastore"
+)
+
+var (
+	getPreferences   = `SELECT pref_key, pref_value FROM user_preferences WHERE user_guid = $1`
+	countPreference  = `SELECT COUNT(*) FROM user_preferences WHERE user_guid = $1 AND pref_key = $2`
+	insertPreference = `INSERT INTO user_preferences (user_guid, pref_key, pref_value) VALUES ($1, $2, $3)`
+	updatePreference = `UPDATE user_preferences SET pref_value = $1, last_updated = CURRENT_TIMESTAMP WHERE user_guid = $2 AND pref_key = $3`
+	deletePreference = `DELETE FROM user_preferences WHERE user_guid = $1 AND pref_key = $2`
+)
+
+// InitRepositoryProvider - One time init for the given DB Provider
+func InitRepositoryProvider(databaseProvider string) {
+	// Modify the database statements if needed, for the given database type
+	getPreferences = datastore.ModifySQLStatement(getPreferences, databaseProvider)
+	countPreference = datastore.ModifySQLStatement(countPreference, databaseProvider)
+	insertPreference = datastore.ModifySQLStatement(insertPreference, databaseProvider)
+	updatePreference = datastore.ModifySQLStatement(updatePreference, databaseProvider)
+	deletePreference = datastore.ModifySQLStatement(deletePreference, databaseProvider)
+}
+
+// UserPreferencesDBStore is a DB-backed User Preferences repository
+type UserPreferencesDBStore struct {
+	db *sql.DB
+}
+
+// NewUserPreferencesDBStore will create a new instance of the UserPreferencesDBStore
+func NewUserPreferencesDBStore(dcp *sql.DB) (UserPreferencesStore, error) {
+	return &UserPreferencesDBStore{db: dcp}, nil
+}
+
+// Get - Returns all preferences stored for the user
+func (p *UserPreferencesDBStore) Get(userGUID string) (map[string]string, error) {
+	log.Debug("Get")
+	rows, err := p.db.Query(getPreferences, userGUID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve User Preference records: %v", err)
+	}
+	defer rows.Close()
+
+	prefs := make(map[string]string)
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("Unable to scan User Preference records: %v", err)
+		}
+		prefs[key] = value.String
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to List User Preference records: %v", err)
+	}
+
+	return prefs, nil
+}
+
+// Save will persist the given User Preferences to the datastore and remove the reset ones, in a single transaction
+func (p *UserPreferencesDBStore) Save(userGUID string, prefs map[string]string, reset []string) error {
+	log.Debug("Save")
+	txn, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Unable to start User Preference transaction: %v", err)
+	}
+
+	for key, value := range prefs {
+		var count int
+		if err := txn.QueryRow(countPreference, userGUID, key).Scan(&count); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("Unable to find User Preference record: %v", err)
+		}
+
+		if count == 0 {
+			_, err = txn.Exec(insertPreference, userGUID, key, value)
+		} else {
+			_, err = txn.Exec(updatePreference, value, userGUID, key)
+		}
+		if err != nil {
+			txn.Rollback()
+			return fmt.Errorf("Unable to save User Preference record: %v", err)
+		}
+	}
+
+	for _, key := range reset {
+		if _, err := txn.Exec(deletePreference, userGUID, key); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("Unable to delete User Preference record: %v", err)
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("Unable to save User Preference records: %v", err)
+	}
+
+	return nil
+}
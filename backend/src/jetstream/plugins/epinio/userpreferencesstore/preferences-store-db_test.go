@@ -0,0 +1,94 @@
+package userpreferencesstore
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const (
+	getPreferencesSQL   = `SELECT pref_key, pref_value FROM user_preferences WHERE (.+)`
+	countPreferenceSQL  = `SELECT COUNT\(\*\) FROM user_preferences WHERE (.+)`
+	insertPreferenceSQL = `INSERT INTO user_preferences`
+	updatePreferenceSQL = `UPDATE user_preferences SET`
+	deletePreferenceSQL = `DELETE FROM user_preferences WHERE (.+)`
+
+	mockUserGUID = "user-guid"
+)
+
+func TestUserPreferencesDBStore(t *testing.T) {
+	t.Parallel()
+
+	Convey("The user preferences store", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		store, err := NewUserPreferencesDBStore(db)
+		So(err, ShouldBeNil)
+
+		Convey("Should get the stored preferences", func() {
+			mock.ExpectQuery(getPreferencesSQL).WithArgs(mockUserGUID).
+				WillReturnRows(sqlmock.NewRows([]string{"pref_key", "pref_value"}).AddRow("theme", "ui-dark").AddRow("locale", nil))
+
+			prefs, err := store.Get(mockUserGUID)
+			So(err, ShouldBeNil)
+			So(prefs, ShouldResemble, map[string]string{"theme": "ui-dark", "locale": ""})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should fail to get the preferences if the database fails", func() {
+			mock.ExpectQuery(getPreferencesSQL).WillReturnError(errors.New("database down"))
+
+			_, err := store.Get(mockUserGUID)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should insert new preferences", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(countPreferenceSQL).WithArgs(mockUserGUID, "theme").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec(insertPreferenceSQL).WithArgs(mockUserGUID, "theme", "ui-dark").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			So(store.Save(mockUserGUID, map[string]string{"theme": "ui-dark"}, nil), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should update stored preferences", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(countPreferenceSQL).WithArgs(mockUserGUID, "theme").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectExec(updatePreferenceSQL).WithArgs("ui-light", mockUserGUID, "theme").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			So(store.Save(mockUserGUID, map[string]string{"theme": "ui-light"}, nil), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should delete reset preferences", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(deletePreferenceSQL).WithArgs(mockUserGUID, "theme").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			So(store.Save(mockUserGUID, map[string]string{}, []string{"theme"}), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Should roll back if a preference can't be saved", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(countPreferenceSQL).WithArgs(mockUserGUID, "theme").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec(insertPreferenceSQL).WillReturnError(errors.New("database down"))
+			mock.ExpectRollback()
+
+			So(store.Save(mockUserGUID, map[string]string{"theme": "ui-dark"}, nil), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
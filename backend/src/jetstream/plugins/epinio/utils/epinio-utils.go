@@ -7,10 +7,21 @@ import (
 	eInterfaces "github.com/epinio/ui/backend/src/jetstream/plugins/epinio/interfaces"
 	jInterfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 
+	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
 )
 
-func FindEpinioEndpoint(p jInterfaces.PortalProxy) (*jInterfaces.CNSIRecord, error) {
+const (
+	// DefaultClusterName is the name of the endpoint registered from the un-indexed EPINIO_* env vars
+	DefaultClusterName = "default"
+	// ClusterQueryParam is the query param used by login requests to target a specific cluster
+	ClusterQueryParam = "cluster"
+	// LoginClusterContextKey is the echo context key holding the GUID of the cluster a user is logging in to
+	LoginClusterContextKey = "epinio_login_cluster"
+)
+
+// FindEpinioEndpoints returns all registered epinio endpoints
+func FindEpinioEndpoints(p jInterfaces.PortalProxy) ([]*jInterfaces.CNSIRecord, error) {
 	endpoints, err := p.ListEndpoints()
 	if err != nil {
 		msg := "failed to fetch list of endpoints: %+v"
@@ -18,17 +29,64 @@ func FindEpinioEndpoint(p jInterfaces.PortalProxy) (*jInterfaces.CNSIRecord, err
 		return nil, fmt.Errorf(msg, err)
 	}
 
+	epinioEndpoints := make([]*jInterfaces.CNSIRecord, 0)
 	for _, e := range endpoints {
 		if e.CNSIType == eInterfaces.EndpointType {
+			epinioEndpoints = append(epinioEndpoints, e)
+		}
+	}
+
+	return epinioEndpoints, nil
+}
+
+// FindEpinioEndpoint returns the default epinio endpoint, or the first one found if there's no default
+func FindEpinioEndpoint(p jInterfaces.PortalProxy) (*jInterfaces.CNSIRecord, error) {
+	endpoints, err := FindEpinioEndpoints(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range endpoints {
+		if e.Name == DefaultClusterName {
 			return e, nil
 		}
 	}
 
+	if len(endpoints) > 0 {
+		return endpoints[0], nil
+	}
+
 	msg := "failed to find an epinio endpoint"
 	log.Error(msg)
 	return nil, fmt.Errorf(msg)
 }
 
+// FindEpinioEndpointByName returns the epinio endpoint registered with the given name
+func FindEpinioEndpointByName(p jInterfaces.PortalProxy, name string) (*jInterfaces.CNSIRecord, error) {
+	endpoints, err := FindEpinioEndpoints(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range endpoints {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+
+	msg := "failed to find an epinio endpoint named %s"
+	log.Errorf(msg, name)
+	return nil, fmt.Errorf(msg, name)
+}
+
+// FindLoginEndpoint returns the epinio endpoint requested via the `cluster` query param, falling back on the default
+func FindLoginEndpoint(p jInterfaces.PortalProxy, ec echo.Context) (*jInterfaces.CNSIRecord, error) {
+	if name := ec.QueryParam(ClusterQueryParam); len(name) > 0 {
+		return FindEpinioEndpointByName(p, name)
+	}
+	return FindEpinioEndpoint(p)
+}
+
 func GetMetadata(record *jInterfaces.CNSIRecord) (eInterfaces.CNSIMetadata, error) {
 	var metadata eInterfaces.CNSIMetadata
 
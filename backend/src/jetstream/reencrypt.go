@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
+	"github.com/epinio/ui/backend/src/jetstream/repository/cnsis"
+	"github.com/epinio/ui/backend/src/jetstream/repository/localusers"
+	"github.com/epinio/ui/backend/src/jetstream/repository/tokens"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reencryptSecrets moves all tokens, endpoint client secrets and local user MFA secrets to the current encryption key, using AES-GCM. It runs
+// in the background while the backend serves requests: rows are only updated if they have not changed since they were
+// read, so it's safe to run on several instances at once
+func (p *portalProxy) reencryptSecrets() {
+	keyID := crypto.KeyID(p.Config.EncryptionKeyInBytes)
+	log.Infof("Re-encrypting tokens and endpoint secrets with encryption key %s", keyID)
+
+	tokenRepo, err := tokens.NewPgsqlTokenRepository(p.DatabaseConnectionPool)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt tokens: %v", err)
+		return
+	}
+	updated, err := tokenRepo.Reencrypt(p.Config.EncryptionKeyInBytes)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt all tokens: %v", err)
+	}
+	log.Infof("Re-encrypted %d tokens with encryption key %s", updated, keyID)
+
+	cnsiRepo, err := cnsis.NewPostgresCNSIRepository(p.DatabaseConnectionPool)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt endpoint secrets: %v", err)
+		return
+	}
+	updated, err = cnsiRepo.Reencrypt(p.Config.EncryptionKeyInBytes)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt all endpoint secrets: %v", err)
+	}
+	log.Infof("Re-encrypted %d endpoint secrets with encryption key %s", updated, keyID)
+
+	localUsersRepo, err := localusers.NewPgsqlLocalUsersRepository(p.DatabaseConnectionPool)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt MFA secrets: %v", err)
+		return
+	}
+	updated, err = localUsersRepo.ReencryptMFA(p.Config.EncryptionKeyInBytes)
+	if err != nil {
+		log.Errorf("Unable to re-encrypt all MFA secrets: %v", err)
+	}
+	log.Infof("Re-encrypted %d MFA secrets with encryption key %s", updated, keyID)
+}
@@ -1,12 +1,18 @@
 package apikeys
 
-import "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+import (
+	"time"
+
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
 
 // Repository - API keys repository
 type Repository interface {
-	AddAPIKey(userID string, comment string) (*interfaces.APIKey, error)
+	AddAPIKey(userID string, comment string, scopes []string, expires *time.Time) (*interfaces.APIKey, error)
 	GetAPIKeyBySecret(keySecret string) (*interfaces.APIKey, error)
 	ListAPIKeys(userID string) ([]interfaces.APIKey, error)
 	DeleteAPIKey(userGUID string, keyGUID string) error
+	DeleteAPIKeys(userGUID string) error
+	RotateAPIKey(userGUID string, keyGUID string) (*interfaces.APIKey, error)
 	UpdateAPIKeyLastUsed(keyGUID string) error
 }
@@ -8,6 +8,7 @@ import (
 	interfaces "github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
+	time "time"
 )
 
 // MockRepository is a mock of Repository interface
@@ -34,18 +35,18 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 }
 
 // AddAPIKey mocks base method
-func (m *MockRepository) AddAPIKey(userID, comment string) (*interfaces.APIKey, error) {
+func (m *MockRepository) AddAPIKey(userID, comment string, scopes []string, expires *time.Time) (*interfaces.APIKey, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddAPIKey", userID, comment)
+	ret := m.ctrl.Call(m, "AddAPIKey", userID, comment, scopes, expires)
 	ret0, _ := ret[0].(*interfaces.APIKey)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddAPIKey indicates an expected call of AddAPIKey
-func (mr *MockRepositoryMockRecorder) AddAPIKey(userID, comment interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) AddAPIKey(userID, comment, scopes, expires interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAPIKey", reflect.TypeOf((*MockRepository)(nil).AddAPIKey), userID, comment)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAPIKey", reflect.TypeOf((*MockRepository)(nil).AddAPIKey), userID, comment, scopes, expires)
 }
 
 // GetAPIKeyBySecret mocks base method
@@ -92,6 +93,35 @@ func (mr *MockRepositoryMockRecorder) DeleteAPIKey(userGUID, keyGUID interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAPIKey", reflect.TypeOf((*MockRepository)(nil).DeleteAPIKey), userGUID, keyGUID)
 }
 
+// DeleteAPIKeys mocks base method
+func (m *MockRepository) DeleteAPIKeys(userGUID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteAPIKeys", userGUID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteAPIKeys indicates an expected call of DeleteAPIKeys
+func (mr *MockRepositoryMockRecorder) DeleteAPIKeys(userGUID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAPIKeys", reflect.TypeOf((*MockRepository)(nil).DeleteAPIKeys), userGUID)
+}
+
+// RotateAPIKey mocks base method
+func (m *MockRepository) RotateAPIKey(userGUID, keyGUID string) (*interfaces.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateAPIKey", userGUID, keyGUID)
+	ret0, _ := ret[0].(*interfaces.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateAPIKey indicates an expected call of RotateAPIKey
+func (mr *MockRepositoryMockRecorder) RotateAPIKey(userGUID, keyGUID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateAPIKey", reflect.TypeOf((*MockRepository)(nil).RotateAPIKey), userGUID, keyGUID)
+}
+
 // UpdateAPIKeyLastUsed mocks base method
 func (m *MockRepository) UpdateAPIKeyLastUsed(keyGUID string) error {
 	m.ctrl.T.Helper()
@@ -3,9 +3,11 @@ package apikeys
 import (
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/epinio/ui/backend/src/jetstream/crypto"
@@ -17,18 +19,32 @@ import (
 
 var sqlQueries = struct {
 	InsertAPIKey         string
-	GetAPIKeyBySecret    string
+	GetAPIKeysByPrefix   string
+	GetAPIKey            string
 	ListAPIKeys          string
 	DeleteAPIKey         string
+	DeleteAPIKeys        string
+	RotateAPIKey         string
 	UpdateAPIKeyLastUsed string
 }{
-	InsertAPIKey:         `INSERT INTO api_keys (guid, secret, user_guid, comment) VALUES ($1, $2, $3, $4)`,
-	GetAPIKeyBySecret:    `SELECT guid, user_guid, comment, last_used FROM api_keys WHERE secret = $1`,
-	ListAPIKeys:          `SELECT guid, user_guid, comment, last_used FROM api_keys WHERE user_guid = $1`,
+	// The secret column holds the salted hash of the secret
+	InsertAPIKey:         `INSERT INTO api_keys (guid, secret, salt, prefix, user_guid, comment, scopes, created, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+	GetAPIKeysByPrefix:   `SELECT guid, secret, salt, prefix, user_guid, comment, scopes, created, expires, last_used FROM api_keys WHERE prefix = $1`,
+	GetAPIKey:            `SELECT guid, secret, salt, prefix, user_guid, comment, scopes, created, expires, last_used FROM api_keys WHERE user_guid = $1 AND guid = $2`,
+	ListAPIKeys:          `SELECT guid, secret, salt, prefix, user_guid, comment, scopes, created, expires, last_used FROM api_keys WHERE user_guid = $1`,
 	DeleteAPIKey:         `DELETE FROM api_keys WHERE user_guid = $1 AND guid = $2`,
+	DeleteAPIKeys:        `DELETE FROM api_keys WHERE user_guid = $1`,
+	RotateAPIKey:         `UPDATE api_keys SET secret = $1, salt = $2, prefix = $3 WHERE user_guid = $4 AND guid = $5`,
 	UpdateAPIKeyLastUsed: `UPDATE api_keys SET last_used = $1 WHERE guid = $2`,
 }
 
+// storedAPIKey is an API key as stored in the DB
+type storedAPIKey struct {
+	interfaces.APIKey
+	hash string
+	salt string
+}
+
 // PgsqlAPIKeysRepository - Postgresql-backed API keys repository
 type PgsqlAPIKeysRepository struct {
 	db *sql.DB
@@ -59,7 +75,7 @@ func InitRepositoryProvider(databaseProvider string) {
 }
 
 // AddAPIKey - Add a new API key to the datastore.
-func (p *PgsqlAPIKeysRepository) AddAPIKey(userID string, comment string) (*interfaces.APIKey, error) {
+func (p *PgsqlAPIKeysRepository) AddAPIKey(userID string, comment string, scopes []string, expires *time.Time) (*interfaces.APIKey, error) {
 	log.Debug("AddAPIKey")
 
 	var err error
@@ -75,19 +91,24 @@ func (p *PgsqlAPIKeysRepository) AddAPIKey(userID string, comment string) (*inte
 		return nil, err
 	}
 
-	randomBytes, err := crypto.GenerateRandomBytes(48)
+	keyUUID, err := uuid.NewV4()
 	if err != nil {
 		return nil, err
 	}
+	keyGUID := keyUUID.String()
 
-	keyUUID, err := uuid.NewV4()
+	keySecret, salt, err := newSecret()
 	if err != nil {
 		return nil, err
 	}
-	keyGUID := keyUUID.String()
-	keySecret := base64.URLEncoding.EncodeToString(randomBytes)
 
-	err = execQuery(p, sqlQueries.InsertAPIKey, keyGUID, keySecret, userID, comment)
+	created := time.Now().UTC()
+	if expires != nil {
+		utc := expires.UTC()
+		expires = &utc
+	}
+
+	err = execQuery(p, sqlQueries.InsertAPIKey, keyGUID, crypto.HashAPIKeySecret(salt, keySecret), salt, keySecret[:interfaces.APIKeyPrefixLength], userID, comment, strings.Join(scopes, ","), created, expires)
 	if err != nil {
 		return nil, fmt.Errorf("AddAPIKey: %v", err)
 	}
@@ -95,8 +116,12 @@ func (p *PgsqlAPIKeysRepository) AddAPIKey(userID string, comment string) (*inte
 	apiKey := &interfaces.APIKey{
 		GUID:     keyGUID,
 		Secret:   keySecret,
+		Prefix:   maskPrefix(keySecret[:interfaces.APIKeyPrefixLength]),
 		UserGUID: userID,
 		Comment:  comment,
+		Scopes:   scopes,
+		Created:  &created,
+		Expires:  expires,
 	}
 
 	return apiKey, err
@@ -106,44 +131,121 @@ func (p *PgsqlAPIKeysRepository) AddAPIKey(userID string, comment string) (*inte
 func (p *PgsqlAPIKeysRepository) GetAPIKeyBySecret(keySecret string) (*interfaces.APIKey, error) {
 	log.Debug("GetAPIKeyBySecret")
 
-	var apiKey interfaces.APIKey
-
-	err := p.db.QueryRow(sqlQueries.GetAPIKeyBySecret, keySecret).Scan(
-		&apiKey.GUID,
-		&apiKey.UserGUID,
-		&apiKey.Comment,
-		&apiKey.LastUsed,
-	)
+	if len(keySecret) <= interfaces.APIKeyPrefixLength {
+		return nil, sql.ErrNoRows
+	}
 
+	candidates, err := p.queryAPIKeys(sqlQueries.GetAPIKeysByPrefix, keySecret[:interfaces.APIKeyPrefixLength])
 	if err != nil {
 		return nil, err
 	}
 
-	return &apiKey, nil
+	for _, candidate := range candidates {
+		if crypto.CheckAPIKeySecret(candidate.salt, keySecret, candidate.hash) {
+			return &candidate.APIKey, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
 }
 
 // ListAPIKeys - list API keys for a given user GUID
 func (p *PgsqlAPIKeysRepository) ListAPIKeys(userID string) ([]interfaces.APIKey, error) {
 	log.Debug("ListAPIKeys")
 
-	rows, err := p.db.Query(sqlQueries.ListAPIKeys, userID)
+	keys, err := p.queryAPIKeys(sqlQueries.ListAPIKeys, userID)
 	if err != nil {
 		log.Errorf("unable to list API keys: %v", err)
 		return nil, err
 	}
 
 	result := []interfaces.APIKey{}
+	for _, key := range keys {
+		result = append(result, key.APIKey)
+	}
+
+	return result, nil
+}
+
+// RotateAPIKey - replace the secret of an API key, the previous secret stops working immediately
+func (p *PgsqlAPIKeysRepository) RotateAPIKey(userGUID string, keyGUID string) (*interfaces.APIKey, error) {
+	log.Debug("RotateAPIKey")
+
+	keySecret, salt, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = execQuery(p, sqlQueries.RotateAPIKey, crypto.HashAPIKeySecret(salt, keySecret), salt, keySecret[:interfaces.APIKeyPrefixLength], userGUID, keyGUID)
+	if err != nil {
+		return nil, fmt.Errorf("RotateAPIKey: %v", err)
+	}
+
+	keys, err := p.queryAPIKeys(sqlQueries.GetAPIKey, userGUID, keyGUID)
+	if err != nil {
+		return nil, fmt.Errorf("RotateAPIKey: %v", err)
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("RotateAPIKey: %v", sql.ErrNoRows)
+	}
+
+	apiKey := keys[0].APIKey
+	apiKey.Secret = keySecret
+
+	return &apiKey, nil
+}
+
+func (p *PgsqlAPIKeysRepository) queryAPIKeys(query string, args ...interface{}) ([]storedAPIKey, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []storedAPIKey{}
 	for rows.Next() {
-		var apiKey interfaces.APIKey
-		err = rows.Scan(&apiKey.GUID, &apiKey.UserGUID, &apiKey.Comment, &apiKey.LastUsed)
+		var (
+			key    storedAPIKey
+			salt   sql.NullString
+			prefix sql.NullString
+			scopes sql.NullString
+		)
+		err = rows.Scan(&key.GUID, &key.hash, &salt, &prefix, &key.UserGUID, &key.Comment, &scopes, &key.Created, &key.Expires, &key.LastUsed)
 		if err != nil {
 			log.Errorf("Scan: %v", err)
 			return nil, err
 		}
-		result = append(result, apiKey)
+
+		key.salt = salt.String
+		key.Prefix = maskPrefix(prefix.String)
+		if len(scopes.String) > 0 {
+			key.Scopes = strings.Split(scopes.String, ",")
+		}
+
+		result = append(result, key)
 	}
 
-	return result, nil
+	return result, rows.Err()
+}
+
+// newSecret generates a random API key secret and the salt used to hash it
+func newSecret() (string, string, error) {
+	randomBytes, err := crypto.GenerateRandomBytes(48)
+	if err != nil {
+		return "", "", err
+	}
+
+	saltBytes, err := crypto.GenerateRandomBytes(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(randomBytes), hex.EncodeToString(saltBytes), nil
+}
+
+// maskPrefix shows the start of a secret, so the user can tell their keys apart
+func maskPrefix(prefix string) string {
+	return prefix + strings.Repeat("*", 8)
 }
 
 // DeleteAPIKey - delete an API key identified by its GUID
@@ -158,6 +260,17 @@ func (p *PgsqlAPIKeysRepository) DeleteAPIKey(userGUID string, keyGUID string) e
 	return nil
 }
 
+// DeleteAPIKeys - delete all API keys of a user
+func (p *PgsqlAPIKeysRepository) DeleteAPIKeys(userGUID string) error {
+	log.Debug("DeleteAPIKeys")
+
+	if _, err := p.db.Exec(sqlQueries.DeleteAPIKeys, userGUID); err != nil {
+		return fmt.Errorf("DeleteAPIKeys: %v", err)
+	}
+
+	return nil
+}
+
 // UpdateAPIKeyLastUsed - sets API key last_used field to current time
 func (p *PgsqlAPIKeysRepository) UpdateAPIKeyLastUsed(keyGUID string) error {
 	log.Debug("UpdateAPIKeyLastUsed")
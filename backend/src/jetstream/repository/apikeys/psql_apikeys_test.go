@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -48,7 +49,7 @@ func TestAddAPIKey(t *testing.T) {
 		repository, _ := NewPgsqlAPIKeysRepository(db)
 
 		Convey("when the comment exceeds maximal length", func() {
-			_, err := repository.AddAPIKey(userID, strings.Repeat("a", 256))
+			_, err := repository.AddAPIKey(userID, strings.Repeat("a", 256), nil, nil)
 
 			Convey("an error should be returned", func() {
 				So(err, ShouldResemble, errors.New("comment maximum length is 255 characters"))
@@ -57,10 +58,10 @@ func TestAddAPIKey(t *testing.T) {
 
 		Convey("when a key can't be inserted", func() {
 			mock.ExpectExec(insertIntoAPIKeys).
-				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), userID, comment).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), userID, comment, "", sqlmock.AnyArg(), nil).
 				WillReturnResult(sqlmock.NewResult(0, 0))
 
-			apiKey, err := repository.AddAPIKey(userID, comment)
+			apiKey, err := repository.AddAPIKey(userID, comment, nil, nil)
 
 			Convey("an error should be returned", func() {
 				So(err, ShouldResemble, errors.New("AddAPIKey: no rows were updated"))
@@ -73,10 +74,10 @@ func TestAddAPIKey(t *testing.T) {
 
 		Convey("when the comment is not empty", func() {
 			mock.ExpectExec(insertIntoAPIKeys).
-				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), userID, comment).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), userID, comment, "", sqlmock.AnyArg(), nil).
 				WillReturnResult(sqlmock.NewResult(1, 1))
 
-			apiKey, err := repository.AddAPIKey(userID, comment)
+			apiKey, err := repository.AddAPIKey(userID, comment, nil, nil)
 
 			Convey("there should be no error returned", func() {
 				So(err, ShouldBeNil)
@@ -89,6 +90,10 @@ func TestAddAPIKey(t *testing.T) {
 			Convey("API key secret should not be empty", func() {
 				So(len(apiKey.Secret), ShouldBeGreaterThan, 0)
 			})
+
+			Convey("API key prefix should be masked", func() {
+				So(apiKey.Prefix, ShouldEqual, apiKey.Secret[:8]+"********")
+			})
 		})
 	})
 }
@@ -96,7 +101,7 @@ func TestAddAPIKey(t *testing.T) {
 func TestListAPIKeys(t *testing.T) {
 	var (
 		userID            = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
-		rowFields         = []string{"guid", "user_guid", "comment", "last_used"}
+		rowFields         = []string{"guid", "secret", "salt", "prefix", "user_guid", "comment", "scopes", "created", "expires", "last_used"}
 		selectUserAPIKeys = `SELECT (.+) FROM api_keys WHERE user_guid = (.+)`
 	)
 
@@ -138,24 +143,29 @@ func TestListAPIKeys(t *testing.T) {
 			r1 := &interfaces.APIKey{
 				GUID:     "00000000-0000-0000-0000-000000000000",
 				Secret:   "",
+				Prefix:   "AbCd1234********",
 				UserGUID: userID,
 				Comment:  "First key",
+				Scopes:   []string{"read-only", "cnsi:foo"},
+				Created:  &t,
 				LastUsed: &t,
 			}
 
 			r2 := &interfaces.APIKey{
 				GUID:     "11111111-1111-1111-1111-111111111111",
 				Secret:   "",
+				Prefix:   "EfGh5678********",
 				UserGUID: userID,
 				Comment:  "Second key",
+				Expires:  &t,
 				LastUsed: nil,
 			}
 
 			expectedList := []interfaces.APIKey{*r1, *r2}
 
 			mockRows := sqlmock.NewRows(rowFields).
-				AddRow(r1.GUID, r1.UserGUID, r1.Comment, r1.LastUsed).
-				AddRow(r2.GUID, r2.UserGUID, r2.Comment, r2.LastUsed)
+				AddRow(r1.GUID, "hash", "salt", "AbCd1234", r1.UserGUID, r1.Comment, "read-only,cnsi:foo", r1.Created, nil, r1.LastUsed).
+				AddRow(r2.GUID, "hash", "salt", "EfGh5678", r2.UserGUID, r2.Comment, nil, nil, r2.Expires, r2.LastUsed)
 
 			mock.ExpectQuery(selectUserAPIKeys).WillReturnRows(mockRows)
 
@@ -182,8 +192,9 @@ func TestListAPIKeys(t *testing.T) {
 
 func TestGetAPIKeyBySecret(t *testing.T) {
 	var (
-		rowFields            = []string{"guid", "user_guid", "comment", "last_used"}
-		selectAPIKeyBySecret = `SELECT (.+) FROM api_keys WHERE secret = (.+)`
+		rowFields            = []string{"guid", "secret", "salt", "prefix", "user_guid", "comment", "scopes", "created", "expires", "last_used"}
+		selectAPIKeyBySecret = `SELECT (.+) FROM api_keys WHERE prefix = (.+)`
+		secret               = "AbCd1234-secret"
 	)
 
 	Convey("Given a request to get an API key by its secret", t, func() {
@@ -195,10 +206,22 @@ func TestGetAPIKeyBySecret(t *testing.T) {
 
 		repository, err := NewPgsqlAPIKeysRepository(db)
 
+		Convey("if the secret is too short", func() {
+			results, err := repository.GetAPIKeyBySecret("test")
+
+			Convey("an error should be returned", func() {
+				So(err, ShouldResemble, errors.New("sql: no rows in result set"))
+			})
+
+			Convey("result should be nil", func() {
+				So(results, ShouldBeNil)
+			})
+		})
+
 		Convey("if no matching record exists in the DB", func() {
 			rs := sqlmock.NewRows(rowFields)
-			mock.ExpectQuery(selectAPIKeyBySecret).WillReturnRows(rs)
-			results, err := repository.GetAPIKeyBySecret("test")
+			mock.ExpectQuery(selectAPIKeyBySecret).WithArgs("AbCd1234").WillReturnRows(rs)
+			results, err := repository.GetAPIKeyBySecret(secret)
 
 			Convey("DB query expectations should be met", func() {
 				So(mock.ExpectationsWereMet(), ShouldBeNil)
@@ -219,17 +242,20 @@ func TestGetAPIKeyBySecret(t *testing.T) {
 			r := &interfaces.APIKey{
 				GUID:     "00000000-0000-0000-0000-000000000000",
 				Secret:   "",
+				Prefix:   "AbCd1234********",
 				UserGUID: "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa",
 				Comment:  "First key",
 				LastUsed: &t,
 			}
 
+			// A key with the same prefix but a different secret must not match
 			mockRows := sqlmock.NewRows(rowFields).
-				AddRow(r.GUID, r.UserGUID, r.Comment, r.LastUsed)
+				AddRow("11111111-1111-1111-1111-111111111111", crypto.HashAPIKeySecret("salt", "AbCd1234-other"), "salt", "AbCd1234", r.UserGUID, "Other key", nil, nil, nil, nil).
+				AddRow(r.GUID, crypto.HashAPIKeySecret("salt", secret), "salt", "AbCd1234", r.UserGUID, r.Comment, nil, nil, nil, r.LastUsed)
 
-			mock.ExpectQuery(selectAPIKeyBySecret).WillReturnRows(mockRows)
+			mock.ExpectQuery(selectAPIKeyBySecret).WithArgs("AbCd1234").WillReturnRows(mockRows)
 
-			results, err := repository.GetAPIKeyBySecret("test")
+			results, err := repository.GetAPIKeyBySecret(secret)
 
 			Convey("DB query expectations should be met", func() {
 				So(mock.ExpectationsWereMet(), ShouldBeNil)
@@ -292,6 +318,44 @@ func TestDeleteAPIKey(t *testing.T) {
 	})
 }
 
+func TestDeleteAPIKeys(t *testing.T) {
+	var (
+		userID            = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+		deleteUserAPIKeys = `DELETE FROM api_keys WHERE user_guid = (.+)`
+	)
+
+	Convey("Given a request to delete the API keys of a user", t, func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Errorf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		repository, _ := NewPgsqlAPIKeysRepository(db)
+
+		Convey("when the user has no keys", func() {
+			mock.ExpectExec(deleteUserAPIKeys).
+				WithArgs(userID).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			Convey("there should be no error returned", func() {
+				So(repository.DeleteAPIKeys(userID), ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("when the query fails", func() {
+			mock.ExpectExec(deleteUserAPIKeys).
+				WithArgs(userID).
+				WillReturnError(errors.New("doesn't exist"))
+
+			Convey("an error should be returned", func() {
+				So(repository.DeleteAPIKeys(userID), ShouldResemble, errors.New("DeleteAPIKeys: doesn't exist"))
+			})
+		})
+	})
+}
+
 //
 func TestUpdateAPIKeyLastUsed(t *testing.T) {
 	var (
@@ -337,3 +401,57 @@ func TestUpdateAPIKeyLastUsed(t *testing.T) {
 		})
 	})
 }
+
+func TestRotateAPIKey(t *testing.T) {
+	var (
+		userID       = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+		keyID        = "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb"
+		rowFields    = []string{"guid", "secret", "salt", "prefix", "user_guid", "comment", "scopes", "created", "expires", "last_used"}
+		rotateAPIKey = `UPDATE api_keys SET secret = (.+), salt = (.+), prefix = (.+) WHERE user_guid = (.+) AND guid = (.+)`
+		selectAPIKey = `SELECT (.+) FROM api_keys WHERE user_guid = (.+) AND guid = (.+)`
+	)
+
+	Convey("Given a request to rotate an API key", t, func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Errorf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		repository, _ := NewPgsqlAPIKeysRepository(db)
+
+		Convey("when a matching key doesn't exist", func() {
+			mock.ExpectExec(rotateAPIKey).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), userID, keyID).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			apiKey, err := repository.RotateAPIKey(userID, keyID)
+
+			Convey("an error should be returned", func() {
+				So(err, ShouldResemble, errors.New("RotateAPIKey: no rows were updated"))
+				So(apiKey, ShouldBeNil)
+			})
+		})
+
+		Convey("when a matching key exists", func() {
+			mock.ExpectExec(rotateAPIKey).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), userID, keyID).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(selectAPIKey).
+				WithArgs(userID, keyID).
+				WillReturnRows(sqlmock.NewRows(rowFields).AddRow(keyID, "hash", "salt", "AbCd1234", userID, "key", "admin", nil, nil, nil))
+
+			apiKey, err := repository.RotateAPIKey(userID, keyID)
+
+			Convey("DB query expectations should be met", func() {
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+
+			Convey("the new secret should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(apiKey.Secret), ShouldBeGreaterThan, 0)
+				So(apiKey.Scopes, ShouldResemble, []string{"admin"})
+			})
+		})
+	})
+}
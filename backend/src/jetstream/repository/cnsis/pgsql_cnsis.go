@@ -40,6 +40,11 @@ var updateCNSIMetadata = `UPDATE cnsis SET meta_data = $1 WHERE guid = $2`
 
 var countCNSI = `SELECT COUNT(*) FROM cnsis WHERE guid=$1`
 
+var listEncryptedCNSIs = `SELECT guid, client_secret FROM cnsis`
+
+// The secret is compared so that a secret changed since it was read is not overwritten
+var reencryptCNSI = `UPDATE cnsis SET client_secret = $1 WHERE guid = $2 AND client_secret = $3`
+
 // PostgresCNSIRepository is a PostgreSQL-backed CNSI repository
 type PostgresCNSIRepository struct {
 	db *sql.DB
@@ -62,6 +67,8 @@ func InitRepositoryProvider(databaseProvider string) {
 	updateCNSI = datastore.ModifySQLStatement(updateCNSI, databaseProvider)
 	updateCNSIMetadata = datastore.ModifySQLStatement(updateCNSIMetadata, databaseProvider)
 	countCNSI = datastore.ModifySQLStatement(countCNSI, databaseProvider)
+	listEncryptedCNSIs = datastore.ModifySQLStatement(listEncryptedCNSIs, databaseProvider)
+	reencryptCNSI = datastore.ModifySQLStatement(reencryptCNSI, databaseProvider)
 }
 
 // List - Returns a list of CNSI Records
@@ -371,3 +378,59 @@ func (p *PostgresCNSIRepository) SaveOrUpdate(endpoint interfaces.CNSIRecord, en
 		return p.Update(endpoint, encryptionKey)
 	}
 }
+
+// Reencrypt - Re-encrypt all client secrets that are not encrypted with the given key. Returns the number of endpoints
+// updated
+func (p *PostgresCNSIRepository) Reencrypt(encryptionKey []byte) (int, error) {
+	log.Debug("Reencrypt")
+
+	rows, err := p.db.Query(listEncryptedCNSIs)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to retrieve CNSI records: %v", err)
+	}
+
+	// Read all rows before updating, some databases don't allow writes while a query is open
+	secrets := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			guid         string
+			clientSecret []byte
+		)
+		if err = rows.Scan(&guid, &clientSecret); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("Unable to scan CNSI records: %v", err)
+		}
+		secrets[guid] = clientSecret
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("Unable to retrieve CNSI records: %v", err)
+	}
+
+	updated, failed := 0, 0
+	for guid, clientSecret := range secrets {
+		reencrypted, err := crypto.ReencryptToken(encryptionKey, clientSecret)
+		if err != nil {
+			log.Warnf("Unable to re-encrypt client secret of endpoint %s: %v", guid, err)
+			failed++
+			continue
+		}
+		if reencrypted == nil {
+			continue
+		}
+
+		result, err := p.db.Exec(reencryptCNSI, reencrypted, guid, clientSecret)
+		if err != nil {
+			return updated, fmt.Errorf("Unable to UPDATE endpoint: %v", err)
+		}
+		if count, err := result.RowsAffected(); err == nil && count > 0 {
+			updated++
+		}
+	}
+
+	if failed > 0 {
+		return updated, fmt.Errorf("Unable to re-encrypt %d client secrets", failed)
+	}
+
+	return updated, nil
+}
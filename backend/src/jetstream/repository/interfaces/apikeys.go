@@ -1,12 +1,77 @@
 package interfaces
 
-import "time"
+import (
+	"strings"
+	"time"
+)
+
+// APIKeyPrefixLength - number of leading characters of a secret that are stored in plain text, to find the key
+const APIKeyPrefixLength = 8
+
+// API key scopes. A key without scopes has all the permissions of its user, except for the requests to the endpoints
+// themselves (see AllowsProxy)
+const (
+	// APIKeyScopeReadOnly - only GET, HEAD and OPTIONS requests are allowed
+	APIKeyScopeReadOnly = "read-only"
+	// APIKeyScopeAdmin - admin endpoints are allowed (if the user is an admin)
+	APIKeyScopeAdmin = "admin"
+	// APIKeyScopeProxy - requests to the endpoints themselves (/proxy and /direct) are allowed
+	APIKeyScopeProxy = "proxy"
+	// APIKeyScopeCNSIPrefix - requests are only allowed to the endpoints given as `cnsi:<guid>`
+	APIKeyScopeCNSIPrefix = "cnsi:"
+)
 
 // APIKey - represents API key DB entry
 type APIKey struct {
-	GUID     string     `json:"guid"`
-	Secret   string     `json:"secret"`
+	GUID string `json:"guid"`
+	// Secret is only known when the key is created or rotated, only its hash is stored
+	Secret string `json:"secret,omitempty"`
+	// Prefix is the masked secret, e.g. `AbCd1234****`
+	Prefix   string     `json:"prefix"`
 	UserGUID string     `json:"user_guid"`
 	Comment  string     `json:"comment"`
+	Scopes   []string   `json:"scopes"`
+	Created  *time.Time `json:"created"`
+	Expires  *time.Time `json:"expires"`
 	LastUsed *time.Time `json:"last_used"`
 }
+
+// HasScope - true if the key has the given scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired - true if the key has an expiry that has passed
+func (k *APIKey) IsExpired() bool {
+	return k.Expires != nil && time.Now().After(*k.Expires)
+}
+
+// AllowsAdmin - true if the key can be used for admin endpoints
+func (k *APIKey) AllowsAdmin() bool {
+	return len(k.Scopes) == 0 || k.HasScope(APIKeyScopeAdmin)
+}
+
+// AllowsProxy - true if the key can be used for requests to the endpoints themselves. Keys without scopes (like those
+// created before these requests accepted keys) can't, this needs the proxy or read-only scope
+func (k *APIKey) AllowsProxy() bool {
+	return k.HasScope(APIKeyScopeProxy) || k.HasScope(APIKeyScopeReadOnly)
+}
+
+// AllowsCNSI - true if the key can be used for requests to the endpoint
+func (k *APIKey) AllowsCNSI(cnsiGUID string) bool {
+	restricted := false
+	for _, s := range k.Scopes {
+		if strings.HasPrefix(s, APIKeyScopeCNSIPrefix) {
+			restricted = true
+			if strings.TrimPrefix(s, APIKeyScopeCNSIPrefix) == cnsiGUID {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
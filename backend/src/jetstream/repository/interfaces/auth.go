@@ -1,6 +1,10 @@
 package interfaces
 
-import "github.com/labstack/echo/v4"
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
 
 const (
 	// DefaultAdminUserName is the default admin user name
@@ -17,3 +21,12 @@ type StratosAuth interface {
 	VerifySession(c echo.Context, sessionUser string, sessionExpireTime int64) error
 	BeforeVerifySession(c echo.Context)
 }
+
+// StratosAuthSessionLifetime is implemented by auth providers that limit the lifetime of a session beyond the
+// session store's expiry (for example absolute and idle timeouts)
+type StratosAuthSessionLifetime interface {
+	// VerifySessionActivity checks the session is still valid and records the activity. Called on every authenticated request
+	VerifySessionActivity(c echo.Context) error
+	// SessionExpiresOn returns when the session will expire if there's no further activity
+	SessionExpiresOn(c echo.Context) (time.Time, error)
+}
@@ -11,6 +11,7 @@ type EndpointRepository interface {
 	Update(endpoint CNSIRecord, encryptionKey []byte) error
 	UpdateMetadata(guid string, metadata string) error
 	SaveOrUpdate(endpoint CNSIRecord, encryptionKey []byte) error
+	Reencrypt(encryptionKey []byte) (int, error)
 }
 
 type Endpoint interface {
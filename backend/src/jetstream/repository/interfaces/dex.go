@@ -9,9 +9,12 @@ import (
 
 // OIDCProvider wraps an oidc.Provider and its Configuration
 type OIDCProvider interface {
-	AuthCodeURLWithPKCE(state string) (string, string)
+	AuthCodeURLWithPKCE(state, nonce, codeVerifier string, opts ...oauth2.AuthCodeOption) string
 	ExchangeWithPKCE(ctx context.Context, authCode, codeVerifier string) (*oauth2.Token, error)
+	RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error)
 	Verify(ctx context.Context, rawIDToken string) (*oidc.IDToken, error)
+	RevokeToken(ctx context.Context, refreshToken string) error
+	EndSessionURL(postLogoutRedirectURL string) string
 
 	GetConfig() *oauth2.Config
 }
@@ -10,3 +10,16 @@ type LocalUser struct {
 	GivenName    string `json:"given_name"`
 	FamilyName   string `json:"family_name"`
 }
+
+// LocalUserMFA - TOTP second factor of a local user
+type LocalUserMFA struct {
+	UserGUID string
+	// Secret is the encrypted TOTP secret
+	Secret []byte
+	// Enabled is false until the user has verified a first code
+	Enabled       bool
+	RecoverySalt  string
+	RecoveryCodes []string
+	// LastStep is the time step of the last TOTP code used, older codes are rejected
+	LastStep int64
+}
@@ -89,6 +89,7 @@ type PortalProxy interface {
 
 	SetSecureCacheContentMiddleware(h echo.HandlerFunc) echo.HandlerFunc
 	SessionMiddleware() echo.MiddlewareFunc
+	AdminMiddleware() echo.MiddlewareFunc
 
-	GetDex() (OIDCProvider, error)
+	GetDex(cnsiGUID string) (OIDCProvider, error)
 }
@@ -2,6 +2,7 @@ package interfaces
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -367,6 +368,13 @@ type CNSIRequest struct {
 	Error          error        `json:"-"`
 	ResponseGUID   string       `json:"-"`
 	Token          *TokenRecord `json:"-"` // Optional Token record to use instead of looking up
+	// BodyReader streams the request body instead of sending Body, ContentLength is its length or -1 if unknown
+	BodyReader    io.Reader `json:"-"`
+	ContentLength int64     `json:"-"`
+	// StreamResponse leaves the response body unread in ResponseBody, which the caller must close, instead of
+	// reading it into Response
+	StreamResponse bool          `json:"-"`
+	ResponseBody   io.ReadCloser `json:"-"`
 }
 
 type PortalConfig struct {
@@ -382,10 +390,12 @@ type PortalConfig struct {
 	CFClient                           string   `configName:"CF_CLIENT"`
 	CFClientSecret                     string   `configName:"CF_CLIENT_SECRET"`
 	AllowedOrigins                     []string `configName:"ALLOWED_ORIGINS"`
+	TrustedProxies                     []string `configName:"TRUSTED_PROXIES"`
 	SessionStoreSecret                 string   `configName:"SESSION_STORE_SECRET"`
 	EncryptionKeyVolume                string   `configName:"ENCRYPTION_KEY_VOLUME"`
 	EncryptionKeyFilename              string   `configName:"ENCRYPTION_KEY_FILENAME"`
 	EncryptionKey                      string   `configName:"ENCRYPTION_KEY"`
+	EncryptionKeysPrevious             []string `configName:"ENCRYPTION_KEYS_PREVIOUS"`
 	AutoRegisterCFUrl                  string   `configName:"AUTO_REG_CF_URL"`
 	AutoRegisterCFName                 string   `configName:"AUTO_REG_CF_NAME"`
 	SSOLogin                           bool     `configName:"SSO_LOGIN"`
@@ -412,6 +422,24 @@ type PortalConfig struct {
 	CanMigrateDatabaseSchema           bool
 	APIKeysEnabled                     config.APIKeysConfigValue `configName:"API_KEYS_ENABLED"`
 	HomeViewShowFavoritesOnly          bool                      `configName:"HOME_VIEW_SHOW_FAVORITES_ONLY"`
+	LoginMaxAttempts                   int64                     `configName:"LOGIN_MAX_ATTEMPTS"`
+	LoginMaxAttemptsPerIP              int64                     `configName:"LOGIN_MAX_ATTEMPTS_PER_IP"`
+	LoginBackoffInSecs                 int64                     `configName:"LOGIN_BACKOFF_IN_SECS"`
+	LoginLockoutInSecs                 int64                     `configName:"LOGIN_LOCKOUT_IN_SECS"`
+	PasswordHashAlgorithm              string                    `configName:"PASSWORD_HASH_ALGORITHM"`
+	PasswordHashArgon2idMemoryKiB      int64                     `configName:"PASSWORD_HASH_ARGON2ID_MEMORY_KIB"`
+	PasswordHashArgon2idIterations     int64                     `configName:"PASSWORD_HASH_ARGON2ID_ITERATIONS"`
+	PasswordHashArgon2idParallelism    int64                     `configName:"PASSWORD_HASH_ARGON2ID_PARALLELISM"`
+	PasswordHashBcryptCost             int64                     `configName:"PASSWORD_HASH_BCRYPT_COST"`
+	ProxyMaxRequestBodyMB              int64                     `configName:"PROXY_MAX_REQUEST_BODY_MB"`
+	ProxyMaxResponseBodyMB             int64                     `configName:"PROXY_MAX_RESPONSE_BODY_MB"`
+	ProxyMaxBufferedBodyMB             int64                     `configName:"PROXY_MAX_BUFFERED_BODY_MB"`
+	ProxyResponseHeaders               string                    `configName:"PROXY_RESPONSE_HEADERS"`
+	ProxyJobRetentionInSecs            int64                     `configName:"PROXY_JOB_RETENTION_IN_SECS"`
+	ProxyMaxRunningJobsPerUser         int64                     `configName:"PROXY_MAX_RUNNING_JOBS_PER_USER"`
+	TokenRefreshIntervalInSecs         int64                     `configName:"TOKEN_REFRESH_INTERVAL_IN_SECS"`
+	TokenRefreshAheadInSecs            int64                     `configName:"TOKEN_REFRESH_AHEAD_IN_SECS"`
+	TokenRefreshConcurrency            int64                     `configName:"TOKEN_REFRESH_CONCURRENCY"`
 	// CanMigrateDatabaseSchema indicates if we can safely perform migrations
 	// This depends on the deployment mechanism and the database config
 	// e.g. if running in Cloud Foundry with a shared DB, then only the 0-index application instance
@@ -7,6 +7,14 @@ type Token struct {
 	Record    TokenRecord
 }
 
+// ExpiringToken identifies a CNSI token that is about to expire
+type ExpiringToken struct {
+	CNSIGUID    string
+	UserGUID    string
+	AuthType    string
+	TokenExpiry int64
+}
+
 // TokenRepository is an application of the repository pattern for storing tokens
 type TokenRepository interface {
 	FindAuthToken(userGUID string, encryptionKey []byte) (TokenRecord, error)
@@ -17,8 +25,19 @@ type TokenRepository interface {
 	FindAllCNSITokenBackup(cnsiGUID string, encryptionKey []byte) ([]BackupTokenRecord, error)
 	DeleteCNSIToken(cnsiGUID string, userGUID string) error
 	DeleteCNSITokens(cnsiGUID string) error
+	// Delete all tokens of a user, e.g. when the user is removed
+	DeleteUserTokens(userGUID string) error
 	SaveCNSIToken(cnsiGUID string, userGUID string, tokenRecord TokenRecord, encryptionKey []byte) error
 
 	// Update a token's auth data
 	UpdateTokenAuth(userGUID string, tokenRecord TokenRecord, encryptionKey []byte) error
+
+	// Refresh a CNSI token while holding a lock on it, refresh returns nil to keep the stored token
+	RefreshCNSIToken(cnsiGUID string, userGUID string, encryptionKey []byte, refresh func(TokenRecord) (*TokenRecord, error)) (TokenRecord, error)
+
+	// Find the connected CNSI tokens of users with recent activity that expire before the given time (unix seconds)
+	FindExpiringCNSITokens(expiresBefore int64) ([]ExpiringToken, error)
+
+	// Re-encrypt all tokens not encrypted with the key
+	Reencrypt(encryptionKey []byte) (int, error)
 }
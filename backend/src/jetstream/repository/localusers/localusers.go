@@ -11,9 +11,19 @@ type Repository interface {
 	AddLocalUser(user interfaces.LocalUser) error
 	UpdateLocalUser(user interfaces.LocalUser) error
 	FindPasswordHash(userGUID string) ([]byte, error)
+	UpdatePasswordHash(userGUID string, hash []byte, previous []byte) (bool, error)
 	FindUserGUID(username string) (string, error)
 	FindUserScope(userGUID string) (string, error)
 	FindUser(userGUID string) (interfaces.LocalUser, error)
 	UpdateLastLoginTime(userGUID string, loginTime time.Time) error
 	FindLastLoginTime(userGUID string) (time.Time, error)
+	ListLocalUsers() ([]interfaces.LocalUser, error)
+	DeleteLocalUser(userGUID string) error
+	FindSessionVersion(userGUID string) (int64, error)
+	RevokeSessions(userGUID string) error
+	FindMFA(userGUID string) (*interfaces.LocalUserMFA, error)
+	SaveMFA(mfa interfaces.LocalUserMFA) error
+	UpdateMFAUsage(mfa interfaces.LocalUserMFA, previous interfaces.LocalUserMFA) (bool, error)
+	DeleteMFA(userGUID string) error
+	ReencryptMFA(encryptionKey []byte) (int, error)
 }
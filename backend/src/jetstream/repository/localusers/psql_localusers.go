@@ -2,10 +2,13 @@ package localusers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
 	"github.com/epinio/ui/backend/src/jetstream/datastore"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	log "github.com/sirupsen/logrus"
@@ -19,9 +22,20 @@ var findUserScope = `SELECT user_scope FROM local_users WHERE user_guid = $1`
 var insertLocalUser = `INSERT INTO local_users (user_guid, password_hash, user_name, user_email, user_scope, given_name, family_name) VALUES ($1, $2, $3, $4, $5, $6, $7)`
 var updateLocalUser = `UPDATE local_users SET password_hash=$1, user_name=$2, user_email=$3, user_scope=$4, given_name=$5, family_name=$6, last_updated=CURRENT_TIMESTAMP WHERE user_guid=$7`
 var updateLastLoginTime = `UPDATE local_users SET last_login=$1 WHERE user_guid = $2`
+var updatePasswordHash = `UPDATE local_users SET password_hash=$1 WHERE user_guid = $2 AND password_hash = $3`
 var findLastLoginTime = `SELECT last_login FROM local_users WHERE user_guid = $1`
 var getTableCount = `SELECT count(user_guid) FROM local_users`
 var findUser = `SELECT user_name, user_email, user_scope, given_name, family_name FROM local_users WHERE user_guid = $1`
+var listLocalUsers = `SELECT user_guid, user_name, user_email, user_scope, given_name, family_name FROM local_users ORDER BY user_name`
+var deleteLocalUser = `DELETE FROM local_users WHERE user_guid = $1`
+var findSessionVersion = `SELECT session_version FROM local_users WHERE user_guid = $1`
+var revokeSessions = `UPDATE local_users SET session_version = session_version + 1 WHERE user_guid = $1`
+var findMFA = `SELECT secret, enabled, recovery_salt, recovery_codes, last_step FROM local_users_mfa WHERE user_guid = $1`
+var insertMFA = `INSERT INTO local_users_mfa (user_guid, secret, enabled, recovery_salt, recovery_codes, last_step) VALUES ($1, $2, $3, $4, $5, $6)`
+var updateMFAUsage = `UPDATE local_users_mfa SET recovery_codes = $1, last_step = $2, last_updated = CURRENT_TIMESTAMP WHERE user_guid = $3 AND recovery_codes = $4 AND last_step = $5`
+var deleteMFA = `DELETE FROM local_users_mfa WHERE user_guid = $1`
+var listMFASecrets = `SELECT user_guid, secret FROM local_users_mfa`
+var reencryptMFA = `UPDATE local_users_mfa SET secret = $1 WHERE user_guid = $2 AND secret = $3`
 
 // PgsqlLocalUsersRepository is a PostgreSQL-backed local users repository
 type PgsqlLocalUsersRepository struct {
@@ -45,7 +59,18 @@ func InitRepositoryProvider(databaseProvider string) {
 	updateLocalUser = datastore.ModifySQLStatement(updateLocalUser, databaseProvider)
 	getTableCount = datastore.ModifySQLStatement(getTableCount, databaseProvider)
 	updateLastLoginTime = datastore.ModifySQLStatement(updateLastLoginTime, databaseProvider)
+	updatePasswordHash = datastore.ModifySQLStatement(updatePasswordHash, databaseProvider)
 	findLastLoginTime = datastore.ModifySQLStatement(findLastLoginTime, databaseProvider)
+	listLocalUsers = datastore.ModifySQLStatement(listLocalUsers, databaseProvider)
+	deleteLocalUser = datastore.ModifySQLStatement(deleteLocalUser, databaseProvider)
+	findSessionVersion = datastore.ModifySQLStatement(findSessionVersion, databaseProvider)
+	revokeSessions = datastore.ModifySQLStatement(revokeSessions, databaseProvider)
+	findMFA = datastore.ModifySQLStatement(findMFA, databaseProvider)
+	insertMFA = datastore.ModifySQLStatement(insertMFA, databaseProvider)
+	updateMFAUsage = datastore.ModifySQLStatement(updateMFAUsage, databaseProvider)
+	deleteMFA = datastore.ModifySQLStatement(deleteMFA, databaseProvider)
+	listMFASecrets = datastore.ModifySQLStatement(listMFASecrets, databaseProvider)
+	reencryptMFA = datastore.ModifySQLStatement(reencryptMFA, databaseProvider)
 }
 
 // FindPasswordHash returns the password hash from the datastore, for the given user
@@ -199,6 +224,28 @@ func (p *PgsqlLocalUsersRepository) UpdateLastLoginTime(userGUID string, loginTi
 	return err
 }
 
+// UpdatePasswordHash replaces the password hash of a user, e.g. with a hash created with the current algorithm. The
+// hash is only replaced if it's still the previous hash, so a password changed in the meantime is not reverted
+func (p *PgsqlLocalUsersRepository) UpdatePasswordHash(userGUID string, hash []byte, previous []byte) (bool, error) {
+	log.Debug("UpdatePasswordHash")
+
+	if userGUID == "" || len(hash) == 0 {
+		return false, errors.New("unable to update password hash without a valid user GUID and hash")
+	}
+
+	result, err := p.db.Exec(updatePasswordHash, hash, userGUID, previous)
+	if err != nil {
+		return false, fmt.Errorf("unable to UPDATE local user password hash: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("unable to UPDATE local user password hash: could not determine number of rows that were updated")
+	}
+
+	return rowsUpdates > 0, nil
+}
+
 //FindLastLoginTime selects the last_login field from the local_users table in the db, for the given user.
 func (p *PgsqlLocalUsersRepository) FindLastLoginTime(userGUID string) (time.Time, error) {
 	log.Debug("FindLastLoginTime")
@@ -324,3 +371,242 @@ func (p *PgsqlLocalUsersRepository) UpdateLocalUser(user interfaces.LocalUser) e
 
 	return err
 }
+
+// ListLocalUsers returns all local users, without their password hashes
+func (p *PgsqlLocalUsersRepository) ListLocalUsers() ([]interfaces.LocalUser, error) {
+	log.Debug("ListLocalUsers")
+
+	rows, err := p.db.Query(listLocalUsers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list local users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]interfaces.LocalUser, 0)
+	for rows.Next() {
+		var (
+			user       interfaces.LocalUser
+			email      sql.NullString
+			givenName  sql.NullString
+			familyName sql.NullString
+		)
+
+		if err = rows.Scan(&user.UserGUID, &user.Username, &email, &user.Scope, &givenName, &familyName); err != nil {
+			return nil, fmt.Errorf("unable to scan local user: %v", err)
+		}
+
+		user.Email = email.String
+		user.GivenName = givenName.String
+		user.FamilyName = familyName.String
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list local users: %v", err)
+	}
+
+	return users, nil
+}
+
+// DeleteLocalUser removes a local user from the datastore
+func (p *PgsqlLocalUsersRepository) DeleteLocalUser(userGUID string) error {
+	log.Debug("DeleteLocalUser")
+
+	if userGUID == "" {
+		return errors.New("unable to delete local user without a valid User GUID")
+	}
+
+	if err := p.DeleteMFA(userGUID); err != nil {
+		return err
+	}
+
+	result, err := p.db.Exec(deleteLocalUser, userGUID)
+	if err != nil {
+		return fmt.Errorf("unable to DELETE local user: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("unable to DELETE local user: could not determine number of rows that were updated")
+	} else if rowsUpdates < 1 {
+		return errors.New("unable to DELETE local user: no rows were updated")
+	}
+
+	return nil
+}
+
+// FindSessionVersion returns the session version of a user, sessions started with an older version have been revoked
+func (p *PgsqlLocalUsersRepository) FindSessionVersion(userGUID string) (int64, error) {
+	log.Debug("FindSessionVersion")
+
+	var version int64
+	if err := p.db.QueryRow(findSessionVersion, userGUID).Scan(&version); err != nil {
+		return 0, fmt.Errorf("unable to find local user session version: %v", err)
+	}
+
+	return version, nil
+}
+
+// RevokeSessions ends all sessions of a user by incrementing the user's session version
+func (p *PgsqlLocalUsersRepository) RevokeSessions(userGUID string) error {
+	log.Debug("RevokeSessions")
+
+	result, err := p.db.Exec(revokeSessions, userGUID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke local user sessions: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("unable to revoke local user sessions: could not determine number of rows that were updated")
+	} else if rowsUpdates < 1 {
+		return errors.New("unable to revoke local user sessions: no rows were updated")
+	}
+
+	return nil
+}
+
+// FindMFA returns the second factor of a local user, nil if the user has none
+func (p *PgsqlLocalUsersRepository) FindMFA(userGUID string) (*interfaces.LocalUserMFA, error) {
+	log.Debug("FindMFA")
+
+	var secret, recoveryCodes string
+	mfa := &interfaces.LocalUserMFA{UserGUID: userGUID}
+
+	err := p.db.QueryRow(findMFA, userGUID).Scan(&secret, &mfa.Enabled, &mfa.RecoverySalt, &recoveryCodes, &mfa.LastStep)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to find local user MFA: %v", err)
+	}
+
+	if mfa.Secret, err = base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("unable to decode local user MFA secret: %v", err)
+	}
+	mfa.RecoveryCodes = splitRecoveryCodes(recoveryCodes)
+
+	return mfa, nil
+}
+
+// SaveMFA stores the second factor of a local user, replacing any previous one
+func (p *PgsqlLocalUsersRepository) SaveMFA(mfa interfaces.LocalUserMFA) error {
+	log.Debug("SaveMFA")
+
+	if mfa.UserGUID == "" || len(mfa.Secret) == 0 {
+		return errors.New("unable to save local user MFA without a valid User GUID and secret")
+	}
+
+	txn, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to save local user MFA: %v", err)
+	}
+
+	if _, err = txn.Exec(deleteMFA, mfa.UserGUID); err == nil {
+		_, err = txn.Exec(insertMFA, mfa.UserGUID, base64.StdEncoding.EncodeToString(mfa.Secret), mfa.Enabled,
+			mfa.RecoverySalt, strings.Join(mfa.RecoveryCodes, ","), mfa.LastStep)
+	}
+	if err != nil {
+		txn.Rollback()
+		return fmt.Errorf("unable to save local user MFA: %v", err)
+	}
+
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("unable to save local user MFA: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateMFAUsage records the use of a code: the last TOTP step and the remaining recovery codes. The update only
+// happens if neither has changed since previous was read, so a code can't be used twice at the same time
+func (p *PgsqlLocalUsersRepository) UpdateMFAUsage(mfa interfaces.LocalUserMFA, previous interfaces.LocalUserMFA) (bool, error) {
+	log.Debug("UpdateMFAUsage")
+
+	result, err := p.db.Exec(updateMFAUsage, strings.Join(mfa.RecoveryCodes, ","), mfa.LastStep, mfa.UserGUID,
+		strings.Join(previous.RecoveryCodes, ","), previous.LastStep)
+	if err != nil {
+		return false, fmt.Errorf("unable to UPDATE local user MFA: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("unable to UPDATE local user MFA: could not determine number of rows that were updated")
+	}
+
+	return rowsUpdates > 0, nil
+}
+
+// DeleteMFA removes the second factor of a local user
+func (p *PgsqlLocalUsersRepository) DeleteMFA(userGUID string) error {
+	log.Debug("DeleteMFA")
+
+	if _, err := p.db.Exec(deleteMFA, userGUID); err != nil {
+		return fmt.Errorf("unable to DELETE local user MFA: %v", err)
+	}
+	return nil
+}
+
+// ReencryptMFA re-encrypts all TOTP secrets that are not encrypted with the given key. Returns the number of secrets
+// updated
+func (p *PgsqlLocalUsersRepository) ReencryptMFA(encryptionKey []byte) (int, error) {
+	log.Debug("ReencryptMFA")
+
+	rows, err := p.db.Query(listMFASecrets)
+	if err != nil {
+		return 0, fmt.Errorf("unable to retrieve local user MFA: %v", err)
+	}
+
+	// Read all rows before updating, some databases don't allow writes while a query is open
+	secrets := make(map[string]string)
+	for rows.Next() {
+		var userGUID, secret string
+		if err = rows.Scan(&userGUID, &secret); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("unable to scan local user MFA: %v", err)
+		}
+		secrets[userGUID] = secret
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to retrieve local user MFA: %v", err)
+	}
+
+	updated, failed := 0, 0
+	for userGUID, secret := range secrets {
+		var reencrypted []byte
+		encrypted, err := base64.StdEncoding.DecodeString(secret)
+		if err == nil {
+			reencrypted, err = crypto.ReencryptToken(encryptionKey, encrypted)
+		}
+		if err != nil {
+			log.Warnf("Unable to re-encrypt MFA secret of local user %s: %v", userGUID, err)
+			failed++
+			continue
+		}
+		if reencrypted == nil {
+			continue
+		}
+
+		result, err := p.db.Exec(reencryptMFA, base64.StdEncoding.EncodeToString(reencrypted), userGUID, secret)
+		if err != nil {
+			return updated, fmt.Errorf("unable to UPDATE local user MFA: %v", err)
+		}
+		if count, err := result.RowsAffected(); err == nil && count > 0 {
+			updated++
+		}
+	}
+
+	if failed > 0 {
+		return updated, fmt.Errorf("unable to re-encrypt %d MFA secrets", failed)
+	}
+
+	return updated, nil
+}
+
+func splitRecoveryCodes(value string) []string {
+	if len(value) == 0 {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,44 @@
+package loginattempts
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var defaultInterval = time.Minute * 5
+
+// Cleanup runs a background goroutine every interval that deletes the attempts of keys that have not failed for maxAge
+func (p *PgsqlLoginAttemptsRepository) Cleanup(interval, maxAge time.Duration) (chan<- struct{}, <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	quit, done := make(chan struct{}), make(chan struct{})
+	go p.cleanup(interval, maxAge, quit, done)
+	return quit, done
+}
+
+// StopCleanup stops the background cleanup from running.
+func (p *PgsqlLoginAttemptsRepository) StopCleanup(quit chan<- struct{}, done <-chan struct{}) {
+	quit <- struct{}{}
+	<-done
+}
+
+// cleanup deletes expired attempts at set intervals.
+func (p *PgsqlLoginAttemptsRepository) cleanup(interval, maxAge time.Duration, quit <-chan struct{}, done chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			done <- struct{}{}
+			return
+		case <-ticker.C:
+			if err := p.deleteExpired(time.Now().Add(-maxAge)); err != nil {
+				log.Warnf("LoginAttemptsRepository: unable to delete expired login attempts: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package loginattempts
+
+import (
+	"time"
+)
+
+// Attempts are the failed logins recorded for a key (a username or a client address)
+type Attempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Repository is an application of the repository pattern for storing failed login attempts
+type Repository interface {
+	// Find returns the attempts recorded for the key, nil if there are none
+	Find(key string) (*Attempts, error)
+	Insert(attempts Attempts) error
+	// Update replaces the attempts, as long as the recorded number of failures is still previousFailures. Returns
+	// false if they were changed in the meantime
+	Update(attempts Attempts, previousFailures int) (bool, error)
+	Delete(key string) error
+}
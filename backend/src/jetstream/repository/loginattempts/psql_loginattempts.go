@@ -0,0 +1,99 @@
+package loginattempts
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/datastore"
+)
+
+var findAttempts = `SELECT failures, last_failure, locked_until FROM login_attempts WHERE attempt_key = $1`
+var insertAttempts = `INSERT INTO login_attempts (attempt_key, failures, last_failure, locked_until) VALUES ($1, $2, $3, $4)`
+var updateAttempts = `UPDATE login_attempts SET failures = $1, last_failure = $2, locked_until = $3 WHERE attempt_key = $4 AND failures = $5`
+var deleteAttempts = `DELETE FROM login_attempts WHERE attempt_key = $1`
+var deleteExpiredAttempts = `DELETE FROM login_attempts WHERE last_failure < $1 AND locked_until < $2`
+
+// PgsqlLoginAttemptsRepository is a PostgreSQL-backed failed login attempts repository
+type PgsqlLoginAttemptsRepository struct {
+	db *sql.DB
+}
+
+// NewPgsqlLoginAttemptsRepository - get a reference to the login attempts data source
+func NewPgsqlLoginAttemptsRepository(dcp *sql.DB) (*PgsqlLoginAttemptsRepository, error) {
+	return &PgsqlLoginAttemptsRepository{db: dcp}, nil
+}
+
+// InitRepositoryProvider - One time init for the given DB Provider
+func InitRepositoryProvider(databaseProvider string) {
+	// Modify the database statements if needed, for the given database type
+	findAttempts = datastore.ModifySQLStatement(findAttempts, databaseProvider)
+	insertAttempts = datastore.ModifySQLStatement(insertAttempts, databaseProvider)
+	updateAttempts = datastore.ModifySQLStatement(updateAttempts, databaseProvider)
+	deleteAttempts = datastore.ModifySQLStatement(deleteAttempts, databaseProvider)
+	deleteExpiredAttempts = datastore.ModifySQLStatement(deleteExpiredAttempts, databaseProvider)
+}
+
+// Find returns the failed attempts recorded for the key, nil if there are none
+func (p *PgsqlLoginAttemptsRepository) Find(key string) (*Attempts, error) {
+	var lastFailure, lockedUntil int64
+	attempts := &Attempts{Key: key}
+
+	err := p.db.QueryRow(findAttempts, key).Scan(&attempts.Failures, &lastFailure, &lockedUntil)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("Unable to find login attempts: %v", err)
+	}
+
+	attempts.LastFailure = time.Unix(lastFailure, 0)
+	attempts.LockedUntil = time.Unix(lockedUntil, 0)
+	return attempts, nil
+}
+
+// Insert records the failed attempts for a key that has none yet
+func (p *PgsqlLoginAttemptsRepository) Insert(attempts Attempts) error {
+	if _, err := p.db.Exec(insertAttempts, attempts.Key, attempts.Failures, attempts.LastFailure.Unix(), attempts.LockedUntil.Unix()); err != nil {
+		return fmt.Errorf("Unable to insert login attempts: %v", err)
+	}
+	return nil
+}
+
+// Update replaces the failed attempts of a key, if they haven't been changed since previousFailures were read
+func (p *PgsqlLoginAttemptsRepository) Update(attempts Attempts, previousFailures int) (bool, error) {
+	result, err := p.db.Exec(updateAttempts, attempts.Failures, attempts.LastFailure.Unix(), attempts.LockedUntil.Unix(), attempts.Key, previousFailures)
+	if err != nil {
+		return false, fmt.Errorf("Unable to update login attempts: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Unable to update login attempts: could not determine number of rows that were updated")
+	}
+
+	return rowsUpdates > 0, nil
+}
+
+// Delete removes the failed attempts of a key
+func (p *PgsqlLoginAttemptsRepository) Delete(key string) error {
+	if _, err := p.db.Exec(deleteAttempts, key); err != nil {
+		return fmt.Errorf("Unable to delete login attempts: %v", err)
+	}
+	return nil
+}
+
+// deleteExpired removes the attempts that neither lock nor count towards a lock anymore
+func (p *PgsqlLoginAttemptsRepository) deleteExpired(before time.Time) error {
+	result, err := p.db.Exec(deleteExpiredAttempts, before.Unix(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+		log.Debugf("Deleted %d expired login attempts", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package proxyjobs
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var defaultInterval = time.Minute * 5
+
+// Cleanup runs a background goroutine every interval that deletes the jobs past their retention
+func (p *PgsqlProxyJobsRepository) Cleanup(interval time.Duration) (chan<- struct{}, <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	quit, done := make(chan struct{}), make(chan struct{})
+	go p.cleanup(interval, quit, done)
+	return quit, done
+}
+
+// StopCleanup stops the background cleanup from running.
+func (p *PgsqlProxyJobsRepository) StopCleanup(quit chan<- struct{}, done <-chan struct{}) {
+	quit <- struct{}{}
+	<-done
+}
+
+// cleanup deletes expired jobs at set intervals.
+func (p *PgsqlProxyJobsRepository) cleanup(interval time.Duration, quit <-chan struct{}, done chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			done <- struct{}{}
+			return
+		case <-ticker.C:
+			if err := p.deleteExpired(); err != nil {
+				log.Warnf("ProxyJobsRepository: unable to delete expired proxy jobs: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package proxyjobs
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// MaxStatusTextLength is the length of the status text column, longer texts (e.g. errors) are truncated
+const MaxStatusTextLength = 255
+
+// Job is a long-running proxied request that continues in the background after the client stopped waiting for it
+type Job struct {
+	ID           string
+	UserGUID     string
+	EndpointGUID string
+	Method       string
+	URL          string
+	// Passthrough is true if the response is returned as it is, rather than wrapped into a JSON object keyed by the
+	// endpoint guid
+	Passthrough bool
+	Status      string
+	// StatusCode, StatusText and Response are the response of the endpoint once the job has finished. The response is
+	// encrypted
+	StatusCode int
+	StatusText string
+	Response   []byte
+	Created    time.Time
+	Updated    time.Time
+	Expires    time.Time
+}
+
+// truncatedStatusText returns the status text cut to MaxStatusTextLength characters
+func (j Job) truncatedStatusText() string {
+	if utf8.RuneCountInString(j.StatusText) <= MaxStatusTextLength {
+		return j.StatusText
+	}
+	return string([]rune(j.StatusText)[:MaxStatusTextLength])
+}
+
+// Repository is an application of the repository pattern for storing proxy jobs
+type Repository interface {
+	// Find returns the job, nil if there is none
+	Find(id string) (*Job, error)
+	Insert(job Job) error
+	// Finish stores the response of a running job. Returns false if the job is not running anymore
+	Finish(job Job) (bool, error)
+	// CountRunning returns the number of jobs of the user that are still running
+	CountRunning(userGUID string) (int, error)
+}
@@ -0,0 +1,107 @@
+package proxyjobs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/datastore"
+)
+
+var findJob = `SELECT user_guid, endpoint_guid, method, url, passthrough, status, status_code, status_text, response, created, updated, expires FROM proxy_jobs WHERE id = $1`
+var insertJob = `INSERT INTO proxy_jobs (id, user_guid, endpoint_guid, method, url, passthrough, status, status_code, status_text, created, updated, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+var finishJob = `UPDATE proxy_jobs SET status = $1, status_code = $2, status_text = $3, response = $4, updated = $5, expires = $6 WHERE id = $7 AND status = $8`
+var countRunningJobs = `SELECT COUNT(*) FROM proxy_jobs WHERE user_guid = $1 AND status = $2 AND expires >= $3`
+var deleteExpiredJobs = `DELETE FROM proxy_jobs WHERE expires < $1`
+
+// PgsqlProxyJobsRepository is a PostgreSQL-backed proxy jobs repository
+type PgsqlProxyJobsRepository struct {
+	db *sql.DB
+}
+
+// NewPgsqlProxyJobsRepository - get a reference to the proxy jobs data source
+func NewPgsqlProxyJobsRepository(dcp *sql.DB) (*PgsqlProxyJobsRepository, error) {
+	return &PgsqlProxyJobsRepository{db: dcp}, nil
+}
+
+// InitRepositoryProvider - One time init for the given DB Provider
+func InitRepositoryProvider(databaseProvider string) {
+	// Modify the database statements if needed, for the given database type
+	findJob = datastore.ModifySQLStatement(findJob, databaseProvider)
+	insertJob = datastore.ModifySQLStatement(insertJob, databaseProvider)
+	finishJob = datastore.ModifySQLStatement(finishJob, databaseProvider)
+	countRunningJobs = datastore.ModifySQLStatement(countRunningJobs, databaseProvider)
+	deleteExpiredJobs = datastore.ModifySQLStatement(deleteExpiredJobs, databaseProvider)
+}
+
+// Find returns the job with the given id, nil if there is none or it has expired
+func (p *PgsqlProxyJobsRepository) Find(id string) (*Job, error) {
+	var created, updated, expires int64
+	job := &Job{ID: id}
+
+	err := p.db.QueryRow(findJob, id).Scan(&job.UserGUID, &job.EndpointGUID, &job.Method, &job.URL, &job.Passthrough, &job.Status,
+		&job.StatusCode, &job.StatusText, &job.Response, &created, &updated, &expires)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("Unable to find proxy job: %v", err)
+	}
+
+	job.Created = time.Unix(created, 0)
+	job.Updated = time.Unix(updated, 0)
+	job.Expires = time.Unix(expires, 0)
+	if job.Expires.Before(time.Now()) {
+		// Not deleted yet
+		return nil, nil
+	}
+	return job, nil
+}
+
+// Insert stores a new job
+func (p *PgsqlProxyJobsRepository) Insert(job Job) error {
+	if _, err := p.db.Exec(insertJob, job.ID, job.UserGUID, job.EndpointGUID, job.Method, job.URL, job.Passthrough, job.Status,
+		job.StatusCode, job.truncatedStatusText(), job.Created.Unix(), job.Updated.Unix(), job.Expires.Unix()); err != nil {
+		return fmt.Errorf("Unable to insert proxy job: %v", err)
+	}
+	return nil
+}
+
+// Finish stores the outcome of a job, if it is still running
+func (p *PgsqlProxyJobsRepository) Finish(job Job) (bool, error) {
+	result, err := p.db.Exec(finishJob, job.Status, job.StatusCode, job.truncatedStatusText(), job.Response, job.Updated.Unix(), job.Expires.Unix(), job.ID, JobRunning)
+	if err != nil {
+		return false, fmt.Errorf("Unable to update proxy job: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Unable to update proxy job: could not determine number of rows that were updated")
+	}
+
+	return rowsUpdates > 0, nil
+}
+
+// CountRunning returns the number of running jobs of a user
+func (p *PgsqlProxyJobsRepository) CountRunning(userGUID string) (int, error) {
+	var count int
+	if err := p.db.QueryRow(countRunningJobs, userGUID, JobRunning, time.Now().Unix()).Scan(&count); err != nil {
+		return 0, fmt.Errorf("Unable to count running proxy jobs: %v", err)
+	}
+	return count, nil
+}
+
+// deleteExpired removes the jobs that are past their retention
+func (p *PgsqlProxyJobsRepository) deleteExpired() error {
+	result, err := p.db.Exec(deleteExpiredJobs, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+		log.Debugf("Deleted %d expired proxy jobs", deleted)
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package tokens
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/epinio/ui/backend/src/jetstream/crypto"
 	"github.com/epinio/ui/backend/src/jetstream/datastore"
@@ -61,11 +64,36 @@ var deleteCNSIToken = `DELETE FROM tokens
 										WHERE token_type = 'cnsi' AND cnsi_guid = $1 AND user_guid = $2`
 var deleteCNSITokens = `DELETE FROM tokens
 											WHERE token_type = 'cnsi' AND cnsi_guid = $1`
+var deleteUserTokens = `DELETE FROM tokens
+											WHERE user_guid = $1`
 
 var updateToken = `UPDATE tokens
 										SET auth_token = $1, refresh_token = $2, token_expiry = $3
 										WHERE token_guid = $4 AND user_guid = $5`
 
+var listEncryptedTokens = `SELECT user_guid, cnsi_guid, token_guid, auth_token, refresh_token
+										FROM tokens`
+
+// Tokens of users whose sessions were active recently, see the user_activity table
+var findExpiringCNSITokens = `SELECT cnsi_guid, user_guid, auth_type, token_expiry
+										FROM tokens
+										WHERE token_type = 'cnsi' AND disconnected = '0' AND token_expiry < $1
+										AND user_guid IN (SELECT user_guid FROM user_activity WHERE active_until >= $2)`
+
+// The row is locked until the refreshed token has been stored, see RefreshCNSIToken. Not supported (or needed) by SQLite
+var lockCNSIToken = `SELECT token_guid, auth_token, refresh_token, token_expiry, disconnected, auth_type, meta_data
+										FROM tokens
+										WHERE cnsi_guid = $1 AND user_guid = $2 AND token_type = 'cnsi' FOR UPDATE`
+
+var refreshCNSIToken = `UPDATE tokens
+										SET auth_token = $1, refresh_token = $2, token_expiry = $3
+										WHERE token_guid = $4 AND user_guid = $5`
+
+// The auth token is compared so that a token refreshed since it was read is not overwritten
+var reencryptToken = `UPDATE tokens
+										SET auth_token = $1, refresh_token = $2
+										WHERE user_guid = $3 AND cnsi_guid = $4 AND token_guid = $5 AND auth_token = $6`
+
 // PgsqlTokenRepository is a PostgreSQL-backed token repository
 type PgsqlTokenRepository struct {
 	db *sql.DB
@@ -95,7 +123,18 @@ func InitRepositoryProvider(databaseProvider string) {
 	updateCNSIToken = datastore.ModifySQLStatement(updateCNSIToken, databaseProvider)
 	deleteCNSIToken = datastore.ModifySQLStatement(deleteCNSIToken, databaseProvider)
 	deleteCNSITokens = datastore.ModifySQLStatement(deleteCNSITokens, databaseProvider)
+	deleteUserTokens = datastore.ModifySQLStatement(deleteUserTokens, databaseProvider)
 	updateToken = datastore.ModifySQLStatement(updateToken, databaseProvider)
+	listEncryptedTokens = datastore.ModifySQLStatement(listEncryptedTokens, databaseProvider)
+	reencryptToken = datastore.ModifySQLStatement(reencryptToken, databaseProvider)
+	lockCNSIToken = datastore.ModifySQLStatement(lockCNSIToken, databaseProvider)
+	refreshCNSIToken = datastore.ModifySQLStatement(refreshCNSIToken, databaseProvider)
+	findExpiringCNSITokens = datastore.ModifySQLStatement(findExpiringCNSITokens, databaseProvider)
+
+	// SQLite locks the whole database for writes
+	if databaseProvider == datastore.SQLITE {
+		lockCNSIToken = strings.Replace(lockCNSIToken, " FOR UPDATE", "", 1)
+	}
 }
 
 // saveAuthToken - Save the Auth token to the datastore
@@ -573,6 +612,114 @@ func (p *PgsqlTokenRepository) DeleteCNSITokens(cnsiGUID string) error {
 	return nil
 }
 
+// DeleteUserTokens - remove the UAA and CNSI tokens of a user
+func (p *PgsqlTokenRepository) DeleteUserTokens(userGUID string) error {
+	log.Debug("DeleteUserTokens")
+	if userGUID == "" {
+		msg := "Unable to delete tokens without a valid User GUID."
+		log.Debug(msg)
+		return errors.New(msg)
+	}
+
+	_, err := p.db.Exec(deleteUserTokens, userGUID)
+	if err != nil {
+		msg := "Unable to Delete user tokens: %v"
+		log.Debugf(msg, err)
+		return fmt.Errorf(msg, err)
+	}
+
+	return nil
+}
+
+// RefreshCNSIToken - Lock the CNSI token of a user while it is refreshed, so that only one instance refreshes it at a
+// time. refresh is passed the stored token and returns the refreshed token to store, or nil to keep the stored token
+// (e.g. because another instance has refreshed it in the meantime). Returns the token that is stored once done
+func (p *PgsqlTokenRepository) RefreshCNSIToken(cnsiGUID string, userGUID string, encryptionKey []byte, refresh func(interfaces.TokenRecord) (*interfaces.TokenRecord, error)) (interfaces.TokenRecord, error) {
+	log.Debug("RefreshCNSIToken")
+	if cnsiGUID == "" || userGUID == "" {
+		return interfaces.TokenRecord{}, errors.New("Unable to refresh CNSI Token without a valid CNSI and User GUID.")
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return interfaces.TokenRecord{}, fmt.Errorf("Unable to refresh CNSI token: %v", err)
+	}
+	// Releases the lock if the token was not refreshed
+	defer tx.Rollback()
+
+	var (
+		ciphertextAuthToken    []byte
+		ciphertextRefreshToken []byte
+		tokenExpiry            sql.NullInt64
+		metadata               sql.NullString
+	)
+	tr := interfaces.TokenRecord{}
+	err = tx.QueryRow(lockCNSIToken, cnsiGUID, userGUID).Scan(&tr.TokenGUID, &ciphertextAuthToken, &ciphertextRefreshToken, &tokenExpiry, &tr.Disconnected, &tr.AuthType, &metadata)
+	if err != nil {
+		return interfaces.TokenRecord{}, fmt.Errorf("Unable to Find CNSI token: %v", err)
+	}
+
+	if tr.AuthToken, err = crypto.DecryptToken(encryptionKey, ciphertextAuthToken); err != nil {
+		return interfaces.TokenRecord{}, err
+	}
+	if tr.RefreshToken, err = crypto.DecryptToken(encryptionKey, ciphertextRefreshToken); err != nil {
+		return interfaces.TokenRecord{}, err
+	}
+	tr.TokenExpiry = tokenExpiry.Int64
+	tr.Metadata = metadata.String
+
+	refreshed, err := refresh(tr)
+	if err != nil {
+		return interfaces.TokenRecord{}, err
+	}
+	if refreshed == nil {
+		return tr, nil
+	}
+
+	if ciphertextAuthToken, err = crypto.EncryptToken(encryptionKey, refreshed.AuthToken); err != nil {
+		return interfaces.TokenRecord{}, err
+	}
+	if ciphertextRefreshToken, err = crypto.EncryptToken(encryptionKey, refreshed.RefreshToken); err != nil {
+		return interfaces.TokenRecord{}, err
+	}
+
+	if _, err = tx.Exec(refreshCNSIToken, ciphertextAuthToken, ciphertextRefreshToken, refreshed.TokenExpiry, tr.TokenGUID, userGUID); err != nil {
+		return interfaces.TokenRecord{}, fmt.Errorf("Unable to UPDATE CNSI token: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return interfaces.TokenRecord{}, fmt.Errorf("Unable to UPDATE CNSI token: %v", err)
+	}
+
+	refreshed.TokenGUID = tr.TokenGUID
+	return *refreshed, nil
+}
+
+// FindExpiringCNSITokens - Find the connected CNSI tokens of users with recent activity that expire before the given
+// time (unix seconds), so that they can be refreshed ahead of time
+func (p *PgsqlTokenRepository) FindExpiringCNSITokens(expiresBefore int64) ([]interfaces.ExpiringToken, error) {
+	log.Debug("FindExpiringCNSITokens")
+
+	rows, err := p.db.Query(findExpiringCNSITokens, expiresBefore, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find expiring CNSI tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]interfaces.ExpiringToken, 0)
+	for rows.Next() {
+		var token interfaces.ExpiringToken
+		if err = rows.Scan(&token.CNSIGUID, &token.UserGUID, &token.AuthType, &token.TokenExpiry); err != nil {
+			return nil, fmt.Errorf("Unable to scan expiring CNSI tokens: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to find expiring CNSI tokens: %v", err)
+	}
+	return tokens, nil
+}
+
 // UpdateTokenAuth - Update a token's auth data
 func (p *PgsqlTokenRepository) UpdateTokenAuth(userGUID string, tr interfaces.TokenRecord, encryptionKey []byte) error {
 	log.Debug("UpdateTokenAuth")
@@ -651,3 +798,71 @@ func (p *PgsqlTokenRepository) UpdateTokenAuth(userGUID string, tr interfaces.To
 
 	return nil
 }
+
+// Reencrypt - Re-encrypt all tokens that are not encrypted with the given key. Returns the number of tokens updated
+func (p *PgsqlTokenRepository) Reencrypt(encryptionKey []byte) (int, error) {
+	log.Debug("Reencrypt")
+
+	type encryptedToken struct {
+		userGUID     string
+		cnsiGUID     string
+		tokenGUID    string
+		authToken    []byte
+		refreshToken []byte
+	}
+
+	rows, err := p.db.Query(listEncryptedTokens)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to retrieve tokens: %v", err)
+	}
+
+	// Read all rows before updating, some databases don't allow writes while a query is open
+	var encryptedTokens []encryptedToken
+	for rows.Next() {
+		var t encryptedToken
+		if err = rows.Scan(&t.userGUID, &t.cnsiGUID, &t.tokenGUID, &t.authToken, &t.refreshToken); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("Unable to scan token records: %v", err)
+		}
+		encryptedTokens = append(encryptedTokens, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("Unable to retrieve tokens: %v", err)
+	}
+
+	updated, failed := 0, 0
+	for _, t := range encryptedTokens {
+		authToken, err := crypto.ReencryptToken(encryptionKey, t.authToken)
+		if err == nil && authToken == nil {
+			authToken = t.authToken
+		}
+		refreshToken, refreshErr := crypto.ReencryptToken(encryptionKey, t.refreshToken)
+		if refreshErr == nil && refreshToken == nil {
+			refreshToken = t.refreshToken
+		}
+		if err != nil || refreshErr != nil {
+			log.Warnf("Unable to re-encrypt token %s of user %s: %v %v", t.tokenGUID, t.userGUID, err, refreshErr)
+			failed++
+			continue
+		}
+
+		if bytes.Equal(authToken, t.authToken) && bytes.Equal(refreshToken, t.refreshToken) {
+			continue
+		}
+
+		result, err := p.db.Exec(reencryptToken, authToken, refreshToken, t.userGUID, t.cnsiGUID, t.tokenGUID, t.authToken)
+		if err != nil {
+			return updated, fmt.Errorf("Unable to update token: %v", err)
+		}
+		if count, err := result.RowsAffected(); err == nil && count > 0 {
+			updated++
+		}
+	}
+
+	if failed > 0 {
+		return updated, fmt.Errorf("Unable to re-encrypt %d tokens", failed)
+	}
+
+	return updated, nil
+}
@@ -1,29 +1,34 @@
 package tokens
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"log"
 	"testing"
 	"time"
 
+	"github.com/epinio/ui/backend/src/jetstream/crypto"
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
 const (
-	mockUAAToken        = `eyJhbGciOiJSUzI1NiIsImtpZCI6ImxlZ2FjeS10b2tlbi1rZXkiLCJ0eXAiOiJKV1QifQ.eyJqdGkiOiI2ZGIyYTI5NGYyYWE0OGNlYjI1NDgzMDk4ZDNjY2Q3YyIsInN1YiI6Ijg4YmNlYWE1LWJkY2UtNDdiOC04MmYzLTRhZmMxNGYyNjZmOSIsInNjb3BlIjpbIm9wZW5pZCIsInNjaW0ucmVhZCIsImNsb3VkX2NvbnRyb2xsZXIuYWRtaW4iLCJ1YWEudXNlciIsImNsb3VkX2NvbnRyb2xsZXIucmVhZCIsInBhc3N3b3JkLndyaXRlIiwicm91dGluZy5yb3V0ZXJfZ3JvdXBzLnJlYWQiLCJjbG91ZF9jb250cm9sbGVyLndyaXRlIiwiZG9wcGxlci5maXJlaG9zZSIsInNjaW0ud3JpdGUiXSwiY2xpZW50X2lkIjoiY2YiLCJjaWQiOiJjZiIsImF6cCI6ImNmIiwiZ3JhbnRfdHlwZSI6InBhc3N3b3JkIiwidXNlcl9pZCI6Ijg4YmNlYWE1LWJkY2UtNDdiOC04MmYzLTRhZmMxNGYyNjZmOSIsIm9yaWdpbiI6InVhYSIsInVzZXJfbmFtZSI6ImFkbWluIiwiZW1haWwiOiJhZG1pbiIsImF1dGhfdGltZSI6MTQ2Nzc2OTgxNiwicmV2X3NpZyI6IjE0MGUwMjZiIiwiaWF0IjoxNDY3NzY5ODE2LCJleHAiOjE0Njc3NzA0MTYsImlzcyI6Imh0dHBzOi8vdWFhLmV4YW1wbGUuY29tL29hdXRoL3Rva2VuIiwiemlkIjoidWFhIiwiYXVkIjpbImNmIiwib3BlbmlkIiwic2NpbSIsImNsb3VkX2NvbnRyb2xsZXIiLCJ1YWEiLCJwYXNzd29yZCIsInJvdXRpbmcucm91dGVyX2dyb3VwcyIsImRvcHBsZXIiXX0.q2u0JX42Qiwr0ZsBU5Y6bF74_0URWmmBYTLf8l7of_6huFoMkyqvirEYcbYbATt6Hz2zcN6xlXcInALxQ6nt6Jk01kZHRNYfuu6QziLHHw2o_dJWk9iipiermUze7BvSGtU_JXx45BSBNVFxvRxG9Yv54Lwa9FvyhMSmK3CI5S8NtVDchzrsH3sMsIjlTAb-L7sch-OOQ7ncWH1JoGMtw8sTbiaHvfNJQclSq8Ro11NUtRHiWeGFFxYIerzKO-TrSpDojFJrYVuK1m0YPmBDa_dY3cneRuppagRIn8oI0VFHF8BckrIqNCHvOMoVz6uzHebo9LK7H5z5SluxJ2vYUgPiHE_Tyo-7gELnNSy8qL4Bk9yTxNseeGiq13TSTGOtNnbrv1eq4ZeW7eafseLceKIZH2QZlXVzwd_aWbuKRv9ApDwy4AcSbpM0XtU89IjUEDoOf3IDWV2YZTZkEaXZ52Mhztb1O_IVpHyyks88P67RoANFt83MnCai9U3stCX45LEsg9oz2djrVnfHDzRNQVlg9hKJYbxsa2R5tpnftjhz-hfpsoPRxBkJDKM2islyd-gLqHtsERiZEoifu93VRE0Jvk6vaCNdStw7y4mq73Co6ykNUYA78SlT9lCwDJRQHTJiDWg33EeKpXne8joZbElwrKNcv93X1qxxvmp1wXQ bearer eyJhbGciOiJSUzI1NiIsImtpZCI6ImxlZ2FjeS10b2tlbi1rZXkiLCJ0eXAiOiJKV1QifQ.eyJqdGkiOiI2ZGIyYTI5NGYyYWE0OGNlYjI1NDgzMDk4ZDNjY2Q3Yy1yIiwic3ViIjoiODhiY2VhYTUtYmRjZS00N2I4LTgyZjMtNGFmYzE0ZjI2NmY5Iiwic2NvcGUiOlsib3BlbmlkIiwic2NpbS5yZWFkIiwiY2xvdWRfY29udHJvbGxlci5hZG1pbiIsInVhYS51c2VyIiwiY2xvdWRfY29udHJvbGxlci5yZWFkIiwicGFzc3dvcmQud3JpdGUiLCJyb3V0aW5nLnJvdXRlcl9ncm91cHMucmVhZCIsImNsb3VkX2NvbnRyb2xsZXIud3JpdGUiLCJkb3BwbGVyLmZpcmVob3NlIiwic2NpbS53cml0ZSJdLCJpYXQiOjE0Njc3Njk4MTYsImV4cCI6MTQ3MDM2MTgxNiwiY2lkIjoiY2YiLCJjbGllbnRfaWQiOiJjZiIsImlzcyI6Imh0dHBzOi8vdWFhLmV4YW1wbGUuY29tL29hdXRoL3Rva2VuIiwiemlkIjoidWFhIiwiZ3JhbnRfdHlwZSI6InBhc3N3b3JkIiwidXNlcl9uYW1lIjoiYWRtaW4iLCJvcmlnaW4iOiJ1YWEiLCJ1c2VyX2lkIjoiODhiY2VhYTUtYmRjZS00N2I4LTgyZjMtNGFmYzE0ZjI2NmY5IiwicmV2X3NpZyI6IjE0MGUwMjZiIiwiYXVkIjpbImNmIiwib3BlbmlkIiwic2NpbSIsImNsb3VkX2NvbnRyb2xsZXIiLCJ1YWEiLCJwYXNzd29yZCIsInJvdXRpbmcucm91dGVyX2dyb3VwcyIsImRvcHBsZXIiXX0.K5M_isGkEBAN_MaXqkVvJfHG86rGIUkDgsHaFnoKOA1x5FNC4APDvhImWJZ8zbFHhXT3PYHTyeSf_HQaFDFUHFvGZUhSSry2ID4kdU5kRyZ-y3ydkv2mq32BlUQBSC9ap0r5vFTv7BY1yf2EcDaKGe4v4ODMhTm2SIkdTyk2ZcLXHIucS0xgSZdjgxNqh3pnKtmcFkw72-CyREW4_2Nbvn_7U2UNUCb2SeAuWmYaNAOkuGveB8jAhg9ftTrxn5GNtNe1sdVycm51X1O0dGPt_rLbwkRDCdNpm0La_xzLqZEl60_YUqwo33eOChFgqXB5y_0Pzs9gD__uExrIXYIgMsltFELXryyRUDKTTHZEEw1bnLTbQfF-GAnS0E0CaTU_kcDVqDYcqfh0TCcr7nGCEozExMPm3J0OGUSP3FQAD5mDICsKKcSIi_kIjggkJ87tuNAY6QOW1WzBoRizXJVS4jb3QOnrii2LmH786qBYJMX0nH__JRYEU-HWLi_OGXVTo03Pe9QcB8qJvbu2DGRfQdBfjhvgt2AItY4voJnZcjwT29q144C5wvJ2_W8cUzNY-Xw_tN_fWK4LWCu6KRNLVLO2MNbl0aOfkvb1U5NZJUpUUC2jG3cZM2c8232YNFKVjdjbf-Mlx17OxOYQ5XtG5BiSEj7BA6s5hWftUXEUchg`
-	mockCNSIToken       = mockUAAToken
-	mockTokenGUID       = "mock-token-guid"
-	mockUserGuid        = "foo-bar"
-	mockCNSIGuid        = "foo-bar"
-	countTokensSql      = `SELECT COUNT`
-	insertTokenSql      = `INSERT INTO tokens`
-	updateUAATokenSql   = `UPDATE tokens`
-	findTokenSql        = `SELECT token_guid, auth_token, refresh_token, token_expiry, disconnected, auth_type, meta_data, user_guid, linked_token FROM tokens .*`
-	findUAATokenSql     = `SELECT token_guid, auth_token, refresh_token, token_expiry, auth_type, meta_data FROM tokens WHERE token_type = 'uaa' AND .*`
-	deleteFromTokensSql = `DELETE FROM tokens`
+	mockUAAToken           = `eyJhbGciOiJSUzI1NiIsImtpZCI6ImxlZ2FjeS10b2tlbi1rZXkiLCJ0eXAiOiJKV1QifQ.eyJqdGkiOiI2ZGIyYTI5NGYyYWE0OGNlYjI1NDgzMDk4ZDNjY2Q3YyIsInN1YiI6Ijg4YmNlYWE1LWJkY2UtNDdiOC04MmYzLTRhZmMxNGYyNjZmOSIsInNjb3BlIjpbIm9wZW5pZCIsInNjaW0ucmVhZCIsImNsb3VkX2NvbnRyb2xsZXIuYWRtaW4iLCJ1YWEudXNlciIsImNsb3VkX2NvbnRyb2xsZXIucmVhZCIsInBhc3N3b3JkLndyaXRlIiwicm91dGluZy5yb3V0ZXJfZ3JvdXBzLnJlYWQiLCJjbG91ZF9jb250cm9sbGVyLndyaXRlIiwiZG9wcGxlci5maXJlaG9zZSIsInNjaW0ud3JpdGUiXSwiY2xpZW50X2lkIjoiY2YiLCJjaWQiOiJjZiIsImF6cCI6ImNmIiwiZ3JhbnRfdHlwZSI6InBhc3N3b3JkIiwidXNlcl9pZCI6Ijg4YmNlYWE1LWJkY2UtNDdiOC04MmYzLTRhZmMxNGYyNjZmOSIsIm9yaWdpbiI6InVhYSIsInVzZXJfbmFtZSI6ImFkbWluIiwiZW1haWwiOiJhZG1pbiIsImF1dGhfdGltZSI6MTQ2Nzc2OTgxNiwicmV2X3NpZyI6IjE0MGUwMjZiIiwiaWF0IjoxNDY3NzY5ODE2LCJleHAiOjE0Njc3NzA0MTYsImlzcyI6Imh0dHBzOi8vdWFhLmV4YW1wbGUuY29tL29hdXRoL3Rva2VuIiwiemlkIjoidWFhIiwiYXVkIjpbImNmIiwib3BlbmlkIiwic2NpbSIsImNsb3VkX2NvbnRyb2xsZXIiLCJ1YWEiLCJwYXNzd29yZCIsInJvdXRpbmcucm91dGVyX2dyb3VwcyIsImRvcHBsZXIiXX0.q2u0JX42Qiwr0ZsBU5Y6bF74_0URWmmBYTLf8l7of_6huFoMkyqvirEYcbYbATt6Hz2zcN6xlXcInALxQ6nt6Jk01kZHRNYfuu6QziLHHw2o_dJWk9iipiermUze7BvSGtU_JXx45BSBNVFxvRxG9Yv54Lwa9FvyhMSmK3CI5S8NtVDchzrsH3sMsIjlTAb-L7sch-OOQ7ncWH1JoGMtw8sTbiaHvfNJQclSq8Ro11NUtRHiWeGFFxYIerzKO-TrSpDojFJrYVuK1m0YPmBDa_dY3cneRuppagRIn8oI0VFHF8BckrIqNCHvOMoVz6uzHebo9LK7H5z5SluxJ2vYUgPiHE_Tyo-7gELnNSy8qL4Bk9yTxNseeGiq13TSTGOtNnbrv1eq4ZeW7eafseLceKIZH2QZlXVzwd_aWbuKRv9ApDwy4AcSbpM0XtU89IjUEDoOf3IDWV2YZTZkEaXZ52Mhztb1O_IVpHyyks88P67RoANFt83MnCai9U3stCX45LEsg9oz2djrVnfHDzRNQVlg9hKJYbxsa2R5tpnftjhz-hfpsoPRxBkJDKM2islyd-gLqHtsERiZEoifu93VRE0Jvk6vaCNdStw7y4mq73Co6ykNUYA78SlT9lCwDJRQHTJiDWg33EeKpXne8joZbElwrKNcv93X1qxxvmp1wXQ bearer eyJhbGciOiJSUzI1NiIsImtpZCI6ImxlZ2FjeS10b2tlbi1rZXkiLCJ0eXAiOiJKV1QifQ.eyJqdGkiOiI2ZGIyYTI5NGYyYWE0OGNlYjI1NDgzMDk4ZDNjY2Q3Yy1yIiwic3ViIjoiODhiY2VhYTUtYmRjZS00N2I4LTgyZjMtNGFmYzE0ZjI2NmY5Iiwic2NvcGUiOlsib3BlbmlkIiwic2NpbS5yZWFkIiwiY2xvdWRfY29udHJvbGxlci5hZG1pbiIsInVhYS51c2VyIiwiY2xvdWRfY29udHJvbGxlci5yZWFkIiwicGFzc3dvcmQud3JpdGUiLCJyb3V0aW5nLnJvdXRlcl9ncm91cHMucmVhZCIsImNsb3VkX2NvbnRyb2xsZXIud3JpdGUiLCJkb3BwbGVyLmZpcmVob3NlIiwic2NpbS53cml0ZSJdLCJpYXQiOjE0Njc3Njk4MTYsImV4cCI6MTQ3MDM2MTgxNiwiY2lkIjoiY2YiLCJjbGllbnRfaWQiOiJjZiIsImlzcyI6Imh0dHBzOi8vdWFhLmV4YW1wbGUuY29tL29hdXRoL3Rva2VuIiwiemlkIjoidWFhIiwiZ3JhbnRfdHlwZSI6InBhc3N3b3JkIiwidXNlcl9uYW1lIjoiYWRtaW4iLCJvcmlnaW4iOiJ1YWEiLCJ1c2VyX2lkIjoiODhiY2VhYTUtYmRjZS00N2I4LTgyZjMtNGFmYzE0ZjI2NmY5IiwicmV2X3NpZyI6IjE0MGUwMjZiIiwiYXVkIjpbImNmIiwib3BlbmlkIiwic2NpbSIsImNsb3VkX2NvbnRyb2xsZXIiLCJ1YWEiLCJwYXNzd29yZCIsInJvdXRpbmcucm91dGVyX2dyb3VwcyIsImRvcHBsZXIiXX0.K5M_isGkEBAN_MaXqkVvJfHG86rGIUkDgsHaFnoKOA1x5FNC4APDvhImWJZ8zbFHhXT3PYHTyeSf_HQaFDFUHFvGZUhSSry2ID4kdU5kRyZ-y3ydkv2mq32BlUQBSC9ap0r5vFTv7BY1yf2EcDaKGe4v4ODMhTm2SIkdTyk2ZcLXHIucS0xgSZdjgxNqh3pnKtmcFkw72-CyREW4_2Nbvn_7U2UNUCb2SeAuWmYaNAOkuGveB8jAhg9ftTrxn5GNtNe1sdVycm51X1O0dGPt_rLbwkRDCdNpm0La_xzLqZEl60_YUqwo33eOChFgqXB5y_0Pzs9gD__uExrIXYIgMsltFELXryyRUDKTTHZEEw1bnLTbQfF-GAnS0E0CaTU_kcDVqDYcqfh0TCcr7nGCEozExMPm3J0OGUSP3FQAD5mDICsKKcSIi_kIjggkJ87tuNAY6QOW1WzBoRizXJVS4jb3QOnrii2LmH786qBYJMX0nH__JRYEU-HWLi_OGXVTo03Pe9QcB8qJvbu2DGRfQdBfjhvgt2AItY4voJnZcjwT29q144C5wvJ2_W8cUzNY-Xw_tN_fWK4LWCu6KRNLVLO2MNbl0aOfkvb1U5NZJUpUUC2jG3cZM2c8232YNFKVjdjbf-Mlx17OxOYQ5XtG5BiSEj7BA6s5hWftUXEUchg`
+	mockCNSIToken          = mockUAAToken
+	mockTokenGUID          = "mock-token-guid"
+	mockUserGuid           = "foo-bar"
+	mockCNSIGuid           = "foo-bar"
+	countTokensSql         = `SELECT COUNT`
+	insertTokenSql         = `INSERT INTO tokens`
+	updateUAATokenSql      = `UPDATE tokens`
+	findTokenSql           = `SELECT token_guid, auth_token, refresh_token, token_expiry, disconnected, auth_type, meta_data, user_guid, linked_token FROM tokens .*`
+	findUAATokenSql        = `SELECT token_guid, auth_token, refresh_token, token_expiry, auth_type, meta_data FROM tokens WHERE token_type = 'uaa' AND .*`
+	deleteFromTokensSql    = `DELETE FROM tokens`
+	listEncryptedTokensSql = `SELECT user_guid, cnsi_guid, token_guid, auth_token, refresh_token FROM tokens`
+	lockTokenSql           = `SELECT token_guid, auth_token, refresh_token, token_expiry, disconnected, auth_type, meta_data FROM tokens WHERE cnsi_guid = (.+) FOR UPDATE`
+	findExpiringTokensSql  = `SELECT cnsi_guid, user_guid, auth_type, token_expiry FROM tokens WHERE (.+) user_activity`
 )
 
 var mockTokenExpiry = time.Now().AddDate(0, 0, 1).Unix()
@@ -460,3 +465,184 @@ func TestDeleteCNSITokens(t *testing.T) {
 	})
 
 }
+
+func TestDeleteUserTokens(t *testing.T) {
+
+	Convey("DeleteUserTokens Tests", t, func() {
+
+		db, mock, repository := initialiseRepo(t)
+
+		Convey("should fail to delete tokens with an invalid user GUID", func() {
+			err := repository.DeleteUserTokens("")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should throw exception when encountering DB error", func() {
+			mock.ExpectExec(deleteFromTokensSql).
+				WithArgs(mockUserGuid).
+				WillReturnError(errors.New("doesn't exist"))
+			err := repository.DeleteUserTokens(mockUserGuid)
+
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Test successful path", func() {
+			mock.ExpectExec(deleteFromTokensSql).
+				WithArgs(mockUserGuid).
+				WillReturnResult(sqlmock.NewResult(2, 2))
+			err := repository.DeleteUserTokens(mockUserGuid)
+
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			db.Close()
+		})
+
+	})
+
+}
+
+func TestReencryptTokens(t *testing.T) {
+
+	Convey("Reencrypt Tests", t, func() {
+
+		db, mock, repository := initialiseRepo(t)
+		currentToken, _ := crypto.EncryptToken(mockEncryptionKey, mockUAAToken)
+		previousToken, _ := crypto.EncryptToken(bytes.Repeat([]byte{1}, 32), mockUAAToken)
+
+		Convey("should only update tokens not encrypted with the key", func() {
+			So(crypto.SetPreviousKeys([][]byte{bytes.Repeat([]byte{1}, 32)}), ShouldBeNil)
+
+			mock.ExpectQuery(listEncryptedTokensSql).
+				WillReturnRows(sqlmock.NewRows([]string{"user_guid", "cnsi_guid", "token_guid", "auth_token", "refresh_token"}).
+					AddRow(mockUserGuid, mockCNSIGuid, mockTokenGUID, currentToken, currentToken).
+					AddRow(mockUserGuid, "STRATOS", mockTokenGUID, previousToken, previousToken))
+
+			mock.ExpectExec(updateUAATokenSql).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), mockUserGuid, "STRATOS", mockTokenGUID, previousToken).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			updated, err := repository.Reencrypt(mockEncryptionKey)
+			So(err, ShouldBeNil)
+			So(updated, ShouldEqual, 1)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("should report tokens that can't be decrypted", func() {
+			So(crypto.SetPreviousKeys(nil), ShouldBeNil)
+
+			mock.ExpectQuery(listEncryptedTokensSql).
+				WillReturnRows(sqlmock.NewRows([]string{"user_guid", "cnsi_guid", "token_guid", "auth_token", "refresh_token"}).
+					AddRow(mockUserGuid, "STRATOS", mockTokenGUID, previousToken, previousToken))
+
+			updated, err := repository.Reencrypt(mockEncryptionKey)
+			So(err, ShouldNotBeNil)
+			So(updated, ShouldEqual, 0)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			crypto.SetPreviousKeys(nil)
+			db.Close()
+		})
+	})
+}
+
+func TestRefreshCNSIToken(t *testing.T) {
+
+	Convey("RefreshCNSIToken Tests", t, func() {
+
+		db, mock, repository := initialiseRepo(t)
+		storedToken, _ := crypto.EncryptToken(mockEncryptionKey, mockCNSIToken)
+		lockedRow := func() sqlmock.Rows {
+			return sqlmock.NewRows([]string{"token_guid", "auth_token", "refresh_token", "token_expiry", "disconnected", "auth_type", "meta_data"}).
+				AddRow(mockTokenGUID, storedToken, storedToken, mockTokenExpiry, false, "dex", "{}")
+		}
+
+		Convey("should store the refreshed token before releasing the lock", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockTokenSql).WithArgs(mockCNSIGuid, mockUserGuid).WillReturnRows(lockedRow())
+			mock.ExpectExec(updateUAATokenSql).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(42), mockTokenGUID, mockUserGuid).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			refreshed, err := repository.RefreshCNSIToken(mockCNSIGuid, mockUserGuid, mockEncryptionKey, func(tr interfaces.TokenRecord) (*interfaces.TokenRecord, error) {
+				So(tr.AuthToken, ShouldEqual, mockCNSIToken)
+				So(tr.Metadata, ShouldEqual, "{}")
+				return &interfaces.TokenRecord{AuthToken: "new", RefreshToken: "new-refresh", TokenExpiry: 42}, nil
+			})
+			So(err, ShouldBeNil)
+			So(refreshed.AuthToken, ShouldEqual, "new")
+			So(refreshed.TokenGUID, ShouldEqual, mockTokenGUID)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("should keep the stored token", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockTokenSql).WithArgs(mockCNSIGuid, mockUserGuid).WillReturnRows(lockedRow())
+			mock.ExpectRollback()
+
+			refreshed, err := repository.RefreshCNSIToken(mockCNSIGuid, mockUserGuid, mockEncryptionKey, func(tr interfaces.TokenRecord) (*interfaces.TokenRecord, error) {
+				return nil, nil
+			})
+			So(err, ShouldBeNil)
+			So(refreshed.AuthToken, ShouldEqual, mockCNSIToken)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("should release the lock if the refresh fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockTokenSql).WithArgs(mockCNSIGuid, mockUserGuid).WillReturnRows(lockedRow())
+			mock.ExpectRollback()
+
+			_, err := repository.RefreshCNSIToken(mockCNSIGuid, mockUserGuid, mockEncryptionKey, func(tr interfaces.TokenRecord) (*interfaces.TokenRecord, error) {
+				return nil, errors.New("invalid_grant")
+			})
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			db.Close()
+		})
+	})
+}
+
+func TestFindExpiringCNSITokens(t *testing.T) {
+
+	Convey("FindExpiringCNSITokens Tests", t, func() {
+
+		db, mock, repository := initialiseRepo(t)
+
+		Convey("should return the tokens expiring before the given time", func() {
+			expiresBefore := time.Now().Add(5 * time.Minute).Unix()
+			rows := sqlmock.NewRows([]string{"cnsi_guid", "user_guid", "auth_type", "token_expiry"}).
+				AddRow(mockCNSIGuid, mockUserGuid, "Dex", expiresBefore-60).
+				AddRow(mockCNSIGuid, "other-user", "OAuth2", expiresBefore-120)
+			mock.ExpectQuery(findExpiringTokensSql).WithArgs(expiresBefore, sqlmock.AnyArg()).WillReturnRows(rows)
+
+			tokens, err := repository.FindExpiringCNSITokens(expiresBefore)
+			So(err, ShouldBeNil)
+			So(tokens, ShouldHaveLength, 2)
+			So(tokens[0], ShouldResemble, interfaces.ExpiringToken{CNSIGUID: mockCNSIGuid, UserGUID: mockUserGuid, AuthType: "Dex", TokenExpiry: expiresBefore - 60})
+			So(tokens[1].UserGUID, ShouldEqual, "other-user")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("should fail if the tokens can't be found", func() {
+			mock.ExpectQuery(findExpiringTokensSql).WillReturnError(errors.New("doesn't exist"))
+
+			_, err := repository.FindExpiringCNSITokens(time.Now().Unix())
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			db.Close()
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package useractivity
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/datastore"
+)
+
+var extendActivity = `UPDATE user_activity SET active_until = $1 WHERE user_guid = $2 AND active_until < $3`
+var countActivity = `SELECT COUNT(*) FROM user_activity WHERE user_guid = $1`
+var insertActivity = `INSERT INTO user_activity (user_guid, active_until) VALUES ($1, $2)`
+var deleteExpiredActivity = `DELETE FROM user_activity WHERE active_until < $1`
+
+// PgsqlUserActivityRepository is a PostgreSQL-backed user activity repository
+type PgsqlUserActivityRepository struct {
+	db *sql.DB
+}
+
+// NewPgsqlUserActivityRepository - get a reference to the user activity data source
+func NewPgsqlUserActivityRepository(dcp *sql.DB) (*PgsqlUserActivityRepository, error) {
+	return &PgsqlUserActivityRepository{db: dcp}, nil
+}
+
+// InitRepositoryProvider - One time init for the given DB Provider
+func InitRepositoryProvider(databaseProvider string) {
+	// Modify the database statements if needed, for the given database type
+	extendActivity = datastore.ModifySQLStatement(extendActivity, databaseProvider)
+	countActivity = datastore.ModifySQLStatement(countActivity, databaseProvider)
+	insertActivity = datastore.ModifySQLStatement(insertActivity, databaseProvider)
+	deleteExpiredActivity = datastore.ModifySQLStatement(deleteExpiredActivity, databaseProvider)
+}
+
+// Record extends the activity of the user until the given time, if it is later than the recorded time. The user may
+// have other sessions that are active for longer
+func (p *PgsqlUserActivityRepository) Record(userGUID string, activeUntil time.Time) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Unable to record user activity: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(extendActivity, activeUntil.Unix(), userGUID, activeUntil.Unix())
+	if err != nil {
+		return fmt.Errorf("Unable to update user activity: %v", err)
+	}
+
+	rowsUpdates, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Unable to update user activity: could not determine number of rows that were updated")
+	}
+
+	if rowsUpdates == 0 {
+		var count int
+		if err = tx.QueryRow(countActivity, userGUID).Scan(&count); err != nil {
+			return fmt.Errorf("Unable to find user activity: %v", err)
+		}
+		if count == 0 {
+			if _, err = tx.Exec(insertActivity, userGUID, activeUntil.Unix()); err != nil {
+				return fmt.Errorf("Unable to insert user activity: %v", err)
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Unable to record user activity: %v", err)
+	}
+	return nil
+}
+
+// deleteExpired removes the activity of users whose sessions have all expired
+func (p *PgsqlUserActivityRepository) deleteExpired() error {
+	result, err := p.db.Exec(deleteExpiredActivity, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+		log.Debugf("Deleted the activity of %d users", deleted)
+	}
+	return nil
+}
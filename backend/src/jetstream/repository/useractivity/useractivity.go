@@ -0,0 +1,11 @@
+package useractivity
+
+import (
+	"time"
+)
+
+// Repository is an application of the repository pattern for storing until when users have active sessions
+type Repository interface {
+	// Record extends the activity of the user until the given time, if it is later than the recorded time
+	Record(userGUID string, activeUntil time.Time) error
+}
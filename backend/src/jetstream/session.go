@@ -194,19 +194,36 @@ func (p *portalProxy) removeEmptyCookie(c echo.Context) {
 	req.Header.Set("Cookie", cleanCookie)
 }
 
+// sessionExpiresOn returns when the current session expires, in the session store or earlier in the auth provider
+func (p *portalProxy) sessionExpiresOn(c echo.Context) (time.Time, error) {
+	expOn, err := p.GetSessionValue(c, "expires_on")
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiry := expOn.(time.Time)
+
+	// The auth provider may end the session before the session store does
+	if lifetime, ok := p.StratosAuthService.(interfaces.StratosAuthSessionLifetime); ok {
+		if expiresOn, err := lifetime.SessionExpiresOn(c); err == nil && expiresOn.Before(expiry) {
+			expiry = expiresOn
+		}
+	}
+
+	return expiry, nil
+}
+
 func (p *portalProxy) handleSessionExpiryHeader(c echo.Context) error {
 
 	// Explicitly tell the client when this session will expire. This is needed because browsers actively hide
 	// the Set-Cookie header and session cookie expires_on from client side javascript
-	expOn, err := p.GetSessionValue(c, "expires_on")
+	expiry, err := p.sessionExpiresOn(c)
 	if err != nil {
 		msg := "Could not get session expiry"
 		log.Error(msg+" - ", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, msg)
 	}
-	c.Response().Header().Set(sessionExpiresOnHeader, strconv.FormatInt(expOn.(time.Time).Unix(), 10))
 
-	expiry := expOn.(time.Time)
+	c.Response().Header().Set(sessionExpiresOnHeader, strconv.FormatInt(expiry.Unix(), 10))
 	expiryDuration := expiry.Sub(time.Now())
 
 	// Subtract time now to get the duration add this to the time provided by the client
@@ -4,11 +4,13 @@ import (
 	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
 type sessionTestPortalProxy struct {
@@ -75,3 +77,82 @@ func TestSession(t *testing.T) {
 	})
 
 }
+
+func TestEpinioSessionActivity(t *testing.T) {
+	t.Parallel()
+
+	// setupEpinioSession returns an epinio session that was last active at the given time
+	setupEpinioSession := func(lastActive time.Time, values map[string]interface{}) (echo.Context, *epinioAuth, sqlmock.Sqlmock, func()) {
+		req := setupMockReq("GET", "", nil)
+		_, _, ctx, pp, db, mock := setupHTTPTest(req)
+
+		sessionValues := map[string]interface{}{
+			"user_id":               mockUserGUID,
+			"exp":                   time.Now().Add(time.Hour).Unix(),
+			epinioSessionLastActive: lastActive.Unix(),
+		}
+		for k, v := range values {
+			sessionValues[k] = v
+		}
+		So(pp.setSessionValues(ctx, sessionValues), ShouldBeNil)
+
+		return ctx, newEpinioAuth(pp), mock, func() { db.Close() }
+	}
+
+	Convey("Verifying a session does not count as activity", t, func() {
+		lastActive := time.Now().Add(-10 * time.Minute)
+		ctx, auth, _, done := setupEpinioSession(lastActive, nil)
+		defer done()
+
+		So(auth.VerifySession(ctx, mockUserGUID, 0), ShouldBeNil)
+		recorded, err := auth.p.GetSessionInt64Value(ctx, epinioSessionLastActive)
+		So(err, ShouldBeNil)
+		So(recorded, ShouldEqual, lastActive.Unix())
+
+		Convey("Other requests do", func() {
+			So(auth.VerifySessionActivity(ctx), ShouldBeNil)
+			recorded, err := auth.p.GetSessionInt64Value(ctx, epinioSessionLastActive)
+			So(err, ShouldBeNil)
+			So(recorded, ShouldBeGreaterThan, lastActive.Unix())
+		})
+	})
+
+	Convey("An idle session expires", t, func() {
+		ctx, auth, _, done := setupEpinioSession(time.Now().Add(-2*time.Hour), nil)
+		defer done()
+
+		So(auth.VerifySession(ctx, mockUserGUID, 0), ShouldNotBeNil)
+		So(auth.VerifySessionActivity(ctx), ShouldNotBeNil)
+	})
+
+	Convey("An OIDC session", t, func() {
+		oidcSession := map[string]interface{}{
+			epinioSessionAuthType:     "oidc",
+			epinioSessionLoginCluster: mockCNSIGUID,
+		}
+
+		Convey("is active with a valid Dex token", func() {
+			ctx, auth, mock, done := setupEpinioSession(time.Now(), oidcSession)
+			defer done()
+
+			mock.ExpectQuery(selectAnyFromTokens).
+				WithArgs(mockCNSIGUID, mockUserGUID, mockAdminGUID).
+				WillReturnRows(expectEncryptedTokenRow(auth.p.Config.EncryptionKeyInBytes))
+
+			So(auth.VerifySessionActivity(ctx), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("has expired without a Dex token", func() {
+			ctx, auth, mock, done := setupEpinioSession(time.Now(), oidcSession)
+			defer done()
+
+			mock.ExpectQuery(selectAnyFromTokens).
+				WithArgs(mockCNSIGUID, mockUserGUID, mockAdminGUID).
+				WillReturnError(errors.New("no token"))
+
+			So(auth.VerifySessionActivity(ctx), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
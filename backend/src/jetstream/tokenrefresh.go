@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+	"github.com/epinio/ui/backend/src/jetstream/repository/useractivity"
+)
+
+const (
+	defaultTokenRefreshInterval    = time.Minute
+	defaultTokenRefreshAhead       = 5 * time.Minute
+	defaultTokenRefreshConcurrency = 4
+
+	// How often the activity of a user is recorded by an instance at most
+	userActivityResolution = time.Minute
+
+	// Metric names
+	metricTokenRefresherScans           = "token_refresher_scans"
+	metricTokenRefresherScanFailures    = "token_refresher_scan_failures"
+	metricTokenRefresherRefreshes       = "token_refresher_refreshes"
+	metricTokenRefresherRefreshFailures = "token_refresher_refresh_failures"
+)
+
+// tokenRefreshLimits are the settings of the background token refresher, see TOKEN_REFRESH_INTERVAL_IN_SECS, etc
+type tokenRefreshLimits struct {
+	// How often tokens about to expire are looked for, 0 if the refresher is disabled
+	interval time.Duration
+	// How long before they expire tokens are refreshed
+	ahead time.Duration
+	// Tokens refreshed at the same time by an instance
+	concurrency int
+}
+
+func newTokenRefreshLimits(pc interfaces.PortalConfig) tokenRefreshLimits {
+	limits := tokenRefreshLimits{
+		interval:    defaultTokenRefreshInterval,
+		ahead:       defaultTokenRefreshAhead,
+		concurrency: defaultTokenRefreshConcurrency,
+	}
+
+	switch {
+	case pc.TokenRefreshIntervalInSecs < 0:
+		limits.interval = 0
+	case pc.TokenRefreshIntervalInSecs > 0:
+		limits.interval = time.Duration(pc.TokenRefreshIntervalInSecs) * time.Second
+	}
+	if pc.TokenRefreshAheadInSecs > 0 {
+		limits.ahead = time.Duration(pc.TokenRefreshAheadInSecs) * time.Second
+	}
+	if pc.TokenRefreshConcurrency > 0 {
+		limits.concurrency = int(pc.TokenRefreshConcurrency)
+	}
+
+	return limits
+}
+
+// jitter returns a random delay for a refresh, so that the refreshes of tokens that expire at the same time (e.g.
+// after a restart) and of instances that find the same tokens are spread out
+func (l tokenRefreshLimits) jitter() time.Duration {
+	spread := l.interval
+	if l.ahead < spread {
+		spread = l.ahead
+	}
+	if spread /= 2; spread <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(spread)))
+}
+
+// userActivityRecorder remembers when an instance last recorded the activity of users
+type userActivityRecorder struct {
+	mu       sync.Mutex
+	recorded map[string]time.Time
+}
+
+func newUserActivityRecorder() *userActivityRecorder {
+	return &userActivityRecorder{recorded: make(map[string]time.Time)}
+}
+
+// due returns true if the activity of the user has not been recorded in the last userActivityResolution
+func (r *userActivityRecorder) due(userGUID string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if recorded, ok := r.recorded[userGUID]; ok && now.Sub(recorded) < userActivityResolution {
+		return false
+	}
+
+	for user, recorded := range r.recorded {
+		if now.Sub(recorded) >= userActivityResolution {
+			delete(r.recorded, user)
+		}
+	}
+	r.recorded[userGUID] = now
+	return true
+}
+
+// recordUserActivity records until when the session of the user is active, so that the user's tokens are refreshed
+// in the background until then
+func (p *portalProxy) recordUserActivity(c echo.Context, userGUID string) {
+	if newTokenRefreshLimits(p.Config).interval == 0 || !userActivity.due(userGUID, time.Now()) {
+		return
+	}
+
+	activeUntil, err := p.sessionExpiresOn(c)
+	if err != nil {
+		log.Debugf("Unable to record activity of user %s: %v", userGUID, err)
+		return
+	}
+
+	repo, err := useractivity.NewPgsqlUserActivityRepository(p.DatabaseConnectionPool)
+	if err == nil {
+		err = repo.Record(userGUID, activeUntil)
+	}
+	if err != nil {
+		log.Warnf("Unable to record activity of user %s: %v", userGUID, err)
+	}
+}
+
+// tokenRefresher refreshes the Dex and OAuth tokens of users with active sessions before they expire, so that the
+// next request to the endpoint doesn't have to
+type tokenRefresher struct {
+	p      *portalProxy
+	limits tokenRefreshLimits
+
+	// Tokens waiting for or being refreshed, so that they are not picked up again by the next scan
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+// RefreshTokens runs a background goroutine that refreshes the tokens about to expire, see TOKEN_REFRESH_INTERVAL_IN_SECS
+func (p *portalProxy) RefreshTokens() (chan<- struct{}, <-chan struct{}) {
+	r := &tokenRefresher{
+		p:        p,
+		limits:   newTokenRefreshLimits(p.Config),
+		inFlight: make(map[string]bool),
+	}
+
+	quit, done := make(chan struct{}), make(chan struct{})
+	go r.run(quit, done)
+	return quit, done
+}
+
+// StopRefreshTokens stops the background token refresher, once the refreshes in progress have finished
+func (p *portalProxy) StopRefreshTokens(quit chan<- struct{}, done <-chan struct{}) {
+	quit <- struct{}{}
+	<-done
+}
+
+// run looks for tokens about to expire at set intervals, and refreshes them
+func (r *tokenRefresher) run(quit <-chan struct{}, done chan<- struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var refreshes sync.WaitGroup
+	slots := make(chan struct{}, r.limits.concurrency)
+
+	// A disabled refresher just waits to be stopped
+	var tick <-chan time.Time
+	if r.limits.interval > 0 {
+		ticker := time.NewTicker(r.limits.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-quit:
+			cancel()
+			refreshes.Wait()
+			done <- struct{}{}
+			return
+		case <-tick:
+			r.scan(ctx, &refreshes, slots)
+		}
+	}
+}
+
+// scan starts the refresh of the tokens that expire within limits.ahead
+func (r *tokenRefresher) scan(ctx context.Context, refreshes *sync.WaitGroup, slots chan struct{}) {
+	metrics.Inc(metricTokenRefresherScans)
+
+	tokenRepo, err := r.p.GetStoreFactory().TokenStore()
+	if err != nil {
+		metrics.Inc(metricTokenRefresherScanFailures)
+		log.Warnf("Unable to find expiring tokens: %v", err)
+		return
+	}
+
+	tokens, err := tokenRepo.FindExpiringCNSITokens(time.Now().Add(r.limits.ahead).Unix())
+	if err != nil {
+		metrics.Inc(metricTokenRefresherScanFailures)
+		log.Warnf("Unable to find expiring tokens: %v", err)
+		return
+	}
+
+	for _, token := range tokens {
+		if token.AuthType != interfaces.AuthTypeDex && token.AuthType != interfaces.AuthTypeOAuth2 {
+			continue
+		}
+
+		key := token.CNSIGUID + ":" + token.UserGUID
+		r.mu.Lock()
+		if r.inFlight[key] {
+			r.mu.Unlock()
+			continue
+		}
+		r.inFlight[key] = true
+		r.mu.Unlock()
+
+		refreshes.Add(1)
+		go func(token interfaces.ExpiringToken, key string) {
+			defer refreshes.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.inFlight, key)
+				r.mu.Unlock()
+			}()
+			r.refresh(ctx, token, slots)
+		}(token, key)
+	}
+}
+
+// refresh refreshes the token after a random delay, once there is a free slot
+func (r *tokenRefresher) refresh(ctx context.Context, token interfaces.ExpiringToken, slots chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(r.limits.jitter()):
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case slots <- struct{}{}:
+	}
+	defer func() { <-slots }()
+
+	metrics.Inc(metricTokenRefresherRefreshes)
+	if err := r.p.refreshExpiringToken(ctx, token); err != nil && ctx.Err() == nil {
+		metrics.Inc(metricTokenRefresherRefreshFailures)
+		log.Warnf("Unable to refresh token of user %s for endpoint %s: %v", token.UserGUID, token.CNSIGUID, err)
+	}
+}
+
+func (p *portalProxy) refreshExpiringToken(ctx context.Context, token interfaces.ExpiringToken) error {
+	cnsi, err := p.GetCNSIRecord(token.CNSIGUID)
+	if err != nil {
+		return err
+	}
+
+	switch token.AuthType {
+	case interfaces.AuthTypeDex:
+		_, err = p.RefreshDexToken(ctx, token.CNSIGUID, token.UserGUID)
+	case interfaces.AuthTypeOAuth2:
+		_, err = p.RefreshOAuthToken(cnsi.SkipSSLValidation, token.CNSIGUID, token.UserGUID, cnsi.ClientId, cnsi.ClientSecret, cnsi.TokenEndpoint)
+	default:
+		err = fmt.Errorf("tokens of type %s can't be refreshed", token.AuthType)
+	}
+	return err
+}
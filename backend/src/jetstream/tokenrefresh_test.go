@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/epinio/ui/backend/src/jetstream/metrics"
+	"github.com/epinio/ui/backend/src/jetstream/repository/interfaces"
+)
+
+const findExpiringTokens = `SELECT cnsi_guid, user_guid, auth_type, token_expiry FROM tokens`
+
+func TestTokenRefreshLimits(t *testing.T) {
+	t.Parallel()
+
+	Convey("Token refresh limits", t, func() {
+
+		Convey("Should use the defaults if not configured", func() {
+			limits := newTokenRefreshLimits(interfaces.PortalConfig{})
+			So(limits.interval, ShouldEqual, defaultTokenRefreshInterval)
+			So(limits.ahead, ShouldEqual, defaultTokenRefreshAhead)
+			So(limits.concurrency, ShouldEqual, defaultTokenRefreshConcurrency)
+		})
+
+		Convey("Should use the configured limits", func() {
+			limits := newTokenRefreshLimits(interfaces.PortalConfig{TokenRefreshIntervalInSecs: 30, TokenRefreshAheadInSecs: 120, TokenRefreshConcurrency: 2})
+			So(limits.interval, ShouldEqual, 30*time.Second)
+			So(limits.ahead, ShouldEqual, 2*time.Minute)
+			So(limits.concurrency, ShouldEqual, 2)
+		})
+
+		Convey("Should disable the refresher with a negative interval", func() {
+			limits := newTokenRefreshLimits(interfaces.PortalConfig{TokenRefreshIntervalInSecs: -1})
+			So(limits.interval, ShouldEqual, 0)
+			So(limits.jitter(), ShouldEqual, 0)
+		})
+
+		Convey("Should spread refreshes over half the interval", func() {
+			limits := newTokenRefreshLimits(interfaces.PortalConfig{})
+			for i := 0; i < 100; i++ {
+				jitter := limits.jitter()
+				So(jitter, ShouldBeGreaterThanOrEqualTo, 0)
+				So(jitter, ShouldBeLessThan, limits.interval/2)
+			}
+		})
+	})
+}
+
+func TestUserActivityRecorder(t *testing.T) {
+	t.Parallel()
+
+	Convey("User activity recorder", t, func() {
+		recorder := newUserActivityRecorder()
+		now := time.Now()
+
+		So(recorder.due(mockUserGUID, now), ShouldBeTrue)
+		So(recorder.due(mockUserGUID, now.Add(time.Second)), ShouldBeFalse)
+		So(recorder.due("other-user", now.Add(time.Second)), ShouldBeTrue)
+		So(recorder.due(mockUserGUID, now.Add(userActivityResolution)), ShouldBeTrue)
+	})
+}
+
+func TestTokenRefresherScan(t *testing.T) {
+	t.Parallel()
+
+	Convey("Token refresher", t, func() {
+		req := setupMockReq("GET", "", nil)
+		_, _, _, pp, db, mock := setupHTTPTest(req)
+		defer db.Close()
+
+		r := &tokenRefresher{p: pp, limits: newTokenRefreshLimits(pp.Config), inFlight: make(map[string]bool)}
+
+		Convey("Should look for the tokens that expire soon", func() {
+			scans := metrics.Get(metricTokenRefresherScans)
+			refreshes := metrics.Get(metricTokenRefresherRefreshes)
+			expiresBefore := time.Now().Add(defaultTokenRefreshAhead).Unix()
+			mock.ExpectQuery(findExpiringTokens).WillReturnRows(sqlmock.NewRows([]string{"cnsi_guid", "user_guid", "auth_type", "token_expiry"}).
+				AddRow(mockCNSIGUID, mockUserGUID, interfaces.AuthTypeDex, expiresBefore).
+				AddRow(mockCNSIGUID, mockUserGUID, interfaces.AuthTypeBearer, expiresBefore))
+
+			// Stopped before any token is refreshed
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var wg sync.WaitGroup
+			r.scan(ctx, &wg, make(chan struct{}))
+			wg.Wait()
+
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(metrics.Get(metricTokenRefresherScans)-scans, ShouldEqual, 1)
+			So(metrics.Get(metricTokenRefresherRefreshes), ShouldEqual, refreshes)
+			So(r.inFlight, ShouldBeEmpty)
+		})
+
+		Convey("Should count failed scans", func() {
+			failures := metrics.Get(metricTokenRefresherScanFailures)
+			mock.ExpectQuery(findExpiringTokens).WillReturnError(errors.New("doesn't exist"))
+
+			var wg sync.WaitGroup
+			r.scan(context.Background(), &wg, make(chan struct{}, 1))
+			wg.Wait()
+
+			So(metrics.Get(metricTokenRefresherScanFailures)-failures, ShouldEqual, 1)
+		})
+	})
+}
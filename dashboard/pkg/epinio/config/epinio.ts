@@ -8,6 +8,24 @@ import { MULTI_CLUSTER } from '@shell/store/features';
 
 export const BLANK_CLUSTER = '_';
 
+/**
+ * Each Dex connector is published as its own auth provider (`epinio-<connector id>`). The login page looks up the
+ * login component by provider id, so register the epinio one for each of them once they're known
+ */
+function registerConnectorLogins(store: any) {
+  store.subscribeAction({
+    after: (action: { type: string }) => {
+      if (action.type !== 'auth/getAuthProviders' || !store.$plugin) {
+        return;
+      }
+
+      store.getters['rancher/all']('authProvider')
+        .filter((provider: { id: string }) => provider.id.startsWith('epinio-') && !store.$plugin.getDynamic('login', provider.id))
+        .forEach((provider: { id: string }) => store.$plugin.register('login', provider.id, () => import('../login/epinio.vue')));
+    }
+  });
+}
+
 export function init($plugin: any, store: any) {
   const {
     product,
@@ -36,6 +54,8 @@ export function init($plugin: any, store: any) {
         return displayVersion || 'unknown';
       },
     });
+
+    registerConnectorLogins(store);
   }
 
   product({